@@ -0,0 +1,284 @@
+package gcode
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Box is an axis aligned bounding box, in mm.
+type Box struct {
+	MinX float64 `json:"minX"`
+	MaxX float64 `json:"maxX"`
+	MinY float64 `json:"minY"`
+	MaxY float64 `json:"maxY"`
+	MinZ float64 `json:"minZ"`
+	MaxZ float64 `json:"maxZ"`
+}
+
+// Width, Depth and Height are the dimensions of the box.
+func (b Box) Width() float64  { return b.MaxX - b.MinX }
+func (b Box) Depth() float64  { return b.MaxY - b.MinY }
+func (b Box) Height() float64 { return b.MaxZ - b.MinZ }
+
+func (b *Box) extend(p Position) {
+	b.MinX = math.Min(b.MinX, p.X)
+	b.MaxX = math.Max(b.MaxX, p.X)
+	b.MinY = math.Min(b.MinY, p.Y)
+	b.MaxY = math.Max(b.MaxY, p.Y)
+	b.MinZ = math.Min(b.MinZ, p.Z)
+	b.MaxZ = math.Max(b.MaxZ, p.Z)
+}
+
+// Filament is the filament used by one extruder.
+type Filament struct {
+	// Length in mm.
+	Length float64 `json:"length"`
+	// Volume in cm³.
+	Volume float64 `json:"volume"`
+}
+
+// Layer is a Z height at which filament is extruded.
+type Layer struct {
+	Z float64 `json:"z"`
+	// Height is the distance to the previous layer.
+	Height float64 `json:"height"`
+	// Time is the estimated print time when the layer starts, in seconds.
+	Time float64 `json:"time"`
+	// Offset is the byte offset of the first extruding move of the layer.
+	Offset int64 `json:"offset"`
+	// Line is the line number of that move, starting at 1.
+	Line int `json:"line"`
+}
+
+// Analysis is the result of analysing a G-code file.
+type Analysis struct {
+	// EstimatedPrintTime in seconds.
+	EstimatedPrintTime float64 `json:"estimatedPrintTime"`
+	// Filament per extruder, e.g. `tool0`.
+	Filament map[string]Filament `json:"filament"`
+	// PrintingArea is the bounding box of all extruding moves.
+	PrintingArea Box `json:"printingArea"`
+	// Layers in print order.
+	Layers []Layer `json:"layers"`
+	// MaxTemperatures set per heater, e.g. `tool0`, `bed` or `chamber`.
+	MaxTemperatures map[string]float64 `json:"maxTemperatures"`
+	// Commands counts how often each command is used.
+	Commands map[string]int `json:"commands"`
+	// Lines is the number of lines in the file.
+	Lines int `json:"lines"`
+	// Size of the file in bytes.
+	Size int64 `json:"size"`
+}
+
+// TotalFilament is the filament used by all extruders.
+func (a *Analysis) TotalFilament() Filament {
+	var total Filament
+	for _, f := range a.Filament {
+		total.Length += f.Length
+		total.Volume += f.Volume
+	}
+	return total
+}
+
+// LayerHeights returns the distinct layer heights, ascending.
+func (a *Analysis) LayerHeights() []float64 {
+	seen := make(map[float64]bool)
+	var heights []float64
+	for _, layer := range a.Layers {
+		h := math.Round(layer.Height*1000) / 1000
+		if !seen[h] {
+			seen[h] = true
+			heights = append(heights, h)
+		}
+	}
+	sort.Float64s(heights)
+	return heights
+}
+
+// Analyzer estimates print time and material use of G-code files.
+type Analyzer struct {
+	// Acceleration used for the time estimate, in mm/s².
+	Acceleration float64
+	// FilamentDiameter used for the volume, in mm.
+	FilamentDiameter float64
+}
+
+// NewAnalyzer returns an analyzer with common defaults.
+func NewAnalyzer() *Analyzer {
+	return &Analyzer{Acceleration: 1000, FilamentDiameter: 1.75}
+}
+
+// AnalyzeFile analyses a file with the default analyzer.
+func AnalyzeFile(path string) (*Analysis, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return NewAnalyzer().Analyze(f)
+}
+
+// Analyze reads G-code from r until EOF.
+func (a *Analyzer) Analyze(r io.Reader) (*Analysis, error) {
+	result := &Analysis{
+		Filament:        make(map[string]Filament),
+		MaxTemperatures: make(map[string]float64),
+		Commands:        make(map[string]int),
+		PrintingArea: Box{
+			MinX: math.Inf(1), MaxX: math.Inf(-1),
+			MinY: math.Inf(1), MaxY: math.Inf(-1),
+			MinZ: math.Inf(1), MaxZ: math.Inf(-1),
+		},
+	}
+
+	machine := NewMachine()
+	extruded := make(map[int]float64)
+	used := make(map[int]float64)
+	elapsed := 0.0
+
+	reader := bufio.NewReader(r)
+	var offset int64
+	for {
+		raw, err := reader.ReadString('\n')
+		if len(raw) > 0 {
+			result.Lines++
+			lineOffset := offset
+			offset += int64(len(raw))
+
+			if cmd, ok := ParseLine(raw); ok {
+				result.Commands[cmd.Name]++
+				a.temperatures(result, cmd, machine.Tool)
+
+				if cmd.Name == "G4" {
+					elapsed += dwell(cmd)
+				}
+
+				if move, ok := machine.Apply(cmd); ok && !move.Home {
+					elapsed += a.moveTime(move)
+
+					extruded[move.Tool] += move.Extrude
+					used[move.Tool] = math.Max(used[move.Tool], extruded[move.Tool])
+
+					if move.Extruding() {
+						result.PrintingArea.extend(move.From)
+						result.PrintingArea.extend(move.To)
+						a.layer(result, move.To.Z, elapsed, lineOffset, result.Lines)
+					}
+				}
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result.Size = offset
+	result.EstimatedPrintTime = elapsed
+
+	if len(result.Layers) == 0 {
+		result.PrintingArea = Box{}
+	}
+
+	radius := a.FilamentDiameter / 2
+	for tool, length := range used {
+		if length <= 0 {
+			continue
+		}
+		result.Filament["tool"+strconv.Itoa(tool)] = Filament{
+			Length: length,
+			Volume: math.Pi * radius * radius * length / 1000,
+		}
+	}
+	return result, nil
+}
+
+// layer starts a new layer when filament is extruded above the last one
+func (a *Analyzer) layer(result *Analysis, z float64, elapsed float64, offset int64, line int) {
+	previous := 0.0
+	if n := len(result.Layers); n > 0 {
+		previous = result.Layers[n-1].Z
+		if z <= previous+1e-6 {
+			return
+		}
+	}
+
+	result.Layers = append(result.Layers, Layer{
+		Z:      z,
+		Height: z - previous,
+		Time:   elapsed,
+		Offset: offset,
+		Line:   line,
+	})
+}
+
+// moveTime estimates the duration of a move that accelerates from and
+// decelerates to standstill
+func (a *Analyzer) moveTime(move Move) float64 {
+	distance := move.Length
+	if distance == 0 {
+		distance = math.Abs(move.Extrude)
+	}
+
+	speed := move.Feedrate / 60
+	if distance == 0 || speed <= 0 {
+		return 0
+	}
+	if a.Acceleration <= 0 {
+		return distance / speed
+	}
+
+	// Cruising speed is reached
+	if distance >= speed*speed/a.Acceleration {
+		return distance/speed + speed/a.Acceleration
+	}
+	return 2 * math.Sqrt(distance/a.Acceleration)
+}
+
+func (a *Analyzer) temperatures(result *Analysis, cmd Command, tool int) {
+	value, ok := cmd.Get('S')
+	if !ok {
+		value, ok = cmd.Get('R')
+	}
+	if !ok {
+		return
+	}
+
+	var heater string
+	switch cmd.Name {
+	case "M104", "M109":
+		if t, ok := cmd.Get('T'); ok {
+			tool = int(t)
+		}
+		heater = "tool" + strconv.Itoa(tool)
+	case "M140", "M190":
+		heater = "bed"
+	case "M141", "M191":
+		heater = "chamber"
+	default:
+		return
+	}
+
+	if value > result.MaxTemperatures[heater] {
+		result.MaxTemperatures[heater] = value
+	}
+}
+
+// dwell returns the duration of G4, P is in milliseconds and S in seconds
+func dwell(cmd Command) float64 {
+	if s, ok := cmd.Get('S'); ok {
+		return s
+	}
+	if p, ok := cmd.Get('P'); ok {
+		return p / 1000
+	}
+	return 0
+}
@@ -0,0 +1,98 @@
+package gcode
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testGCode = `; two layers of a 10x10 square
+M140 S60
+M104 S200
+M190 S60
+M109 S210
+G28
+G90
+M82
+G92 E0
+G1 Z0.2 F600
+G1 X0 Y0 F6000
+G1 X10 Y0 E1 F1200
+G1 X10 Y10 E2
+G1 X0 Y10 E3
+G1 X0 Y0 E4
+G1 E2 F2400 ; retract
+G1 Z0.4 F600
+G1 E4 F2400
+G1 X10 Y0 E5 F1200
+G1 X10 Y10 E6
+G4 P500
+M104 S0
+`
+
+func TestAnalyze(t *testing.T) {
+	a, err := NewAnalyzer().Analyze(strings.NewReader(testGCode))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 22, a.Lines)
+	assert.InDelta(t, 6., a.Filament["tool0"].Length, 1e-9)
+	assert.True(t, a.Filament["tool0"].Volume > 0)
+
+	assert.Len(t, a.Layers, 2)
+	assert.InDelta(t, 0.2, a.Layers[0].Z, 1e-9)
+	assert.InDelta(t, 0.2, a.Layers[1].Height, 1e-9)
+	assert.True(t, a.Layers[1].Time > a.Layers[0].Time)
+	assert.Equal(t, []float64{0.2}, a.LayerHeights())
+
+	assert.Equal(t, Box{MinX: 0, MaxX: 10, MinY: 0, MaxY: 10, MinZ: 0.2, MaxZ: 0.4}, a.PrintingArea)
+
+	assert.Equal(t, 210., a.MaxTemperatures["tool0"])
+	assert.Equal(t, 60., a.MaxTemperatures["bed"])
+	assert.Equal(t, 11, a.Commands["G1"])
+
+	// 60mm extruded at 20mm/s and a 0.5s dwell at least
+	assert.True(t, a.EstimatedPrintTime > 3+0.5)
+}
+
+func TestAnalyze_RelativeExtrusionAndTools(t *testing.T) {
+	a, err := NewAnalyzer().Analyze(strings.NewReader(`M83
+T1
+G1 Z0.3
+G1 X10 E2
+G1 E-1
+G1 E1
+G1 X20 E2
+T0
+G1 X30 E3
+`))
+	assert.NoError(t, err)
+
+	assert.InDelta(t, 4., a.Filament["tool1"].Length, 1e-9)
+	assert.InDelta(t, 3., a.Filament["tool0"].Length, 1e-9)
+	assert.Len(t, a.Layers, 1)
+}
+
+func TestMachine_Arc(t *testing.T) {
+	m := NewMachine()
+	m.Position = Position{X: 10, Y: 0}
+
+	cmd, _ := ParseLine("G3 X-10 Y0 I-10 J0")
+	move, ok := m.Apply(cmd)
+	assert.True(t, ok)
+
+	// Half circle with radius 10
+	assert.InDelta(t, 31.4159, move.Length, 1e-3)
+	assert.Equal(t, Position{X: -10, Y: 0}, m.Position)
+}
+
+func TestMachine_Inches(t *testing.T) {
+	m := NewMachine()
+
+	cmd, _ := ParseLine("G20")
+	m.Apply(cmd)
+	cmd, _ = ParseLine("G1 X1")
+	m.Apply(cmd)
+
+	assert.InDelta(t, 25.4, m.Position.X, 1e-9)
+}
@@ -0,0 +1,224 @@
+package gcode
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+const mmPerInch = 25.4
+
+// Position is a position in the printer's logical coordinate system, in mm.
+type Position struct {
+	X float64 `json:"X"`
+	Y float64 `json:"Y"`
+	Z float64 `json:"Z"`
+	E float64 `json:"E"`
+}
+
+// Move is the result of a motion command.
+type Move struct {
+	From Position
+	To   Position
+	// Feedrate in mm/min.
+	Feedrate float64
+	// Length of the travelled path in XYZ, in mm, arcs included.
+	Length float64
+	// Extrude is the change of E, negative for retractions.
+	Extrude float64
+	// Tool that was active during the move.
+	Tool int
+	// Home is set for G28, the positions of homed axes are then 0.
+	Home bool
+}
+
+// Extruding reports whether filament is laid down while moving in XY.
+func (m Move) Extruding() bool {
+	return m.Extrude > 0 && (m.From.X != m.To.X || m.From.Y != m.To.Y)
+}
+
+// Machine interprets G-code and keeps track of the printer's modal state:
+// position, absolute/relative mode for XYZ and E, units, feedrate and tool.
+type Machine struct {
+	Position  Position
+	Absolute  bool
+	AbsoluteE bool
+	Inches    bool
+	// Feedrate in mm/min.
+	Feedrate float64
+	Tool     int
+}
+
+// NewMachine returns a machine in the power-on state of Marlin.
+func NewMachine() *Machine {
+	return &Machine{
+		Absolute:  true,
+		AbsoluteE: true,
+		Feedrate:  1500,
+	}
+}
+
+// Apply updates the state with cmd and returns the move it caused, if any.
+func (m *Machine) Apply(cmd Command) (Move, bool) {
+	switch cmd.Name {
+	case "G0", "G1":
+		return m.linear(cmd), true
+
+	case "G2", "G3":
+		return m.arc(cmd, cmd.Name == "G2"), true
+
+	case "G28":
+		return m.home(cmd), true
+
+	case "G20":
+		m.Inches = true
+	case "G21":
+		m.Inches = false
+
+	case "G90":
+		m.Absolute = true
+		m.AbsoluteE = true
+	case "G91":
+		m.Absolute = false
+		m.AbsoluteE = false
+	case "M82":
+		m.AbsoluteE = true
+	case "M83":
+		m.AbsoluteE = false
+
+	case "G92":
+		m.setPosition(cmd)
+
+	default:
+		if strings.HasPrefix(cmd.Name, "T") {
+			if tool, err := strconv.Atoi(cmd.Name[1:]); err == nil {
+				m.Tool = tool
+			}
+		}
+	}
+	return Move{}, false
+}
+
+func (m *Machine) units(v float64) float64 {
+	if m.Inches {
+		return v * mmPerInch
+	}
+	return v
+}
+
+// target computes the end position of a move command
+func (m *Machine) target(cmd Command) Position {
+	to := m.Position
+
+	axis := func(letter byte, current float64, absolute bool) float64 {
+		v, ok := cmd.Get(letter)
+		if !ok {
+			return current
+		}
+		if absolute {
+			return m.units(v)
+		}
+		return current + m.units(v)
+	}
+
+	to.X = axis('X', to.X, m.Absolute)
+	to.Y = axis('Y', to.Y, m.Absolute)
+	to.Z = axis('Z', to.Z, m.Absolute)
+	to.E = axis('E', to.E, m.AbsoluteE)
+	return to
+}
+
+func (m *Machine) updateFeedrate(cmd Command) {
+	if f, ok := cmd.Get('F'); ok && f > 0 {
+		m.Feedrate = m.units(f)
+	}
+}
+
+func (m *Machine) linear(cmd Command) Move {
+	m.updateFeedrate(cmd)
+	to := m.target(cmd)
+
+	move := Move{
+		From:     m.Position,
+		To:       to,
+		Feedrate: m.Feedrate,
+		Length:   math.Sqrt(sq(to.X-m.Position.X) + sq(to.Y-m.Position.Y) + sq(to.Z-m.Position.Z)),
+		Extrude:  to.E - m.Position.E,
+		Tool:     m.Tool,
+	}
+	m.Position = to
+	return move
+}
+
+// arc handles G2 (clockwise) and G3 with I/J center offsets, arcs given
+// with R are measured as their chord
+func (m *Machine) arc(cmd Command, clockwise bool) Move {
+	move := m.linear(cmd)
+
+	i, hasI := cmd.Get('I')
+	j, hasJ := cmd.Get('J')
+	if !hasI && !hasJ {
+		return move
+	}
+
+	cx := move.From.X + m.units(i)
+	cy := move.From.Y + m.units(j)
+	radius := math.Hypot(move.From.X-cx, move.From.Y-cy)
+
+	start := math.Atan2(move.From.Y-cy, move.From.X-cx)
+	end := math.Atan2(move.To.Y-cy, move.To.X-cx)
+
+	sweep := end - start
+	if clockwise {
+		sweep = -sweep
+	}
+	for sweep <= 0 {
+		sweep += 2 * math.Pi
+	}
+
+	move.Length = math.Hypot(radius*sweep, move.To.Z-move.From.Z)
+	return move
+}
+
+func (m *Machine) home(cmd Command) Move {
+	move := Move{From: m.Position, Feedrate: m.Feedrate, Tool: m.Tool, Home: true}
+
+	all := !cmd.Has('X') && !cmd.Has('Y') && !cmd.Has('Z')
+	if all || cmd.Has('X') {
+		m.Position.X = 0
+	}
+	if all || cmd.Has('Y') {
+		m.Position.Y = 0
+	}
+	if all || cmd.Has('Z') {
+		m.Position.Z = 0
+	}
+
+	move.To = m.Position
+	return move
+}
+
+// setPosition handles G92, without parameters all axes are set to 0
+func (m *Machine) setPosition(cmd Command) {
+	if len(cmd.Params) == 0 {
+		m.Position = Position{}
+		return
+	}
+
+	if v, ok := cmd.Get('X'); ok {
+		m.Position.X = m.units(v)
+	}
+	if v, ok := cmd.Get('Y'); ok {
+		m.Position.Y = m.units(v)
+	}
+	if v, ok := cmd.Get('Z'); ok {
+		m.Position.Z = m.units(v)
+	}
+	if v, ok := cmd.Get('E'); ok {
+		m.Position.E = m.units(v)
+	}
+}
+
+func sq(v float64) float64 {
+	return v * v
+}
@@ -0,0 +1,144 @@
+// Package gcode parses G-code as sent to RepRap/Marlin style printers.
+package gcode
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Command is a single parsed G-code line, e.g. `G1 X10 Y5 F3000`.
+type Command struct {
+	// Name is the letter and number of the command, e.g. `G1`, `M104` or `T0`.
+	Name string
+	// Params holds the numeric parameters by upper case letter.
+	Params map[byte]float64
+	// Flags holds parameters given without a value, e.g. the X of `G28 X`.
+	Flags map[byte]bool
+	// Text is the free text argument of commands like `M117 Hello`.
+	Text string
+	// Comment is the comment of the line without the leading `;`.
+	Comment string
+}
+
+// Has reports whether the parameter is present, with or without a value.
+func (c *Command) Has(letter byte) bool {
+	_, ok := c.Params[letter]
+	return ok || c.Flags[letter]
+}
+
+// Get returns the value of a parameter and whether it was present.
+func (c *Command) Get(letter byte) (float64, bool) {
+	v, ok := c.Params[letter]
+	return v, ok
+}
+
+// textCommands take the rest of the line as text instead of parameters.
+var textCommands = map[string]bool{
+	"M23": true, "M28": true, "M30": true, "M32": true, "M117": true, "M118": true,
+}
+
+// ParseLine parses a line of G-code. ok is false for empty and comment only
+// lines, their comment is still returned.
+func ParseLine(line string) (cmd Command, ok bool) {
+	line = strings.TrimSpace(line)
+
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		cmd.Comment = strings.TrimSpace(line[i+1:])
+		line = line[:i]
+	}
+	line = stripParenComments(line)
+
+	// Checksum
+	if i := strings.IndexByte(line, '*'); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	rest := strings.TrimSpace(line)
+
+	// Line number
+	if len(fields) > 0 && (fields[0][0] == 'N' || fields[0][0] == 'n') {
+		rest = strings.TrimSpace(rest[len(fields[0]):])
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return cmd, false
+	}
+
+	name, ok := normalizeName(fields[0])
+	if !ok {
+		return cmd, false
+	}
+	cmd.Name = name
+
+	// The text follows the command word
+	if textCommands[name] {
+		cmd.Text = strings.TrimSpace(rest[len(fields[0]):])
+		return cmd, true
+	}
+
+	cmd.Params = make(map[byte]float64)
+	for _, field := range fields[1:] {
+		letter := byte(unicode.ToUpper(rune(field[0])))
+		if letter < 'A' || letter > 'Z' {
+			continue
+		}
+
+		if len(field) == 1 {
+			if cmd.Flags == nil {
+				cmd.Flags = make(map[byte]bool)
+			}
+			cmd.Flags[letter] = true
+			continue
+		}
+
+		value, err := strconv.ParseFloat(field[1:], 64)
+		if err != nil {
+			continue
+		}
+		cmd.Params[letter] = value
+	}
+	return cmd, true
+}
+
+// normalizeName turns `g01`, `G1.0` and `G1` into `G1`.
+func normalizeName(word string) (string, bool) {
+	letter := unicode.ToUpper(rune(word[0]))
+	if letter != 'G' && letter != 'M' && letter != 'T' {
+		return "", false
+	}
+
+	number := word[1:]
+	if strings.HasSuffix(number, ".0") {
+		number = strings.TrimSuffix(number, ".0")
+	}
+
+	// Subcodes like G29.1 are kept
+	if strings.Contains(number, ".") {
+		if _, err := strconv.ParseFloat(number, 64); err != nil {
+			return "", false
+		}
+		return string(letter) + number, true
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return "", false
+	}
+	return string(letter) + strconv.Itoa(n), true
+}
+
+func stripParenComments(line string) string {
+	for {
+		start := strings.IndexByte(line, '(')
+		if start < 0 {
+			return line
+		}
+		end := strings.IndexByte(line[start:], ')')
+		if end < 0 {
+			return line[:start]
+		}
+		line = line[:start] + " " + line[start+end+1:]
+	}
+}
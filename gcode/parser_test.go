@@ -0,0 +1,65 @@
+package gcode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLine(t *testing.T) {
+	cmd, ok := ParseLine("N12 g01 X10.5 y-2 F3000 E0.4*57 ; perimeter")
+	assert.True(t, ok)
+
+	assert.Equal(t, "G1", cmd.Name)
+	assert.Equal(t, 10.5, cmd.Params['X'])
+	assert.Equal(t, -2., cmd.Params['Y'])
+	assert.Equal(t, 3000., cmd.Params['F'])
+	assert.Equal(t, 0.4, cmd.Params['E'])
+	assert.Equal(t, "perimeter", cmd.Comment)
+}
+
+func TestParseLine_Flags(t *testing.T) {
+	cmd, ok := ParseLine("G28 X Y")
+	assert.True(t, ok)
+
+	assert.Equal(t, "G28", cmd.Name)
+	assert.True(t, cmd.Has('X'))
+	assert.True(t, cmd.Has('Y'))
+	assert.False(t, cmd.Has('Z'))
+}
+
+func TestParseLine_Text(t *testing.T) {
+	cmd, ok := ParseLine("M117 Printing layer 2")
+	assert.True(t, ok)
+
+	assert.Equal(t, "M117", cmd.Name)
+	assert.Equal(t, "Printing layer 2", cmd.Text)
+
+	// Line number and checksum as sent by the host
+	cmd, ok = ParseLine("N12 M117 Hello*85")
+	assert.True(t, ok)
+	assert.Equal(t, "M117", cmd.Name)
+	assert.Equal(t, "Hello", cmd.Text)
+
+	cmd, ok = ParseLine("n7   M23  parts/cube.gco ; select")
+	assert.True(t, ok)
+	assert.Equal(t, "M23", cmd.Name)
+	assert.Equal(t, "parts/cube.gco", cmd.Text)
+	assert.Equal(t, "select", cmd.Comment)
+
+	cmd, ok = ParseLine("M117")
+	assert.True(t, ok)
+	assert.Empty(t, cmd.Text)
+}
+
+func TestParseLine_Comments(t *testing.T) {
+	_, ok := ParseLine("; generated by slicer")
+	assert.False(t, ok)
+
+	_, ok = ParseLine("")
+	assert.False(t, ok)
+
+	cmd, ok := ParseLine("G1 (move) X5")
+	assert.True(t, ok)
+	assert.Equal(t, 5., cmd.Params['X'])
+}
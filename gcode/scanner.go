@@ -0,0 +1,234 @@
+package gcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Actions a policy can take for a finding.
+const (
+	ActionAllow  = "allow"
+	ActionWarn   = "warn"
+	ActionReject = "reject"
+)
+
+// maxFindings limits the report, further findings are only counted.
+const maxFindings = 50
+
+// Policy describes what a file may do on a printer.
+type Policy struct {
+	// Maximum temperatures in °C, 0 disables the check.
+	MaxToolTemp       float64 `json:"max_tool_temp"`
+	MaxBedTemp        float64 `json:"max_bed_temp"`
+	MaxChamberTemp    float64 `json:"max_chamber_temp"`
+	TemperatureAction string  `json:"temperature_action"`
+	// Volume is the build volume, nil disables the check.
+	Volume *Box `json:"-"`
+	// VolumeMargin allows moves slightly outside the volume, e.g. purge lines.
+	VolumeMargin float64 `json:"volume_margin"`
+	VolumeAction string  `json:"volume_action"`
+	// Commands maps a command, e.g. `M502`, to an action.
+	Commands map[string]string `json:"commands"`
+}
+
+// commandReasons explains why a command is in the default policy.
+var commandReasons = map[string]string{
+	"M500": "writes settings to EEPROM",
+	"M502": "resets settings to factory defaults",
+	"M997": "starts a firmware update",
+	"M999": "restarts the firmware after an error",
+	"M112": "triggers an emergency stop",
+	"M302": "allows cold extrusion",
+	"M211": "disables software endstops",
+	"M121": "disables endstops",
+	"M303": "runs PID autotuning",
+	"M92":  "changes steps per unit",
+	"M301": "changes hotend PID values",
+	"M304": "changes bed PID values",
+	"M201": "changes maximum acceleration",
+	"M203": "changes maximum feedrate",
+	"M906": "changes motor current",
+	"M907": "changes motor current",
+}
+
+// conditions restrict a command rule to the dangerous use of the command.
+var conditions = map[string]func(cmd Command) bool{
+	// M302 S0 or M302 P1 allow extrusion at any temperature, M302 alone only reports
+	"M302": func(cmd Command) bool {
+		s, hasS := cmd.Get('S')
+		p, _ := cmd.Get('P')
+		return (hasS && s == 0) || p == 1
+	},
+	"M211": func(cmd Command) bool {
+		s, hasS := cmd.Get('S')
+		return hasS && s == 0
+	},
+}
+
+// DefaultPolicy rejects firmware and EEPROM changes and disabled protections
+// and warns about configuration changes.
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxToolTemp:       285,
+		MaxBedTemp:        120,
+		MaxChamberTemp:    70,
+		TemperatureAction: ActionReject,
+		VolumeMargin:      5,
+		VolumeAction:      ActionReject,
+		Commands: map[string]string{
+			"M500": ActionReject,
+			"M502": ActionReject,
+			"M997": ActionReject,
+			"M302": ActionReject,
+			"M211": ActionReject,
+			"M121": ActionReject,
+			"M999": ActionWarn,
+			"M112": ActionWarn,
+			"M303": ActionWarn,
+			"M92":  ActionWarn,
+			"M301": ActionWarn,
+			"M304": ActionWarn,
+			"M201": ActionWarn,
+			"M203": ActionWarn,
+			"M906": ActionWarn,
+			"M907": ActionWarn,
+		},
+	}
+}
+
+// Finding is a line that violates the policy.
+type Finding struct {
+	Line    int    `json:"line"`
+	Command string `json:"command"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+}
+
+// ScanReport is the result of a scan.
+type ScanReport struct {
+	Findings []Finding `json:"findings"`
+	// Suppressed counts findings beyond the report limit.
+	Suppressed int `json:"suppressed,omitempty"`
+	// Rejected is set if any finding has the reject action.
+	Rejected bool `json:"rejected"`
+}
+
+func (r *ScanReport) add(f Finding) {
+	if f.Action == ActionAllow || f.Action == "" {
+		return
+	}
+	if f.Action == ActionReject {
+		r.Rejected = true
+	}
+
+	if len(r.Findings) >= maxFindings {
+		r.Suppressed++
+		return
+	}
+	r.Findings = append(r.Findings, f)
+}
+
+// Scan checks G-code read from r against the policy.
+func (p Policy) Scan(r io.Reader) (*ScanReport, error) {
+	report := &ScanReport{}
+	machine := NewMachine()
+	// known marks the X, Y and Z positions that can be checked
+	var known [3]bool
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		cmd, ok := ParseLine(scanner.Text())
+		if !ok {
+			continue
+		}
+
+		if action, listed := p.Commands[cmd.Name]; listed {
+			if condition, exists := conditions[cmd.Name]; !exists || condition(cmd) {
+				reason := commandReasons[cmd.Name]
+				if reason == "" {
+					reason = "not allowed by policy"
+				}
+				report.add(Finding{Line: line, Command: cmd.Name, Action: action, Reason: reason})
+			}
+		}
+
+		if reason := p.checkTemperature(cmd, machine.Tool); reason != "" {
+			report.add(Finding{Line: line, Command: cmd.Name, Action: p.TemperatureAction, Reason: reason})
+		}
+
+		move, isMove := machine.Apply(cmd)
+		if !isMove {
+			continue
+		}
+		if move.Home {
+			all := !cmd.Has('X') && !cmd.Has('Y') && !cmd.Has('Z')
+			for i, axis := range []byte("XYZ") {
+				known[i] = known[i] || all || cmd.Has(axis)
+			}
+			continue
+		}
+
+		// A file without a G28 of its own relies on the printer being homed,
+		// e.g. by OctoPrint's before print script, so absolute positions are
+		// checked. Relative moves from an unknown position are not.
+		for i, axis := range []byte("XYZ") {
+			known[i] = known[i] || (machine.Absolute && cmd.Has(axis))
+		}
+		if p.Volume != nil {
+			if reason := p.checkVolume(move.To, known); reason != "" {
+				report.add(Finding{Line: line, Command: cmd.Name, Action: p.VolumeAction, Reason: reason})
+			}
+		}
+	}
+	return report, scanner.Err()
+}
+
+func (p Policy) checkTemperature(cmd Command, tool int) string {
+	value, ok := cmd.Get('S')
+	if !ok {
+		value, ok = cmd.Get('R')
+	}
+	if !ok {
+		return ""
+	}
+
+	var heater string
+	var limit float64
+	switch cmd.Name {
+	case "M104", "M109":
+		if t, ok := cmd.Get('T'); ok {
+			tool = int(t)
+		}
+		heater, limit = "tool"+strconv.Itoa(tool), p.MaxToolTemp
+	case "M140", "M190":
+		heater, limit = "bed", p.MaxBedTemp
+	case "M141", "M191":
+		heater, limit = "chamber", p.MaxChamberTemp
+	default:
+		return ""
+	}
+
+	if limit > 0 && value > limit {
+		return fmt.Sprintf("%s temperature %.0f°C exceeds %.0f°C", heater, value, limit)
+	}
+	return ""
+}
+
+// checkVolume checks the known axes of pos against the build volume
+func (p Policy) checkVolume(pos Position, known [3]bool) string {
+	v, m := p.Volume, p.VolumeMargin
+	outside := func(value, min, max float64) bool { return value < min-m || value > max+m }
+	if (known[0] && outside(pos.X, v.MinX, v.MaxX)) ||
+		(known[1] && outside(pos.Y, v.MinY, v.MaxY)) ||
+		(known[2] && outside(pos.Z, v.MinZ, v.MaxZ)) {
+		return fmt.Sprintf("move to X%.1f Y%.1f Z%.1f is outside the build volume", pos.X, pos.Y, pos.Z)
+	}
+	return ""
+}
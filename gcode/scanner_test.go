@@ -0,0 +1,100 @@
+package gcode
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy_Scan(t *testing.T) {
+	p := DefaultPolicy()
+	p.Volume = &Box{MaxX: 200, MaxY: 200, MaxZ: 180}
+
+	report, err := p.Scan(strings.NewReader(`M104 S215
+M140 S130
+M302 ; only reports the setting
+M302 S0
+G28
+G1 X100 Y100 Z0.2
+G1 X250 Y100
+M303 E0 S200 C8
+M500
+`))
+	assert.NoError(t, err)
+	assert.True(t, report.Rejected)
+
+	var lines []int
+	for _, f := range report.Findings {
+		lines = append(lines, f.Line)
+	}
+	assert.Equal(t, []int{2, 4, 7, 8, 9}, lines)
+	assert.Equal(t, ActionWarn, report.Findings[3].Action)
+}
+
+func TestPolicy_ScanClean(t *testing.T) {
+	p := DefaultPolicy()
+	p.Volume = &Box{MaxX: 200, MaxY: 200, MaxZ: 180}
+
+	report, err := p.Scan(strings.NewReader(testGCode))
+	assert.NoError(t, err)
+
+	assert.False(t, report.Rejected)
+	assert.Len(t, report.Findings, 0)
+}
+
+func TestPolicy_ScanAllow(t *testing.T) {
+	p := DefaultPolicy()
+	p.Commands["M500"] = ActionAllow
+
+	report, err := p.Scan(strings.NewReader("M500\n"))
+	assert.NoError(t, err)
+
+	assert.False(t, report.Rejected)
+	assert.Len(t, report.Findings, 0)
+}
+
+func TestPolicy_ScanWithoutHoming(t *testing.T) {
+	p := DefaultPolicy()
+	p.Volume = &Box{MaxX: 200, MaxY: 200, MaxZ: 180}
+
+	// The start G-code lives in OctoPrint's before print script
+	report, err := p.Scan(strings.NewReader(`G90
+G1 X100 Y100 Z0.2
+G1 X250 Y100
+G1 X100
+G91
+G1 X150
+G1 X-150 Z10
+G90
+`))
+	assert.NoError(t, err)
+	assert.True(t, report.Rejected)
+
+	var lines []int
+	for _, f := range report.Findings {
+		lines = append(lines, f.Line)
+	}
+	assert.Equal(t, []int{3, 6}, lines)
+	assert.Equal(t, "move to X250.0 Y100.0 Z0.2 is outside the build volume", report.Findings[0].Reason)
+}
+
+func TestPolicy_ScanUnknownPosition(t *testing.T) {
+	p := DefaultPolicy()
+	p.Volume = &Box{MinX: -100, MaxX: 100, MinY: -100, MaxY: 100, MaxZ: 180}
+
+	// Relative moves from wherever the head is cannot be checked, until the
+	// axis is homed or moved to an absolute position
+	report, err := p.Scan(strings.NewReader(`G91
+G1 Z-150
+G1 X-120
+G90
+G1 Z5
+G28 X
+G1 X-120
+`))
+	assert.NoError(t, err)
+	if assert.Len(t, report.Findings, 1) {
+		assert.Equal(t, 7, report.Findings[0].Line)
+	}
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"encoding/json"
-
-	"cwtch.im/cwtch/protocol/connections"
 )
 
 func Admin(commandList []string) string {
@@ -92,7 +90,7 @@ func AddContact(commandList []string) string {
 
 	case 3:
 		newcontact := commandList[1]
-		result := cwtchbot.Peer.ImportBundle(newcontact)
+		result := transport.ImportBundle(newcontact)
 		if result != nil {
 			return "Error: contact was not added"
 		} else {
@@ -128,18 +126,15 @@ func GetContactStatus(commandList []string) string {
 		if commandList[1] == "-help" {
 			return "usage: contactstatus contact_ntkID (admin, peer, user)"
 		} else {
-			connectionState := cwtchbot.Peer.GetPeerState(commandList[1])
+			connectionState := transport.PeerState(commandList[1])
 			switch connectionState {
-			case connections.DISCONNECTED:
+			case PeerOffline:
 				return "Peer is not online"
 
-			case connections.AUTHENTICATED:
-				return "Peer is online"
-
-			case connections.CONNECTED:
+			case PeerOnline:
 				return "Peer is online"
 
-			case connections.CONNECTING:
+			case PeerConnecting:
 				return "Peer is connecting"
 
 			default:
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"octoAgent/gcode"
 	"octoAgent/octoprint"
 	"os"
 	"os/exec"
@@ -98,6 +99,19 @@ type GcodeAnalysis struct {
 		Length uint32  `json:"length"`
 		Volume float64 `json:"volume"`
 	} `json:"filament"`
+	// Source is octoprint, or agent when OctoPrint has no analysis yet
+	Source  string        `json:"source"`
+	Details *GcodeDetails `json:"details,omitempty"`
+}
+
+// GcodeDetails is only available from the agent's own analysis
+type GcodeDetails struct {
+	Filament        map[string]gcode.Filament `json:"filament"`
+	PrintingArea    gcode.Box                 `json:"printingArea"`
+	LayerCount      int                       `json:"layerCount"`
+	LayerHeights    []float64                 `json:"layerHeights"`
+	MaxTemperatures map[string]float64        `json:"maxTemperatures"`
+	Commands        map[string]int            `json:"commands"`
 }
 
 type Filament struct {
@@ -136,6 +150,8 @@ type PrintStatus struct {
 	PositionE    float64 `json:"position_e"`
 	ExtruderTemp float64 `json:"extruder_temp"`
 	BedTemp      float64 `json:"bed_temp"`
+	// Layer is only known for files the agent could analyse
+	Layer *LayerProgress `json:"layer,omitempty"`
 }
 
 type FilesResponse struct {
@@ -447,7 +463,7 @@ func DeleteOctoFile(commandList []string) string {
 	}
 }
 
-func PrintOctoFile(commandList []string) string {
+func PrintOctoFile(commandList []string, requester int) string {
 	switch len(commandList) {
 	case 2:
 		if commandList[1] == "-help" {
@@ -473,6 +489,15 @@ func PrintOctoFile(commandList []string) string {
 			return fmt.Sprintf("Error: file %s does not exist", filePath)
 		}
 
+		// Refuse to start if a pre-flight check fails
+		report := runPreflight(fileName)
+		if !report.Passed {
+			return "Error: pre-flight check failed:\n" + report.String()
+		}
+
+		// Record who started the job, before the watcher can see it start
+		jobHistory.Expect(fileName, requester)
+
 		// Select and print file in OctoPrint’s local storage
 		octoReq := octoprint.SelectFileRequest{
 			Location: octoprint.Local,
@@ -482,8 +507,14 @@ func PrintOctoFile(commandList []string) string {
 
 		err = octoReq.Do(octoclient)
 		if err != nil {
+			jobHistory.Forget(fileName)
 			return "Error: not able to print file: " + err.Error()
 		}
+		useBedClear()
+
+		if warnings := report.Warnings(); len(warnings) > 0 {
+			return "File is printing, warning: " + strings.Join(warnings, ", ")
+		}
 		return "File is printing"
 
 	default:
@@ -546,7 +577,7 @@ func GetGcodeAnalysis(commandList []string) string {
 	switch len(commandList) {
 	case 2:
 		if commandList[1] == "-help" {
-			return "usage: printfile filename.ext"
+			return "usage: getgcodeanalysis filename.ext"
 		}
 
 		if !isConnected {
@@ -573,9 +604,32 @@ func GetGcodeAnalysis(commandList []string) string {
 				Length uint32  `json:"length"`
 				Volume float64 `json:"volume"`
 			}{
-				Length: response.GCodeAnalysis.Filament.Length,
+				Length: uint32(response.GCodeAnalysis.Filament.Length),
 				Volume: response.GCodeAnalysis.Filament.Volume,
 			},
+			Source: "octoprint",
+		}
+
+		// OctoPrint has not analysed the file yet, do it locally
+		if !hasAnalysis(response.GCodeAnalysis) {
+			local, err := localAnalysis(commandList[1])
+			if err != nil {
+				return "Error: no analysis available: " + err.Error()
+			}
+
+			total := local.TotalFilament()
+			analysis.EstimatedPrintTime = local.EstimatedPrintTime
+			analysis.Filament.Length = uint32(total.Length)
+			analysis.Filament.Volume = total.Volume
+			analysis.Source = "agent"
+			analysis.Details = &GcodeDetails{
+				Filament:        local.Filament,
+				PrintingArea:    local.PrintingArea,
+				LayerCount:      len(local.Layers),
+				LayerHeights:    local.LayerHeights(),
+				MaxTemperatures: local.MaxTemperatures,
+				Commands:        local.Commands,
+			}
 		}
 
 		jsonBytes, err := json.Marshal(analysis)
@@ -723,22 +777,34 @@ func GetPrinterState() string {
 	return string(jsonBytes)
 }
 
-// Global tracker instance
+// Global tracker instance, started in main
 var positionTracker *PositionTracker
 
-// Initialize tracker at program start
-func init() {
-	storeZ := flag.Bool("store-z", true, "Store unique Z values to file")
-	zFile := flag.String("z-file", "z_stream.txt", "Output file for Z values")
-	logPath := flag.String("log", "/home/rich/.octoprint/logs/serial.log", "Path to serial.log")
+// serialLogPath is the -log flag, empty for OctoPrint's default location
+var serialLogPath string
+
+// setTrackerFlags parses the command line and sets up the tracker, it runs
+// first in main so that tests are not handed the agent's flags
+func setTrackerFlags() {
+	storeZ := flag.Bool("store-z", true, "Log Z changes per job")
+	zDir := flag.String("z-dir", "zlogs", "Directory for the Z logs")
+	logPath := flag.String("log", "", "Path to serial.log, default ~/.octoprint/logs/serial.log")
+	zFile := flag.String("z-file", "", "Deprecated, Z changes are logged per job in -z-dir")
 	flag.Parse()
 
+	if *zFile != "" {
+		fmt.Printf("Warning: -z-file is deprecated and ignored, Z logs are written to %s\n", *zDir)
+	}
+
 	var err error
-	positionTracker, err = NewPositionTracker(*logPath, *storeZ, *zFile)
-	//positionTracker, err = NewPositionTracker("/home/rich/.octoprint/logs/serial.log", true, "z_stream.txt")
-	if err != nil {
-		fmt.Printf("Failed to initialize position tracker: %v\n", err)
+	if *storeZ {
+		zLog, err = NewZLog(*zDir)
+		if err != nil {
+			fmt.Printf("Failed to open Z log: %v\n", err)
+		}
 	}
+	serialLogPath = *logPath
+	positionTracker = newTracker(zLog)
 }
 
 func GetPrintStatus() string {
@@ -746,25 +812,39 @@ func GetPrintStatus() string {
 		return "Error: not connected"
 	}
 
+	status, err := _getPrintStatus()
+	if err != nil {
+		return "Error " + err.Error()
+	}
+
+	jsonBytes, err := json.Marshal(status)
+	if err != nil {
+		return "Error: failed to encode print state: " + err.Error()
+	}
+	return string(jsonBytes)
+}
+
+// _getPrintStatus combines job, printer state and tracked position
+func _getPrintStatus() (*PrintStatus, error) {
 	// Fetch job data
 	octoReq := octoprint.JobRequest{}
 	job, err := octoReq.Do(octoclient)
 	if err != nil {
-		return "Error GetJobStatus: " + err.Error()
+		return nil, fmt.Errorf("GetJobStatus: %v", err)
 	}
 
 	// Fetch printer state
 	stateReq := octoprint.StateRequest{}
 	state, err := stateReq.Do(octoclient)
 	if err != nil {
-		return "Error GetStateStatus: " + err.Error()
+		return nil, fmt.Errorf("GetStateStatus: %v", err)
 	}
 
 	// Get position from tracker
 	pos := positionTracker.GetPosition()
 
 	// Build status
-	status := PrintStatus{
+	status := &PrintStatus{
 		FileName:     job.Job.File.Name,
 		Progress:     math.Round(job.Progress.Completion),
 		TimeElapsed:  math.Round(job.Progress.PrintTime),
@@ -778,11 +858,10 @@ func GetPrintStatus() string {
 		BedTemp:      getTemperature(state, "bed"),
 	}
 
-	jsonBytes, err := json.Marshal(status)
-	if err != nil {
-		return "Error: failed to encode print state: " + err.Error()
+	if state.State.Flags.Printing || state.State.Flags.Paused {
+		status.Layer = layerTracker.Update(job, pos.Z)
 	}
-	return string(jsonBytes)
+	return status, nil
 }
 
 /*
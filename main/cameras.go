@@ -0,0 +1,476 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"octoAgent/octoprint"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+
+Cameras:
+
+A printer can have several named cameras, CAMERAS lists them, e.g.
+CAMERAS=nozzle,bed, the first one is the default. Each camera is configured
+with CAMERA_<NAME>_* variables, e.g. CAMERA_NOZZLE_BACKEND. Without CAMERAS
+there is a single camera named "default" configured with CAMERA_*.
+
+  BACKEND       octoprint (default), http, v4l2, raspistill, libcamera or file
+  SNAPSHOT_URL  http: image URL, e.g. http://camera.local/snapshot.jpg
+  STREAM_URL    http: MJPEG stream for videos, and for images without
+                SNAPSHOT_URL
+  DEVICE        v4l2: the video device (default /dev/video0)
+  FILE          file: the image returned as snapshot (a test fixture)
+  VIDEO_FILE    file: the video returned as recording
+  WIDTH, HEIGHT resolution (default 1280x720)
+  QUALITY       JPEG quality 1-100 (default 80)
+  DURATION      video length in seconds (default and at most 15)
+
+The octoprint backend uses the snapshot and stream URLs of OctoPrint's webcam
+settings, relative URLs are resolved against BASE_URL. Images from URLs are
+stored as received unless a resolution or quality is configured or requested,
+then they are scaled to fit and re-encoded with ffmpeg. v4l2 devices capture
+at their own resolution unless one is configured or requested.
+
+*/
+
+const (
+	CameraOctoPrint  = "octoprint"
+	CameraHTTP       = "http"
+	CameraV4L2       = "v4l2"
+	CameraRaspistill = "raspistill"
+	CameraLibcamera  = "libcamera"
+	CameraFile       = "file"
+
+	defaultCameraName = "default"
+
+	// maxVideoDuration limits takevideo recordings, they block the command
+	// dispatcher until they are done
+	maxVideoDuration = 15 * time.Second
+)
+
+// CaptureOptions are the settings of a single capture
+type CaptureOptions struct {
+	Width    int           `json:"width"`
+	Height   int           `json:"height"`
+	Quality  int           `json:"quality"`
+	Duration time.Duration `json:"-"`
+	Seconds  int           `json:"duration,omitempty"` // Duration for JSON
+	// CustomSize is set when Width or Height were configured or requested
+	CustomSize bool `json:"-"`
+	// CustomQuality is set when Quality was configured or requested
+	CustomQuality bool `json:"-"`
+}
+
+// Camera captures images and videos
+type Camera interface {
+	Snapshot(filePath string, opts CaptureOptions) error
+	Record(filePath string, opts CaptureOptions) error
+}
+
+// NamedCamera is a configured camera of the printer
+type NamedCamera struct {
+	Name     string         `json:"name"`
+	Backend  string         `json:"backend"`
+	Defaults CaptureOptions `json:"defaults"`
+	camera   Camera
+}
+
+// Configured cameras, set up in main, the first one is the default
+var cameras []*NamedCamera
+
+// getCamera returns a camera by name, an empty name is the default camera
+func getCamera(name string) (*NamedCamera, error) {
+	if len(cameras) == 0 {
+		return nil, errors.New("no camera is configured")
+	}
+	if name == "" {
+		return cameras[0], nil
+	}
+	for _, cam := range cameras {
+		if cam.Name == name {
+			return cam, nil
+		}
+	}
+	return nil, errors.New("unknown camera: " + name)
+}
+
+// setCameraVars loads the camera settings from the environment
+func setCameraVars() error {
+	if value := os.Getenv("SNAPSHOT_DIR"); value != "" {
+		snapshot_dir = value
+	}
+
+	cameras = nil
+	names := os.Getenv("CAMERAS")
+	if names == "" {
+		cam, err := newNamedCamera(defaultCameraName, "CAMERA_")
+		if err != nil {
+			return err
+		}
+		cameras = append(cameras, cam)
+	} else {
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if _, err := getCamera(name); err == nil {
+				return errors.New("duplicate camera: " + name)
+			}
+			cam, err := newNamedCamera(name, "CAMERA_"+strings.ToUpper(name)+"_")
+			if err != nil {
+				return fmt.Errorf("camera %s: %v", name, err)
+			}
+			cameras = append(cameras, cam)
+		}
+	}
+	return os.MkdirAll(snapshot_dir, 0755)
+}
+
+// newNamedCamera configures a camera from the variables starting with prefix
+func newNamedCamera(name, prefix string) (*NamedCamera, error) {
+	env := func(key string) string { return os.Getenv(prefix + key) }
+
+	cam := &NamedCamera{
+		Name:     name,
+		Backend:  env("BACKEND"),
+		Defaults: CaptureOptions{Width: 1280, Height: 720, Quality: 80, Duration: 15 * time.Second},
+	}
+	if cam.Backend == "" {
+		cam.Backend = CameraOctoPrint
+	}
+
+	for key, target := range map[string]*int{"WIDTH": &cam.Defaults.Width, "HEIGHT": &cam.Defaults.Height, "QUALITY": &cam.Defaults.Quality} {
+		if value := env(key); value != "" {
+			number, err := strconv.Atoi(value)
+			if err != nil || number < 1 {
+				return nil, fmt.Errorf("%s%s must be a positive number", prefix, key)
+			}
+			*target = number
+		}
+	}
+	cam.Defaults.CustomSize = env("WIDTH") != "" || env("HEIGHT") != ""
+	cam.Defaults.CustomQuality = env("QUALITY") != ""
+	if value := env("DURATION"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("%sDURATION must be a positive number of seconds", prefix)
+		}
+		cam.Defaults.Duration = time.Duration(seconds) * time.Second
+	}
+	if err := cam.Defaults.validate(); err != nil {
+		return nil, err
+	}
+
+	switch cam.Backend {
+	case CameraOctoPrint:
+		cam.camera = &httpCamera{urls: octoWebcamURLs}
+	case CameraHTTP, "url":
+		snapshotURL, streamURL := env("SNAPSHOT_URL"), env("STREAM_URL")
+		if snapshotURL == "" && streamURL == "" {
+			return nil, fmt.Errorf("%sBACKEND=http needs %sSNAPSHOT_URL or %sSTREAM_URL", prefix, prefix, prefix)
+		}
+		cam.Backend = CameraHTTP
+		cam.camera = &httpCamera{urls: func() (string, string, error) { return snapshotURL, streamURL, nil }}
+	case CameraV4L2:
+		device := env("DEVICE")
+		if device == "" {
+			device = "/dev/video0"
+		}
+		cam.camera = &v4l2Camera{device: device}
+	case CameraRaspistill:
+		cam.camera = &piCamera{still: "raspistill", video: "raspivid", longFlags: false}
+	case CameraLibcamera:
+		cam.camera = &piCamera{still: "libcamera-still", video: "libcamera-vid", longFlags: true}
+	case CameraFile:
+		image := env("FILE")
+		if image == "" {
+			return nil, fmt.Errorf("%sBACKEND=file needs %sFILE", prefix, prefix)
+		}
+		cam.camera = &fileCamera{image: image, video: env("VIDEO_FILE")}
+	default:
+		return nil, fmt.Errorf("unknown %sBACKEND: %s", prefix, cam.Backend)
+	}
+	return cam, nil
+}
+
+func (opts CaptureOptions) validate() error {
+	if opts.Quality < 1 || opts.Quality > 100 {
+		return errors.New("quality must be between 1 and 100")
+	}
+	if opts.Duration > maxVideoDuration {
+		return fmt.Errorf("duration must be at most %s", maxVideoDuration)
+	}
+	return nil
+}
+
+// ffmpegQuality maps a JPEG quality of 1-100 to ffmpeg's -q:v scale of 31-2
+func ffmpegQuality(quality int) string {
+	return strconv.Itoa(2 + (100-quality)*29/99)
+}
+
+// runCapture runs a capture command and reports its output on failure
+func runCapture(name string, args ...string) error {
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// httpCamera fetches snapshots from a URL and records an MJPEG stream
+type httpCamera struct {
+	urls func() (snapshotURL, streamURL string, err error)
+}
+
+func (c *httpCamera) Snapshot(filePath string, opts CaptureOptions) error {
+	snapshotURL, streamURL, err := c.urls()
+	if err != nil {
+		return err
+	}
+	if snapshotURL == "" {
+		args := append([]string{"-y", "-loglevel", "error", "-i", streamURL, "-frames:v", "1"}, snapshotArgs(opts)...)
+		return runCapture("ffmpeg", append(args, filePath)...)
+	}
+	if !opts.CustomSize && !opts.CustomQuality {
+		return fetchSnapshot(snapshotURL, filePath)
+	}
+
+	// The camera decides the size and quality, the image is re-encoded
+	fetched := filePath + ".orig" + IMAGE_TYPE
+	if err := fetchSnapshot(snapshotURL, fetched); err != nil {
+		return err
+	}
+	defer os.Remove(fetched)
+	args := append([]string{"-y", "-loglevel", "error", "-i", fetched}, snapshotArgs(opts)...)
+	return runCapture("ffmpeg", append(args, filePath)...)
+}
+
+// snapshotArgs sets the quality of an image and, when it was asked for,
+// scales it down to fit the size
+func snapshotArgs(opts CaptureOptions) []string {
+	args := []string{"-q:v", ffmpegQuality(opts.Quality)}
+	if opts.CustomSize {
+		args = append(args, "-vf", fmt.Sprintf(
+			"scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", opts.Width, opts.Height))
+	}
+	return args
+}
+
+func (c *httpCamera) Record(filePath string, opts CaptureOptions) error {
+	_, streamURL, err := c.urls()
+	if err != nil {
+		return err
+	}
+	if streamURL == "" {
+		return errors.New("no stream URL is configured for videos")
+	}
+	return runCapture("ffmpeg", "-y", "-loglevel", "error", "-i", streamURL,
+		"-t", formatSeconds(opts.Duration),
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", opts.Width),
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "+faststart", filePath)
+}
+
+// octoWebcamURLs returns the snapshot and stream URLs configured in OctoPrint
+func octoWebcamURLs() (string, string, error) {
+	settingsReq := octoprint.SettingsRequest{}
+	settings, err := settingsReq.Do(octoclient)
+	if err != nil {
+		return "", "", err
+	}
+	if settings.Webcam == nil || (settings.Webcam.SnapshotURL == "" && settings.Webcam.StreamURL == "") {
+		return "", "", errors.New("no webcam is configured in OctoPrint")
+	}
+
+	// OctoPrint usually proxies the webcam, e.g. /webcam/?action=snapshot
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", "", err
+	}
+	resolve := func(ref string) (string, error) {
+		if ref == "" {
+			return "", nil
+		}
+		parsed, err := url.Parse(ref)
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(parsed).String(), nil
+	}
+
+	snapshotURL, err := resolve(settings.Webcam.SnapshotURL)
+	if err != nil {
+		return "", "", err
+	}
+	streamURL, err := resolve(settings.Webcam.StreamURL)
+	if err != nil {
+		return "", "", err
+	}
+	return snapshotURL, streamURL, nil
+}
+
+// v4l2Camera captures from a video device with ffmpeg
+type v4l2Camera struct {
+	device string
+}
+
+// inputArgs selects the device, a device that does not support the default
+// resolution fails, so the size is only passed when it was asked for
+func (c *v4l2Camera) inputArgs(opts CaptureOptions) []string {
+	args := []string{"-y", "-loglevel", "error", "-f", "v4l2"}
+	if opts.CustomSize {
+		args = append(args, "-video_size", fmt.Sprintf("%dx%d", opts.Width, opts.Height))
+	}
+	return append(args, "-i", c.device)
+}
+
+func (c *v4l2Camera) Snapshot(filePath string, opts CaptureOptions) error {
+	args := append(c.inputArgs(opts), "-frames:v", "1", "-q:v", ffmpegQuality(opts.Quality), filePath)
+	return runCapture("ffmpeg", args...)
+}
+
+func (c *v4l2Camera) Record(filePath string, opts CaptureOptions) error {
+	args := append(c.inputArgs(opts), "-t", formatSeconds(opts.Duration),
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "+faststart", filePath)
+	return runCapture("ffmpeg", args...)
+}
+
+// piCamera captures with the Raspberry Pi camera tools, the legacy raspistill
+// and raspivid or their libcamera successors
+type piCamera struct {
+	still     string
+	video     string
+	longFlags bool // libcamera uses --width/--height
+}
+
+func (c *piCamera) sizeArgs(opts CaptureOptions) []string {
+	if c.longFlags {
+		return []string{"--width", strconv.Itoa(opts.Width), "--height", strconv.Itoa(opts.Height)}
+	}
+	return []string{"-w", strconv.Itoa(opts.Width), "-h", strconv.Itoa(opts.Height)}
+}
+
+func (c *piCamera) Snapshot(filePath string, opts CaptureOptions) error {
+	args := append([]string{"-n", "-o", filePath, "-q", strconv.Itoa(opts.Quality)}, c.sizeArgs(opts)...)
+	return runCapture(c.still, args...)
+}
+
+func (c *piCamera) Record(filePath string, opts CaptureOptions) error {
+	// The raw H.264 stream is wrapped into an MP4 container
+	args := append([]string{"-n", "-o", "-", "-t", strconv.FormatInt(opts.Duration.Milliseconds(), 10)}, c.sizeArgs(opts)...)
+	videoCmd := exec.Command(c.video, args...)
+	ffmpegCmd := exec.Command("ffmpeg", "-y", "-loglevel", "error", "-r", "30", "-i", "-", "-c:v", "copy", filePath)
+
+	stdout, err := videoCmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	ffmpegCmd.Stdin = stdout
+
+	if err := videoCmd.Start(); err != nil {
+		return fmt.Errorf("starting %s: %v", c.video, err)
+	}
+	if err := ffmpegCmd.Start(); err != nil {
+		videoCmd.Process.Kill()
+		videoCmd.Wait()
+		return fmt.Errorf("starting ffmpeg: %v", err)
+	}
+
+	if err := videoCmd.Wait(); err != nil {
+		ffmpegCmd.Wait()
+		return fmt.Errorf("%s: %v", c.video, err)
+	}
+	if err := ffmpegCmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg: %v", err)
+	}
+	return nil
+}
+
+// fileCamera returns fixed files, for setups without a camera and for tests
+type fileCamera struct {
+	image string
+	video string
+}
+
+func (c *fileCamera) Snapshot(filePath string, _ CaptureOptions) error {
+	return copyFile(c.image, filePath)
+}
+
+func (c *fileCamera) Record(filePath string, _ CaptureOptions) error {
+	if c.video == "" {
+		return errors.New("no video file is configured")
+	}
+	return copyFile(c.video, filePath)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// parseCaptureArgs reads [camera] [width=N] [height=N] [quality=N]
+// [duration=S] from a command, duration only when video is set
+func parseCaptureArgs(args []string, video bool) (*NamedCamera, CaptureOptions, error) {
+	name := ""
+	if len(args) > 0 && !strings.Contains(args[0], "=") {
+		name = args[0]
+		args = args[1:]
+	}
+	cam, err := getCamera(name)
+	if err != nil {
+		return nil, CaptureOptions{}, err
+	}
+
+	opts := cam.Defaults
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			return nil, opts, errors.New("syntax: " + arg)
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 {
+			return nil, opts, errors.New(key + " must be a positive number")
+		}
+		switch {
+		case key == "width":
+			opts.Width = number
+			opts.CustomSize = true
+		case key == "height":
+			opts.Height = number
+			opts.CustomSize = true
+		case key == "quality":
+			opts.Quality = number
+			opts.CustomQuality = true
+		case key == "duration" && video:
+			opts.Duration = time.Duration(number) * time.Second
+		default:
+			return nil, opts, errors.New("unknown attribute " + key)
+		}
+	}
+	return cam, opts, opts.validate()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setTestCameras configures a file camera named default and one named nozzle
+func setTestCameras(t *testing.T) string {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "fixture.jpg")
+	assert.NoError(t, os.WriteFile(image, []byte("jpeg"), 0644))
+
+	previous := cameras
+	t.Cleanup(func() { cameras = previous })
+
+	t.Setenv("CAMERA_BACKEND", CameraFile)
+	t.Setenv("CAMERA_FILE", image)
+	t.Setenv("CAMERA_NOZZLE_BACKEND", CameraFile)
+	t.Setenv("CAMERA_NOZZLE_FILE", image)
+	t.Setenv("CAMERA_NOZZLE_WIDTH", "640")
+	t.Setenv("CAMERA_NOZZLE_HEIGHT", "480")
+	t.Setenv("CAMERA_NOZZLE_DURATION", "5")
+
+	cameras = nil
+	for _, name := range []string{"default", "nozzle"} {
+		prefix := "CAMERA_"
+		if name != "default" {
+			prefix = "CAMERA_NOZZLE_"
+		}
+		cam, err := newNamedCamera(name, prefix)
+		assert.NoError(t, err)
+		cameras = append(cameras, cam)
+	}
+	return image
+}
+
+func TestNewNamedCamera(t *testing.T) {
+	image := setTestCameras(t)
+
+	cam := cameras[0]
+	assert.Equal(t, CameraFile, cam.Backend)
+	assert.Equal(t, CaptureOptions{Width: 1280, Height: 720, Quality: 80, Duration: 15 * time.Second}, cam.Defaults)
+
+	nozzle := cameras[1]
+	assert.Equal(t, CaptureOptions{Width: 640, Height: 480, Quality: 80, Duration: 5 * time.Second, CustomSize: true}, nozzle.Defaults)
+
+	snapshot := filepath.Join(t.TempDir(), "snapshot.jpg")
+	assert.NoError(t, nozzle.camera.Snapshot(snapshot, nozzle.Defaults))
+	data, err := os.ReadFile(snapshot)
+	assert.NoError(t, err)
+	assert.Equal(t, "jpeg", string(data))
+	// No VIDEO_FILE
+	assert.Error(t, nozzle.camera.Record(filepath.Join(t.TempDir(), "video.mp4"), nozzle.Defaults))
+
+	for env, value := range map[string]string{
+		"CAMERA_TEST_BACKEND":  "webcam",
+		"CAMERA_TEST_QUALITY":  "101",
+		"CAMERA_TEST_WIDTH":    "wide",
+		"CAMERA_TEST_DURATION": "60",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv("CAMERA_TEST_BACKEND", CameraFile)
+			t.Setenv("CAMERA_TEST_FILE", image)
+			t.Setenv(env, value)
+			_, err := newNamedCamera("test", "CAMERA_TEST_")
+			assert.Error(t, err)
+		})
+	}
+
+	t.Setenv("CAMERA_TEST_BACKEND", CameraFile)
+	t.Setenv("CAMERA_TEST_FILE", "")
+	_, err = newNamedCamera("test", "CAMERA_TEST_")
+	assert.EqualError(t, err, "CAMERA_TEST_BACKEND=file needs CAMERA_TEST_FILE")
+}
+
+func TestParseCaptureArgs(t *testing.T) {
+	setTestCameras(t)
+
+	cam, opts, err := parseCaptureArgs(nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "default", cam.Name)
+	assert.Equal(t, cameras[0].Defaults, opts)
+
+	cam, opts, err = parseCaptureArgs([]string{"nozzle", "quality=50"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "nozzle", cam.Name)
+	assert.Equal(t, 50, opts.Quality)
+	assert.Equal(t, 640, opts.Width)
+
+	_, opts, err = parseCaptureArgs([]string{"width=800", "duration=10"}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 800, opts.Width)
+	assert.Equal(t, 720, opts.Height)
+	assert.True(t, opts.CustomSize)
+	assert.Equal(t, 10*time.Second, opts.Duration)
+
+	for _, args := range [][]string{
+		{"bed"},
+		{"quality"},
+		{"quality=0"},
+		{"quality=101"},
+		{"width=-1"},
+		{"duration=10"}, // images have no duration
+		{"focus=3"},
+	} {
+		_, _, err := parseCaptureArgs(args, false)
+		assert.Error(t, err, "%v", args)
+	}
+	_, _, err = parseCaptureArgs([]string{"duration=16"}, true)
+	assert.EqualError(t, err, "duration must be at most 15s")
+}
+
+func TestFfmpegQuality(t *testing.T) {
+	assert.Equal(t, "2", ffmpegQuality(100))
+	assert.Equal(t, "7", ffmpegQuality(80))
+	assert.Equal(t, "16", ffmpegQuality(50))
+	assert.Equal(t, "31", ffmpegQuality(1))
+}
+
+func TestV4L2InputArgs(t *testing.T) {
+	c := &v4l2Camera{device: "/dev/video2"}
+	opts := CaptureOptions{Width: 1280, Height: 720, Quality: 80}
+	assert.Equal(t, []string{"-y", "-loglevel", "error", "-f", "v4l2", "-i", "/dev/video2"}, c.inputArgs(opts))
+
+	opts.CustomSize = true
+	assert.Equal(t, []string{"-y", "-loglevel", "error", "-f", "v4l2", "-video_size", "1280x720", "-i", "/dev/video2"}, c.inputArgs(opts))
+}
+
+func TestHTTPCameraSnapshot(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("jpeg"))
+	}))
+	defer server.Close()
+
+	// ffmpeg writes its arguments instead of an image
+	bin := t.TempDir()
+	script := "#!/bin/sh\nfor arg; do out=$arg; done\necho \"$@\" > \"$out\"\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(script), 0755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	capture := func(c *httpCamera, opts CaptureOptions) string {
+		filePath := filepath.Join(t.TempDir(), "snapshot.jpg")
+		assert.NoError(t, c.Snapshot(filePath, opts))
+		data, err := os.ReadFile(filePath)
+		assert.NoError(t, err)
+		entries, err := os.ReadDir(filepath.Dir(filePath))
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		return strings.TrimSpace(string(data))
+	}
+	defaults := CaptureOptions{Width: 1280, Height: 720, Quality: 80}
+
+	snapshot := &httpCamera{urls: func() (string, string, error) { return server.URL, "", nil }}
+	assert.Equal(t, "jpeg", capture(snapshot, defaults))
+
+	// A requested size or quality is applied to the fetched image
+	sized := defaults
+	sized.Width, sized.Height, sized.CustomSize = 640, 480, true
+	args := capture(snapshot, sized)
+	assert.Contains(t, args, ".orig.jpg -q:v 7 -vf scale='min(640,iw)':'min(480,ih)':force_original_aspect_ratio=decrease ")
+	quality := defaults
+	quality.Quality, quality.CustomQuality = 50, true
+	args = capture(snapshot, quality)
+	assert.Contains(t, args, ".orig.jpg -q:v 16 ")
+	assert.NotContains(t, args, "scale")
+
+	stream := &httpCamera{urls: func() (string, string, error) { return "", "http://camera.local/stream", nil }}
+	assert.True(t, strings.HasPrefix(capture(stream, defaults), "-y -loglevel error -i http://camera.local/stream -frames:v 1 -q:v 7 /"))
+	assert.Contains(t, capture(stream, sized), "-q:v 7 -vf scale='min(640,iw)'")
+}
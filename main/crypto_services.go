@@ -1,157 +1,350 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+
+	"golang.org/x/crypto/scrypt"
 )
 
-func EncryptFile(password string, inputFilepath string, outputFilepath string) error {
-	// Hash the password using SHA-256
-	hashedPassword := sha256.Sum256([]byte(password))
+/*
 
-	// Convert the hashed password to a byte slice
-	key := hashedPassword[:]
+File encryption:
 
-	// Generate a random nonce
-	nonce := make([]byte, 16)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return err
+Files shared over S3 are encrypted with a password in a versioned, streaming
+format:
+
+  magic     "OAE" and the format version 1
+  kdf       scrypt log2(N), r and p, one byte each
+  salt      16 random bytes
+  chunk     plaintext chunk size, uint32 big endian
+  nonce     8 random bytes, the prefix of every chunk nonce
+  chunks    AES-256-GCM sealed chunks, the nonce is the prefix followed by the
+            chunk counter (uint32 big endian)
+
+The header and a final flag are the additional data of every chunk, so
+changing the header, reordering, dropping or truncating chunks fails the
+authentication. The key is derived from the password with scrypt.
+
+Files without a valid header are decrypted as the legacy format: a 16 byte
+IV followed by AES-CBC with the SHA-256 of the password as key.
+
+*/
+
+const (
+	encryptionMagic   = "OAE"
+	encryptionVersion = 1
+
+	encryptionSaltSize   = 16
+	encryptionPrefixSize = 8
+	encryptionChunkSize  = 64 * 1024
+	encryptionHeaderSize = len(encryptionMagic) + 1 + 3 + encryptionSaltSize + 4 + encryptionPrefixSize
+
+	// scrypt parameters of new files, N = 2^15
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+
+	// limits for the parameters of files to decrypt, so a crafted header
+	// cannot exhaust memory, scrypt needs 128*r*N bytes
+	maxScryptLogN      = 20
+	maxScryptMemory    = 64 * 1024 * 1024
+	maxScryptP         = 4
+	maxEncryptionChunk = 16 * 1024 * 1024
+)
+
+var errDecrypt = errors.New("wrong password or corrupted file")
+
+// encryptionHeader is the header of the current format
+type encryptionHeader struct {
+	logN, r, p byte
+	salt       []byte
+	chunkSize  uint32
+	prefix     []byte
+}
+
+func (h *encryptionHeader) marshal() []byte {
+	buf := make([]byte, 0, encryptionHeaderSize)
+	buf = append(buf, encryptionMagic...)
+	buf = append(buf, encryptionVersion, h.logN, h.r, h.p)
+	buf = append(buf, h.salt...)
+	buf = binary.BigEndian.AppendUint32(buf, h.chunkSize)
+	return append(buf, h.prefix...)
+}
+
+func parseEncryptionHeader(buf []byte) (*encryptionHeader, error) {
+	if buf[len(encryptionMagic)] != encryptionVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", buf[len(encryptionMagic)])
+	}
+	kdf := buf[len(encryptionMagic)+1:]
+	h := &encryptionHeader{logN: kdf[0], r: kdf[1], p: kdf[2]}
+	if h.logN < 10 || h.logN > maxScryptLogN || h.r < 1 || 128*int(h.r)<<h.logN > maxScryptMemory || h.p < 1 || h.p > maxScryptP {
+		return nil, errors.New("invalid key derivation parameters")
 	}
 
-	// Open the input file
-	inputFileHandle, err := os.Open(inputFilepath)
-	if err != nil {
-		return err
+	rest := kdf[3:]
+	h.salt = rest[:encryptionSaltSize]
+	h.chunkSize = binary.BigEndian.Uint32(rest[encryptionSaltSize:])
+	h.prefix = rest[encryptionSaltSize+4:]
+	if h.chunkSize == 0 || h.chunkSize > maxEncryptionChunk {
+		return nil, errors.New("invalid chunk size")
 	}
-	defer inputFileHandle.Close()
+	return h, nil
+}
 
-	// Create the output file
-	outputFileHandle, err := os.Create(outputFilepath)
+// aead derives the key of the header from the password
+func (h *encryptionHeader) aead(password string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(password), h.salt, 1<<h.logN, int(h.r), int(h.p), 32)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer outputFileHandle.Close()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
 
-	// Write the nonce to the beginning of the output file
-	if _, err := outputFileHandle.Write(nonce); err != nil {
-		return err
+// chunkNonce and chunkAD bind a chunk to its position and the header
+func (h *encryptionHeader) chunkNonce(counter uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, h.prefix...), counter)
+}
+
+func chunkAD(header []byte, final bool) []byte {
+	ad := append([]byte{}, header...)
+	if final {
+		return append(ad, 1)
 	}
+	return append(ad, 0)
+}
 
-	// Create a new AES cipher block using the provided key
-	block, err := aes.NewCipher(key)
+// EncryptFile encrypts inputFilepath with the password into outputFilepath
+func EncryptFile(password string, inputFilepath string, outputFilepath string) error {
+	h := &encryptionHeader{
+		logN:      scryptLogN,
+		r:         scryptR,
+		p:         scryptP,
+		salt:      make([]byte, encryptionSaltSize),
+		chunkSize: encryptionChunkSize,
+		prefix:    make([]byte, encryptionPrefixSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, h.salt); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, h.prefix); err != nil {
+		return err
+	}
+	aead, err := h.aead(password)
 	if err != nil {
 		return err
 	}
 
-	// Create a cipher mode for AES in CBC mode
-	cbc := cipher.NewCBCEncrypter(block, nonce)
-
-	// Create a buffer to hold the encrypted data
-	buffer := make([]byte, aes.BlockSize)
+	inputFileHandle, err := os.Open(inputFilepath)
+	if err != nil {
+		return err
+	}
+	defer inputFileHandle.Close()
+	input := bufio.NewReaderSize(inputFileHandle, encryptionChunkSize)
 
-	// Encrypt the data
-	for {
-		n, err := inputFileHandle.Read(buffer)
-		if err != nil && err != io.EOF {
+	return writeAtomically(outputFilepath, func(output io.Writer) error {
+		header := h.marshal()
+		if _, err := output.Write(header); err != nil {
 			return err
 		}
 
-		if n == 0 {
-			break
-		}
-
-		// Pad the input data if necessary
-		if n < aes.BlockSize {
-			for i := n; i < aes.BlockSize; i++ {
-				buffer[i] = byte(aes.BlockSize - n)
+		chunk := make([]byte, h.chunkSize)
+		sealed := make([]byte, 0, int(h.chunkSize)+aead.Overhead())
+		for counter := uint32(0); ; counter++ {
+			if counter == ^uint32(0) {
+				return errors.New("file too large to encrypt")
 			}
-		}
-
-		// Encrypt the buffer
-		cbc.CryptBlocks(buffer, buffer)
 
-		// Write the encrypted data to the output file
-		if _, err := outputFileHandle.Write(buffer); err != nil {
-			return err
-		}
+			n, err := io.ReadFull(input, chunk)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			// A full chunk is the final one if nothing follows
+			final := err != nil
+			if !final {
+				if _, peekErr := input.Peek(1); peekErr == io.EOF {
+					final = true
+				}
+			}
 
-		if n < aes.BlockSize {
-			break
+			sealed = aead.Seal(sealed[:0], h.chunkNonce(counter), chunk[:n], chunkAD(header, final))
+			if _, err := output.Write(sealed); err != nil {
+				return err
+			}
+			if final {
+				return nil
+			}
 		}
-	}
-	return nil
+	})
 }
 
+// DecryptFile decrypts inputFilepath with the password into outputFilepath,
+// the output is only created when the whole file is authentic
 func DecryptFile(password string, inputFilepath string, outputFilepath string) error {
-	// Hash the password using SHA-256
-	hashedPassword := sha256.Sum256([]byte(password))
-
-	// Convert the hashed password to a byte slice
-	key := hashedPassword[:]
-
-	// Open the input file
 	inputFileHandle, err := os.Open(inputFilepath)
 	if err != nil {
 		return err
 	}
 	defer inputFileHandle.Close()
+	input := bufio.NewReaderSize(inputFileHandle, encryptionChunkSize)
 
-	// Create the output file
-	outputFileHandle, err := os.Create(outputFilepath)
-	if err != nil {
+	// A legacy IV can start with the magic, only a valid header is the
+	// current format
+	var h *encryptionHeader
+	headerErr := errDecrypt
+	peeked, err := input.Peek(encryptionHeaderSize)
+	// The header outlives the buffer, the parsed salt and prefix refer to it
+	header := append([]byte{}, peeked...)
+	if err == nil && bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		h, headerErr = parseEncryptionHeader(header)
+	}
+	if h == nil {
+		err := writeAtomically(outputFilepath, func(output io.Writer) error {
+			return decryptLegacy(password, input, output)
+		})
+		if err == errDecrypt {
+			return headerErr
+		}
 		return err
 	}
-	defer outputFileHandle.Close()
-
-	// Get the file size for reading
-	stat, err := inputFileHandle.Stat()
-	if err != nil {
+	if _, err := input.Discard(encryptionHeaderSize); err != nil {
 		return err
 	}
-	fileSize := stat.Size()
 
-	// Create a buffer to read the file contents
-	encryptedData := make([]byte, fileSize)
-	_, err = inputFileHandle.Read(encryptedData)
+	aead, err := h.aead(password)
 	if err != nil {
 		return err
 	}
 
-	// Get the nonce from the beginning of the encrypted data
-	nonceSize := 16 // 16 bytes for a 16-byte nonce
-	nonce := encryptedData[:nonceSize]
-	encryptedData = encryptedData[nonceSize:]
+	return writeAtomically(outputFilepath, func(output io.Writer) error {
+		sealed := make([]byte, int(h.chunkSize)+aead.Overhead())
+		chunk := make([]byte, 0, h.chunkSize)
+		for counter := uint32(0); ; counter++ {
+			n, err := io.ReadFull(input, sealed)
+			if err == io.EOF {
+				// The final chunk is missing
+				return errDecrypt
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			final := err != nil
+			if !final {
+				if _, peekErr := input.Peek(1); peekErr == io.EOF {
+					final = true
+				}
+			}
 
-	// Create a new AES cipher block using the provided key
-	block, err := aes.NewCipher(key)
+			chunk, err = aead.Open(chunk[:0], h.chunkNonce(counter), sealed[:n], chunkAD(header, final))
+			if err != nil {
+				return errDecrypt
+			}
+			if _, err := output.Write(chunk); err != nil {
+				return err
+			}
+			if final {
+				return nil
+			}
+		}
+	})
+}
+
+// decryptLegacy decrypts the AES-CBC format of earlier versions. Its padding
+// was omitted for block aligned files, so padding is only removed when it is
+// well formed.
+func decryptLegacy(password string, input io.Reader, output io.Writer) error {
+	hashedPassword := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(hashedPassword[:])
 	if err != nil {
 		return err
 	}
 
-	// Create a cipher mode for AES in CBC mode
-	cbc := cipher.NewCBCDecrypter(block, nonce)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(input, iv); err != nil {
+		return errDecrypt
+	}
+	cbc := cipher.NewCBCDecrypter(block, iv)
 
-	// Create a buffer to hold the decrypted data
-	decryptedData := make([]byte, len(encryptedData))
+	// The last block is held back until the end is known
+	var last []byte
+	buffer := make([]byte, encryptionChunkSize)
+	for {
+		n, err := io.ReadFull(input, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n%aes.BlockSize != 0 {
+			return errDecrypt
+		}
+		if n > 0 {
+			if _, err := output.Write(last); err != nil {
+				return err
+			}
+			cbc.CryptBlocks(buffer[:n], buffer[:n])
+			if _, err := output.Write(buffer[:n-aes.BlockSize]); err != nil {
+				return err
+			}
+			last = append(last[:0], buffer[n-aes.BlockSize:n]...)
+		}
+		if err != nil {
+			break
+		}
+	}
 
-	// Decrypt the data
-	cbc.CryptBlocks(decryptedData, encryptedData)
+	_, err = output.Write(stripLegacyPadding(last))
+	return err
+}
 
-	// Remove padding
-	paddingLen := int(decryptedData[len(decryptedData)-1])
-	if paddingLen > 0 && paddingLen <= aes.BlockSize {
-		decryptedData = decryptedData[:len(decryptedData)-paddingLen]
+func stripLegacyPadding(last []byte) []byte {
+	if len(last) == 0 {
+		return last
+	}
+	// The old writer only padded partial blocks, with 1 to 15 bytes
+	paddingLen := int(last[len(last)-1])
+	if paddingLen == 0 || paddingLen >= aes.BlockSize || paddingLen > len(last) {
+		return last
+	}
+	for _, b := range last[len(last)-paddingLen:] {
+		if int(b) != paddingLen {
+			return last
+		}
 	}
+	return last[:len(last)-paddingLen]
+}
 
-	// Write the decrypted data to the output file
-	_, err = outputFileHandle.Write(decryptedData)
+// writeAtomically writes a file through a temporary file that replaces it
+// only when write succeeds
+func writeAtomically(filePath string, write func(io.Writer) error) error {
+	tmp := filePath + ".tmp"
+	file, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	output := bufio.NewWriter(file)
+	err = write(output)
+	if err == nil {
+		err = output.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filePath)
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPassword = "secret"
+
+// testPlaintext returns size random bytes
+func testPlaintext(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	assert.NoError(t, err)
+	return data
+}
+
+// legacyEncrypt writes the format of the baseline encrypter: a 16 byte IV
+// and AES-CBC, with padding only for a final partial block
+func legacyEncrypt(t *testing.T, password string, data []byte) []byte {
+	return legacyEncryptIV(t, password, testPlaintext(t, aes.BlockSize), data)
+}
+
+func legacyEncryptIV(t *testing.T, password string, iv, data []byte) []byte {
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	assert.NoError(t, err)
+
+	cbc := cipher.NewCBCEncrypter(block, iv)
+	out := append([]byte{}, iv...)
+	for len(data) > 0 {
+		buffer := make([]byte, aes.BlockSize)
+		n := copy(buffer, data)
+		data = data[n:]
+		for i := n; i < aes.BlockSize; i++ {
+			buffer[i] = byte(aes.BlockSize - n)
+		}
+		cbc.CryptBlocks(buffer, buffer)
+		out = append(out, buffer...)
+	}
+	return out
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "plain")
+	encPath := filepath.Join(dir, "plain.enc")
+	decPath := filepath.Join(dir, "plain.dec")
+
+	for _, size := range []int{0, 16, encryptionChunkSize, encryptionChunkSize + 1} {
+		data := testPlaintext(t, size)
+		assert.NoError(t, os.WriteFile(plainPath, data, 0600))
+
+		assert.NoError(t, EncryptFile(testPassword, plainPath, encPath))
+		assert.NoError(t, DecryptFile(testPassword, encPath, decPath))
+		decrypted, err := os.ReadFile(decPath)
+		assert.NoError(t, err)
+		assert.Equal(t, data, decrypted, "size %d", size)
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "plain")
+	encPath := filepath.Join(dir, "plain.enc")
+	badPath := filepath.Join(dir, "bad.enc")
+	decPath := filepath.Join(dir, "plain.dec")
+
+	assert.NoError(t, os.WriteFile(plainPath, testPlaintext(t, encryptionChunkSize+1), 0600))
+	assert.NoError(t, EncryptFile(testPassword, plainPath, encPath))
+	encrypted, err := os.ReadFile(encPath)
+	assert.NoError(t, err)
+
+	// Wrong password
+	assert.Equal(t, errDecrypt, DecryptFile("wrong", encPath, decPath))
+	assert.NoFileExists(t, decPath)
+
+	// A flipped ciphertext byte
+	flipped := append([]byte{}, encrypted...)
+	flipped[encryptionHeaderSize+10] ^= 1
+	assert.NoError(t, os.WriteFile(badPath, flipped, 0600))
+	assert.Equal(t, errDecrypt, DecryptFile(testPassword, badPath, decPath))
+	assert.NoFileExists(t, decPath)
+
+	// Truncated after the first chunk, which is not the final one
+	truncated := encrypted[:encryptionHeaderSize+encryptionChunkSize+16]
+	assert.NoError(t, os.WriteFile(badPath, truncated, 0600))
+	assert.Equal(t, errDecrypt, DecryptFile(testPassword, badPath, decPath))
+	assert.NoFileExists(t, decPath)
+
+	// Truncated after the header
+	assert.NoError(t, os.WriteFile(badPath, encrypted[:encryptionHeaderSize], 0600))
+	assert.Equal(t, errDecrypt, DecryptFile(testPassword, badPath, decPath))
+	assert.NoFileExists(t, decPath)
+}
+
+func TestParseEncryptionHeader(t *testing.T) {
+	h := &encryptionHeader{
+		logN:      scryptLogN,
+		r:         scryptR,
+		p:         scryptP,
+		salt:      make([]byte, encryptionSaltSize),
+		chunkSize: encryptionChunkSize,
+		prefix:    make([]byte, encryptionPrefixSize),
+	}
+	parsed, err := parseEncryptionHeader(h.marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, h, parsed)
+
+	for _, kdf := range [][3]byte{
+		{9, 8, 1},
+		{maxScryptLogN + 1, 1, 1},
+		// 1 GiB and 2 GiB of memory
+		{20, 8, 1},
+		{17, 255, 1},
+		{scryptLogN, 0, 1},
+		{scryptLogN, scryptR, 0},
+		{scryptLogN, scryptR, maxScryptP + 1},
+	} {
+		bad := *h
+		bad.logN, bad.r, bad.p = kdf[0], kdf[1], kdf[2]
+		_, err := parseEncryptionHeader(bad.marshal())
+		assert.Error(t, err, "kdf %v", kdf)
+	}
+
+	bad := *h
+	bad.chunkSize = maxEncryptionChunk + 1
+	_, err = parseEncryptionHeader(bad.marshal())
+	assert.Error(t, err)
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	dir := t.TempDir()
+	encPath := filepath.Join(dir, "legacy.enc")
+	decPath := filepath.Join(dir, "legacy.dec")
+
+	// Aligned files were written without padding, their last byte must not
+	// look like padding to decrypt unchanged
+	for _, size := range []int{5, 16, 100, 4096, encryptionChunkSize + 3} {
+		data := testPlaintext(t, size)
+		data[size-1] = 0xff
+		assert.NoError(t, os.WriteFile(encPath, legacyEncrypt(t, testPassword, data), 0600))
+
+		assert.NoError(t, DecryptFile(testPassword, encPath, decPath))
+		decrypted, err := os.ReadFile(decPath)
+		assert.NoError(t, err)
+		assert.Equal(t, data, decrypted, "size %d", size)
+	}
+
+	// A final block of 16 bytes of 16 is data, the old writer padded 1 to 15
+	data := append(testPlaintext(t, 32), make([]byte, aes.BlockSize)...)
+	for i := 32; i < len(data); i++ {
+		data[i] = aes.BlockSize
+	}
+	assert.NoError(t, os.WriteFile(encPath, legacyEncrypt(t, testPassword, data), 0600))
+	assert.NoError(t, DecryptFile(testPassword, encPath, decPath))
+	decrypted, err := os.ReadFile(decPath)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	// A random IV that starts with the magic and the version
+	iv := append([]byte(encryptionMagic), encryptionVersion)
+	iv = append(iv, make([]byte, aes.BlockSize-len(iv))...)
+	data = testPlaintext(t, 100)
+	assert.NoError(t, os.WriteFile(encPath, legacyEncryptIV(t, testPassword, iv, data), 0600))
+	assert.NoError(t, DecryptFile(testPassword, encPath, decPath))
+	decrypted, err = os.ReadFile(decPath)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	// A newer format is not mistaken for a legacy file
+	newer := append([]byte(encryptionMagic), 2)
+	newer = append(newer, make([]byte, encryptionHeaderSize+17-len(newer))...)
+	assert.NoError(t, os.WriteFile(encPath, newer, 0600))
+	assert.EqualError(t, DecryptFile(testPassword, encPath, decPath), "unsupported encryption version 2")
+	assert.NoFileExists(t, decPath+".tmp")
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"octoAgent/octoprint"
+	"octoAgent/vision"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Failure detection:
+
+While a job runs, a snapshot is taken every FAILURE_INTERVAL seconds
+(default 60) with FAILURE_CAMERA (default the first camera) and compared
+with the previous ones (see the vision package). When the confidence of a
+failure stays above FAILURE_THRESHOLD (0-1, default 0.6) for FAILURE_CONFIRM
+snapshots (default 3), the admins get an alert with the confidence and the
+offending image. FAILURE_DETECTION selects the action:
+
+  off    (default) no detection
+  alert  only the alert is sent
+  pause  the job is paused as well, unless the scene barely changed: new
+         texture alone may be a large part growing and is only alerted
+
+A job is alerted once, resuming it starts a new baseline.
+
+failuredetection [off|alert|pause] [threshold=0.N]
+
+*/
+
+const (
+	FailureOff   = "off"
+	FailureAlert = "alert"
+	FailurePause = "pause"
+)
+
+// FailureStatus is the state of the detection
+type FailureStatus struct {
+	Action    string        `json:"action"`
+	Threshold float64       `json:"threshold"`
+	Camera    string        `json:"camera"`
+	Running   bool          `json:"running"`
+	File      string        `json:"file,omitempty"`
+	Alerted   bool          `json:"alerted"`
+	Last      vision.Result `json:"last"`
+	LastTime  time.Time     `json:"last_time"`
+}
+
+// Global detector instance, set up in main
+var failureDetector *FailureDetector
+
+type FailureDetector struct {
+	mutex    sync.Mutex
+	action   string
+	interval time.Duration
+	camera   string
+	detector *vision.Detector
+
+	// The job being watched, stop is nil between jobs
+	stop     chan struct{}
+	file     string
+	paused   bool
+	alerted  bool
+	last     vision.Result
+	lastTime time.Time
+}
+
+func NewFailureDetector(action string, interval time.Duration, camera string, config vision.Config) (*FailureDetector, error) {
+	switch action {
+	case "":
+		action = FailureOff
+	case FailureOff, FailureAlert, FailurePause:
+	default:
+		return nil, fmt.Errorf("unknown FAILURE_DETECTION: %s", action)
+	}
+	cam, err := getCamera(camera)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FailureDetector{
+		action:   action,
+		interval: interval,
+		camera:   cam.Name,
+		detector: vision.NewDetector(config),
+	}, nil
+}
+
+// OnPrintEvent is the PrintWatcher listener that starts and stops the checks
+func (fd *FailureDetector) OnPrintEvent(ev PrintEvent) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	switch ev.Type {
+	case PrintStarted:
+		fd.file = ev.File
+		fd.start()
+	case PrintPaused:
+		fd.paused = true
+	case PrintResumed:
+		// The print was checked, the scene may have changed since
+		fd.paused = false
+		fd.alerted = false
+		fd.detector.Reset()
+	case PrintDone, PrintFailed, PrintCancelled, PrinterError, PrinterDisconnected:
+		fd.file = ""
+		fd.halt()
+	}
+}
+
+// start runs the checks for the current job, fd.mutex is held
+func (fd *FailureDetector) start() {
+	fd.halt()
+	if fd.action == FailureOff || fd.file == "" {
+		return
+	}
+
+	stop := make(chan struct{})
+	fd.stop = stop
+	fd.paused = false
+	fd.alerted = false
+	fd.detector.Reset()
+
+	go func() {
+		ticker := time.NewTicker(fd.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := fd.check(stop); err != nil {
+					log.Printf("Error: failure detection: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// halt stops the checks, fd.mutex is held
+func (fd *FailureDetector) halt() {
+	if fd.stop != nil {
+		close(fd.stop)
+		fd.stop = nil
+	}
+}
+
+// check analyzes a new snapshot of the job
+func (fd *FailureDetector) check(stop chan struct{}) error {
+	fd.mutex.Lock()
+	skip := fd.paused || fd.alerted
+	fd.mutex.Unlock()
+	if skip {
+		return nil
+	}
+
+	cam, err := getCamera(fd.camera)
+	if err != nil {
+		return err
+	}
+	checkPath := filepath.Join(snapshot_dir, bot_name+"-failure-check"+IMAGE_TYPE)
+	if err := cam.camera.Snapshot(checkPath, cam.Defaults); err != nil {
+		return err
+	}
+	img, err := vision.DecodeFile(checkPath)
+	if err != nil {
+		return err
+	}
+
+	fd.mutex.Lock()
+	// The job may have ended or been paused while the snapshot was taken
+	if fd.stop != stop || fd.paused || fd.alerted {
+		fd.mutex.Unlock()
+		return nil
+	}
+	result := fd.detector.Analyze(img)
+	fd.last, fd.lastTime = result, time.Now()
+	if result.Failure {
+		fd.alerted = true
+	}
+	action, file := fd.action, fd.file
+	fd.mutex.Unlock()
+
+	if !result.Failure {
+		return nil
+	}
+
+	// Keep the offending image, the check image is overwritten
+	imagePath := filepath.Join(snapshot_dir, bot_name+"-failure-"+time.Now().Format(TIME_STAMP)+IMAGE_TYPE)
+	if err := os.Rename(checkPath, imagePath); err != nil {
+		return err
+	}
+	fd.alert(action, file, result, imagePath)
+	return nil
+}
+
+// alert applies the action and sends the alert with the image to the admins
+func (fd *FailureDetector) alert(action, file string, result vision.Result, imagePath string) {
+	msg := fmt.Sprintf("%s: possible print failure of %s, confidence %.0f%%", bot_name, file, result.Confidence*100)
+	log.Printf("Failure detection: %s, %s", msg, imagePath)
+
+	if action == FailurePause && !result.Pause {
+		msg += ", not paused as the scene barely changed"
+	} else if action == FailurePause {
+		msg += ", job paused"
+		pauseReq := octoprint.PauseRequest{Action: octoprint.Pause}
+		if err := pauseReq.Do(octoclient); err != nil {
+			msg += " failed: " + err.Error()
+		}
+	}
+
+	for _, admin := range bot_admin_list {
+		conversation, err := transport.ContactInfo(admin)
+		if err != nil {
+			continue
+		}
+		if err := sendReply(conversation.ID, msg); err != nil {
+			log.Printf("Error: sending failure alert to %s: %v", admin, err)
+			continue
+		}
+
+		pref := requesterPreference(conversation.ID)
+		if pref.Method == DeliverPath {
+			continue
+		}
+		if _, err := deliverMediaWith(conversation.ID, imagePath, pref); err != nil {
+			log.Printf("Error: sending failure image to %s: %v", admin, err)
+		}
+	}
+}
+
+func (fd *FailureDetector) Status() FailureStatus {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	return FailureStatus{
+		Action:    fd.action,
+		Threshold: fd.detector.Config().Threshold,
+		Camera:    fd.camera,
+		Running:   fd.stop != nil,
+		File:      fd.file,
+		Alerted:   fd.alerted,
+		Last:      fd.last,
+		LastTime:  fd.lastTime,
+	}
+}
+
+// Command structure: failuredetection [off|alert|pause] [threshold=0.N]
+func FailureDetection(commandList []string) string {
+	usage := "usage: failuredetection [off|alert|pause] [threshold=0.N]"
+	if len(commandList) == 2 && commandList[1] == "-help" {
+		return usage
+	}
+	if failureDetector == nil {
+		return "Error: failure detection is not available"
+	}
+
+	fd := failureDetector
+	if len(commandList) > 1 {
+		fd.mutex.Lock()
+		action, config := fd.action, fd.detector.Config()
+		for _, arg := range commandList[1:] {
+			switch arg {
+			case FailureOff, FailureAlert, FailurePause:
+				action = arg
+				continue
+			}
+
+			key, value, found := strings.Cut(arg, "=")
+			if !found || key != "threshold" {
+				fd.mutex.Unlock()
+				return "Error: syntax, " + usage
+			}
+			threshold, err := strconv.ParseFloat(value, 64)
+			if err != nil || threshold <= 0 || threshold > 1 {
+				fd.mutex.Unlock()
+				return "Error: threshold must be between 0 and 1"
+			}
+			config.Threshold = threshold
+		}
+
+		if config != fd.detector.Config() {
+			fd.detector = vision.NewDetector(config)
+		}
+		fd.action = action
+		// Apply the new action to a running job
+		if fd.file != "" && (action == FailureOff) != (fd.stop == nil) {
+			fd.start()
+		}
+		fd.mutex.Unlock()
+	}
+
+	jsonBytes, err := json.Marshal(fd.Status())
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return string(jsonBytes)
+}
+
+// setFailureDetector sets up the detector from the environment
+func setFailureDetector() error {
+	config := vision.DefaultConfig()
+	interval := 60
+
+	if value := os.Getenv("FAILURE_INTERVAL"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 1 {
+			return errors.New("FAILURE_INTERVAL must be a positive number of seconds")
+		}
+		interval = seconds
+	}
+	if value := os.Getenv("FAILURE_THRESHOLD"); value != "" {
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			return errors.New("FAILURE_THRESHOLD must be between 0 and 1")
+		}
+		config.Threshold = threshold
+	}
+	if value := os.Getenv("FAILURE_CONFIRM"); value != "" {
+		confirm, err := strconv.Atoi(value)
+		if err != nil || confirm < 1 {
+			return errors.New("FAILURE_CONFIRM must be a positive number")
+		}
+		config.Confirm = confirm
+	}
+
+	var err error
+	failureDetector, err = NewFailureDetector(os.Getenv("FAILURE_DETECTION"),
+		time.Duration(interval)*time.Second, os.Getenv("FAILURE_CAMERA"), config)
+	return err
+}
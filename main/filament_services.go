@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"octoAgent/octoprint"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Filament inventory:
+
+Spools are kept in SPOOLS_FILE (default spools.json) with their material,
+color, diameter, density and remaining weight. A spool is loaded on a tool
+and the filament of every finished job is deducted from it, jobs that did
+not finish are prorated by their progress.
+
+The pre-flight filament check compares the estimated filament of the file
+with the spools loaded on its tools. FILAMENT_CHECK sets what happens if a
+spool does not have enough left: warn (default), refuse or off.
+
+addspool material color diameter weight [density]
+getspoollist
+removespool spoolID
+loadspool spoolID tool0
+unloadspool tool0
+setspoolweight spoolID grams
+
+*/
+
+const (
+	FilamentCheckOff    = "off"
+	FilamentCheckWarn   = "warn"
+	FilamentCheckRefuse = "refuse"
+)
+
+// Typical densities in g/cm³, used when a spool is added without one
+var materialDensity = map[string]float64{
+	"PLA":  1.24,
+	"PETG": 1.27,
+	"ABS":  1.04,
+	"ASA":  1.07,
+	"TPU":  1.21,
+	"PA":   1.14,
+	"PC":   1.20,
+}
+
+type Spool struct {
+	ID        int       `json:"id"`
+	Material  string    `json:"material"`
+	Color     string    `json:"color"`
+	Diameter  float64   `json:"diameter"` // mm
+	Density   float64   `json:"density"`  // g/cm³
+	Weight    float64   `json:"weight"`   // g, net weight when added
+	Remaining float64   `json:"remaining"`
+	Tool      string    `json:"tool,omitempty"`
+	Added     time.Time `json:"added"`
+}
+
+// Grams converts a filament length in mm into the weight used from this spool
+func (s *Spool) Grams(length float64) float64 {
+	radius := s.Diameter / 2
+	return math.Pi * radius * radius * length / 1000 * s.Density
+}
+
+// Global inventory, set up in main
+var spoolInventory *SpoolInventory
+
+type SpoolInventory struct {
+	mutex  sync.Mutex
+	file   string
+	check  string
+	spools []*Spool
+}
+
+func NewSpoolInventory(file string, check string) (*SpoolInventory, error) {
+	switch check {
+	case "":
+		check = FilamentCheckWarn
+	case FilamentCheckOff, FilamentCheckWarn, FilamentCheckRefuse:
+	default:
+		return nil, errors.New("FILAMENT_CHECK must be off, warn or refuse")
+	}
+
+	inv := &SpoolInventory{file: file, check: check}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &inv.spools); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return inv, nil
+}
+
+func (inv *SpoolInventory) save() error {
+	data, err := json.MarshalIndent(inv.spools, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := inv.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, inv.file)
+}
+
+func (inv *SpoolInventory) find(id int) *Spool {
+	for _, spool := range inv.spools {
+		if spool.ID == id {
+			return spool
+		}
+	}
+	return nil
+}
+
+func (inv *SpoolInventory) loaded(tool string) *Spool {
+	for _, spool := range inv.spools {
+		if spool.Tool == tool {
+			return spool
+		}
+	}
+	return nil
+}
+
+// OnPrintEvent is the PrintWatcher listener that deducts used filament
+func (inv *SpoolInventory) OnPrintEvent(ev PrintEvent) {
+	if ev.Type != PrintDone && ev.Type != PrintFailed && ev.Type != PrintCancelled {
+		return
+	}
+
+	share := 1.0
+	if ev.Type != PrintDone {
+		share = ev.Progress / 100
+	}
+
+	usage := ev.FilamentTools
+	if len(usage) == 0 && ev.FilamentLength > 0 {
+		usage = map[string]float64{"tool0": ev.FilamentLength}
+	}
+
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	changed := false
+	for tool, length := range usage {
+		spool := inv.loaded(tool)
+		if spool == nil || length <= 0 {
+			continue
+		}
+
+		used := spool.Grams(length * share)
+		spool.Remaining = math.Max(0, spool.Remaining-used)
+		changed = true
+		log.Printf("Filament: %.1fg deducted from spool %d on %s, %.1fg left", used, spool.ID, tool, spool.Remaining)
+	}
+
+	if changed {
+		if err := inv.save(); err != nil {
+			log.Printf("Error: saving spools: %v", err)
+		}
+	}
+}
+
+// shortages lists the tools whose loaded spool cannot cover the estimate
+func (inv *SpoolInventory) shortages(estimate octoprint.FilamentInformation) []string {
+	usage := make(map[string]float64)
+	for tool, filament := range estimate.Tools {
+		usage[tool] = filament.Length
+	}
+	if len(usage) == 0 && estimate.Length > 0 {
+		usage["tool0"] = estimate.Length
+	}
+
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	var shortages []string
+	for tool, length := range usage {
+		spool := inv.loaded(tool)
+		if spool == nil || length <= 0 {
+			continue
+		}
+
+		needed := spool.Grams(length)
+		if needed > spool.Remaining {
+			shortages = append(shortages, fmt.Sprintf("%s needs %.1fg, spool %d has %.1fg", tool, needed, spool.ID, spool.Remaining))
+		}
+	}
+	sort.Strings(shortages)
+	return shortages
+}
+
+// Command structure: addspool material color diameter weight [density]
+func AddSpool(commandList []string) string {
+	switch len(commandList) {
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: addspool material color diameter weight [density]"
+		}
+		return "Error: parameter mismatch"
+
+	case 5, 6:
+		material := strings.ToUpper(commandList[1])
+
+		diameter, err := strconv.ParseFloat(commandList[3], 64)
+		if err != nil || diameter <= 0 {
+			return "Error: diameter must be a positive number of mm"
+		}
+		weight, err := strconv.ParseFloat(commandList[4], 64)
+		if err != nil || weight <= 0 {
+			return "Error: weight must be a positive number of grams"
+		}
+
+		density, known := materialDensity[material]
+		if len(commandList) == 6 {
+			density, err = strconv.ParseFloat(commandList[5], 64)
+			if err != nil || density <= 0 {
+				return "Error: density must be a positive number of g/cm³"
+			}
+		} else if !known {
+			return "Error: unknown material, density is required"
+		}
+
+		spoolInventory.mutex.Lock()
+		defer spoolInventory.mutex.Unlock()
+
+		spool := &Spool{
+			ID:        1,
+			Material:  material,
+			Color:     commandList[2],
+			Diameter:  diameter,
+			Density:   density,
+			Weight:    weight,
+			Remaining: weight,
+			Added:     time.Now(),
+		}
+		if n := len(spoolInventory.spools); n > 0 {
+			spool.ID = spoolInventory.spools[n-1].ID + 1
+		}
+		spoolInventory.spools = append(spoolInventory.spools, spool)
+
+		if err := spoolInventory.save(); err != nil {
+			return "Error: saving spools: " + err.Error()
+		}
+		return fmt.Sprintf("Spool %d was added", spool.ID)
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
+
+func GetSpoolList(commandList []string) string {
+	switch len(commandList) {
+	case 1:
+		spoolInventory.mutex.Lock()
+		defer spoolInventory.mutex.Unlock()
+
+		jsonBytes, err := json.Marshal(spoolInventory.spools)
+		if err != nil {
+			return "Error: failed to encode spools: " + err.Error()
+		}
+		return string(jsonBytes)
+
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: getspoollist"
+		}
+		return "Error: parameter mismatch"
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
+
+func RemoveSpool(commandList []string) string {
+	switch len(commandList) {
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: removespool spoolID"
+		}
+
+		id, err := strconv.Atoi(commandList[1])
+		if err != nil {
+			return "Error: spoolID must be a number"
+		}
+
+		spoolInventory.mutex.Lock()
+		defer spoolInventory.mutex.Unlock()
+
+		for i, spool := range spoolInventory.spools {
+			if spool.ID == id {
+				spoolInventory.spools = append(spoolInventory.spools[:i], spoolInventory.spools[i+1:]...)
+				if err := spoolInventory.save(); err != nil {
+					return "Error: saving spools: " + err.Error()
+				}
+				return "Spool was removed"
+			}
+		}
+		return "Error: spool not found"
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
+
+func LoadSpool(commandList []string) string {
+	switch len(commandList) {
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: loadspool spoolID tool0"
+		}
+		return "Error: parameter mismatch"
+
+	case 3:
+		id, err := strconv.Atoi(commandList[1])
+		if err != nil {
+			return "Error: spoolID must be a number"
+		}
+		tool := commandList[2]
+		if !strings.HasPrefix(tool, "tool") {
+			return "Error: tool must be tool0, tool1, ..."
+		}
+
+		spoolInventory.mutex.Lock()
+		defer spoolInventory.mutex.Unlock()
+
+		spool := spoolInventory.find(id)
+		if spool == nil {
+			return "Error: spool not found"
+		}
+
+		// Only one spool per tool
+		if previous := spoolInventory.loaded(tool); previous != nil {
+			previous.Tool = ""
+		}
+		spool.Tool = tool
+
+		if err := spoolInventory.save(); err != nil {
+			return "Error: saving spools: " + err.Error()
+		}
+		return fmt.Sprintf("Spool %d was loaded on %s", id, tool)
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
+
+func UnloadSpool(commandList []string) string {
+	switch len(commandList) {
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: unloadspool tool0"
+		}
+
+		spoolInventory.mutex.Lock()
+		defer spoolInventory.mutex.Unlock()
+
+		spool := spoolInventory.loaded(commandList[1])
+		if spool == nil {
+			return "Error: no spool loaded on " + commandList[1]
+		}
+		spool.Tool = ""
+
+		if err := spoolInventory.save(); err != nil {
+			return "Error: saving spools: " + err.Error()
+		}
+		return fmt.Sprintf("Spool %d was unloaded", spool.ID)
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
+
+func SetSpoolWeight(commandList []string) string {
+	switch len(commandList) {
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: setspoolweight spoolID grams"
+		}
+		return "Error: parameter mismatch"
+
+	case 3:
+		id, err := strconv.Atoi(commandList[1])
+		if err != nil {
+			return "Error: spoolID must be a number"
+		}
+		grams, err := strconv.ParseFloat(commandList[2], 64)
+		if err != nil || grams < 0 {
+			return "Error: grams must be a positive number"
+		}
+
+		spoolInventory.mutex.Lock()
+		defer spoolInventory.mutex.Unlock()
+
+		spool := spoolInventory.find(id)
+		if spool == nil {
+			return "Error: spool not found"
+		}
+		spool.Remaining = grams
+
+		if err := spoolInventory.save(); err != nil {
+			return "Error: saving spools: " + err.Error()
+		}
+		return "Spool weight was set"
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"octoAgent/octoprint"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestSpoolInventory installs an inventory with PLA spools loaded on tool0
+// and tool1 and a third one on the shelf
+func newTestSpoolInventory(t *testing.T, check string) *SpoolInventory {
+	inv, err := NewSpoolInventory(filepath.Join(t.TempDir(), "spools.json"), check)
+	assert.NoError(t, err)
+	inv.spools = []*Spool{
+		{ID: 1, Material: "PLA", Diameter: 1.75, Density: 1.24, Weight: 1000, Remaining: 1000, Tool: "tool0"},
+		{ID: 2, Material: "PLA", Diameter: 1.75, Density: 1.24, Weight: 1000, Remaining: 5, Tool: "tool1"},
+		{ID: 3, Material: "PETG", Diameter: 1.75, Density: 1.27, Weight: 1000, Remaining: 1000},
+	}
+
+	previous := spoolInventory
+	t.Cleanup(func() { spoolInventory = previous })
+	spoolInventory = inv
+	return inv
+}
+
+func TestSpoolInventoryDeductsPerTool(t *testing.T) {
+	inv := newTestSpoolInventory(t, "")
+	assert.Equal(t, FilamentCheckWarn, inv.check)
+	tool0, tool1, shelf := inv.spools[0], inv.spools[1], inv.spools[2]
+	tool1.Remaining = 0.5
+
+	recordJob(t, inv.OnPrintEvent, "100")
+	assert.InDelta(t, 1000-tool0.Grams(1200.5), tool0.Remaining, 1e-9)
+	// The spool runs empty, it does not go below zero
+	assert.Equal(t, 0., tool1.Remaining)
+	assert.Equal(t, 1000., shelf.Remaining)
+
+	// Cancelled jobs are prorated by their progress
+	tool1.Remaining = 500
+	recordJob(t, inv.OnPrintEvent, "50")
+	assert.InDelta(t, 1000-tool0.Grams(1200.5)-tool0.Grams(600.25), tool0.Remaining, 1e-9)
+	assert.InDelta(t, 500-tool1.Grams(150), tool1.Remaining, 1e-9)
+
+	reloaded, err := NewSpoolInventory(inv.file, FilamentCheckRefuse)
+	assert.NoError(t, err)
+	if assert.Len(t, reloaded.spools, 3) {
+		assert.InDelta(t, tool0.Remaining, reloaded.spools[0].Remaining, 1e-9)
+		assert.Equal(t, "tool0", reloaded.spools[0].Tool)
+	}
+}
+
+func TestSpoolInventorySingleTool(t *testing.T) {
+	inv := newTestSpoolInventory(t, FilamentCheckWarn)
+	tool0, tool1 := inv.spools[0], inv.spools[1]
+
+	// Only the total is known, it is used by tool0
+	inv.OnPrintEvent(PrintEvent{Type: PrintFailed, Progress: 25, FilamentLength: 1000})
+	assert.InDelta(t, 1000-tool0.Grams(250), tool0.Remaining, 1e-9)
+	assert.Equal(t, 5., tool1.Remaining)
+
+	// Only the end of a job counts
+	remaining := tool0.Remaining
+	for _, eventType := range []PrintEventType{PrintStarted, PrintPaused, PrintResumed, PrinterError, PrinterDisconnected} {
+		inv.OnPrintEvent(PrintEvent{Type: eventType, Progress: 50, FilamentLength: 1000})
+	}
+	assert.Equal(t, remaining, tool0.Remaining)
+}
+
+func TestSpoolInventoryShortages(t *testing.T) {
+	inv := newTestSpoolInventory(t, FilamentCheckWarn)
+
+	estimate := octoprint.FilamentInformation{Tools: map[string]octoprint.ToolFilament{
+		"tool0": {Length: 1000},
+		"tool1": {Length: 2000},
+		"tool2": {Length: 1000},
+	}}
+	// tool1 has 5g left, tool2 has no spool
+	assert.Equal(t, []string{"tool1 needs 6.0g, spool 2 has 5.0g"}, inv.shortages(estimate))
+
+	estimate.Tools["tool0"] = octoprint.ToolFilament{Length: 400000}
+	assert.Equal(t, []string{
+		"tool0 needs 1193.0g, spool 1 has 1000.0g",
+		"tool1 needs 6.0g, spool 2 has 5.0g",
+	}, inv.shortages(estimate))
+
+	// Only the total is known, it is used by tool0
+	assert.Empty(t, inv.shortages(octoprint.FilamentInformation{Length: 1000}))
+	assert.Len(t, inv.shortages(octoprint.FilamentInformation{Length: 400000}), 1)
+	assert.Empty(t, inv.shortages(octoprint.FilamentInformation{}))
+}
+
+func TestCheckFilament(t *testing.T) {
+	analysis := &octoprint.GCodeAnalysisInformation{}
+	analysis.Filament.Tools = map[string]octoprint.ToolFilament{"tool1": {Length: 2000}}
+	ctx := &preflightContext{analysis: analysis}
+
+	for _, tc := range []struct {
+		check  string
+		status string
+	}{
+		{FilamentCheckOff, PreflightSkip},
+		{FilamentCheckWarn, PreflightWarn},
+		{FilamentCheckRefuse, PreflightFail},
+	} {
+		newTestSpoolInventory(t, tc.check)
+		status, message := checkFilament(ctx)
+		assert.Equal(t, tc.status, status, tc.check)
+		if tc.check != FilamentCheckOff {
+			assert.Equal(t, "tool1 needs 6.0g, spool 2 has 5.0g", message)
+		}
+	}
+
+	newTestSpoolInventory(t, FilamentCheckRefuse)
+	status, _ := checkFilament(&preflightContext{})
+	assert.Equal(t, PreflightSkip, status)
+	analysis.Filament.Tools["tool1"] = octoprint.ToolFilament{Length: 1000}
+	status, _ = checkFilament(ctx)
+	assert.Equal(t, PreflightPass, status)
+
+	_, err := NewSpoolInventory(filepath.Join(t.TempDir(), "spools.json"), "maybe")
+	assert.Error(t, err)
+}
@@ -156,11 +156,11 @@ func Getfile(commandList []string) string {
 func Downloadfile(commandList []string) string {
 	switch len(commandList) {
 	case 1:
-		return packageReply("Error: parameter mismatch")
+		return "Error: parameter mismatch"
 
 	case 2:
 		if commandList[1] == "-help" {
-			return packageReply("usage: downloadfile s3FilePath")
+			return "usage: downloadfile s3FilePath"
 		}
 
 		// Assign URI
@@ -191,12 +191,34 @@ func Downloadfile(commandList []string) string {
 			}
 
 			fmt.Println(fileName + " was downloaded")
-			return fileName + " was downloaded"
+			return scanDownload(fileName, filePath)
 		}
 
 	default:
-		return packageReply("Error: parameter mismatch")
+		return "Error: parameter mismatch"
+	}
+}
+
+// scanDownload runs the safety scan on a downloaded file and deletes it if rejected
+func scanDownload(fileName string, filePath string) string {
+	if !isGcodeFile(fileName) {
+		return fileName + " was downloaded"
+	}
+
+	report, err := scanFile(filePath)
+	if err != nil {
+		os.Remove(filePath)
+		return "Error: " + fileName + " could not be scanned: " + err.Error()
+	}
+
+	if report.Rejected {
+		os.Remove(filePath)
+		return "Error: " + fileName + " was rejected by the safety scan:\n" + formatScanReport(report)
+	}
+	if len(report.Findings) > 0 {
+		return fileName + " was downloaded, safety scan warnings:\n" + formatScanReport(report)
 	}
+	return fileName + " was downloaded"
 }
 
 func Uploadfile(commandList []string) string {
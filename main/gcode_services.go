@@ -0,0 +1,93 @@
+package main
+
+import (
+	"octoAgent/gcode"
+	"octoAgent/octoprint"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+
+Local G-code analysis:
+
+OctoPrint analyses uploaded files in the background, until it is done the
+agent analyses the file in OctoPrint's uploads folder itself. Results are
+cached until the file changes.
+
+*/
+
+type cachedAnalysis struct {
+	modified time.Time
+	size     int64
+	analysis *gcode.Analysis
+}
+
+var (
+	analysisMutex sync.Mutex
+	analysisCache = make(map[string]cachedAnalysis)
+)
+
+// octoUploadPath returns the path of a file in OctoPrint's local storage
+func octoUploadPath(fileName string) (string, error) {
+	user, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(user.HomeDir, ".octoprint/uploads", fileName), nil
+}
+
+// localAnalysis analyses a file in OctoPrint's local storage
+func localAnalysis(fileName string) (*gcode.Analysis, error) {
+	filePath, err := octoUploadPath(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	analysisMutex.Lock()
+	cached, exists := analysisCache[filePath]
+	analysisMutex.Unlock()
+	if exists && cached.modified.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.analysis, nil
+	}
+
+	analysis, err := gcode.AnalyzeFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	analysisMutex.Lock()
+	analysisCache[filePath] = cachedAnalysis{modified: info.ModTime(), size: info.Size(), analysis: analysis}
+	analysisMutex.Unlock()
+	return analysis, nil
+}
+
+// analysisInformation converts a local analysis into OctoPrint's format
+func analysisInformation(a *gcode.Analysis) octoprint.GCodeAnalysisInformation {
+	var info octoprint.GCodeAnalysisInformation
+	info.EstimatedPrintTime = a.EstimatedPrintTime
+
+	info.Filament.Tools = make(map[string]octoprint.ToolFilament)
+	for tool, filament := range a.Filament {
+		info.Filament.Tools[tool] = octoprint.ToolFilament{Length: filament.Length, Volume: filament.Volume}
+		info.Filament.Length += filament.Length
+		info.Filament.Volume += filament.Volume
+	}
+
+	area := a.PrintingArea
+	info.Dimensions.Width = area.Width()
+	info.Dimensions.Depth = area.Depth()
+	info.Dimensions.Height = area.Height()
+	info.PrintingArea.MinX, info.PrintingArea.MaxX = area.MinX, area.MaxX
+	info.PrintingArea.MinY, info.PrintingArea.MaxY = area.MinY, area.MaxY
+	info.PrintingArea.MinZ, info.PrintingArea.MaxZ = area.MinZ, area.MaxZ
+	return info
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+
+Local control API:
+
+An optional HTTP/JSON front end to the admin command registry for tooling
+running on the same host (dashboards, scripts), so it does not have to go
+through Tor. It is enabled by setting HTTP_API_ADDR in .env and must be bound
+to a loopback address. Every request must carry HTTP_API_TOKEN, either as
+"Authorization: Bearer <token>" or as "X-Api-Key: <token>".
+
+POST /api/command        {"command":"gettemp"} or {"command":"getoctofileinfo","args":["Ring.gcode"]}
+GET  /api/commands       list of registered commands
+GET  /api/status/stream  server-sent events carrying GetPrintStatus every ?interval= seconds
+
+*/
+
+const (
+	// localRequester is passed as requester for commands not issued over Cwtch
+	localRequester = -1
+
+	defaultStreamInterval = 5
+)
+
+var (
+	httpAPIAddr  = ""
+	httpAPIToken = ""
+)
+
+type APICommandRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+type APICommandResult struct {
+	Command string          `json:"command"`
+	Success bool            `json:"success"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// startControlAPI starts the local HTTP API if it has been configured
+func startControlAPI() error {
+	httpAPIAddr = os.Getenv("HTTP_API_ADDR")
+	httpAPIToken = os.Getenv("HTTP_API_TOKEN")
+
+	if httpAPIAddr == "" {
+		return nil
+	}
+
+	if httpAPIToken == "" {
+		return errors.New("HTTP_API_TOKEN is empty")
+	}
+
+	if err := checkLoopback(httpAPIAddr); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", httpAPIAddr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Printf("Control API listening on %s", listener.Addr())
+		if err := http.Serve(listener, newControlAPIHandler(httpAPIToken)); err != nil {
+			log.Printf("Error: control API stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// checkLoopback refuses any listen address that is not a loopback address
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("control API must be bound to a loopback address, got %q", host)
+	}
+	return nil
+}
+
+func newControlAPIHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/command", handleAPICommand)
+	mux.HandleFunc("/api/commands", handleAPICommandList)
+	mux.HandleFunc("/api/status/stream", handleAPIStatusStream)
+	return requireToken(token, mux)
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := r.Header.Get("X-Api-Key")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			provided = strings.TrimPrefix(auth, "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleAPICommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var req APICommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(req.Command))
+	if _, exists := adminCommands[name]; !exists {
+		writeAPIError(w, http.StatusNotFound, "unrecognized command: "+req.Command)
+		return
+	}
+
+	log.Printf("Control API command was received: %s", name)
+	cmd := append([]string{name}, req.Args...)
+	output := runAdminCommand(cmd, localRequester)
+
+	writeJSON(w, http.StatusOK, newAPICommandResult(name, output))
+}
+
+func handleAPICommandList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	names := make([]string, 0, len(adminCommands))
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeJSON(w, http.StatusOK, names)
+}
+
+func handleAPIStatusStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	interval := defaultStreamInterval
+	if value := r.URL.Query().Get("interval"); value != "" {
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 1 {
+			writeAPIError(w, http.StatusBadRequest, "interval must be a positive number of seconds")
+			return
+		}
+		interval = i
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		commandMutex.Lock()
+		status := GetPrintStatus()
+		commandMutex.Unlock()
+
+		result := newAPICommandResult("getprintstatus", status)
+		data, _ := json.Marshal(result)
+
+		eventName := "status"
+		if !result.Success {
+			eventName = "error"
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventName, data)
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// newAPICommandResult converts the string returned by a command handler into
+// a structured result. JSON output is embedded as is, anything else as a string.
+func newAPICommandResult(name string, output string) APICommandResult {
+	result := APICommandResult{Command: name, Success: !isErrorResult(output)}
+
+	trimmed := strings.TrimSpace(output)
+	if json.Valid([]byte(trimmed)) {
+		result.Result = json.RawMessage(trimmed)
+	} else {
+		result.Result, _ = json.Marshal(output)
+	}
+
+	if !result.Success {
+		result.Error = output
+	}
+	return result
+}
+
+// isErrorResult recognizes the error conventions used by the command handlers:
+// an "Error..." prefix or a JSON object with an error key
+func isErrorResult(output string) bool {
+	trimmed := strings.TrimSpace(output)
+	if strings.HasPrefix(strings.ToLower(trimmed), "error") {
+		return true
+	}
+
+	var obj map[string]interface{}
+	if json.Unmarshal([]byte(trimmed), &obj) == nil {
+		_, lower := obj["error"]
+		_, upper := obj["Error"]
+		return lower || upper
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
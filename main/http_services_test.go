@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAPIToken = "token"
+
+// apiRequest sends a request to a control API handler
+func apiRequest(t *testing.T, handler http.Handler, method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCheckLoopback(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:8080", "[::1]:8080", "localhost:8080"} {
+		assert.NoError(t, checkLoopback(addr), addr)
+	}
+	for _, addr := range []string{"0.0.0.0:8080", ":8080", "192.168.1.2:8080", "example.com:8080", "127.0.0.1"} {
+		assert.Error(t, checkLoopback(addr), addr)
+	}
+}
+
+func TestControlAPIToken(t *testing.T) {
+	newTestTransport(t)
+	handler := newControlAPIHandler(testAPIToken)
+
+	for _, header := range []map[string]string{
+		nil,
+		{"X-Api-Key": "wrong"},
+		{"Authorization": "Bearer wrong"},
+		{"Authorization": testAPIToken},
+	} {
+		rec := apiRequest(t, handler, http.MethodGet, "/api/commands", "", header)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "%v", header)
+	}
+
+	for _, header := range []map[string]string{
+		{"X-Api-Key": testAPIToken},
+		{"Authorization": "Bearer " + testAPIToken},
+	} {
+		rec := apiRequest(t, handler, http.MethodGet, "/api/commands", "", header)
+		assert.Equal(t, http.StatusOK, rec.Code, "%v", header)
+	}
+}
+
+func TestControlAPICommand(t *testing.T) {
+	newTestTransport(t)
+	handler := newControlAPIHandler(testAPIToken)
+	auth := map[string]string{"X-Api-Key": testAPIToken}
+
+	rec := apiRequest(t, handler, http.MethodPost, "/api/command", `{"command":"GetAdminList"}`, auth)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var result APICommandResult
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, "getadminlist", result.Command)
+	assert.True(t, result.Success)
+	assert.JSONEq(t, `["admin"]`, string(result.Result))
+
+	rec = apiRequest(t, handler, http.MethodPost, "/api/command", `{"command":"getadminlist","args":["extra","args"]}`, auth)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.False(t, result.Success)
+	assert.Equal(t, "Error: parameter mismatch", result.Error)
+
+	rec = apiRequest(t, handler, http.MethodPost, "/api/command", `{"command":"nosuchcommand"}`, auth)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = apiRequest(t, handler, http.MethodPost, "/api/command", `{"command":`, auth)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = apiRequest(t, handler, http.MethodGet, "/api/command", "", auth)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = apiRequest(t, handler, http.MethodGet, "/api/commands", "", auth)
+	var names []string
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &names))
+	assert.Contains(t, names, "getadminlist")
+	assert.Len(t, names, len(adminCommands))
+}
+
+func TestControlAPICommandSerialized(t *testing.T) {
+	lt, _, _ := newTestTransport(t)
+	handler := newControlAPIHandler(testAPIToken)
+	auth := map[string]string{"X-Api-Key": testAPIToken}
+
+	// Commands from the API and from Cwtch change the same admin list
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"command":"addadmin","args":["api%d"]}`, i)
+			apiRequest(t, handler, http.MethodPost, "/api/command", body, auth)
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			runAdminCommand([]string{"addadmin", fmt.Sprintf("cwtch%d", i)}, 0)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Len(t, bot_admin_list, 21)
+	assert.Empty(t, lt.Sent())
+}
+
+func TestNewAPICommandResult(t *testing.T) {
+	result := newAPICommandResult("gettemp", `{"tool0":{"actual":200}}`)
+	assert.True(t, result.Success)
+	assert.JSONEq(t, `{"tool0":{"actual":200}}`, string(result.Result))
+
+	result = newAPICommandResult("connect", "Connected")
+	assert.True(t, result.Success)
+	assert.Equal(t, `"Connected"`, string(result.Result))
+
+	for _, output := range []string{"Error: not connected", `{"error":"offline"}`, `{"Error":"offline"}`} {
+		result = newAPICommandResult("gettemp", output)
+		assert.False(t, result.Success, output)
+		assert.Equal(t, output, result.Error)
+	}
+}
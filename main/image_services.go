@@ -1,66 +1,168 @@
 package main
 
 import (
-	"os/exec"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
 const (
-	STILL      = "raspistill"
-	VIDEO      = "raspivid"
 	IMAGE_TYPE = ".jpg"
 	VIDEO_TYPE = ".mp4"
 	TIME_STAMP = "2006-01-02_15:04:05"
 )
 
-func TakePicture() string {
-	// Define filename
-	filename := bot_name + "-" + time.Now().Format(TIME_STAMP) + IMAGE_TYPE
+/*
 
-	// Define command
-	cmd := exec.Command(STILL, "-o", filename, "-w", "1280", "-h", "720", "-q", "80")
+Snapshots:
 
-	// Run command
-	err := cmd.Run()
+takepicture captures an image and takevideo a video with one of the
+printer's cameras (see cameras.go). Both are stored in SNAPSHOT_DIR (default
+snapshots) and delivered to the requester (see media_delivery.go).
 
-	// Check for errors
+takepicture [camera] [width=N] [height=N] [quality=N]
+takevideo [camera] [duration=S] [width=N] [height=N] [quality=N]
+cameras
+
+*/
+
+// maxSnapshotSize limits the download of a snapshot
+const maxSnapshotSize = 20 * 1024 * 1024
+
+var snapshot_dir = "snapshots"
+
+// fetchSnapshot downloads an image into filePath
+func fetchSnapshot(snapshotURL, filePath string) error {
+	client := http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get(snapshotURL)
 	if err != nil {
-		return "Error capturing image: " + err.Error()
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot request failed: %s", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "image/") {
+		return fmt.Errorf("snapshot is not an image: %s", contentType)
+	}
+
+	tmp := filePath + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(file, io.LimitReader(resp.Body, maxSnapshotSize+1))
+	file.Close()
+	if err == nil && n > maxSnapshotSize {
+		err = errors.New("snapshot exceeds the size limit")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filePath)
+}
+
+// captureSnapshot captures an image with the default camera into the
+// snapshot directory and returns the path of the stored file
+func captureSnapshot() (string, error) {
+	cam, err := getCamera("")
+	if err != nil {
+		return "", err
+	}
+	return captureSnapshotWith(cam, cam.Defaults)
+}
+
+func captureSnapshotWith(cam *NamedCamera, opts CaptureOptions) (string, error) {
+	filePath := mediaPath(cam, IMAGE_TYPE)
+	if err := cam.camera.Snapshot(filePath, opts); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+// captureImage captures a JPEG image into filePath with the default camera
+func captureImage(filePath string) error {
+	cam, err := getCamera("")
+	if err != nil {
+		return err
 	}
+	return cam.camera.Snapshot(filePath, cam.Defaults)
+}
 
-	return "Image captured and saved as: " + filename
+// mediaPath names a capture after the agent, the camera and the time
+func mediaPath(cam *NamedCamera, ext string) string {
+	filename := bot_name + "-"
+	if cam.Name != defaultCameraName {
+		filename += cam.Name + "-"
+	}
+	return filepath.Join(snapshot_dir, filename+time.Now().Format(TIME_STAMP)+ext)
 }
 
-func TakeVideo() string {
-	// Define raspivid command
-	raspividCmd := exec.Command(VIDEO, "-o", "-", "-t", "15000", "-w", "768", "-h", "480")
+// Command structure: takepicture [camera] [width=N] [height=N] [quality=N]
+func TakePicture(commandList []string, requester int) string {
+	usage := "usage: takepicture [camera] [width=N] [height=N] [quality=N]"
+	if len(commandList) == 2 && commandList[1] == "-help" {
+		return usage
+	}
 
-	// Define filename
-	filename := bot_name + "-" + time.Now().Format(TIME_STAMP) + VIDEO_TYPE
+	cam, opts, err := parseCaptureArgs(commandList[1:], false)
+	if err != nil {
+		return "Error: " + err.Error() + ", " + usage
+	}
 
-	// Define ffmpeg command
-	ffmpegCmd := exec.Command("ffmpeg", "-r", "30", "-i", "-", "-c:v", "copy", filename)
+	filePath, err := captureSnapshotWith(cam, opts)
+	if err != nil {
+		return "Error capturing image: " + err.Error()
+	}
+	return "Image captured. " + deliverMedia(requester, filePath)
+}
 
-	// Pipe the output of raspivid to the input of ffmpeg
-	ffmpegCmd.Stdin, _ = raspividCmd.StdoutPipe()
+// Command structure: takevideo [camera] [duration=S] [width=N] [height=N] [quality=N]
+func TakeVideo(commandList []string, requester int) string {
+	usage := "usage: takevideo [camera] [duration=S] [width=N] [height=N] [quality=N]"
+	if len(commandList) == 2 && commandList[1] == "-help" {
+		return usage
+	}
 
-	// Start the raspivid command
-	if err := raspividCmd.Start(); err != nil {
-		return "Error starting raspivid: " + err.Error()
+	cam, opts, err := parseCaptureArgs(commandList[1:], true)
+	if err != nil {
+		return "Error: " + err.Error() + ", " + usage
 	}
 
-	// Start the ffmpeg command
-	if err := ffmpegCmd.Start(); err != nil {
-		return "Error starting ffmpeg: " + err.Error()
+	filePath := mediaPath(cam, VIDEO_TYPE)
+	if err := cam.camera.Record(filePath, opts); err != nil {
+		os.Remove(filePath)
+		return "Error capturing video: " + err.Error()
 	}
+	return "Video captured. " + deliverMedia(requester, filePath)
+}
 
-	// Wait for both commands to finish
-	if err := raspividCmd.Wait(); err != nil {
-		return "Error waiting for raspivid: " + err.Error()
+// Command structure: cameras
+func Cameras(commandList []string) string {
+	if len(commandList) == 2 && commandList[1] == "-help" {
+		return "usage: cameras"
 	}
-	if err := ffmpegCmd.Wait(); err != nil {
-		return "Error waiting for ffmpeg: " + err.Error()
+	if len(commandList) != 1 {
+		return "Error: parameter mismatch"
 	}
 
-	return "Video captured and saved as: " + filename
+	list := make([]NamedCamera, 0, len(cameras))
+	for _, cam := range cameras {
+		entry := *cam
+		entry.Defaults.Seconds = int(cam.Defaults.Duration / time.Second)
+		list = append(list, entry)
+	}
+	jsonBytes, err := json.Marshal(list)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return string(jsonBytes)
 }
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"octoAgent/octoprint"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Job history:
+
+Every print job seen by the PrintWatcher is recorded in JOB_HISTORY_FILE
+(default jobhistory.json) when it ends: file, MD5 hash, printer profile,
+start/end, result, duration, filament and the onion of the admin that
+started it with printoctofile (empty when started from OctoPrint itself).
+
+jobhistory [count=10] [file=name] [result=done|failed|cancelled]
+stats [since=720h] [by=day|week|month]
+
+Filament of jobs that did not finish is prorated by their progress.
+
+*/
+
+// JobRecord is a finished print job
+type JobRecord struct {
+	ID        int       `json:"id"`
+	File      string    `json:"file"`
+	Path      string    `json:"path"`
+	Hash      string    `json:"hash,omitempty"`
+	Printer   string    `json:"printer"`
+	Requester string    `json:"requester,omitempty"`
+	Started   time.Time `json:"started"`
+	Ended     time.Time `json:"ended"`
+	Result    string    `json:"result"`
+	Duration  float64   `json:"duration"`
+	Progress  float64   `json:"progress"`
+	Filament  float64   `json:"filament"`        // mm
+	Volume    float64   `json:"filament_volume"` // cm³
+}
+
+// Global history instance, set up in main
+var jobHistory *JobHistory
+
+type JobHistory struct {
+	mutex    sync.Mutex
+	file     string
+	records  []JobRecord
+	current  *JobRecord
+	expected map[string]string
+}
+
+func NewJobHistory(file string) (*JobHistory, error) {
+	h := &JobHistory{file: file, expected: make(map[string]string)}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &h.records); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return h, nil
+}
+
+// Expect remembers who asked to print path, the job is matched when it starts
+func (h *JobHistory) Expect(path string, requester int) {
+	handle := "local"
+	if requester != localRequester {
+		contact, err := transport.Contact(requester)
+		if err != nil {
+			return
+		}
+		handle = contact.Handle
+	}
+
+	h.mutex.Lock()
+	h.expected[path] = handle
+	h.mutex.Unlock()
+}
+
+// Forget drops the expectation for path, e.g. when the job did not start
+func (h *JobHistory) Forget(path string) {
+	h.mutex.Lock()
+	delete(h.expected, path)
+	h.mutex.Unlock()
+}
+
+// OnPrintEvent is the PrintWatcher listener that records jobs
+func (h *JobHistory) OnPrintEvent(ev PrintEvent) {
+	switch ev.Type {
+	case PrintStarted:
+		h.start(ev)
+
+	case PrintDone, PrintFailed, PrintCancelled:
+		h.finish(ev)
+	}
+}
+
+func (h *JobHistory) start(ev PrintEvent) {
+	record := &JobRecord{
+		File:    ev.File,
+		Path:    ev.Path,
+		Printer: currentPrinterProfile(),
+		Started: ev.Time,
+	}
+
+	fileReq := octoprint.FileRequest{Location: octoprint.Local, Filename: ev.Path}
+	if file, err := fileReq.Do(octoclient); err == nil {
+		record.Hash = file.Hash
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	record.Requester = h.expected[ev.Path]
+	delete(h.expected, ev.Path)
+	h.current = record
+}
+
+func (h *JobHistory) finish(ev PrintEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	record := h.current
+	h.current = nil
+
+	// The agent started in the middle of this job
+	if record == nil || record.Path != ev.Path {
+		record = &JobRecord{
+			File:    ev.File,
+			Path:    ev.Path,
+			Printer: currentPrinterProfile(),
+			Started: ev.Started,
+		}
+	}
+
+	record.Ended = ev.Time
+	record.Result = string(ev.Type)
+	record.Duration = ev.Duration
+	record.Progress = ev.Progress
+
+	share := 1.0
+	if ev.Type != PrintDone {
+		share = ev.Progress / 100
+	}
+	record.Filament = ev.FilamentLength * share
+	record.Volume = ev.FilamentVolume * share
+
+	record.ID = 1
+	if n := len(h.records); n > 0 {
+		record.ID = h.records[n-1].ID + 1
+	}
+	h.records = append(h.records, *record)
+
+	if err := h.save(); err != nil {
+		log.Printf("Error: saving job history: %v", err)
+	}
+}
+
+func (h *JobHistory) save() error {
+	data, err := json.MarshalIndent(h.records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := h.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.file)
+}
+
+// Records returns a copy of the recorded jobs, oldest first
+func (h *JobHistory) Records() []JobRecord {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]JobRecord{}, h.records...)
+}
+
+// currentPrinterProfile returns the OctoPrint printer profile in use, or the agent name
+func currentPrinterProfile() string {
+	octoReq := octoprint.ConnectionRequest{}
+	connection, err := octoReq.Do(octoclient)
+	if err != nil || connection.Current.PrinterProfile == "" {
+		return bot_name
+	}
+	return connection.Current.PrinterProfile
+}
+
+// Command structure: jobhistory [count=N] [file=name] [result=done|failed|cancelled]
+func JobHistoryCommand(commandList []string) string {
+	if len(commandList) == 2 && commandList[1] == "-help" {
+		return "usage: jobhistory [count=10] [file=name] [result=done|failed|cancelled]"
+	}
+
+	count := 10
+	file, result := "", ""
+
+	for _, arg := range commandList[1:] {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			return "Error: syntax, expected key=value: " + arg
+		}
+
+		switch key {
+		case "count":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return "Error: count must be a positive number"
+			}
+			count = n
+		case "file":
+			file = value
+		case "result":
+			if value != string(PrintDone) && value != string(PrintFailed) && value != string(PrintCancelled) {
+				return "Error: result must be done, failed or cancelled"
+			}
+			result = value
+		default:
+			return "Error: unknown attribute " + key
+		}
+	}
+
+	records := jobHistory.Records()
+
+	// Newest first
+	var selected []JobRecord
+	for i := len(records) - 1; i >= 0 && len(selected) < count; i-- {
+		r := records[i]
+		if (file == "" || r.File == file || r.Path == file) && (result == "" || r.Result == result) {
+			selected = append(selected, r)
+		}
+	}
+
+	data, err := json.Marshal(selected)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return string(data)
+}
+
+// JobStats aggregates a set of jobs
+type JobStats struct {
+	Jobs      int     `json:"jobs"`
+	Done      int     `json:"done"`
+	Failed    int     `json:"failed"`
+	Cancelled int     `json:"cancelled"`
+	Success   float64 `json:"success_rate"`
+	Hours     float64 `json:"hours"`
+	Filament  float64 `json:"filament"`        // mm
+	Volume    float64 `json:"filament_volume"` // cm³
+}
+
+func (s *JobStats) add(r JobRecord) {
+	s.Jobs++
+	switch r.Result {
+	case string(PrintDone):
+		s.Done++
+	case string(PrintFailed):
+		s.Failed++
+	case string(PrintCancelled):
+		s.Cancelled++
+	}
+	s.Success = float64(s.Done) / float64(s.Jobs)
+	s.Hours += r.Duration / 3600
+	s.Filament += r.Filament
+	s.Volume += r.Volume
+}
+
+type JobStatsReport struct {
+	Since   time.Time            `json:"since"`
+	Total   JobStats             `json:"total"`
+	File    map[string]*JobStats `json:"file"`
+	Printer map[string]*JobStats `json:"printer"`
+	Period  map[string]*JobStats `json:"period"`
+}
+
+// periodKey returns the day, ISO week or month a time falls into
+func periodKey(t time.Time, by string) string {
+	switch by {
+	case "day":
+		return t.Format("2006-01-02")
+	case "week":
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	default:
+		return t.Format("2006-01")
+	}
+}
+
+// Command structure: stats [since=D] [by=day|week|month]
+func JobStatsCommand(commandList []string) string {
+	if len(commandList) == 2 && commandList[1] == "-help" {
+		return "usage: stats [since=720h] [by=day|week|month]"
+	}
+
+	since := time.Time{}
+	by := "month"
+
+	for _, arg := range commandList[1:] {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			return "Error: syntax, expected key=value: " + arg
+		}
+
+		switch key {
+		case "since":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return "Error: since: " + err.Error()
+			}
+			since = time.Now().Add(-d)
+		case "by":
+			if value != "day" && value != "week" && value != "month" {
+				return "Error: by must be day, week or month"
+			}
+			by = value
+		default:
+			return "Error: unknown attribute " + key
+		}
+	}
+
+	report := JobStatsReport{
+		Since:   since,
+		File:    make(map[string]*JobStats),
+		Printer: make(map[string]*JobStats),
+		Period:  make(map[string]*JobStats),
+	}
+
+	group := func(m map[string]*JobStats, key string, r JobRecord) {
+		if m[key] == nil {
+			m[key] = &JobStats{}
+		}
+		m[key].add(r)
+	}
+
+	records := jobHistory.Records()
+	sort.Slice(records, func(i, j int) bool { return records[i].Ended.Before(records[j].Ended) })
+
+	for _, r := range records {
+		if r.Ended.Before(since) {
+			continue
+		}
+		report.Total.add(r)
+		group(report.File, r.File, r)
+		group(report.Printer, r.Printer, r)
+		group(report.Period, periodKey(r.Ended, by), r)
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return string(data)
+}
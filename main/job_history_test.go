@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"octoAgent/octoprint"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// jobWithTools is an OctoPrint job of a two tool printer, the filament is
+// reported per tool
+const jobWithTools = `{
+	"job": {
+		"file": {"name": "cube.gcode", "path": "parts/cube.gcode"},
+		"filament": {"tool0": {"length": 1200.5, "volume": 2.9}, "tool1": {"length": 300, "volume": 0.7}}
+	},
+	"progress": {"completion": %s, "printTime": 3600},
+	"state": "Printing"
+}`
+
+// newTestOctoPrint serves the requests made while recording a job, tests add
+// their own handlers to the returned mux
+func newTestOctoPrint(t *testing.T) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(octoprint.URIConnection, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"current": {"state": "Printing", "printerProfile": "dual"}}`))
+	})
+	mux.HandleFunc(octoprint.URIFiles+"/local/parts/cube.gcode", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name": "cube.gcode", "path": "parts/cube.gcode", "hash": "5d41402a"}`))
+	})
+	server := httptest.NewServer(mux)
+
+	previous := octoclient
+	t.Cleanup(func() {
+		octoclient = previous
+		server.Close()
+	})
+	octoclient = octoprint.NewClient(server.URL, "test")
+	return mux
+}
+
+// recordJob runs a job with the given completion through a PrintWatcher
+func recordJob(t *testing.T, listener PrintEventListener, completion string) {
+	job := &octoprint.JobResponse{}
+	assert.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(jobWithTools, completion)), job))
+
+	w := NewPrintWatcher(time.Second)
+	w.Subscribe(listener)
+	w.phase = phaseIdle
+	w.transition(phasePrinting, "Printing", job)
+	w.transition(phaseIdle, "Operational", nil)
+}
+
+func TestJobHistoryFilamentPerTool(t *testing.T) {
+	newTestOctoPrint(t)
+	h, err := NewJobHistory(filepath.Join(t.TempDir(), "jobhistory.json"))
+	assert.NoError(t, err)
+
+	recordJob(t, h.OnPrintEvent, "100")
+	recordJob(t, h.OnPrintEvent, "50")
+
+	records := h.Records()
+	assert.Equal(t, 2, len(records))
+
+	done := records[0]
+	assert.Equal(t, string(PrintDone), done.Result)
+	assert.Equal(t, "dual", done.Printer)
+	assert.Equal(t, "5d41402a", done.Hash)
+	assert.InDelta(t, 1500.5, done.Filament, 1e-9)
+	assert.InDelta(t, 3.6, done.Volume, 1e-9)
+
+	// Cancelled jobs are prorated by their progress
+	cancelled := records[1]
+	assert.Equal(t, string(PrintCancelled), cancelled.Result)
+	assert.Equal(t, 2, cancelled.ID)
+	assert.InDelta(t, 750.25, cancelled.Filament, 1e-9)
+	assert.InDelta(t, 1.8, cancelled.Volume, 1e-9)
+
+	// The history is kept across restarts
+	reloaded, err := NewJobHistory(h.file)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(reloaded.Records()))
+	assert.InDelta(t, done.Filament, reloaded.Records()[0].Filament, 1e-9)
+
+	previous := jobHistory
+	t.Cleanup(func() { jobHistory = previous })
+	jobHistory = h
+
+	report := JobStatsReport{}
+	assert.NoError(t, json.Unmarshal([]byte(JobStatsCommand([]string{"stats"})), &report))
+	assert.Equal(t, 2, report.Total.Jobs)
+	assert.InDelta(t, 2250.75, report.Total.Filament, 1e-9)
+	assert.InDelta(t, 2250.75, report.Printer["dual"].Filament, 1e-9)
+}
+
+func TestJobHistoryRequester(t *testing.T) {
+	newTestOctoPrint(t)
+	_, admin, _ := newTestTransport(t)
+	h, err := NewJobHistory(filepath.Join(t.TempDir(), "jobhistory.json"))
+	assert.NoError(t, err)
+
+	h.Expect("parts/cube.gcode", admin.ID)
+	recordJob(t, h.OnPrintEvent, "100")
+	// The expectation is used once
+	recordJob(t, h.OnPrintEvent, "100")
+
+	h.Expect("parts/cube.gcode", localRequester)
+	recordJob(t, h.OnPrintEvent, "100")
+
+	// A job that did not start is forgotten
+	h.Expect("parts/cube.gcode", admin.ID)
+	h.Forget("parts/cube.gcode")
+	recordJob(t, h.OnPrintEvent, "100")
+
+	records := h.Records()
+	if assert.Len(t, records, 4) {
+		assert.Equal(t, "admin", records[0].Requester)
+		assert.Empty(t, records[1].Requester)
+		assert.Equal(t, "local", records[2].Requester)
+		assert.Empty(t, records[3].Requester)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"math"
+	"octoAgent/gcode"
+	"octoAgent/octoprint"
+	"sync"
+	"time"
+)
+
+/*
+
+Layer progress:
+
+The layers of the selected file come from the agent's G-code analysis. The
+current layer is the one whose Z matches the Z tracked from serial.log, it
+can never be ahead of the layer OctoPrint has sent (file position) and never
+goes back during a job, so Z hops and travel moves do not count as layers.
+If the tracker has no Z yet the file position alone is used.
+
+Layer times are measured when a layer is entered, the time left scales the
+analyzer's estimate for the remaining layers by how fast the finished
+layers actually were.
+
+*/
+
+// zTolerance is how close the tracked Z must be to a layer's Z
+const zTolerance = 0.005
+
+type LayerProgress struct {
+	Layer            int     `json:"layer"`
+	TotalLayers      int     `json:"total_layers"`
+	LayerZ           float64 `json:"layer_z"`
+	LayerHeight      float64 `json:"layer_height"`
+	Progress         float64 `json:"progress"`
+	LayerElapsed     float64 `json:"layer_elapsed"`
+	LastLayerTime    float64 `json:"last_layer_time"`
+	AverageLayerTime float64 `json:"average_layer_time"`
+	TimeLeft         float64 `json:"time_left"`
+}
+
+// Global layer tracker
+var layerTracker = &LayerTracker{}
+
+type LayerTracker struct {
+	mutex     sync.Mutex
+	path      string
+	analysis  *gcode.Analysis
+	current   int
+	entered   []time.Time
+	durations []float64
+}
+
+// Start updates the layer while printing, so that layer times do not depend
+// on how often the status is requested
+func (lt *LayerTracker) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !isConnected {
+				continue
+			}
+
+			jobReq := octoprint.JobRequest{}
+			job, err := jobReq.Do(octoclient)
+			if err != nil || !octoprint.ConnectionState(job.State).IsPrinting() {
+				continue
+			}
+			lt.Update(job, positionTracker.GetPosition().Z)
+		}
+	}()
+}
+
+// OnPrintEvent is the PrintWatcher listener that resets the tracker for a new job
+func (lt *LayerTracker) OnPrintEvent(ev PrintEvent) {
+	if ev.Type == PrintStarted {
+		lt.mutex.Lock()
+		lt.path = ""
+		lt.mutex.Unlock()
+	}
+}
+
+// Update correlates the job's file position and the tracked Z with the layers
+// of the file, it returns nil if the layers of the file are not known
+func (lt *LayerTracker) Update(job *octoprint.JobResponse, z float64) *LayerProgress {
+	path := job.Job.File.Path
+	if path == "" || job.Job.File.Origin == "sdcard" {
+		return nil
+	}
+
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	if path != lt.path {
+		lt.load(path)
+	}
+	if lt.analysis == nil {
+		return nil
+	}
+	return lt.update(int64(job.Progress.FilePosition), z, time.Now())
+}
+
+// load analyzes the layers of path, a file without layers is remembered as
+// well so that it is not analyzed again on every update
+func (lt *LayerTracker) load(path string) {
+	lt.path = path
+	lt.analysis = nil
+
+	analysis, err := localAnalysis(path)
+	if err != nil || len(analysis.Layers) == 0 {
+		return
+	}
+	lt.analysis = analysis
+	lt.current = -1
+	lt.entered = make([]time.Time, len(analysis.Layers))
+	lt.durations = nil
+}
+
+// update moves to the layer at filepos and z
+func (lt *LayerTracker) update(filepos int64, z float64, now time.Time) *LayerProgress {
+	layers := lt.analysis.Layers
+
+	// The last layer OctoPrint has started sending
+	sent := -1
+	for i, layer := range layers {
+		if layer.Offset > filepos {
+			break
+		}
+		sent = i
+	}
+
+	layer := sent
+	if z > 0 {
+		matched := -1
+		for i := 0; i <= sent; i++ {
+			if math.Abs(layers[i].Z-z) < zTolerance {
+				matched = i
+			}
+		}
+		if matched >= 0 {
+			layer = matched
+		} else {
+			layer = lt.current
+		}
+	}
+
+	if layer > lt.current {
+		// Only a layer that was seen from start to end has a duration
+		if layer == lt.current+1 && lt.current >= 0 && !lt.entered[lt.current].IsZero() {
+			lt.durations = append(lt.durations, now.Sub(lt.entered[lt.current]).Seconds())
+		}
+		lt.entered[layer] = now
+		lt.current = layer
+	}
+
+	if lt.current < 0 {
+		return &LayerProgress{TotalLayers: len(layers)}
+	}
+	return lt.progress(filepos, now)
+}
+
+func (lt *LayerTracker) progress(filepos int64, now time.Time) *LayerProgress {
+	layers := lt.analysis.Layers
+	current := layers[lt.current]
+
+	p := &LayerProgress{
+		Layer:       lt.current + 1,
+		TotalLayers: len(layers),
+		LayerZ:      current.Z,
+		LayerHeight: current.Height,
+	}
+
+	// Fraction of the current layer that has been sent
+	end := lt.analysis.Size
+	if lt.current+1 < len(layers) {
+		end = layers[lt.current+1].Offset
+	}
+	fraction := 0.0
+	if end > current.Offset {
+		fraction = math.Max(0, math.Min(1, float64(filepos-current.Offset)/float64(end-current.Offset)))
+	}
+	p.Progress = math.Round((float64(lt.current)+fraction)/float64(len(layers))*1000) / 10
+
+	if !lt.entered[lt.current].IsZero() {
+		p.LayerElapsed = math.Round(now.Sub(lt.entered[lt.current]).Seconds())
+	}
+
+	if n := len(lt.durations); n > 0 {
+		total := 0.0
+		for _, d := range lt.durations {
+			total += d
+		}
+		p.LastLayerTime = math.Round(lt.durations[n-1])
+		p.AverageLayerTime = math.Round(total / float64(n))
+	}
+
+	// Scale the estimate of the remaining layers by the measured speed
+	remaining := lt.analysis.EstimatedPrintTime - current.Time
+	scale := 1.0
+	first := lt.firstMeasured()
+	if first >= 0 && first < lt.current {
+		estimated := current.Time - layers[first].Time
+		actual := lt.entered[lt.current].Sub(lt.entered[first]).Seconds()
+		if estimated > 0 && actual > 0 {
+			scale = actual / estimated
+		}
+	}
+	p.TimeLeft = math.Round(math.Max(0, remaining*scale-p.LayerElapsed))
+	return p
+}
+
+// firstMeasured returns the first layer that was entered while tracking
+func (lt *LayerTracker) firstMeasured() int {
+	for i, t := range lt.entered {
+		if !t.IsZero() {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"octoAgent/gcode"
+	"octoAgent/octoprint"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestLayerTracker returns a tracker for a file of 5 layers 0.2mm apart,
+// each starts 100 bytes and 60s after the previous one
+func newTestLayerTracker() *LayerTracker {
+	analysis := &gcode.Analysis{EstimatedPrintTime: 300, Size: 600}
+	for i := 0; i < 5; i++ {
+		analysis.Layers = append(analysis.Layers, gcode.Layer{
+			Z:      0.2 * float64(i+1),
+			Height: 0.2,
+			Time:   60 * float64(i),
+			Offset: 100 * int64(i+1),
+		})
+	}
+	return &LayerTracker{
+		path:     "cube.gcode",
+		analysis: analysis,
+		current:  -1,
+		entered:  make([]time.Time, len(analysis.Layers)),
+	}
+}
+
+func TestLayerTrackerFilePosition(t *testing.T) {
+	lt := newTestLayerTracker()
+	now := time.Now()
+
+	// The start G-code is sent before the first layer
+	p := lt.update(50, 0, now)
+	assert.Equal(t, &LayerProgress{TotalLayers: 5}, p)
+
+	p = lt.update(150, 0, now)
+	assert.Equal(t, 1, p.Layer)
+	assert.Equal(t, 0.2, p.LayerZ)
+	assert.Equal(t, 0.2, p.LayerHeight)
+	assert.Equal(t, 10., p.Progress)
+
+	p = lt.update(575, 0, now)
+	assert.Equal(t, 5, p.Layer)
+	assert.Equal(t, 95., p.Progress)
+}
+
+func TestLayerTrackerZ(t *testing.T) {
+	lt := newTestLayerTracker()
+	now := time.Now()
+
+	// OctoPrint is a few layers ahead of the printer
+	p := lt.update(450, 0.4, now)
+	assert.Equal(t, 2, p.Layer)
+
+	// A Z hop or travel height is not a layer
+	p = lt.update(450, 0.9, now)
+	assert.Equal(t, 2, p.Layer)
+
+	// Never ahead of what was sent
+	p = lt.update(250, 0.8, now)
+	assert.Equal(t, 2, p.Layer)
+
+	// Never back
+	p = lt.update(450, 0.2, now)
+	assert.Equal(t, 2, p.Layer)
+
+	p = lt.update(450, 0.8+zTolerance/2, now)
+	assert.Equal(t, 4, p.Layer)
+
+	// No layer matches yet
+	lt = newTestLayerTracker()
+	p = lt.update(150, 0.6, now)
+	assert.Equal(t, 0, p.Layer)
+}
+
+func TestLayerTrackerDurations(t *testing.T) {
+	lt := newTestLayerTracker()
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	// The first layer seen has no duration, it may have started earlier
+	p := lt.update(150, 0.2, at(0))
+	assert.Equal(t, 0., p.LastLayerTime)
+
+	p = lt.update(250, 0.4, at(50))
+	assert.Equal(t, 50., p.LastLayerTime)
+	assert.Equal(t, 50., p.AverageLayerTime)
+
+	lt.update(350, 0.6, at(80))
+	p = lt.update(350, 0.6, at(90))
+	assert.Equal(t, 3, p.Layer)
+	assert.Equal(t, 30., p.LastLayerTime)
+	assert.Equal(t, 40., p.AverageLayerTime)
+	assert.Equal(t, 10., p.LayerElapsed)
+	// 180s estimated for the rest, the first two layers took 80s instead of 120s
+	assert.Equal(t, 110., p.TimeLeft)
+
+	// A skipped layer has no duration
+	p = lt.update(550, 1.0, at(200))
+	assert.Equal(t, 5, p.Layer)
+	assert.Equal(t, 30., p.LastLayerTime)
+	assert.Equal(t, []float64{50, 30}, lt.durations)
+}
+
+func TestLayerTrackerUnknownFile(t *testing.T) {
+	lt := &LayerTracker{}
+	job := &octoprint.JobResponse{}
+	job.Job.File.Path = "no-such-dir/missing.gcode"
+
+	assert.Nil(t, lt.Update(job, 0.2))
+	// The failed file is not analyzed again on every update
+	assert.Equal(t, job.Job.File.Path, lt.path)
+	assert.Nil(t, lt.analysis)
+	assert.Nil(t, lt.Update(job, 0.2))
+
+	// A new job analyzes it again
+	lt.OnPrintEvent(PrintEvent{Type: PrintStarted})
+	assert.Empty(t, lt.path)
+
+	job.Job.File.Origin = "sdcard"
+	assert.Nil(t, lt.Update(job, 0.2))
+	assert.Empty(t, lt.path)
+}
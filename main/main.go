@@ -12,8 +12,8 @@ import (
 	"runtime"
 	"strconv"
 	"syscall"
+	"time"
 
-	"cwtch.im/cwtch/event"
 	"cwtch.im/cwtch/model/attr"
 	"cwtch.im/cwtch/model/constants"
 
@@ -73,19 +73,23 @@ func instantiateAgent() error {
 	// Instantiate new agent
 	botpath := "/" + bot_name + "/"
 
+	// File sharing delivers snapshots to the requester
+	experiments := []string{constants.FileSharingExperiment}
+
 	switch runtime.GOOS {
 	case "windows":
-		cwtchbot = bot.NewCwtchBot(path.Join("./tor/win", botpath), bot_name)
+		cwtchbot = bot.NewCwtchBotWithExperiments(path.Join("./tor/win", botpath), bot_name, experiments)
 
 	case "linux":
 		_path := path.Join("./tor/linux", botpath)
-		cwtchbot = bot.NewCwtchBot(_path, bot_name)
+		cwtchbot = bot.NewCwtchBotWithExperiments(_path, bot_name, experiments)
 
 	default:
 		return fmt.Errorf("operating system not support = %v", runtime.GOOS)
 	}
 
 	cwtchbot.Launch() // Need some error check here
+	transport = NewCwtchTransport(cwtchbot)
 
 	// Set Some Profile Information
 	cwtchbot.Peer.SetScopedZonedAttribute(attr.PublicScope, attr.ProfileZone, constants.Name, bot_name)
@@ -94,7 +98,7 @@ func instantiateAgent() error {
 	cwtchbot.Peer.SetScopedZonedAttribute(attr.PublicScope, attr.ProfileZone, constants.ProfileAttribute3, bot_attribute)
 
 	// Display address
-	log.Printf("%s address: %v\n", bot_name, cwtchbot.Peer.GetOnion())
+	log.Printf("%s address: %v\n", bot_name, transport.Address())
 
 	return nil
 }
@@ -104,6 +108,8 @@ func sendInvite(id string) {
 }
 
 func main() {
+	setTrackerFlags()
+
 	// Set global variables
 	err := setGlobalVars()
 	if err != nil {
@@ -121,7 +127,7 @@ func main() {
 	// *** This needs to be added to support ABAC *** //
 
 	// Check if there is a contact associated with admin
-	_, err = cwtchbot.Peer.FetchConversationInfo(bot_admin_ID)
+	_, err = transport.ContactInfo(bot_admin_ID)
 	if err != nil {
 		log.Printf("Error: admin is not a contact: %s, sending invite...", bot_admin_ID)
 		sendInvite(bot_admin_ID)
@@ -135,6 +141,208 @@ func main() {
 		return
 	}
 
+	// Track the printer state from the serial communication
+	err = startPositionTracker(serialLogPath)
+	if err != nil {
+		log.Printf("Error: position tracker not started: %s", err)
+		return
+	}
+
+	// Restart persisted subscriptions
+	subscriptionsFile := os.Getenv("SUBSCRIPTIONS_FILE")
+	if subscriptionsFile == "" {
+		subscriptionsFile = "subscriptions.json"
+	}
+	subscriptions = NewSubscriptionManager(subscriptionsFile)
+	err = subscriptions.Restore()
+	if err != nil {
+		log.Printf("Error: restoring subscriptions: %s", err)
+	}
+
+	// Watch the print lifecycle and notify recipients
+	watchInterval := 5
+	if value := os.Getenv("PRINT_WATCH_INTERVAL"); value != "" {
+		watchInterval, err = strconv.Atoi(value)
+		if err != nil || watchInterval < 1 {
+			log.Printf("Error: PRINT_WATCH_INTERVAL must be a positive number of seconds")
+			return
+		}
+	}
+	setNotificationVars()
+	jobHistoryFile := os.Getenv("JOB_HISTORY_FILE")
+	if jobHistoryFile == "" {
+		jobHistoryFile = "jobhistory.json"
+	}
+	jobHistory, err = NewJobHistory(jobHistoryFile)
+	if err != nil {
+		log.Printf("Error: job history: %s", err)
+		return
+	}
+	spoolsFile := os.Getenv("SPOOLS_FILE")
+	if spoolsFile == "" {
+		spoolsFile = "spools.json"
+	}
+	spoolInventory, err = NewSpoolInventory(spoolsFile, os.Getenv("FILAMENT_CHECK"))
+	if err != nil {
+		log.Printf("Error: filament inventory: %s", err)
+		return
+	}
+	err = setCameraVars()
+	if err != nil {
+		log.Printf("Error: camera: %s", err)
+		return
+	}
+	mediaDeliveryFile := os.Getenv("MEDIA_DELIVERY_FILE")
+	if mediaDeliveryFile == "" {
+		mediaDeliveryFile = "media_delivery.json"
+	}
+	mediaPreferences, err = NewMediaPreferences(mediaDeliveryFile)
+	if err != nil {
+		log.Printf("Error: media delivery: %s", err)
+		return
+	}
+	err = setProgressReporter()
+	if err != nil {
+		log.Printf("Error: progress reports: %s", err)
+		return
+	}
+	err = setFailureDetector()
+	if err != nil {
+		log.Printf("Error: failure detection: %s", err)
+		return
+	}
+	err = setPreflightVars()
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+	scanPoliciesFile := os.Getenv("SCAN_POLICIES")
+	if scanPoliciesFile == "" {
+		scanPoliciesFile = "scan_policies.json"
+	}
+	err = loadScanPolicies(scanPoliciesFile)
+	if err != nil {
+		log.Printf("Error: scan policies: %s", err)
+		return
+	}
+	toolpathDir := os.Getenv("TOOLPATH_DIR")
+	if toolpathDir == "" {
+		toolpathDir = "toolpaths"
+	}
+	toolpathKeep := 20
+	if value := os.Getenv("TOOLPATH_KEEP"); value != "" {
+		toolpathKeep, err = strconv.Atoi(value)
+		if err != nil || toolpathKeep < 1 {
+			log.Printf("Error: TOOLPATH_KEEP must be a positive number")
+			return
+		}
+	}
+	toolpathRecorder, err = NewToolpathRecorder(toolpathDir, toolpathKeep)
+	if err != nil {
+		log.Printf("Error: toolpath recording: %s", err)
+		return
+	}
+	positionTracker.Subscribe(toolpathRecorder.OnMove)
+	timelapseInterval := 30
+	if value := os.Getenv("TIMELAPSE_INTERVAL"); value != "" {
+		timelapseInterval, err = strconv.Atoi(value)
+		if err != nil || timelapseInterval < 1 {
+			log.Printf("Error: TIMELAPSE_INTERVAL must be a positive number of seconds")
+			return
+		}
+	}
+	timelapseFPS := 25
+	if value := os.Getenv("TIMELAPSE_FPS"); value != "" {
+		timelapseFPS, err = strconv.Atoi(value)
+		if err != nil || timelapseFPS < 1 {
+			log.Printf("Error: TIMELAPSE_FPS must be a positive number")
+			return
+		}
+	}
+	timelapseDir := os.Getenv("TIMELAPSE_DIR")
+	if timelapseDir == "" {
+		timelapseDir = "timelapses"
+	}
+	timelapse, err = NewTimelapse(os.Getenv("TIMELAPSE_MODE"), time.Duration(timelapseInterval)*time.Second,
+		timelapseDir, timelapseFPS, os.Getenv("TIMELAPSE_DELIVER"))
+	if err != nil {
+		log.Printf("Error: timelapse: %s", err)
+		return
+	}
+	positionTracker.Subscribe(timelapse.OnMove)
+	timelapse.Start()
+	printWatcher = NewPrintWatcher(time.Duration(watchInterval) * time.Second)
+	printWatcher.Subscribe(notifyPrintEvent)
+	printWatcher.Subscribe(jobHistory.OnPrintEvent)
+	printWatcher.Subscribe(spoolInventory.OnPrintEvent)
+	printWatcher.Subscribe(layerTracker.OnPrintEvent)
+	printWatcher.Subscribe(toolpathRecorder.OnPrintEvent)
+	printWatcher.Subscribe(timelapse.OnPrintEvent)
+	printWatcher.Subscribe(progressReporter.OnPrintEvent)
+	printWatcher.Subscribe(failureDetector.OnPrintEvent)
+	if zLog != nil {
+		printWatcher.Subscribe(zLog.OnPrintEvent)
+		zLog.Start()
+	}
+	printWatcher.Start()
+	layerTracker.Start(time.Duration(watchInterval) * time.Second)
+
+	// Watch heater temperatures for anomalies
+	profileFile := os.Getenv("WATCHDOG_PROFILES")
+	if profileFile == "" {
+		profileFile = "watchdog_profiles.json"
+	}
+	thermalWatchdog, err = NewThermalWatchdog(profileFile, os.Getenv("WATCHDOG_ACTION"))
+	if err != nil {
+		log.Printf("Error: thermal watchdog: %s", err)
+		return
+	}
+	thermalWatchdog.Start(time.Duration(watchInterval) * time.Second)
+
+	// Keep a local temperature history
+	historyFile := os.Getenv("TEMP_HISTORY_FILE")
+	if historyFile == "" {
+		historyFile = "temphistory.jsonl"
+	}
+	retention, historyInterval := 72, 10
+	if value := os.Getenv("TEMP_HISTORY_RETENTION"); value != "" {
+		retention, err = strconv.Atoi(value)
+		if err != nil || retention < 1 {
+			log.Printf("Error: TEMP_HISTORY_RETENTION must be a positive number of hours")
+			return
+		}
+	}
+	if value := os.Getenv("TEMP_HISTORY_INTERVAL"); value != "" {
+		historyInterval, err = strconv.Atoi(value)
+		if err != nil || historyInterval < 1 {
+			log.Printf("Error: TEMP_HISTORY_INTERVAL must be a positive number of seconds")
+			return
+		}
+	}
+	tempHistory, err = NewTempHistory(historyFile, time.Duration(retention)*time.Hour)
+	if err != nil {
+		log.Printf("Error: temperature history: %s", err)
+		return
+	}
+	tempHistory.Start(time.Duration(historyInterval) * time.Second)
+
+	// Serve Prometheus metrics, if configured
+	startMetrics()
+
+	// Start the local control API, if configured
+	err = startControlAPI()
+	if err != nil {
+		log.Printf("Error: control API not started: %s", err)
+		return
+	}
+
+	// Start the MQTT bridge, if configured
+	err = startMQTTBridge()
+	if err != nil {
+		log.Printf("Error: MQTT bridge not started: %s", err)
+		return
+	}
+
 	// Handle graceful shutdown
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
@@ -142,128 +350,127 @@ func main() {
 	// Processing loop
 	go func() {
 		log.Println("Starting message queue go coroutine")
-		for {
-			message := cwtchbot.Queue.Next()
-
-			switch message.EventType {
-			// This does not occur with out group invite
-			case event.InvitePeerToGroup:
-				conversation, _ := cwtchbot.Peer.FetchConversationInfo(message.Data[event.RemotePeer])
-				log.Printf("Invite received contact from %v with data = %v\n", conversation, message.Data[event.RemotePeer])
-
-				if inList(conversation.Handle, bot_admin_list) {
-					cwtchbot.Peer.AcceptConversation(conversation.ID)
-					reply := packageReply("Admin: invite has been accepted")
-					cwtchbot.Peer.SendMessage(conversation.ID, reply)
-				} else {
-					log.Printf("Invite refused from %v %v\n", conversation, message.Data[event.RemotePeer])
-				}
+		runDispatcher(transport)
+	}()
 
-			case event.ContactCreated:
-				conversation, _ := cwtchbot.Peer.FetchConversationInfo(message.Data[event.RemotePeer])
-				log.Printf("Received contact request from %v %v\n", conversation, message.Data[event.RemotePeer])
-
-				if inList(conversation.Handle, bot_admin_list) {
-					cwtchbot.Peer.AcceptConversation(conversation.ID)
-					reply := packageReply("Admin: contact request has been accepted")
-					cwtchbot.Peer.SendMessage(conversation.ID, reply)
-				} else if inList(conversation.Handle, bot_user_list) {
-					cwtchbot.Peer.AcceptConversation(conversation.ID)
-					reply := packageReply("User: contact request has been accepted")
-					cwtchbot.Peer.SendMessage(conversation.ID, reply)
-				} else {
-					log.Printf("Contact request refused from %v %v\n", conversation, message.Data[event.RemotePeer])
-				}
+	// Block until a signal is received
+	<-shutdown
+	log.Println("Shutting down gracefully...")
 
-			case event.NewMessageFromPeer:
-				conversation, _ := cwtchbot.Peer.FetchConversationInfo(message.Data[event.RemotePeer])
-				envelope := Unwrap(conversation.ID, message.Data[event.Data])
-
-				log.Println("NewMessageFromPeer")
-				//log.Printf("Remote Peer = %v\n", message.Data[event.RemotePeer])
-				//log.Printf("Raw envelope = %v\n", message.Data[event.Data])
-				//log.Printf("Data = %v\n", envelope.Data)
-
-				// Check if this is a response or not
-				if envelope.Data != "Error:" && envelope.Data != "Success" {
-					if inList(conversation.Handle, bot_admin_list) {
-						switch envelope.Overlay {
-
-						case TextMessageOverlay:
-							reply := adminMessages(envelope)
-							cwtchbot.Peer.SendMessage(conversation.ID, reply)
-
-						case InviteGroupOverlay:
-							reply := inviteGroup(envelope.Data)
-							cwtchbot.Peer.SendMessage(conversation.ID, reply)
-
-						case SuggestContactOverlay:
-							cwtchbot.Peer.SendMessage(conversation.ID, packageReply("Received Suggest Contact Overlay request"))
-
-						default:
-							cwtchbot.Peer.SendMessage(conversation.ID, packageReply("Error: unrecognized command"))
-						}
-					} else if inList(conversation.Handle, bot_user_list) {
-						reply := userMessages(envelope)
-						cwtchbot.Peer.SendMessage(conversation.ID, reply)
-					} else {
-						log.Printf("Error: contact does not have sufficient privileges, message from %v %v\n", conversation, message.Data[event.RemotePeer])
-					}
-				} else {
-					// The response will be logged
-					log.Printf("Response: %s\n", envelope.Data)
-				}
+	if mqttBridge != nil {
+		mqttBridge.Stop()
+	}
+	// Write out the buffered moves of a running job
+	toolpathRecorder.Close()
+	if zLog != nil {
+		zLog.Close()
+	}
+}
 
-			case event.NewMessageFromGroup:
-				conversationID, err := strconv.Atoi(message.Data[event.ConversationID])
-				if err != nil {
-					log.Printf("error: failed to convert string to textto int: %v", err)
-					return
-				}
+// runDispatcher processes inbound events from t until the process exits
+func runDispatcher(t Transport) {
+	for {
+		handleEvent(t, t.Next())
+	}
+}
 
-				envelope := Unwrap(conversationID, message.Data[event.Data])
+// handleEvent applies the access rules and dispatches a single inbound event
+func handleEvent(t Transport, ev TransportEvent) {
+	conversation := ev.Contact
 
-				log.Println("NewMessageFromGroup")
-				//log.Printf("ConversationID = %d", conversationID)
-				//log.Printf("Remote Peer = %v\n", message.Data[event.RemotePeer])
-				//log.Printf("Raw envelope = %v\n", message.Data[event.Data])
-				//log.Printf("Data = %v\n", envelope.Data)
-				//log.Printf("Overlay = %v\n", envelope.Overlay)
+	switch ev.Type {
+	// This does not occur with out group invite
+	case GroupInviteEvent:
+		log.Printf("Invite received contact from %v with data = %v\n", conversation, conversation.Handle)
 
-				cwtchbot.Peer.SendMessage(conversationID, packageReply("octoAgent received: "+envelope.Data))
+		if inList(conversation.Handle, bot_admin_list) {
+			t.AcceptContact(conversation.ID)
+			t.Send(conversation.ID, packageReply("Admin: invite has been accepted"))
+		} else {
+			log.Printf("Invite refused from %v %v\n", conversation, conversation.Handle)
+		}
 
-			case event.PeerStateChange:
-				data := message.Data
-				log.Printf("PeerStateChange: %s\n", data[event.ConnectionState])
-				log.Printf("Remote Peer = %v\n", message.Data[event.RemotePeer])
-				log.Printf("Raw envelope = %v\n", message.Data[event.Data])
+	case ContactRequestEvent:
+		log.Printf("Received contact request from %v %v\n", conversation, conversation.Handle)
+
+		if inList(conversation.Handle, bot_admin_list) {
+			t.AcceptContact(conversation.ID)
+			t.Send(conversation.ID, packageReply("Admin: contact request has been accepted"))
+		} else if inList(conversation.Handle, bot_user_list) {
+			t.AcceptContact(conversation.ID)
+			t.Send(conversation.ID, packageReply("User: contact request has been accepted"))
+		} else {
+			log.Printf("Contact request refused from %v %v\n", conversation, conversation.Handle)
+		}
 
-			case event.ServerStateChange:
-				data := message.Data
-				log.Printf("ServerStateChange: %s\n", data[event.ConnectionState])
-				log.Printf("Remote Peer = %v\n", message.Data[event.RemotePeer])
-				log.Printf("Raw envelope = %v\n", message.Data[event.Data])
+	case PeerMessageEvent:
+		envelope := Unwrap(conversation.ID, ev.Data)
+		if envelope == nil {
+			log.Printf("Error: malformed message from %v\n", conversation.Handle)
+			return
+		}
 
-			case event.PeerAcknowledgement:
-				log.Println("PeerAcknowledgement")
-				log.Printf("Msg EventID = %v\n", message.EventID)
-				log.Printf("Data EventID = %v\n", message.Data[event.EventID])
-				log.Printf("Remote Peer = %v\n", message.Data[event.RemotePeer])
+		log.Println("NewMessageFromPeer")
 
-			case event.SendRetValMessageToPeer:
-				// We need to dig into this, but it does not effect the functionality of the bot
+		// Check if this is a response or not
+		if envelope.Data != "Error:" && envelope.Data != "Success" {
+			if inList(conversation.Handle, bot_admin_list) {
+				switch envelope.Overlay {
 
-			case event.NewGetValMessageFromPeer:
-				// We need to dig into this, but it does not effect the functionality of the bot
+				case TextMessageOverlay:
+					reply := adminMessages(envelope)
+					t.Send(conversation.ID, reply)
 
-			default:
-				log.Printf("Unhandled event: %v\n", message.EventType)
+				case InviteGroupOverlay:
+					reply := inviteGroup(envelope.Data)
+					t.Send(conversation.ID, reply)
+
+				case SuggestContactOverlay:
+					t.Send(conversation.ID, packageReply("Received Suggest Contact Overlay request"))
+
+				default:
+					t.Send(conversation.ID, packageReply("Error: unrecognized command"))
+				}
+			} else if inList(conversation.Handle, bot_user_list) {
+				reply := userMessages(envelope)
+				t.Send(conversation.ID, reply)
+			} else {
+				log.Printf("Error: contact does not have sufficient privileges, message from %v %v\n", conversation, conversation.Handle)
 			}
+		} else {
+			// The response will be logged
+			log.Printf("Response: %s\n", envelope.Data)
 		}
 
-	}()
+	case GroupMessageEvent:
+		envelope := Unwrap(conversation.ID, ev.Data)
+		if envelope == nil {
+			log.Printf("Error: malformed group message in conversation %d\n", conversation.ID)
+			return
+		}
 
-	// Block until a signal is received
-	<-shutdown
-	log.Println("Shutting down gracefully...")
+		log.Println("NewMessageFromGroup")
+
+		t.Send(conversation.ID, packageReply("octoAgent received: "+envelope.Data))
+
+	case PeerStateEvent:
+		log.Printf("PeerStateChange: %s\n", ev.State)
+		log.Printf("Remote Peer = %v\n", conversation.Handle)
+		log.Printf("Raw envelope = %v\n", ev.Data)
+
+	case ServerStateEvent:
+		log.Printf("ServerStateChange: %s\n", ev.State)
+		log.Printf("Remote Peer = %v\n", conversation.Handle)
+		log.Printf("Raw envelope = %v\n", ev.Data)
+
+	case AcknowledgementEvent:
+		log.Println("PeerAcknowledgement")
+		log.Printf("Data EventID = %v\n", ev.Data)
+		log.Printf("Remote Peer = %v\n", conversation.Handle)
+
+	case IgnoredEvent:
+
+	default:
+		log.Printf("Unhandled event: %v\n", ev.Raw)
+	}
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTransport installs a LoopbackTransport with an admin and a stranger
+func newTestTransport(t *testing.T) (*LoopbackTransport, ContactInfo, ContactInfo) {
+	lt := NewLoopbackTransport()
+	previous, previousAdmins, previousUsers := transport, bot_admin_list, bot_user_list
+	t.Cleanup(func() { transport, bot_admin_list, bot_user_list = previous, previousAdmins, previousUsers })
+
+	transport = lt
+	bot_admin_list = []string{"admin"}
+	bot_user_list = nil
+	return lt, lt.AddContact("admin", PeerOnline), lt.AddContact("stranger", PeerOnline)
+}
+
+func TestHandleEvent_AdminCommand(t *testing.T) {
+	lt, admin, _ := newTestTransport(t)
+
+	assert.NoError(t, lt.InjectMessage("admin", "getadminlist"))
+	handleEvent(lt, lt.Next())
+
+	sent := lt.Sent()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, admin.ID, sent[0].ConversationID)
+		envelope := Unwrap(admin.ID, sent[0].Message)
+		if assert.NotNil(t, envelope) {
+			assert.Contains(t, envelope.Data, "admin")
+		}
+	}
+}
+
+func TestHandleEvent_UnknownCommand(t *testing.T) {
+	lt, admin, _ := newTestTransport(t)
+
+	assert.NoError(t, lt.InjectMessage("admin", "nosuchcommand"))
+	handleEvent(lt, lt.Next())
+
+	sent := lt.Sent()
+	if assert.Len(t, sent, 1) {
+		envelope := Unwrap(admin.ID, sent[0].Message)
+		if assert.NotNil(t, envelope) {
+			assert.Equal(t, "Error: unrecognized command", envelope.Data)
+		}
+	}
+}
+
+func TestHandleEvent_NonAdminRefused(t *testing.T) {
+	lt, _, stranger := newTestTransport(t)
+
+	assert.NoError(t, lt.InjectMessage("stranger", "addadmin stranger"))
+	handleEvent(lt, lt.Next())
+
+	assert.Empty(t, lt.Sent())
+	assert.Equal(t, []string{"admin"}, bot_admin_list)
+
+	lt.Inject(TransportEvent{Type: ContactRequestEvent, Contact: stranger})
+	handleEvent(lt, lt.Next())
+
+	assert.Empty(t, lt.Sent())
+	assert.False(t, lt.accepted[stranger.ID])
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Media delivery:
+
+Snapshots, videos and timelapses are delivered to the requester with one of:
+
+  share  (default) Cwtch file sharing, the peer downloads the file while the
+         agent is online
+  s3     encrypted with a random password, uploaded to AWS_S3_BUCKET and sent
+         as a QShare actionable message
+  path   only the local path is returned
+
+Files larger than the size limit are refused, images and videos wider than
+the width limit are downscaled with ffmpeg first. Scaled copies are written
+to a temporary directory and removed after delivery, shared ones are kept
+for scaledShareRetention so the peer can download them. Defaults come from
+MEDIA_DELIVERY (share), MEDIA_MAX_SIZE (MB, default 50) and MEDIA_MAX_WIDTH
+(pixels, default 0 = keep), each requester can change their own settings:
+
+mediadelivery [share|s3|path] [maxsize=MB] [maxwidth=px]
+
+The settings are kept in MEDIA_DELIVERY_FILE (default media_delivery.json)
+keyed by the requester's handle.
+
+*/
+
+const (
+	DeliverShare = "share"
+	DeliverS3    = "s3"
+	DeliverPath  = "path"
+
+	mediaDefaultKey = "_default"
+
+	// scaledShareRetention is how long a scaled copy offered over file
+	// sharing stays available for download
+	scaledShareRetention = 24 * time.Hour
+)
+
+// scaledMediaDir holds the scaled copies, one directory per copy
+var scaledMediaDir = filepath.Join(os.TempDir(), "octoagent-scaled")
+
+// MediaPreference is how media is delivered to a requester
+type MediaPreference struct {
+	Method   string `json:"method"`
+	MaxSize  int    `json:"max_size"`  // MB, 0 = no limit
+	MaxWidth int    `json:"max_width"` // pixels, 0 = keep
+}
+
+// Global preferences, set up in main
+var mediaPreferences *MediaPreferences
+
+type MediaPreferences struct {
+	mutex       sync.Mutex
+	file        string
+	preferences map[string]MediaPreference
+}
+
+func NewMediaPreferences(file string) (*MediaPreferences, error) {
+	defaults := MediaPreference{Method: DeliverShare, MaxSize: 50}
+	if value := os.Getenv("MEDIA_DELIVERY"); value != "" {
+		defaults.Method = value
+	}
+	if value := os.Getenv("MEDIA_MAX_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, errors.New("MEDIA_MAX_SIZE must be a number of MB")
+		}
+		defaults.MaxSize = size
+	}
+	if value := os.Getenv("MEDIA_MAX_WIDTH"); value != "" {
+		width, err := strconv.Atoi(value)
+		if err != nil || width < 0 {
+			return nil, errors.New("MEDIA_MAX_WIDTH must be a number of pixels")
+		}
+		defaults.MaxWidth = width
+	}
+	if !validDeliveryMethod(defaults.Method) {
+		return nil, fmt.Errorf("unknown MEDIA_DELIVERY: %s", defaults.Method)
+	}
+
+	mp := &MediaPreferences{file: file, preferences: make(map[string]MediaPreference)}
+
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &mp.preferences); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	// The environment always wins for the default
+	mp.preferences[mediaDefaultKey] = defaults
+	return mp, nil
+}
+
+func validDeliveryMethod(method string) bool {
+	return method == DeliverShare || method == DeliverS3 || method == DeliverPath
+}
+
+func (mp *MediaPreferences) save() error {
+	data, err := json.MarshalIndent(mp.preferences, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := mp.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, mp.file)
+}
+
+// Get returns the preference of a handle or the default
+func (mp *MediaPreferences) Get(handle string) MediaPreference {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	if pref, exists := mp.preferences[handle]; exists {
+		return pref
+	}
+	return mp.preferences[mediaDefaultKey]
+}
+
+// Set stores the preference of a handle
+func (mp *MediaPreferences) Set(handle string, pref MediaPreference) error {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	mp.preferences[handle] = pref
+	return mp.save()
+}
+
+// requesterPreference returns the preference of a conversation
+func requesterPreference(conversationID int) MediaPreference {
+	if mediaPreferences == nil {
+		return MediaPreference{Method: DeliverShare}
+	}
+	contact, err := transport.Contact(conversationID)
+	if err != nil {
+		return mediaPreferences.Get(mediaDefaultKey)
+	}
+	return mediaPreferences.Get(contact.Handle)
+}
+
+// deliverMedia delivers a file to a conversation and returns a reply for the
+// requester, requests from the local API get the path
+func deliverMedia(conversationID int, filePath string) string {
+	if conversationID == localRequester {
+		return "Saved as: " + filePath
+	}
+
+	result, err := deliverMediaWith(conversationID, filePath, requesterPreference(conversationID))
+	if err != nil {
+		return "Error: delivering " + filepath.Base(filePath) + ": " + err.Error()
+	}
+	return result
+}
+
+// deliverMediaWith delivers a file with the given preference
+func deliverMediaWith(conversationID int, filePath string, pref MediaPreference) (string, error) {
+	if pref.Method == DeliverPath {
+		return "Saved as: " + filePath, nil
+	}
+
+	if pref.MaxWidth == 0 || !isMedia(filePath) {
+		return deliverFile(conversationID, filePath, pref)
+	}
+
+	scaled, err := downscale(filePath, pref.MaxWidth)
+	if err != nil {
+		return "", err
+	}
+	result, err := deliverFile(conversationID, scaled, pref)
+	// A shared copy is downloaded later, it is pruned by downscale
+	if err != nil || pref.Method != DeliverShare {
+		os.RemoveAll(filepath.Dir(scaled))
+	}
+	return result, err
+}
+
+// deliverFile delivers a file as it is, files over the size limit are refused
+func deliverFile(conversationID int, deliverPath string, pref MediaPreference) (string, error) {
+	info, err := os.Stat(deliverPath)
+	if err != nil {
+		return "", err
+	}
+	if limit := int64(pref.MaxSize) * 1024 * 1024; limit > 0 && info.Size() > limit {
+		return "", fmt.Errorf("%.1fMB exceeds the limit of %dMB", float64(info.Size())/1024/1024, pref.MaxSize)
+	}
+
+	switch pref.Method {
+	case DeliverS3:
+		share, err := s3Share(deliverPath)
+		if err != nil {
+			return "", err
+		}
+		if err := transport.Send(conversationID, packageActionableReply(share)); err != nil {
+			return "", err
+		}
+		return "Uploaded: " + filepath.Base(deliverPath), nil
+
+	default:
+		if err := transport.SendFile(conversationID, deliverPath); err != nil {
+			return "", err
+		}
+		return "Shared: " + filepath.Base(deliverPath), nil
+	}
+}
+
+func isMedia(filePath string) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	return ext == IMAGE_TYPE || ext == ".jpeg" || ext == ".png" || ext == VIDEO_TYPE
+}
+
+// downscale writes a copy that is at most width pixels wide into a new
+// directory in scaledMediaDir, files that are narrower keep their size. The
+// caller removes the directory after delivery.
+func downscale(filePath string, width int) (string, error) {
+	pruneScaledMedia(time.Now())
+	if err := os.MkdirAll(scaledMediaDir, 0700); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(scaledMediaDir, "")
+	if err != nil {
+		return "", err
+	}
+
+	ext := filepath.Ext(filePath)
+	name := fmt.Sprintf("%s-%dw%s", strings.TrimSuffix(filepath.Base(filePath), ext), width, ext)
+	scaled := filepath.Join(dir, name)
+
+	args := []string{"-y", "-loglevel", "error", "-i", filePath,
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", width)}
+	if strings.ToLower(ext) == VIDEO_TYPE {
+		args = append(args, "-c:v", "libx264", "-pix_fmt", "yuv420p", "-c:a", "copy")
+	}
+	args = append(args, scaled)
+
+	if output, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("downscaling: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return scaled, nil
+}
+
+// pruneScaledMedia removes the shared copies older than scaledShareRetention
+func pruneScaledMedia(now time.Time) {
+	entries, err := os.ReadDir(scaledMediaDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < scaledShareRetention {
+			continue
+		}
+		os.RemoveAll(filepath.Join(scaledMediaDir, entry.Name()))
+	}
+}
+
+// s3Share encrypts a file with a random password, uploads it and returns
+// the QShare for the recipient
+func s3Share(filePath string) (string, error) {
+	hash, err := FileHash(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	password := hex.EncodeToString(secret)
+
+	encFilepath := filePath + ".aes"
+	if err := EncryptFile(password, filePath, encFilepath); err != nil {
+		return "", err
+	}
+	defer os.Remove(encFilepath)
+
+	uri, err := s3UploadFile(AWS_S3_BUCKET, encFilepath)
+	if err != nil {
+		return "", err
+	}
+
+	share := QShare{
+		Actionabletype: "QShare",
+		Sharetype:      "File",
+		Sharepassword:  password,
+		Hash:           hash,
+		Shareblocks:    []QBlock{{Location: "S3", Uri: AWS_HTTP_PREFIX + uri}},
+	}
+	shareJson, err := json.Marshal(share)
+	if err != nil {
+		return "", err
+	}
+	return string(shareJson), nil
+}
+
+// Command structure: mediadelivery [share|s3|path] [maxsize=MB] [maxwidth=px]
+func MediaDelivery(commandList []string, requester int) string {
+	usage := "usage: mediadelivery [share|s3|path] [maxsize=MB] [maxwidth=px]"
+	if len(commandList) == 2 && commandList[1] == "-help" {
+		return usage
+	}
+	if mediaPreferences == nil {
+		return "Error: media delivery is not available"
+	}
+	if requester == localRequester {
+		return "Error: mediadelivery is only available over Cwtch"
+	}
+
+	contact, err := transport.Contact(requester)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	pref := mediaPreferences.Get(contact.Handle)
+
+	if len(commandList) > 1 {
+		for _, arg := range commandList[1:] {
+			if validDeliveryMethod(arg) {
+				pref.Method = arg
+				continue
+			}
+
+			key, value, found := strings.Cut(arg, "=")
+			if !found {
+				return "Error: syntax, " + usage
+			}
+			number, err := strconv.Atoi(value)
+			if err != nil || number < 0 {
+				return "Error: " + key + " must be a positive number"
+			}
+			switch key {
+			case "maxsize":
+				pref.MaxSize = number
+			case "maxwidth":
+				pref.MaxWidth = number
+			default:
+				return "Error: unknown attribute " + key
+			}
+		}
+
+		if err := mediaPreferences.Set(contact.Handle, pref); err != nil {
+			return "Error: " + err.Error()
+		}
+	}
+
+	jsonBytes, err := json.Marshal(pref)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return string(jsonBytes)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestMediaPreferences installs preferences stored in a temporary file
+func newTestMediaPreferences(t *testing.T) *MediaPreferences {
+	t.Setenv("MEDIA_DELIVERY", "")
+	t.Setenv("MEDIA_MAX_SIZE", "")
+	t.Setenv("MEDIA_MAX_WIDTH", "")
+	mp, err := NewMediaPreferences(filepath.Join(t.TempDir(), "media_delivery.json"))
+	assert.NoError(t, err)
+
+	previous := mediaPreferences
+	t.Cleanup(func() { mediaPreferences = previous })
+	mediaPreferences = mp
+	return mp
+}
+
+// setFakeFfmpeg puts an ffmpeg on PATH that copies its input to its output
+// and a scaled media directory in a temporary directory
+func setFakeFfmpeg(t *testing.T) {
+	bin := t.TempDir()
+	script := "#!/bin/sh\nwhile [ $# -gt 1 ]; do [ \"$1\" = -i ] && in=$2; shift; done\ncp \"$in\" \"$1\"\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(script), 0755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	previous := scaledMediaDir
+	t.Cleanup(func() { scaledMediaDir = previous })
+	scaledMediaDir = filepath.Join(t.TempDir(), "scaled")
+}
+
+func TestMediaPreferencesPerRequester(t *testing.T) {
+	lt, admin, stranger := newTestTransport(t)
+	mp := newTestMediaPreferences(t)
+	assert.Equal(t, MediaPreference{Method: DeliverShare, MaxSize: 50}, requesterPreference(admin.ID))
+
+	assert.Equal(t, `{"method":"path","max_size":10,"max_width":640}`,
+		MediaDelivery([]string{"mediadelivery", "path", "maxsize=10", "maxwidth=640"}, admin.ID))
+	assert.Equal(t, MediaPreference{Method: DeliverPath, MaxSize: 10, MaxWidth: 640}, requesterPreference(admin.ID))
+	// Others keep the default
+	assert.Equal(t, MediaPreference{Method: DeliverShare, MaxSize: 50}, requesterPreference(stranger.ID))
+
+	file := filepath.Join(t.TempDir(), "cube.jpg")
+	assert.NoError(t, os.WriteFile(file, []byte("jpeg"), 0644))
+	assert.Equal(t, "Saved as: "+file, deliverMedia(admin.ID, file))
+	assert.Equal(t, "Shared: cube.jpg", deliverMedia(stranger.ID, file))
+	if files := lt.SentFiles(); assert.Len(t, files, 1) {
+		assert.Equal(t, stranger.ID, files[0].ConversationID)
+	}
+
+	// Settings survive a restart, the environment sets the default
+	t.Setenv("MEDIA_DELIVERY", DeliverS3)
+	reloaded, err := NewMediaPreferences(mp.file)
+	assert.NoError(t, err)
+	assert.Equal(t, MediaPreference{Method: DeliverPath, MaxSize: 10, MaxWidth: 640}, reloaded.Get(admin.Handle))
+	assert.Equal(t, DeliverS3, reloaded.Get(stranger.Handle).Method)
+
+	for _, args := range [][]string{
+		{"mediadelivery", "mail"},
+		{"mediadelivery", "maxsize=-1"},
+		{"mediadelivery", "maxheight=480"},
+	} {
+		assert.True(t, strings.HasPrefix(MediaDelivery(args, admin.ID), "Error: "), "%v", args)
+	}
+	assert.Equal(t, "Error: mediadelivery is only available over Cwtch", MediaDelivery([]string{"mediadelivery"}, localRequester))
+}
+
+func TestDeliverMediaSizeLimit(t *testing.T) {
+	lt, admin, _ := newTestTransport(t)
+	newTestMediaPreferences(t)
+
+	file := filepath.Join(t.TempDir(), "cube.mp4")
+	assert.NoError(t, os.WriteFile(file, make([]byte, 1024*1024+1), 0644))
+
+	_, err := deliverMediaWith(admin.ID, file, MediaPreference{Method: DeliverShare, MaxSize: 1})
+	assert.EqualError(t, err, "1.0MB exceeds the limit of 1MB")
+	assert.Empty(t, lt.SentFiles())
+
+	// 0 is no limit
+	_, err = deliverMediaWith(admin.ID, file, MediaPreference{Method: DeliverShare})
+	assert.NoError(t, err)
+	assert.Len(t, lt.SentFiles(), 1)
+}
+
+func TestDeliverMediaScaledCopies(t *testing.T) {
+	lt, admin, _ := newTestTransport(t)
+	setFakeFfmpeg(t)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "cube.mp4")
+	assert.NoError(t, os.WriteFile(file, []byte("video"), 0644))
+
+	result, err := deliverMediaWith(admin.ID, file, MediaPreference{Method: DeliverShare, MaxWidth: 640})
+	assert.NoError(t, err)
+	assert.Equal(t, "Shared: cube-640w.mp4", result)
+
+	// The shared copy is not next to the original, where it would be listed
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	shared := lt.SentFiles()[0].Message
+	assert.Equal(t, scaledMediaDir, filepath.Dir(filepath.Dir(shared)))
+	assert.FileExists(t, shared)
+
+	// Each delivery gets its own copy, a refused one is removed right away
+	_, err = deliverMediaWith(admin.ID, file, MediaPreference{Method: DeliverShare, MaxWidth: 320, MaxSize: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(file, make([]byte, 1024*1024+1), 0644))
+	_, err = deliverMediaWith(admin.ID, file, MediaPreference{Method: DeliverShare, MaxWidth: 320, MaxSize: 1})
+	assert.Error(t, err)
+	entries, err = os.ReadDir(scaledMediaDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	// Shared copies are pruned once they had time to be downloaded
+	pruneScaledMedia(time.Now().Add(scaledShareRetention))
+	entries, err = os.ReadDir(scaledMediaDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
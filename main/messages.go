@@ -7,6 +7,8 @@ import (
 	"log"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -37,186 +39,142 @@ type Message struct {
 	D string `json:"d"`
 }
 
-func adminMessages(envelope *OverlayEnvelope) string {
-	cmd := strings.Split(envelope.Data, " ")
-	requestingPeerId := envelope.onion
-	fmt.Printf("Command was received: %s\n", strings.ToLower(cmd[0]))
-
-	switch strings.ToLower(cmd[0]) {
-	case "admin":
-		result := Admin(cmd)
-		return packageReply(result)
+// CommandHandler executes an admin command, requester is the conversation ID
+// of the caller (or localRequester when the command did not arrive over Cwtch)
+type CommandHandler func(cmd []string, requester int) string
 
-	case "ping":
-		result := Ping()
-		return packageReply(result)
-
-	case "help":
-		result := Help()
-		return packageReply(result)
+// adminCommands is the command registry shared by every admin front end
+var adminCommands = map[string]CommandHandler{
+	"admin": func(cmd []string, _ int) string { return Admin(cmd) },
+	"ping":  func(cmd []string, _ int) string { return Ping() },
+	"help":  func(cmd []string, _ int) string { return Help() },
 
 	// Admin operations
+	"addadmin":     func(cmd []string, _ int) string { return AddAdmin(cmd) },
+	"getadminlist": func(cmd []string, _ int) string { return GetAdminList(cmd) },
+	"removeadmin":  func(cmd []string, _ int) string { return RemoveAdmin(cmd) },
 
-	case "addadmin":
-		result := AddAdmin(cmd)
-		return packageReply(result)
-
-	case "getadminlist":
-		result := GetAdminList(cmd)
-		return packageReply(result)
+	// Notification Operations
+	"addnotify":     func(cmd []string, _ int) string { return AddNotify(cmd) },
+	"getnotifylist": func(cmd []string, _ int) string { return GetNotifyList(cmd) },
+	"removenotify":  func(cmd []string, _ int) string { return RemoveNotify(cmd) },
+	"notifyevents":  func(cmd []string, _ int) string { return SetNotifyEvents(cmd) },
+	"watchdog":      func(cmd []string, _ int) string { return Watchdog(cmd) },
 
-	case "removeadmin":
-		result := RemoveAdmin(cmd)
-		return packageReply(result)
+	"progressreport":   func(cmd []string, _ int) string { return ProgressReport(cmd) },
+	"failuredetection": func(cmd []string, _ int) string { return FailureDetection(cmd) },
 
 	// Contact Operations
-
-	case "addcontact":
-		result := AddContact(cmd)
-		return packageReply(result)
-
-	case "contactstatus":
-		result := GetContactStatus(cmd)
-		return packageReply(result)
+	"addcontact":    func(cmd []string, _ int) string { return AddContact(cmd) },
+	"contactstatus": func(cmd []string, _ int) string { return GetContactStatus(cmd) },
 
 	// Peer Operations
-
-	case "addpeer":
-		result := AddPeer(cmd)
-		return packageReply(result)
-
-	case "getpeerlist":
-		result := GetPeerList(cmd)
-		return packageReply(result)
-
-	case "removepeer":
-		result := RemovePeer(cmd)
-		return packageReply(result)
+	"addpeer":     func(cmd []string, _ int) string { return AddPeer(cmd) },
+	"getpeerlist": func(cmd []string, _ int) string { return GetPeerList(cmd) },
+	"removepeer":  func(cmd []string, _ int) string { return RemovePeer(cmd) },
 
 	// User Operations
-
-	case "adduser":
-		result := AddUser(cmd)
-		return packageReply(result)
-
-	case "getuserlist":
-		result := GetUserList(cmd)
-		return packageReply(result)
-
-	case "removeuser":
-		result := RemoveUser(cmd)
-		return packageReply(result)
+	"adduser":     func(cmd []string, _ int) string { return AddUser(cmd) },
+	"getuserlist": func(cmd []string, _ int) string { return GetUserList(cmd) },
+	"removeuser":  func(cmd []string, _ int) string { return RemoveUser(cmd) },
 
 	// Upload/Download operations
 	/*
-		case "deletefile":
-			result := Deletefile(cmd)
-			return packageReply(result)
+		"deletefile":  func(cmd []string, _ int) string { return Deletefile(cmd) },
+		"getfilelist": func(cmd []string, _ int) string { return Getfilelist() },
+		"getfile":     func(cmd []string, _ int) string { return Getfile(cmd) },
 	*/
-	/*
-		case "getfilelist":
-			fileList := Getfilelist()
-			return packageReply(fileList)
-	*/
-	/*
-		case "getfile":
-			return Getfile(cmd)
-	*/
-	case "downloadfile":
-		result := Downloadfile(cmd)
-		return packageReply(result)
-
-	case "uploadfile":
-		result := Uploadfile(cmd)
-		return packageReply(result)
+	"downloadfile": func(cmd []string, _ int) string { return Downloadfile(cmd) },
+	"uploadfile":   func(cmd []string, _ int) string { return Uploadfile(cmd) },
 
 	// Image & Picture Operations
+	"takepicture": func(cmd []string, requester int) string { return TakePicture(cmd, requester) },
+	"timelapse":   func(cmd []string, requester int) string { return TimelapseCommand(cmd, requester) },
+	"takevideo":   func(cmd []string, requester int) string { return TakeVideo(cmd, requester) },
+	"cameras":     func(cmd []string, _ int) string { return Cameras(cmd) },
 
-	case "takepicture":
-		result := TakePicture()
-		return packageReply(result)
-
-	case "takevideo":
-		result := TakeVideo()
-		return packageReply(result)
+	"mediadelivery": func(cmd []string, requester int) string { return MediaDelivery(cmd, requester) },
 
 	// Route and Subscribe Operations
-
-	case "route":
-		result := Route(cmd)
-		return packageReply(result)
-
-	case "publish":
-		result := Publish(cmd, requestingPeerId)
-		return packageReply(result)
+	"route":         func(cmd []string, _ int) string { return Route(cmd) },
+	"publish":       func(cmd []string, requester int) string { return Publish(cmd, requester) },
+	"subscribe":     func(cmd []string, requester int) string { return Subscribe(cmd, requester) },
+	"subscriptions": func(cmd []string, _ int) string { return GetSubscriptions(cmd) },
+	"unsubscribe":   func(cmd []string, _ int) string { return Unsubscribe(cmd) },
 
 	// *** Octo Service operations *** //
+	"getapiversion":         func(cmd []string, _ int) string { return GetApiVersion() },
+	"checkoctoservice":      func(cmd []string, _ int) string { return CheckOctoService() },
+	"startoctoservice":      func(cmd []string, _ int) string { return StartOctoService() },
+	"connectoctoservice":    func(cmd []string, _ int) string { return ConnectOctoService() },
+	"disconnectoctoservice": func(cmd []string, _ int) string { return DisconnectOctoService() },
+	"getconnectionsettings": func(cmd []string, _ int) string { return GetConnectionSettings() },
+	"deleteoctofile":        func(cmd []string, _ int) string { return DeleteOctoFile(cmd) },
+	"getoctofilelist":       func(cmd []string, _ int) string { return GetOctoFileList() },
+	"getoctofileinfo":       func(cmd []string, _ int) string { return GetOctoFileInfo(cmd) },
+	"printoctofile":         func(cmd []string, requester int) string { return PrintOctoFile(cmd, requester) },
+	"getgcodeanalysis":      func(cmd []string, _ int) string { return GetGcodeAnalysis(cmd) },
+	"preflight":             func(cmd []string, _ int) string { return Preflight(cmd) },
+	"bedclear":              func(cmd []string, _ int) string { return BedClear(cmd) },
+	"scanfile":              func(cmd []string, _ int) string { return ScanOctoFile(cmd) },
+
+	// This should be replaced by GetPrintStatus
+	"getjobstatus": func(cmd []string, _ int) string { return GetJobStatus() },
+
+	// This should be replaced by GetPrintStatus
+	"getprinterstate": func(cmd []string, _ int) string { return GetPrinterState() },
+
+	"getprintstatus":  func(cmd []string, _ int) string { return GetPrintStatus() },
+	"gettrackerstate": func(cmd []string, _ int) string { return GetTrackerState(cmd) },
+	"toolpath":        func(cmd []string, _ int) string { return ToolpathCommand(cmd) },
+	"zlog":            func(cmd []string, _ int) string { return ZLogCommand(cmd) },
+	"gettemp":         func(cmd []string, _ int) string { return GetTemperature() },
+	"temphistory":     func(cmd []string, _ int) string { return TempHistoryCommand(cmd) },
+
+	// Job history
+	"jobhistory": func(cmd []string, _ int) string { return JobHistoryCommand(cmd) },
+	"stats":      func(cmd []string, _ int) string { return JobStatsCommand(cmd) },
+
+	// Filament ops
+	"addspool":       func(cmd []string, _ int) string { return AddSpool(cmd) },
+	"getspoollist":   func(cmd []string, _ int) string { return GetSpoolList(cmd) },
+	"removespool":    func(cmd []string, _ int) string { return RemoveSpool(cmd) },
+	"loadspool":      func(cmd []string, _ int) string { return LoadSpool(cmd) },
+	"unloadspool":    func(cmd []string, _ int) string { return UnloadSpool(cmd) },
+	"setspoolweight": func(cmd []string, _ int) string { return SetSpoolWeight(cmd) },
+}
 
-	case "getapiversion":
-		result := GetApiVersion()
-		return packageReply(result)
-
-	case "checkoctoservice":
-		result := CheckOctoService()
-		return packageReply(result)
-
-	case "startoctoservice":
-		result := StartOctoService()
-		return packageReply(result)
-
-	case "connectoctoservice":
-		result := ConnectOctoService()
-		return packageReply(result)
-
-	case "disconnectoctoservice":
-		result := DisconnectOctoService()
-		return packageReply(result)
-
-	case "getconnectionsettings":
-		result := GetConnectionSettings()
-		return packageReply(result)
-
-	case "deleteoctofile":
-		result := DeleteOctoFile(cmd)
-		return packageReply(result)
-
-	case "getoctofilelist":
-		result := GetOctoFileList()
-		return packageReply(result)
-
-	case "getoctofileinfo":
-		result := GetOctoFileInfo(cmd)
-		return packageReply(result)
-
-	case "printoctofile":
-		result := PrintOctoFile(cmd)
-		return packageReply(result)
-
-	case "getgcodeanalysis":
-		result := GetGcodeAnalysis(cmd)
-		return packageReply(result)
+func adminMessages(envelope *OverlayEnvelope) string {
+	cmd := strings.Split(envelope.Data, " ")
+	requestingPeerId := envelope.onion
+	fmt.Printf("Command was received: %s\n", strings.ToLower(cmd[0]))
 
-		// This should be replaced by GetPrintStatus
-	case "getjobstatus":
-		result := GetJobStatus()
-		return packageReply(result)
+	result := runAdminCommand(cmd, requestingPeerId)
+	return packageReply(result)
+}
 
-		// This should be replaced by GetPrintStatus
-	case "getprinterstate":
-		result := GetPrinterState()
-		return packageReply(result)
+// commandMutex serializes the command handlers, they run from Cwtch, the
+// control API and MQTT and share globals such as isConnected
+var commandMutex sync.Mutex
 
-	case "getprintstatus":
-		result := GetPrintStatus()
-		return packageReply(result)
+// runAdminCommand looks up cmd[0] in the registry and executes it
+func runAdminCommand(cmd []string, requester int) string {
+	name := strings.ToLower(cmd[0])
+	started := time.Now()
 
-	case "gettemp":
-		result := GetTemperature()
-		return packageReply(result)
+	commandMutex.Lock()
+	defer commandMutex.Unlock()
 
-	default:
-		return packageReply("Error: unrecognized command")
+	handler, exists := adminCommands[name]
+	if !exists {
+		result := "Error: unrecognized command"
+		observeCommand(name, result, started)
+		return result
 	}
+
+	result := handler(cmd, requester)
+	observeCommand(name, result, started)
+	return result
 }
 
 func inviteGroup(bundle string) string {
@@ -226,7 +184,7 @@ func inviteGroup(bundle string) string {
 		return packageReply(err.Error())
 	}
 
-	err = cwtchbot.Peer.ImportBundle(bundle)
+	err = transport.ImportBundle(bundle)
 	if err != nil {
 		return packageReply("Error: Import Bundle: " + err.Error())
 	}
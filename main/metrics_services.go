@@ -0,0 +1,243 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"octoAgent/octoprint"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+
+Metrics:
+
+Prometheus metrics are served on /metrics when METRICS_ADDR is set in .env
+(e.g. 127.0.0.1:9101, the endpoint is not authenticated). Printer metrics are
+read from OctoPrint at scrape time, command and API error metrics are counted
+as they happen. Contacts are reported as counts per role and state, API errors
+per route template, so neither handles nor file names end up in labels.
+
+*/
+
+const metricsNamespace = "octoagent"
+
+var (
+	commandCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_total",
+		Help:      "Number of agent commands executed, by command and result.",
+	}, []string{"command", "result"})
+
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "command_duration_seconds",
+		Help:      "Latency of agent commands.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 8),
+	}, []string{"command"})
+
+	octoprintErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "octoprint_api_errors_total",
+		Help:      "Number of failed OctoPrint API requests, by endpoint.",
+	}, []string{"method", "endpoint"})
+)
+
+func init() {
+	prometheus.MustRegister(commandCounter, commandDuration, octoprintErrorCounter, newPrinterCollector())
+}
+
+// startMetrics serves /metrics if METRICS_ADDR has been configured
+func startMetrics() {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		return
+	}
+
+	// Count OctoPrint API failures from every caller of octoclient
+	octoclient.ErrorHandler = func(method, uri string, err error) {
+		octoprintErrorCounter.WithLabelValues(method, endpointTemplate(uri)).Inc()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		log.Printf("Metrics listening on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Error: metrics server stopped: %v", err)
+		}
+	}()
+}
+
+// endpointRoutes are the OctoPrint routes with path parameters, in the order
+// they are matched
+var endpointRoutes = []struct {
+	prefix   string
+	template []string
+}{
+	{octoprint.URIFiles + "/", []string{"/{location}", "/{location}/{path}"}},
+	{octoprint.URITimelapse + "/unrendered/", []string{"/{name}"}},
+	{octoprint.URITimelapse + "/", []string{"/{name}"}},
+	{octoprint.URIPrinterProfiles + "/", []string{"/{id}"}},
+	{octoprint.URISystemCommands + "/", []string{"/{source}", "/{source}/{action}"}},
+	{"/downloads/timelapse/", []string{"/{name}"}},
+}
+
+// endpointTemplate maps a request URI to its route, e.g. /api/files/local/a.gcode
+// to /api/files/{location}/{path}, so the endpoint label stays bounded
+func endpointTemplate(uri string) string {
+	path := strings.SplitN(uri, "?", 2)[0]
+
+	for _, route := range endpointRoutes {
+		if !strings.HasPrefix(path, route.prefix) || path == route.prefix {
+			continue
+		}
+		rest := path[len(route.prefix):]
+		// The last template takes the remaining segments, e.g. nested paths
+		segments := strings.Count(strings.Trim(rest, "/"), "/") + 1
+		if segments > len(route.template) {
+			segments = len(route.template)
+		}
+		return strings.TrimSuffix(route.prefix, "/") + route.template[segments-1]
+	}
+
+	switch path {
+	case octoprint.URIConnection, octoprint.URIFiles, octoprint.JobTool, octoprint.URILogin,
+		octoprint.URIPrinter, octoprint.URIPrintHead, octoprint.URIPrintTool, octoprint.URIPrintBed,
+		octoprint.URIPrintSD, octoprint.URICommand, octoprint.URICommandCustom, octoprint.URIPrinterProfiles,
+		octoprint.URISettings, octoprint.URISystemCommands, octoprint.URITimelapse, octoprint.URIVersion:
+		return path
+	}
+	return "other"
+}
+
+// observeCommand records the outcome and latency of a command
+func observeCommand(name string, output string, started time.Time) {
+	result := "success"
+	if isErrorResult(output) {
+		result = "error"
+	}
+
+	// Do not let arbitrary input create new label values
+	if _, exists := adminCommands[name]; !exists {
+		name = "unrecognized"
+	}
+
+	commandCounter.WithLabelValues(name, result).Inc()
+	commandDuration.WithLabelValues(name).Observe(time.Since(started).Seconds())
+}
+
+// printerCollector reads printer and peer state at scrape time
+type printerCollector struct {
+	connected   *prometheus.Desc
+	state       *prometheus.Desc
+	tempActual  *prometheus.Desc
+	tempTarget  *prometheus.Desc
+	progress    *prometheus.Desc
+	printTime   *prometheus.Desc
+	timeLeft    *prometheus.Desc
+	peers       *prometheus.Desc
+	scrapeError *prometheus.Desc
+}
+
+func newPrinterCollector() *printerCollector {
+	name := func(n string) string { return prometheus.BuildFQName(metricsNamespace, "", n) }
+
+	return &printerCollector{
+		connected:   prometheus.NewDesc(name("printer_connected"), "Whether the agent is connected to OctoPrint.", nil, nil),
+		state:       prometheus.NewDesc(name("printer_state"), "Current printer state, the state label carries OctoPrint's state text.", []string{"state"}, nil),
+		tempActual:  prometheus.NewDesc(name("temperature_actual_celsius"), "Actual temperature per tool.", []string{"tool"}, nil),
+		tempTarget:  prometheus.NewDesc(name("temperature_target_celsius"), "Target temperature per tool.", []string{"tool"}, nil),
+		progress:    prometheus.NewDesc(name("job_progress_percent"), "Completion of the current job.", nil, nil),
+		printTime:   prometheus.NewDesc(name("job_print_time_seconds"), "Elapsed print time of the current job.", nil, nil),
+		timeLeft:    prometheus.NewDesc(name("job_print_time_left_seconds"), "Estimated print time left of the current job.", nil, nil),
+		peers:       prometheus.NewDesc(name("peers"), "Number of known contacts by role and connection state.", []string{"role", "state"}, nil),
+		scrapeError: prometheus.NewDesc(name("printer_scrape_error"), "Whether reading the printer state failed during this scrape.", nil, nil),
+	}
+}
+
+func (c *printerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connected
+	ch <- c.state
+	ch <- c.tempActual
+	ch <- c.tempTarget
+	ch <- c.progress
+	ch <- c.printTime
+	ch <- c.timeLeft
+	ch <- c.peers
+	ch <- c.scrapeError
+}
+
+func (c *printerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collectPeers(ch)
+
+	ch <- prometheus.MustNewConstMetric(c.connected, prometheus.GaugeValue, boolToFloat(isConnected))
+	if !isConnected || octoclient == nil {
+		return
+	}
+
+	scrapeError := false
+
+	stateReq := octoprint.StateRequest{}
+	state, err := stateReq.Do(octoclient)
+	if err != nil {
+		scrapeError = true
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, 1, state.State.Text)
+		for tool, data := range state.Temperature.Current {
+			ch <- prometheus.MustNewConstMetric(c.tempActual, prometheus.GaugeValue, data.Actual, tool)
+			ch <- prometheus.MustNewConstMetric(c.tempTarget, prometheus.GaugeValue, data.Target, tool)
+		}
+	}
+
+	jobReq := octoprint.JobRequest{}
+	job, err := jobReq.Do(octoclient)
+	if err != nil {
+		scrapeError = true
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.progress, prometheus.GaugeValue, job.Progress.Completion)
+		ch <- prometheus.MustNewConstMetric(c.printTime, prometheus.GaugeValue, job.Progress.PrintTime)
+		ch <- prometheus.MustNewConstMetric(c.timeLeft, prometheus.GaugeValue, job.Progress.PrintTimeLeft)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.scrapeError, prometheus.GaugeValue, boolToFloat(scrapeError))
+}
+
+func (c *printerCollector) collectPeers(ch chan<- prometheus.Metric) {
+	if transport == nil {
+		return
+	}
+
+	roles := map[string][]string{
+		"admin": bot_admin_list,
+		"peer":  bot_peer_list,
+		"user":  bot_user_list,
+	}
+	states := []PeerState{PeerOffline, PeerConnecting, PeerOnline}
+	for role, list := range roles {
+		seen := make(map[string]bool)
+		counts := make(map[PeerState]int)
+		for _, handle := range list {
+			if seen[handle] {
+				continue
+			}
+			seen[handle] = true
+			counts[transport.PeerState(handle)]++
+		}
+		for _, state := range states {
+			ch <- prometheus.MustNewConstMetric(c.peers, prometheus.GaugeValue, float64(counts[state]), role, state.String())
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
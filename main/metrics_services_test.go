@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointTemplate(t *testing.T) {
+	cases := map[string]string{
+		"/api/job":                               "/api/job",
+		"/api/files?recursive=true":              "/api/files",
+		"/api/files/local":                       "/api/files/{location}",
+		"/api/files/local/cube.gcode":            "/api/files/{location}/{path}",
+		"/api/files/local/parts/cube.gcode":      "/api/files/{location}/{path}",
+		"/api/timelapse/cube_20240101.mp4":       "/api/timelapse/{name}",
+		"/api/timelapse/unrendered/cube_2024":    "/api/timelapse/unrendered/{name}",
+		"/api/printerprofiles/_default":          "/api/printerprofiles/{id}",
+		"/api/system/commands/core/restart":      "/api/system/commands/{source}/{action}",
+		"/downloads/timelapse/cube_20240101.mp4": "/downloads/timelapse/{name}",
+		"/api/plugin/unknown":                    "other",
+	}
+	for uri, expected := range cases {
+		assert.Equal(t, expected, endpointTemplate(uri), uri)
+	}
+}
+
+// peersCollector gathers only the contact counts, the printer is not needed
+type peersCollector struct{ *printerCollector }
+
+func (c peersCollector) Describe(ch chan<- *prometheus.Desc) { ch <- c.peers }
+func (c peersCollector) Collect(ch chan<- prometheus.Metric) { c.collectPeers(ch) }
+
+func TestCollectPeers(t *testing.T) {
+	lt, _, _ := newTestTransport(t)
+	lt.AddContact("other-admin", PeerConnecting)
+	bot_admin_list = []string{"admin", "other-admin", "admin"}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(peersCollector{newPrinterCollector()})
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(families))
+
+	counts := make(map[string]float64)
+	for _, metric := range families[0].GetMetric() {
+		labels := make(map[string]string)
+		for _, pair := range metric.GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		assert.Equal(t, 2, len(labels))
+		counts[labels["role"]+"/"+labels["state"]] = metric.GetGauge().GetValue()
+	}
+	assert.Equal(t, 1., counts["admin/online"])
+	assert.Equal(t, 1., counts["admin/connecting"])
+	assert.Equal(t, 0., counts["admin/offline"])
+	assert.Equal(t, 0., counts["user/online"])
+	assert.Equal(t, 9, len(counts))
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"octoAgent/octoprint"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+/*
+
+MQTT bridge:
+
+Optionally publishes printer telemetry to an MQTT broker and accepts agent
+commands on a command topic. It is enabled by setting MQTT_BROKER in .env,
+e.g. tcp://localhost:1883 for a local Mosquitto.
+
+Topics, relative to MQTT_TOPIC_PREFIX (default octoagent/<NAME>):
+
+status            "online"/"offline" (retained, offline is the last will)
+state             printer state text and flags (retained)
+temperature       actual/target per tool
+job               file, progress, print time and time left
+position          tracked X/Y/Z/E
+command           inbound, {"token":..,"command":..,"args":[..]}
+command/response  result of each command, same format as the control API
+
+Commands run with admin rights, so the command topic is only subscribed with
+MQTT_COMMANDS=on and every command must carry MQTT_COMMAND_TOKEN. They run
+one at a time on a worker, not in the paho callback, so long commands do not
+stall the message router.
+
+*/
+
+const (
+	defaultMQTTInterval = 10
+	mqttQoS             = 1
+
+	// mqttCommandQueue is the number of commands waiting for the worker
+	mqttCommandQueue = 16
+)
+
+var mqttBridge *MQTTBridge
+
+type MQTTBridge struct {
+	client   mqtt.Client
+	prefix   string
+	interval time.Duration
+	stop     chan struct{}
+
+	// commands is nil unless MQTT_COMMANDS is on
+	token    string
+	commands chan []string
+}
+
+// MQTTCommandRequest is a command on the command topic
+type MQTTCommandRequest struct {
+	APICommandRequest
+	Token string `json:"token"`
+}
+
+type MQTTState struct {
+	Text        string `json:"text"`
+	Operational bool   `json:"operational"`
+	Printing    bool   `json:"printing"`
+	Paused      bool   `json:"paused"`
+	Error       bool   `json:"error"`
+	Connected   bool   `json:"connected"`
+}
+
+type MQTTJob struct {
+	FileName    string  `json:"file_name"`
+	Progress    float64 `json:"progress"`
+	TimeElapsed float64 `json:"time_elapsed"`
+	TimeLeft    float64 `json:"time_left"`
+}
+
+type MQTTTemperature struct {
+	Actual float64 `json:"actual"`
+	Target float64 `json:"target"`
+}
+
+// startMQTTBridge connects to the configured broker, if any
+func startMQTTBridge() error {
+	broker := os.Getenv("MQTT_BROKER")
+	if broker == "" {
+		return nil
+	}
+
+	bridge, err := newMQTTBridge(broker)
+	if err != nil {
+		return err
+	}
+
+	token := bridge.client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		return errors.New("timeout connecting to MQTT broker " + broker)
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+
+	mqttBridge = bridge
+	go bridge.run()
+	if bridge.commands != nil {
+		go bridge.runCommands()
+	}
+
+	log.Printf("MQTT bridge connected to %s, topic prefix %s", broker, bridge.prefix)
+	return nil
+}
+
+// newMQTTBridge sets up a bridge to broker from the environment, it is not
+// connected yet
+func newMQTTBridge(broker string) (*MQTTBridge, error) {
+	prefix := os.Getenv("MQTT_TOPIC_PREFIX")
+	if prefix == "" {
+		prefix = "octoagent/" + bot_name
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	interval := defaultMQTTInterval
+	if value := os.Getenv("MQTT_PUBLISH_INTERVAL"); value != "" {
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 1 {
+			return nil, errors.New("MQTT_PUBLISH_INTERVAL must be a positive number of seconds")
+		}
+		interval = i
+	}
+
+	clientID := os.Getenv("MQTT_CLIENT_ID")
+	if clientID == "" {
+		clientID = bot_name
+	}
+
+	bridge := &MQTTBridge{
+		prefix:   prefix,
+		interval: time.Duration(interval) * time.Second,
+		stop:     make(chan struct{}),
+	}
+
+	switch os.Getenv("MQTT_COMMANDS") {
+	case "", "off":
+	case "on":
+		bridge.token = os.Getenv("MQTT_COMMAND_TOKEN")
+		if bridge.token == "" {
+			return nil, errors.New("MQTT_COMMANDS=on needs MQTT_COMMAND_TOKEN")
+		}
+		bridge.commands = make(chan []string, mqttCommandQueue)
+	default:
+		return nil, errors.New("MQTT_COMMANDS must be on or off")
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(os.Getenv("MQTT_USERNAME")).
+		SetPassword(os.Getenv("MQTT_PASSWORD")).
+		SetAutoReconnect(true).
+		SetWill(bridge.topic("status"), "offline", mqttQoS, true).
+		SetOnConnectHandler(bridge.onConnect)
+
+	bridge.client = mqtt.NewClient(opts)
+	return bridge, nil
+}
+
+func (b *MQTTBridge) topic(name string) string {
+	return b.prefix + "/" + name
+}
+
+// onConnect runs on every (re)connect, subscriptions are not persistent
+func (b *MQTTBridge) onConnect(client mqtt.Client) {
+	client.Publish(b.topic("status"), mqttQoS, true, "online")
+	if b.commands == nil {
+		return
+	}
+
+	token := client.Subscribe(b.topic("command"), mqttQoS, b.onCommand)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Error: MQTT subscribe to %s failed: %v", b.topic("command"), token.Error())
+	}
+}
+
+// onCommand checks an inbound MQTT message and queues it for the worker
+func (b *MQTTBridge) onCommand(client mqtt.Client, msg mqtt.Message) {
+	var req MQTTCommandRequest
+	if err := json.Unmarshal(msg.Payload(), &req); err != nil || req.Command == "" {
+		b.publishJSON("command/response", false, newAPICommandResult("", "Error: malformed command"))
+		return
+	}
+	name := strings.ToLower(req.Command)
+
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(b.token)) != 1 {
+		log.Printf("Error: MQTT command %s refused, missing or invalid token", name)
+		b.publishJSON("command/response", false, newAPICommandResult(name, "Error: missing or invalid token"))
+		return
+	}
+
+	select {
+	case b.commands <- append([]string{name}, req.Args...):
+	default:
+		b.publishJSON("command/response", false, newAPICommandResult(name, "Error: too many queued commands"))
+	}
+}
+
+// runCommands executes the queued commands until Stop is called
+func (b *MQTTBridge) runCommands() {
+	for {
+		select {
+		case <-b.stop:
+			return
+		case cmd := <-b.commands:
+			log.Printf("MQTT command was received: %s", cmd[0])
+			output := runAdminCommand(cmd, localRequester)
+			b.publishJSON("command/response", false, newAPICommandResult(cmd[0], output))
+		}
+	}
+}
+
+// run publishes telemetry every interval until Stop is called
+func (b *MQTTBridge) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		b.publishTelemetry()
+
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *MQTTBridge) publishTelemetry() {
+	if !isConnected {
+		b.publishJSON("state", true, MQTTState{Text: "Disconnected"})
+		return
+	}
+
+	stateReq := octoprint.StateRequest{}
+	state, err := stateReq.Do(octoclient)
+	if err != nil {
+		log.Printf("Error: MQTT telemetry, printer state: %v", err)
+		return
+	}
+
+	b.publishJSON("state", true, MQTTState{
+		Text:        state.State.Text,
+		Operational: state.State.Flags.Operations,
+		Printing:    state.State.Flags.Printing,
+		Paused:      state.State.Flags.Paused,
+		Error:       state.State.Flags.Error,
+		Connected:   isConnected,
+	})
+
+	temperatures := make(map[string]MQTTTemperature)
+	for tool, data := range state.Temperature.Current {
+		temperatures[tool] = MQTTTemperature{Actual: data.Actual, Target: data.Target}
+	}
+	b.publishJSON("temperature", false, temperatures)
+
+	jobReq := octoprint.JobRequest{}
+	job, err := jobReq.Do(octoclient)
+	if err != nil {
+		log.Printf("Error: MQTT telemetry, job state: %v", err)
+	} else {
+		b.publishJSON("job", false, MQTTJob{
+			FileName:    job.Job.File.Name,
+			Progress:    math.Round(job.Progress.Completion),
+			TimeElapsed: math.Round(job.Progress.PrintTime),
+			TimeLeft:    math.Round(job.Progress.PrintTimeLeft),
+		})
+	}
+
+	if positionTracker != nil {
+		b.publishJSON("position", false, positionTracker.GetPosition())
+	}
+}
+
+func (b *MQTTBridge) publishJSON(name string, retained bool, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error: MQTT encoding %s: %v", name, err)
+		return
+	}
+	b.client.Publish(b.topic(name), mqttQoS, retained, payload)
+}
+
+// Stop ends telemetry and disconnects, marking the agent offline
+func (b *MQTTBridge) Stop() {
+	close(b.stop)
+	token := b.client.Publish(b.topic("status"), mqttQoS, true, "offline")
+	token.WaitTimeout(2 * time.Second)
+	b.client.Disconnect(250)
+}
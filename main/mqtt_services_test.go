@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMQTTClient records publishes and subscriptions instead of talking to a
+// broker, the methods the bridge does not use are left to the nil interface
+type fakeMQTTClient struct {
+	mqtt.Client
+
+	mutex      sync.Mutex
+	published  map[string][]string
+	subscribed map[string]mqtt.MessageHandler
+	notify     chan string
+}
+
+func newFakeMQTTClient() *fakeMQTTClient {
+	return &fakeMQTTClient{
+		published:  make(map[string][]string),
+		subscribed: make(map[string]mqtt.MessageHandler),
+		notify:     make(chan string, 64),
+	}
+}
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.published[topic] = append(c.published[topic], fmt.Sprintf("%s", payload))
+	c.notify <- topic
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeMQTTClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.subscribed[topic] = callback
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeMQTTClient) Disconnect(quiesce uint) {}
+
+// last returns the last payload published to topic
+func (c *fakeMQTTClient) last(topic string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	payloads := c.published[topic]
+	if len(payloads) == 0 {
+		return ""
+	}
+	return payloads[len(payloads)-1]
+}
+
+// waitFor waits until topic has been published
+func (c *fakeMQTTClient) waitFor(t *testing.T, topic string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case published := <-c.notify:
+			if published == topic {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("%s was not published", topic)
+		}
+	}
+}
+
+type fakeMQTTMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *fakeMQTTMessage) Topic() string   { return m.topic }
+func (m *fakeMQTTMessage) Payload() []byte { return m.payload }
+
+// newTestMQTTBridge sets up a bridge from the given environment with a fake
+// client
+func newTestMQTTBridge(t *testing.T, env map[string]string) (*MQTTBridge, *fakeMQTTClient, error) {
+	for _, key := range []string{"MQTT_TOPIC_PREFIX", "MQTT_PUBLISH_INTERVAL", "MQTT_COMMANDS", "MQTT_COMMAND_TOKEN"} {
+		t.Setenv(key, env[key])
+	}
+	bridge, err := newMQTTBridge("tcp://127.0.0.1:1883")
+	if err != nil {
+		return nil, nil, err
+	}
+	client := newFakeMQTTClient()
+	bridge.client = client
+	return bridge, client, nil
+}
+
+func TestMQTTCommandsOptIn(t *testing.T) {
+	bridge, client, err := newTestMQTTBridge(t, map[string]string{"MQTT_TOPIC_PREFIX": "test/"})
+	assert.NoError(t, err)
+	assert.Nil(t, bridge.commands)
+	bridge.onConnect(client)
+	assert.Equal(t, "online", client.last("test/status"))
+	assert.Empty(t, client.subscribed)
+
+	_, _, err = newTestMQTTBridge(t, map[string]string{"MQTT_COMMANDS": "on"})
+	assert.Error(t, err)
+	_, _, err = newTestMQTTBridge(t, map[string]string{"MQTT_COMMANDS": "yes", "MQTT_COMMAND_TOKEN": "secret"})
+	assert.Error(t, err)
+	_, _, err = newTestMQTTBridge(t, map[string]string{"MQTT_PUBLISH_INTERVAL": "0"})
+	assert.Error(t, err)
+
+	bridge, client, err = newTestMQTTBridge(t, map[string]string{
+		"MQTT_TOPIC_PREFIX":  "test",
+		"MQTT_COMMANDS":      "on",
+		"MQTT_COMMAND_TOKEN": "secret",
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, bridge.commands)
+	bridge.onConnect(client)
+	assert.Contains(t, client.subscribed, "test/command")
+}
+
+func TestMQTTCommandToken(t *testing.T) {
+	newTestTransport(t)
+	bridge, client, err := newTestMQTTBridge(t, map[string]string{
+		"MQTT_TOPIC_PREFIX":  "test",
+		"MQTT_COMMANDS":      "on",
+		"MQTT_COMMAND_TOKEN": "secret",
+	})
+	assert.NoError(t, err)
+
+	var result APICommandResult
+	for _, payload := range []string{
+		`{"command":"getadminlist"}`,
+		`{"token":"wrong","command":"getadminlist"}`,
+	} {
+		bridge.onCommand(client, &fakeMQTTMessage{topic: "test/command", payload: []byte(payload)})
+		assert.NoError(t, json.Unmarshal([]byte(client.last("test/command/response")), &result))
+		assert.False(t, result.Success, payload)
+		assert.Equal(t, "Error: missing or invalid token", result.Error)
+	}
+
+	bridge.onCommand(client, &fakeMQTTMessage{topic: "test/command", payload: []byte(`{"token":"secret"}`)})
+	assert.NoError(t, json.Unmarshal([]byte(client.last("test/command/response")), &result))
+	assert.Equal(t, "Error: malformed command", result.Error)
+
+	// Refused commands are not queued
+	assert.Len(t, bridge.commands, 0)
+}
+
+func TestMQTTRunCommands(t *testing.T) {
+	newTestTransport(t)
+	bridge, client, err := newTestMQTTBridge(t, map[string]string{
+		"MQTT_TOPIC_PREFIX":  "test",
+		"MQTT_COMMANDS":      "on",
+		"MQTT_COMMAND_TOKEN": "secret",
+	})
+	assert.NoError(t, err)
+	go bridge.runCommands()
+	defer bridge.Stop()
+
+	payload := `{"token":"secret","command":"GetAdminList"}`
+	bridge.onCommand(client, &fakeMQTTMessage{topic: "test/command", payload: []byte(payload)})
+	client.waitFor(t, "test/command/response")
+
+	var result APICommandResult
+	assert.NoError(t, json.Unmarshal([]byte(client.last("test/command/response")), &result))
+	assert.Equal(t, "getadminlist", result.Command)
+	assert.True(t, result.Success)
+	assert.JSONEq(t, `["admin"]`, string(result.Result))
+
+	payload = `{"token":"secret","command":"getadminlist","args":["extra","args"]}`
+	bridge.onCommand(client, &fakeMQTTMessage{topic: "test/command", payload: []byte(payload)})
+	client.waitFor(t, "test/command/response")
+	assert.NoError(t, json.Unmarshal([]byte(client.last("test/command/response")), &result))
+	assert.False(t, result.Success)
+	assert.Equal(t, "Error: parameter mismatch", result.Error)
+}
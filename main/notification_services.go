@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+
+Notifications:
+
+Print lifecycle events from the PrintWatcher are sent as chat messages to
+every recipient in bot_notify_list, which can hold peers and groups alike.
+The list starts with NOTIFY_RECIPIENTS and NOTIFY_GROUPS from .env (comma
+separated, default is the admin) and NOTIFY_EVENTS restricts which events
+are sent (default all).
+
+*/
+
+var (
+	bot_notify_list   []string
+	bot_notify_events []string
+)
+
+// setNotificationVars loads the notification settings from the environment
+func setNotificationVars() {
+	bot_notify_list = splitList(os.Getenv("NOTIFY_RECIPIENTS"))
+	bot_notify_list = append(bot_notify_list, splitList(os.Getenv("NOTIFY_GROUPS"))...)
+	if len(bot_notify_list) == 0 && bot_admin_ID != "" {
+		bot_notify_list = append(bot_notify_list, bot_admin_ID)
+	}
+
+	bot_notify_events = splitList(os.Getenv("NOTIFY_EVENTS"))
+	if len(bot_notify_events) == 0 {
+		bot_notify_events = allPrintEvents
+	}
+}
+
+// notifyPrintEvent is the PrintWatcher listener that delivers notifications
+func notifyPrintEvent(ev PrintEvent) {
+	if !inList(string(ev.Type), bot_notify_events) {
+		return
+	}
+
+	msg := formatPrintEvent(ev)
+	for _, recipient := range bot_notify_list {
+		conversation, err := transport.ContactInfo(recipient)
+		if err != nil {
+			log.Printf("Error: notification recipient is not a contact: %s", recipient)
+			continue
+		}
+
+		if err := sendReply(conversation.ID, msg); err != nil {
+			log.Printf("Error: sending notification to %s: %v", recipient, err)
+		}
+	}
+}
+
+func formatPrintEvent(ev PrintEvent) string {
+	var strB strings.Builder
+	fmt.Fprintf(&strB, "%s: print %s", bot_name, ev.Type)
+
+	if ev.File != "" {
+		fmt.Fprintf(&strB, ", file %s", ev.File)
+	}
+
+	switch ev.Type {
+	case PrintDone, PrintFailed, PrintCancelled:
+		if ev.Duration > 0 {
+			fmt.Fprintf(&strB, ", duration %s", time.Duration(ev.Duration)*time.Second)
+		}
+		if ev.Type != PrintDone {
+			fmt.Fprintf(&strB, ", progress %.1f%%", ev.Progress)
+		}
+		if ev.FilamentLength > 0 {
+			fmt.Fprintf(&strB, ", filament %.1fmm / %.2fcm³", ev.FilamentLength, ev.FilamentVolume)
+		}
+
+	case PrinterError, PrinterDisconnected:
+		fmt.Fprintf(&strB, ", state %s", ev.State)
+	}
+	return strB.String()
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func AddNotify(commandList []string) string {
+	switch len(commandList) {
+	case 1:
+		return "Error: missing recipientNtKID"
+
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: addnotify recipient_ntkID (peer or group)"
+		} else {
+			recipient := commandList[1]
+			if inList(recipient, bot_notify_list) {
+				return "Recipient is already in the list"
+			}
+			bot_notify_list = append(bot_notify_list, recipient)
+			return "Recipient was added"
+		}
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
+
+func GetNotifyList(commandList []string) string {
+	switch len(commandList) {
+	case 1:
+		return getList(bot_notify_list)
+
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: getnotifylist"
+		} else {
+			return "Error: parameter mismatch"
+		}
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
+
+func RemoveNotify(commandList []string) string {
+	switch len(commandList) {
+	case 1:
+		return "Error: missing recipientNtKID"
+
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: removenotify recipient_ntkID"
+		} else {
+			bot_notify_list = removeUserFromList(bot_notify_list, commandList[1])
+			return "Recipient was removed"
+		}
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
+
+func SetNotifyEvents(commandList []string) string {
+	switch len(commandList) {
+	case 1:
+		return getList(bot_notify_events)
+
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: notifyevents [all|" + strings.Join(allPrintEvents, ",") + "]"
+		}
+
+		if commandList[1] == "all" {
+			bot_notify_events = allPrintEvents
+			return "Notification events were set"
+		}
+
+		events := splitList(strings.ToLower(commandList[1]))
+		for _, ev := range events {
+			if !inList(ev, allPrintEvents) {
+				return "Error: unknown event " + ev
+			}
+		}
+		bot_notify_events = events
+		return "Notification events were set"
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
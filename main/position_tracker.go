@@ -1,48 +1,158 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"octoAgent/gcode"
+	"octoAgent/octoprint"
 	"os"
+	"os/user"
+	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hpcloud/tail"
 )
 
+/*
+
+Position tracker:
+
+The serial communication is interpreted line by line. TRACKER_BACKEND selects
+where it comes from: log (default) tails serial.log, set with -log (default
+~/.octoprint/logs/serial.log), which needs OctoPrint's serial logging.
+push follows the terminal lines of OctoPrint's push API instead, so the agent
+does not need access to the OctoPrint host. As the push API can drop lines
+under load, the position is resynchronised from reports requested according
+to TRACKER_POSITION_REPORT: m154 (default) enables the firmware's position
+auto-report, m114 sends M114, both every TRACKER_REPORT_INTERVAL seconds
+(default 5), none disables them. The auto-report is enabled again whenever
+the printer (re)connects, a reset printer forgets it.
+
+Sent lines run through a G-code state machine that follows absolute/relative
+mode (G90/G91), extrusion mode (M82/M83), units, G92 and G28, feedrate, the
+active tool, fan and temperature commands. Received lines update temperatures (T:/B:/C:), the
+position reported by M114 and count the ok acknowledgements. After a resend
+request (Resend: N) the printer gets the numbered lines again from N on, the
+ones that were applied already are skipped.
+
+*/
+
 // Position holds X/Y/Z coordinates
 type Position struct {
 	X, Y, Z, E float64
 }
 
+// TrackedTemperature is the last reported and the commanded temperature of a heater
+type TrackedTemperature struct {
+	Actual float64 `json:"actual"`
+	Target float64 `json:"target"`
+}
+
+// TrackerSnapshot is the full interpreted printer state
+type TrackerSnapshot struct {
+	Position     Position                      `json:"position"`
+	Feedrate     float64                       `json:"feedrate"` // mm/min
+	Absolute     bool                          `json:"absolute"`
+	AbsoluteE    bool                          `json:"absolute_e"`
+	Inches       bool                          `json:"inches"`
+	Tool         int                           `json:"tool"`
+	Homed        bool                          `json:"homed"`
+	Fans         map[int]float64               `json:"fans"` // percent
+	Temperatures map[string]TrackedTemperature `json:"temperatures"`
+	Sent         int64                         `json:"sent"`
+	Acknowledged int64                         `json:"acknowledged"`
+	LastSend     time.Time                     `json:"last_send"`
+	LastReceive  time.Time                     `json:"last_receive"`
+}
+
+// pushRetryDelay is the wait before reconnecting to the push API
+const pushRetryDelay = 10 * time.Second
+
+var (
+	reTemperature = regexp.MustCompile(`\b([TBC]\d*):\s*(-?[0-9.]+)\s*/\s*(-?[0-9.]+)`)
+	reReportedPos = regexp.MustCompile(`X:\s*(-?[0-9.]+)\s+Y:\s*(-?[0-9.]+)\s+Z:\s*(-?[0-9.]+)\s+E:\s*(-?[0-9.]+)`)
+	reLineNumber  = regexp.MustCompile(`^\s*[Nn](\d+)\s`)
+	reResend      = regexp.MustCompile(`^(?:Resend:|rs)\s*N?(\d+)`)
+)
+
+// MoveListener is called for every executed move, outside the tracker's lock
+type MoveListener func(move gcode.Move, at time.Time)
+
 // PositionTracker monitors serial.log for position updates
 type PositionTracker struct {
-	pos        Position
-	mutex      sync.RWMutex
-	re         *regexp.Regexp
-	reZ        *regexp.Regexp   // For G1 Z without X/Y
-	zMutex     sync.RWMutex     // Mutex for zValues
-	zValues    map[float64]bool // Unique Z values
-	storeZ     bool             // Flag to store Z values
-	outputFile string           // Output file for Z values
+	mutex        sync.RWMutex
+	listeners    []MoveListener
+	machine      *gcode.Machine
+	homed        bool
+	fans         map[int]float64
+	temperatures map[string]TrackedTemperature
+	sent         int64
+	acknowledged int64
+	lastSend     time.Time
+	lastReceive  time.Time
+
+	// lastLine is the highest line number applied, lines up to it are not
+	// applied again while resending
+	lastLine  int64
+	resending bool
+
+	zLog *ZLog // Z changes are appended here, nil disables it
 }
 
-// NewPositionTracker initializes the tracker and starts monitoring
-func NewPositionTracker(logPath string, storeZ bool, outputFile string) (*PositionTracker, error) {
-	tracker := &PositionTracker{
-		re:         regexp.MustCompile(`Send: N\d+ G[0-1] X([-]?[0-9]+(?:\.[0-9]+)?)\s+Y([-]?[0-9]+(?:\.[0-9]+)?)(?:\s+Z([-]?[0-9]+(?:\.[0-9]+)?))?(?:\s+E([-]?[0-9]+(?:\.[0-9]+)?))?`),
-		reZ:        regexp.MustCompile(`Send: N\d+ G[0-1](?:\s+F\d+)?\s+Z([-]?[0-9]+(?:\.[0-9]+)?)`),
-		zValues:    make(map[float64]bool),
-		storeZ:     storeZ,
-		outputFile: outputFile,
+// newTracker returns a tracker in the power-on state
+func newTracker(zLog *ZLog) *PositionTracker {
+	return &PositionTracker{
+		machine:      gcode.NewMachine(),
+		fans:         make(map[int]float64),
+		temperatures: make(map[string]TrackedTemperature),
+		zLog:         zLog,
 	}
+}
+
+// startPositionTracker starts the configured backend, it needs octoclient
+func startPositionTracker(logPath string) error {
+	backend := os.Getenv("TRACKER_BACKEND")
+	switch backend {
+	case "", "log":
+		if logPath == "" {
+			user, err := user.Current()
+			if err != nil {
+				return err
+			}
+			logPath = filepath.Join(user.HomeDir, ".octoprint/logs/serial.log")
+		}
+		go positionTracker.monitorLog(logPath)
+		log.Printf("Position tracker: following %s", logPath)
+
+	case "push":
+		report := os.Getenv("TRACKER_POSITION_REPORT")
+		if report == "" {
+			report = "m154"
+		}
+		if report != "m154" && report != "m114" && report != "none" {
+			return fmt.Errorf("TRACKER_POSITION_REPORT must be m154, m114 or none")
+		}
+
+		interval := 5
+		if value := os.Getenv("TRACKER_REPORT_INTERVAL"); value != "" {
+			var err error
+			interval, err = strconv.Atoi(value)
+			if err != nil || interval < 1 {
+				return fmt.Errorf("TRACKER_REPORT_INTERVAL must be a positive number of seconds")
+			}
+		}
+		go positionTracker.monitorPush(octoclient, report, time.Duration(interval)*time.Second)
+		log.Printf("Position tracker: following the push API, position report %s", report)
 
-	// Start background monitoring
-	go tracker.monitorLog(logPath)
-	return tracker, nil
+	default:
+		return fmt.Errorf("TRACKER_BACKEND must be log or push")
+	}
+	return nil
 }
 
 // monitorLog tails serial.log and updates position
@@ -72,100 +182,315 @@ func (t *PositionTracker) monitorLog(logPath string) {
 	}
 }
 
-// parseLine extracts position from a log line
-func (t *PositionTracker) parseLine(line string) {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
+// monitorPush follows the serial communication on the push API, so that
+// no access to serial.log is needed. Position reports are requested with
+// M154 auto-reports or by sending M114 every interval.
+func (t *PositionTracker) monitorPush(client *octoprint.Client, report string, interval time.Duration) {
+	for {
+		err := t.followPush(client, report, interval)
+		log.Printf("Error: position tracker push API: %v, reconnecting in %s", err, pushRetryDelay)
+		time.Sleep(pushRetryDelay)
+	}
+}
 
-	// Try regex with X/Y
-	matches := t.re.FindStringSubmatch(line)
-	if len(matches) >= 3 {
-		// Update X, Y
-		if x, err := strconv.ParseFloat(matches[1], 64); err == nil {
-			t.pos.X = x
-		}
-		if y, err := strconv.ParseFloat(matches[2], 64); err == nil {
-			t.pos.Y = y
-		}
-
-		// Check for Z and E
-		if len(matches) >= 4 && matches[3] != "" {
-			if z, err := strconv.ParseFloat(matches[3], 64); err == nil {
-				t.pos.Z = z
-				if t.storeZ {
-					t.zMutex.Lock()
-					t.zValues[z] = true
-					t.zMutex.Unlock()
-					t.saveZValues()
-				}
-				if strings.Contains(line, "G1") {
-					log.Printf("Printing Z position (G1): %.3f", z)
-				} else {
-					log.Printf("Travel Z position (G0): %.3f", z)
-				}
+// followPush handles one push API connection until it fails
+func (t *PositionTracker) followPush(client *octoprint.Client, report string, interval time.Duration) error {
+	push, err := client.Push()
+	if err != nil {
+		return err
+	}
+	defer push.Close()
+
+	// enableAutoReport asks for M154 reports, again after every reconnect of
+	// this connection or the printer, which may have been reset
+	enableAutoReport := func() {}
+	switch report {
+	case "m154":
+		enableAutoReport = func() {
+			cmd := octoprint.CommandRequest{Commands: []string{fmt.Sprintf("M154 S%d", int(interval.Seconds()))}}
+			if err := cmd.Do(client); err != nil {
+				log.Printf("Error: enabling position auto-report: %v", err)
 			}
 		}
-		if len(matches) >= 5 && matches[4] != "" {
-			if e, err := strconv.ParseFloat(matches[4], 64); err == nil {
-				t.pos.E = e
+		enableAutoReport()
+
+	case "m114":
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if !isConnected {
+						continue
+					}
+					cmd := octoprint.CommandRequest{Commands: []string{"M114"}}
+					if err := cmd.Do(client); err != nil {
+						log.Printf("Error: requesting position: %v", err)
+					}
+				}
 			}
+		}()
+	}
+
+	wasConnected := isConnected
+	for {
+		message, err := push.Next()
+		if err != nil {
+			return err
+		}
+
+		// The printer connected in OctoPrint, or the agent connected it
+		reconnected := message.Event != nil && message.Event.Type == "Connected"
+		if reconnected || (isConnected && !wasConnected) {
+			enableAutoReport()
 		}
+		wasConnected = isConnected
+
+		// history replays the lines sent before the connection, they have
+		// been interpreted already or are too old to be useful
+		if message.Current == nil {
+			continue
+		}
+		for _, line := range message.Current.Logs {
+			t.parseLine(line)
+		}
+	}
+}
+
+// parseLine dispatches a serial.log line to the send or receive handler
+func (t *PositionTracker) parseLine(line string) {
+	if i := strings.Index(line, "Send: "); i >= 0 {
+		t.handleSend(line[i+len("Send: "):])
 		return
 	}
+	if i := strings.Index(line, "Recv: "); i >= 0 {
+		t.handleReceive(line[i+len("Recv: "):])
+	}
+}
 
-	// Try regex for G1/G0 Z without X/Y
-	matches = t.reZ.FindStringSubmatch(line)
-	if len(matches) == 2 {
-		if z, err := strconv.ParseFloat(matches[1], 64); err == nil {
-			t.pos.Z = z
-			if t.storeZ {
-				t.zMutex.Lock()
-				t.zValues[z] = true
-				t.zMutex.Unlock()
-				t.saveZValues()
-			}
-			if strings.Contains(line, "G1") {
-				log.Printf("Printing Z position (G1, Z-only): %.3f", z)
-			} else {
-				log.Printf("Travel Z position (G0, Z-only): %.3f", z)
+// handleSend runs a sent command through the state machine
+func (t *PositionTracker) handleSend(text string) {
+	cmd, ok := gcode.ParseLine(text)
+	if !ok {
+		return
+	}
+
+	t.mutex.Lock()
+	now := time.Now()
+	t.sent++
+	t.lastSend = now
+
+	if match := reLineNumber.FindStringSubmatch(text); match != nil {
+		line, _ := strconv.ParseInt(match[1], 10, 64)
+		if t.resending && line <= t.lastLine && cmd.Name != "M110" {
+			t.mutex.Unlock()
+			return
+		}
+		// A line past the resent ones, or a reset of the line numbers with M110
+		t.resending = false
+		t.lastLine = line
+	}
+
+	previousZ := t.machine.Position.Z
+	move, isMove := t.machine.Apply(cmd)
+	if move.Home {
+		t.homed = true
+	}
+	t.applyAuxiliary(cmd)
+	z := t.machine.Position.Z
+	listeners := t.listeners
+	t.mutex.Unlock()
+
+	if !isMove {
+		return
+	}
+	if z != previousZ {
+		t.recordZ(z, cmd.Name, now)
+	}
+	for _, listener := range listeners {
+		listener(move, now)
+	}
+}
+
+// Subscribe registers a listener for executed moves
+func (t *PositionTracker) Subscribe(listener MoveListener) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.listeners = append(t.listeners, listener)
+}
+
+// applyAuxiliary tracks fan and temperature commands, t.mutex is held
+func (t *PositionTracker) applyAuxiliary(cmd gcode.Command) {
+	switch cmd.Name {
+	case "M106":
+		fan := 0
+		if p, ok := cmd.Get('P'); ok {
+			fan = int(p)
+		}
+		speed := 255.0
+		if s, ok := cmd.Get('S'); ok {
+			speed = s
+		}
+		t.fans[fan] = speed / 255 * 100
+
+	case "M107":
+		fan := 0
+		if p, ok := cmd.Get('P'); ok {
+			fan = int(p)
+		}
+		t.fans[fan] = 0
+
+	case "M104", "M109", "M140", "M190", "M141", "M191":
+		target, ok := cmd.Get('S')
+		if !ok {
+			target, ok = cmd.Get('R')
+		}
+		if !ok {
+			return
+		}
+
+		heater := "bed"
+		switch cmd.Name {
+		case "M104", "M109":
+			tool := t.machine.Tool
+			if v, ok := cmd.Get('T'); ok {
+				tool = int(v)
 			}
+			heater = "tool" + strconv.Itoa(tool)
+		case "M141", "M191":
+			heater = "chamber"
 		}
+
+		temp := t.temperatures[heater]
+		temp.Target = target
+		t.temperatures[heater] = temp
 	}
 }
 
-// *** we are opening, reading the whole file, sorting, and adding then closing every time.
+// handleReceive parses acknowledgements, temperature and position reports
+func (t *PositionTracker) handleReceive(text string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 
-// saveZValues writes unique Z values to the output file
-func (t *PositionTracker) saveZValues() {
-	if !t.storeZ {
+	t.lastReceive = time.Now()
+	if strings.HasPrefix(text, "ok") {
+		t.acknowledged++
+	}
+	if reResend.MatchString(text) {
+		t.resending = true
 		return
 	}
-	t.zMutex.RLock()
-	defer t.zMutex.RUnlock()
 
-	zValues := make([]float64, 0, len(t.zValues))
-	for z := range t.zValues {
-		zValues = append(zValues, z)
+	for _, match := range reTemperature.FindAllStringSubmatch(text, -1) {
+		actual, err1 := strconv.ParseFloat(match[2], 64)
+		target, err2 := strconv.ParseFloat(match[3], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		var heater string
+		switch {
+		case match[1] == "T":
+			// T alone is the active hotend, T0/T1 are reported alongside it
+			heater = "tool" + strconv.Itoa(t.machine.Tool)
+		case match[1][0] == 'T':
+			heater = "tool" + match[1][1:]
+		case match[1][0] == 'B':
+			heater = "bed"
+		default:
+			heater = "chamber"
+		}
+		t.temperatures[heater] = TrackedTemperature{Actual: actual, Target: target}
 	}
 
-	sort.Float64s(zValues)
+	// M114 reports the logical position
+	if match := reReportedPos.FindStringSubmatch(text); match != nil {
+		var values [4]float64
+		for i := range values {
+			v, err := strconv.ParseFloat(match[i+1], 64)
+			if err != nil {
+				return
+			}
+			values[i] = v
+		}
+		t.machine.Position = gcode.Position{X: values[0], Y: values[1], Z: values[2], E: values[3]}
+	}
+}
 
-	file, err := os.Create(t.outputFile)
-	if err != nil {
-		log.Printf("Failed to write %s: %v", t.outputFile, err)
-		return
+// recordZ logs a Z change and appends it to the Z log
+func (t *PositionTracker) recordZ(z float64, name string, at time.Time) {
+	if name == "G0" {
+		log.Printf("Travel Z position (G0): %.3f", z)
+	} else {
+		log.Printf("Printing Z position (%s): %.3f", name, z)
 	}
-	defer file.Close()
 
-	for _, z := range zValues {
-		fmt.Fprintf(file, "%.3f\n", z)
+	if t.zLog != nil {
+		t.zLog.Record(z, at)
 	}
-	log.Printf("Saved %d unique Z values to %s", len(zValues), t.outputFile)
 }
 
 // GetPosition returns the current position
 func (t *PositionTracker) GetPosition() Position {
 	t.mutex.RLock()
 	defer t.mutex.RUnlock()
-	return t.pos
+
+	p := t.machine.Position
+	return Position{X: p.X, Y: p.Y, Z: p.Z, E: p.E}
+}
+
+// Snapshot returns the full tracked state
+func (t *PositionTracker) Snapshot() TrackerSnapshot {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	m := t.machine
+	snapshot := TrackerSnapshot{
+		Position:     Position{X: m.Position.X, Y: m.Position.Y, Z: m.Position.Z, E: m.Position.E},
+		Feedrate:     m.Feedrate,
+		Absolute:     m.Absolute,
+		AbsoluteE:    m.AbsoluteE,
+		Inches:       m.Inches,
+		Tool:         m.Tool,
+		Homed:        t.homed,
+		Fans:         make(map[int]float64, len(t.fans)),
+		Temperatures: make(map[string]TrackedTemperature, len(t.temperatures)),
+		Sent:         t.sent,
+		Acknowledged: t.acknowledged,
+		LastSend:     t.lastSend,
+		LastReceive:  t.lastReceive,
+	}
+	for fan, speed := range t.fans {
+		snapshot.Fans[fan] = speed
+	}
+	for heater, temp := range t.temperatures {
+		snapshot.Temperatures[heater] = temp
+	}
+	return snapshot
+}
+
+// GetTrackerState returns the tracked printer state as JSON
+func GetTrackerState(commandList []string) string {
+	switch len(commandList) {
+	case 1:
+		jsonBytes, err := json.Marshal(positionTracker.Snapshot())
+		if err != nil {
+			return "Error: failed to encode tracker state: " + err.Error()
+		}
+		return string(jsonBytes)
+
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: gettrackerstate"
+		}
+		return "Error: parameter mismatch"
+
+	default:
+		return "Error: parameter mismatch"
+	}
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"octoAgent/octoprint"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// feedSerialLog parses lines in the format of OctoPrint's serial.log
+func feedSerialLog(t *PositionTracker, lines ...string) {
+	for _, line := range lines {
+		t.parseLine("2024-01-01 12:00:00,000 - " + line)
+	}
+}
+
+func TestTrackerModes(t *testing.T) {
+	tracker := newTracker(nil)
+	feedSerialLog(tracker,
+		"Send: N1 G28*18",
+		"Send: N2 G90*19",
+		"Send: N3 G1 X10 Y10 Z0.2 F1200*97",
+		"Send: N4 G91*22",
+		"Send: N5 G1 X5 Z0.3*40",
+		"Send: N6 G92 E0*70",
+		"Send: N7 G90*16",
+		"Send: N8 M83*26",
+		"Send: N9 G1 X20 E2*75",
+		"Send: N10 G1 X22 E2*112",
+	)
+
+	snapshot := tracker.Snapshot()
+	assert.True(t, snapshot.Homed)
+	assert.True(t, snapshot.Absolute)
+	assert.False(t, snapshot.AbsoluteE)
+	assert.Equal(t, 1200., snapshot.Feedrate)
+	assert.Equal(t, Position{X: 22, Y: 10, Z: 0.5, E: 4}, snapshot.Position)
+	assert.Equal(t, int64(10), snapshot.Sent)
+}
+
+func TestTrackerResend(t *testing.T) {
+	tracker := newTracker(nil)
+	feedSerialLog(tracker,
+		"Send: N0 M110 N0*125",
+		"Send: N1 G91*19",
+		"Send: N2 G1 X1*51",
+		"Send: N3 G1 X1*50",
+		"Recv: ok",
+		"Recv: Error:checksum mismatch, Last Line: 1",
+		"Recv: Resend: 2",
+		"Send: N2 G1 X1*51",
+		"Send: N3 G1 X1*50",
+		"Recv: ok",
+		"Send: N4 G1 X1*53",
+	)
+	assert.Equal(t, 3., tracker.GetPosition().X)
+
+	// Line numbers start over after M110
+	feedSerialLog(tracker,
+		"Send: N0 M110 N0*125",
+		"Send: N1 G1 X1*48",
+	)
+	assert.Equal(t, 4., tracker.GetPosition().X)
+}
+
+func TestTrackerTemperatures(t *testing.T) {
+	tracker := newTracker(nil)
+	feedSerialLog(tracker,
+		"Send: M104 S210",
+		"Send: M140 S60",
+		"Recv: ok T:180.5 /210.0 B:55.2 /60.0 @:127 B@:64",
+		"Send: T1",
+		"Recv:  T:150.0 /0.0 T0:180.5 /210.0 T1:150.0 /0.0 B:55.4 /60.0 C:30.1 /0.0",
+	)
+
+	snapshot := tracker.Snapshot()
+	assert.Equal(t, int64(1), snapshot.Acknowledged)
+	assert.Equal(t, TrackedTemperature{Actual: 180.5, Target: 210}, snapshot.Temperatures["tool0"])
+	assert.Equal(t, TrackedTemperature{Actual: 150, Target: 0}, snapshot.Temperatures["tool1"])
+	assert.Equal(t, TrackedTemperature{Actual: 55.4, Target: 60}, snapshot.Temperatures["bed"])
+	assert.Equal(t, TrackedTemperature{Actual: 30.1, Target: 0}, snapshot.Temperatures["chamber"])
+	assert.Equal(t, 1, snapshot.Tool)
+}
+
+func TestTrackerPositionReport(t *testing.T) {
+	tracker := newTracker(nil)
+	feedSerialLog(tracker,
+		"Send: G1 X5 Y5",
+		"Send: M114",
+		"Recv: X:120.00 Y:80.50 Z:2.40 E:15.30 Count X:9600 Y:6440 Z:960",
+		"Recv: ok",
+	)
+	assert.Equal(t, Position{X: 120, Y: 80.5, Z: 2.4, E: 15.3}, tracker.GetPosition())
+
+	// Moves continue from the reported position
+	feedSerialLog(tracker, "Send: G1 Z2.6")
+	assert.Equal(t, Position{X: 120, Y: 80.5, Z: 2.6, E: 15.3}, tracker.GetPosition())
+}
+
+func TestTrackerPushAutoReport(t *testing.T) {
+	var mutex sync.Mutex
+	var commands []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(octoprint.URILogin, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name": "agent", "session": "s1"}`))
+	})
+	mux.HandleFunc(octoprint.URICommand, func(w http.ResponseWriter, r *http.Request) {
+		request := octoprint.CommandRequest{}
+		json.NewDecoder(r.Body).Decode(&request)
+		mutex.Lock()
+		commands = append(commands, request.Commands...)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc(octoprint.URIPush, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var auth map[string]string
+		conn.ReadJSON(&auth)
+		for _, message := range []string{
+			`{"connected": {"version": "1.9.0"}}`,
+			`{"current": {"logs": ["Send: G1 X5 Y5"]}}`,
+			// The printer was reset and connected again
+			`{"event": {"type": "Disconnected", "payload": {}}}`,
+			`{"event": {"type": "Connected", "payload": {"port": "/dev/ttyACM0"}}}`,
+			`{"current": {"logs": ["Send: G1 X7"]}}`,
+		} {
+			conn.WriteMessage(websocket.TextMessage, []byte(message))
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tracker := newTracker(nil)
+	err := tracker.followPush(octoprint.NewClient(server.URL, "test"), "m154", 5*time.Second)
+	assert.Error(t, err)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"M154 S5", "M154 S5"}, commands)
+	assert.Equal(t, Position{X: 7, Y: 5}, tracker.GetPosition())
+}
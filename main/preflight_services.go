@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"octoAgent/octoprint"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Pre-flight:
+
+printoctofile runs these checks before it starts a print and refuses to
+start if one of them fails, preflight filename runs them without printing.
+
+operational  printer is connected and Operational
+idle         no job is printing or paused
+analysis     OctoPrint or the agent's own G-code analyzer has analysed the file
+volume       the printing area of the file fits the build volume of the printer profile,
+             give or take PREFLIGHT_VOLUME_TOLERANCE mm (default 1) for purge lines and skirts
+filament     the loaded spools have enough filament (fails only with FILAMENT_CHECK=refuse)
+safety       the G-code safety scan does not reject the file
+temperature  readings are between PREFLIGHT_MIN_TEMP and PREFLIGHT_MAX_TEMP (default 5..300)
+             and the thermal watchdog has no active alert
+storage      OctoPrint has more than PREFLIGHT_MIN_FREE_MB free (default 100)
+bedclear     an operator confirmed with bedclear that the bed is empty, only when
+             PREFLIGHT_BED_CLEAR=true; the confirmation is used up by the next print
+             and expires after PREFLIGHT_BED_CLEAR_TTL minutes (default 30)
+
+PREFLIGHT_CHECKS restricts which checks run (comma separated, default all).
+
+*/
+
+const (
+	PreflightPass = "pass"
+	PreflightWarn = "warn"
+	PreflightFail = "fail"
+	PreflightSkip = "skip"
+)
+
+type PreflightCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type PreflightReport struct {
+	File   string           `json:"file"`
+	Passed bool             `json:"passed"`
+	Checks []PreflightCheck `json:"checks"`
+}
+
+func (r *PreflightReport) String() string {
+	var strB strings.Builder
+	for _, check := range r.Checks {
+		fmt.Fprintf(&strB, "- %s: %s", check.Name, check.Status)
+		if check.Detail != "" {
+			fmt.Fprintf(&strB, " (%s)", check.Detail)
+		}
+		strB.WriteString("\n")
+	}
+	return strB.String()
+}
+
+// Warnings returns the details of all checks with a warning
+func (r *PreflightReport) Warnings() []string {
+	var warnings []string
+	for _, check := range r.Checks {
+		if check.Status == PreflightWarn {
+			warnings = append(warnings, check.Name+": "+check.Detail)
+		}
+	}
+	return warnings
+}
+
+// preflightContext is what the checks are run against
+type preflightContext struct {
+	fileName string
+	state    *octoprint.FullStateResponse
+	file     *octoprint.FileInformation
+	profile  *octoprint.PrinterProfile
+	// analysis is OctoPrint's, or the agent's own if OctoPrint has none yet
+	analysis *octoprint.GCodeAnalysisInformation
+	source   string
+}
+
+type preflightStep struct {
+	name string
+	run  func(ctx *preflightContext) (string, string)
+}
+
+var preflightSteps = []preflightStep{
+	{"operational", checkOperational},
+	{"idle", checkIdle},
+	{"analysis", checkAnalysis},
+	{"volume", checkVolume},
+	{"filament", checkFilament},
+	{"safety", checkSafety},
+	{"temperature", checkTemperature},
+	{"storage", checkStorage},
+	{"bedclear", checkBedClear},
+}
+
+var (
+	preflight_checks        []string
+	preflight_min_temp      float64
+	preflight_max_temp      float64
+	preflight_min_free      float64
+	preflight_volume_tol    float64 // mm, purge lines and skirts often touch the edge of the bed
+	preflight_bed_clear     bool
+	preflight_bed_clear_ttl time.Duration
+
+	bedClearMutex sync.Mutex
+	bedClearAt    time.Time
+)
+
+// setPreflightVars loads the pre-flight settings from the environment
+func setPreflightVars() error {
+	preflight_checks = splitList(os.Getenv("PREFLIGHT_CHECKS"))
+	for _, name := range preflight_checks {
+		known := false
+		for _, step := range preflightSteps {
+			known = known || step.name == name
+		}
+		if !known {
+			return errors.New("PREFLIGHT_CHECKS: unknown check " + name)
+		}
+	}
+
+	settings := []struct {
+		name   string
+		target *float64
+		value  float64
+	}{
+		{"PREFLIGHT_MIN_TEMP", &preflight_min_temp, 5},
+		{"PREFLIGHT_MAX_TEMP", &preflight_max_temp, 300},
+		{"PREFLIGHT_MIN_FREE_MB", &preflight_min_free, 100},
+		{"PREFLIGHT_VOLUME_TOLERANCE", &preflight_volume_tol, 1},
+		{"PREFLIGHT_BED_CLEAR_TTL", nil, 30},
+	}
+	for _, setting := range settings {
+		value := setting.value
+		if env := os.Getenv(setting.name); env != "" {
+			v, err := strconv.ParseFloat(env, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", setting.name)
+			}
+			value = v
+		}
+
+		if setting.target != nil {
+			*setting.target = value
+		} else {
+			preflight_bed_clear_ttl = time.Duration(value * float64(time.Minute))
+		}
+	}
+
+	if preflight_volume_tol < 0 {
+		return errors.New("PREFLIGHT_VOLUME_TOLERANCE must not be negative")
+	}
+
+	preflight_bed_clear = os.Getenv("PREFLIGHT_BED_CLEAR") == "true"
+	return nil
+}
+
+// runPreflight loads the printer state and runs all enabled checks
+func runPreflight(fileName string) *PreflightReport {
+	ctx := &preflightContext{fileName: fileName}
+
+	stateReq := octoprint.StateRequest{}
+	if state, err := stateReq.Do(octoclient); err == nil {
+		ctx.state = state
+	}
+
+	fileReq := octoprint.FileRequest{Location: octoprint.Local, Filename: fileName}
+	if file, err := fileReq.Do(octoclient); err == nil {
+		ctx.file = file
+		if hasAnalysis(file.GCodeAnalysis) {
+			ctx.analysis, ctx.source = &file.GCodeAnalysis, "octoprint"
+		} else if local, err := localAnalysis(fileName); err == nil {
+			info := analysisInformation(local)
+			ctx.analysis, ctx.source = &info, "agent"
+		}
+	}
+
+	ctx.profile = activePrinterProfile()
+
+	report := &PreflightReport{File: fileName, Passed: true}
+	for _, step := range preflightSteps {
+		check := PreflightCheck{Name: step.name, Status: PreflightSkip}
+		if len(preflight_checks) == 0 || inList(step.name, preflight_checks) {
+			check.Status, check.Detail = step.run(ctx)
+		}
+
+		if check.Status == PreflightFail {
+			report.Passed = false
+		}
+		report.Checks = append(report.Checks, check)
+	}
+	return report
+}
+
+// activePrinterProfile returns the printer profile in use, nil if not available
+func activePrinterProfile() *octoprint.PrinterProfile {
+	profilesReq := octoprint.PrinterProfilesRequest{}
+	profiles, err := profilesReq.Do(octoclient)
+	if err != nil {
+		return nil
+	}
+
+	for _, profile := range profiles.Profiles {
+		if profile.Current {
+			return profile
+		}
+	}
+	return nil
+}
+
+func checkOperational(ctx *preflightContext) (string, string) {
+	if ctx.state == nil {
+		return PreflightFail, "printer state not available"
+	}
+	if !octoprint.ConnectionState(ctx.state.State.Text).IsOperational() && !ctx.state.State.Flags.Operations {
+		return PreflightFail, ctx.state.State.Text
+	}
+	return PreflightPass, ""
+}
+
+func checkIdle(ctx *preflightContext) (string, string) {
+	if ctx.state == nil {
+		return PreflightFail, "printer state not available"
+	}
+	if ctx.state.State.Flags.Printing || ctx.state.State.Flags.Paused {
+		return PreflightFail, "a job is active: " + ctx.state.State.Text
+	}
+	return PreflightPass, ""
+}
+
+func checkAnalysis(ctx *preflightContext) (string, string) {
+	if ctx.file == nil {
+		return PreflightFail, "file not found in OctoPrint"
+	}
+	if ctx.analysis == nil {
+		return PreflightFail, "no analysis available yet"
+	}
+	return PreflightPass, ctx.source
+}
+
+func hasAnalysis(analysis octoprint.GCodeAnalysisInformation) bool {
+	return analysis.EstimatedPrintTime > 0 || analysis.Filament.Length > 0
+}
+
+func checkVolume(ctx *preflightContext) (string, string) {
+	if ctx.analysis == nil {
+		return PreflightSkip, "no analysis"
+	}
+	if ctx.profile == nil {
+		return PreflightSkip, "printer profile not available"
+	}
+
+	area := ctx.analysis.PrintingArea
+	volume := ctx.profile.Volume
+
+	if area.MaxZ > volume.Height+preflight_volume_tol {
+		return PreflightFail, fmt.Sprintf("height %.1fmm exceeds %.1fmm", area.MaxZ, volume.Height)
+	}
+
+	if volume.FormFactor == "circular" {
+		// Only the bounding box is known, its corners may lie outside a round bed
+		// while the model does not, so only the extent along the axes is checked
+		radius := volume.Width / 2
+		extent := math.Max(math.Max(-area.MinX, area.MaxX), math.Max(-area.MinY, area.MaxY))
+		if extent > radius+preflight_volume_tol {
+			return PreflightFail, fmt.Sprintf("printing area reaches %.1fmm from the center, radius is %.1fmm", extent, radius)
+		}
+		return PreflightPass, ""
+	}
+
+	minX, maxX, minY, maxY := 0.0, volume.Width, 0.0, volume.Depth
+	if volume.Origin == "center" {
+		minX, maxX = -volume.Width/2, volume.Width/2
+		minY, maxY = -volume.Depth/2, volume.Depth/2
+	}
+
+	if area.MinX < minX-preflight_volume_tol || area.MaxX > maxX+preflight_volume_tol ||
+		area.MinY < minY-preflight_volume_tol || area.MaxY > maxY+preflight_volume_tol {
+		return PreflightFail, fmt.Sprintf("printing area X %.1f..%.1f Y %.1f..%.1f exceeds X %.1f..%.1f Y %.1f..%.1f",
+			area.MinX, area.MaxX, area.MinY, area.MaxY, minX, maxX, minY, maxY)
+	}
+	return PreflightPass, ""
+}
+
+func checkFilament(ctx *preflightContext) (string, string) {
+	if spoolInventory.check == FilamentCheckOff {
+		return PreflightSkip, ""
+	}
+	if ctx.analysis == nil {
+		return PreflightSkip, "no analysis"
+	}
+
+	shortages := spoolInventory.shortages(ctx.analysis.Filament)
+	if len(shortages) == 0 {
+		return PreflightPass, ""
+	}
+
+	if spoolInventory.check == FilamentCheckRefuse {
+		return PreflightFail, strings.Join(shortages, ", ")
+	}
+	return PreflightWarn, strings.Join(shortages, ", ")
+}
+
+func checkSafety(ctx *preflightContext) (string, string) {
+	if !isGcodeFile(ctx.fileName) {
+		return PreflightSkip, ""
+	}
+
+	filePath, err := octoUploadPath(ctx.fileName)
+	if err != nil {
+		return PreflightFail, err.Error()
+	}
+
+	report, err := scanFile(filePath)
+	if err != nil {
+		return PreflightFail, "scan failed: " + err.Error()
+	}
+
+	if len(report.Findings) == 0 {
+		return PreflightPass, ""
+	}
+
+	finding := report.Findings[0]
+	detail := fmt.Sprintf("%d findings, line %d %s: %s", len(report.Findings)+report.Suppressed, finding.Line, finding.Command, finding.Reason)
+	if report.Rejected {
+		return PreflightFail, detail
+	}
+	return PreflightWarn, detail
+}
+
+func checkTemperature(ctx *preflightContext) (string, string) {
+	if ctx.state == nil {
+		return PreflightFail, "printer state not available"
+	}
+
+	for tool, data := range ctx.state.Temperature.Current {
+		if data.Actual < preflight_min_temp || data.Actual > preflight_max_temp {
+			return PreflightFail, fmt.Sprintf("%s reads %.1f°C", tool, data.Actual)
+		}
+	}
+
+	if active := thermalWatchdog.Status().Active; len(active) > 0 {
+		return PreflightFail, "watchdog alert " + strings.Join(active, ", ")
+	}
+	return PreflightPass, ""
+}
+
+func checkStorage(ctx *preflightContext) (string, string) {
+	filesReq := octoprint.FilesRequest{Location: octoprint.Local}
+	files, err := filesReq.Do(octoclient)
+	if err != nil {
+		return PreflightFail, "free space not available: " + err.Error()
+	}
+
+	freeMB := float64(files.Free) / (1024 * 1024)
+	if freeMB < preflight_min_free {
+		return PreflightFail, fmt.Sprintf("%.0fMB free", freeMB)
+	}
+	return PreflightPass, ""
+}
+
+func checkBedClear(ctx *preflightContext) (string, string) {
+	if !preflight_bed_clear {
+		return PreflightSkip, ""
+	}
+
+	bedClearMutex.Lock()
+	defer bedClearMutex.Unlock()
+
+	if bedClearAt.IsZero() || time.Since(bedClearAt) > preflight_bed_clear_ttl {
+		return PreflightFail, "confirm with bedclear that the bed is empty"
+	}
+	return PreflightPass, ""
+}
+
+// useBedClear consumes the confirmation once a print has started
+func useBedClear() {
+	bedClearMutex.Lock()
+	bedClearAt = time.Time{}
+	bedClearMutex.Unlock()
+}
+
+func Preflight(commandList []string) string {
+	switch len(commandList) {
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: preflight filename.ext"
+		}
+
+		if !isConnected {
+			return "Error: not connected to octoService"
+		}
+
+		report := runPreflight(commandList[1])
+		if !report.Passed {
+			return "Pre-flight failed:\n" + report.String()
+		}
+		return "Pre-flight passed:\n" + report.String()
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
+
+func BedClear(commandList []string) string {
+	switch len(commandList) {
+	case 1:
+		bedClearMutex.Lock()
+		bedClearAt = time.Now()
+		bedClearMutex.Unlock()
+		return "Bed is clear"
+
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: bedclear"
+		}
+		return "Error: parameter mismatch"
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"octoAgent/octoprint"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckVolumeTolerance(t *testing.T) {
+	previous := preflight_volume_tol
+	t.Cleanup(func() { preflight_volume_tol = previous })
+
+	profile := &octoprint.PrinterProfile{}
+	profile.Volume.FormFactor = "rectangular"
+	profile.Volume.Origin = "lowerleft"
+	profile.Volume.Width, profile.Volume.Depth, profile.Volume.Height = 200, 200, 180
+
+	// A purge line 1.5mm in front of the bed
+	analysis := &octoprint.GCodeAnalysisInformation{}
+	analysis.PrintingArea.MinX, analysis.PrintingArea.MaxX = 10, 190
+	analysis.PrintingArea.MinY, analysis.PrintingArea.MaxY = -1.5, 190
+	analysis.PrintingArea.MaxZ = 20
+	ctx := &preflightContext{profile: profile, analysis: analysis}
+
+	t.Setenv("PREFLIGHT_VOLUME_TOLERANCE", "")
+	assert.NoError(t, setPreflightVars())
+	assert.Equal(t, 1., preflight_volume_tol)
+	status, _ := checkVolume(ctx)
+	assert.Equal(t, PreflightFail, status)
+
+	t.Setenv("PREFLIGHT_VOLUME_TOLERANCE", "2")
+	assert.NoError(t, setPreflightVars())
+	status, _ = checkVolume(ctx)
+	assert.Equal(t, PreflightPass, status)
+
+	t.Setenv("PREFLIGHT_VOLUME_TOLERANCE", "-1")
+	assert.Error(t, setPreflightVars())
+	t.Setenv("PREFLIGHT_VOLUME_TOLERANCE", "wide")
+	assert.Error(t, setPreflightVars())
+}
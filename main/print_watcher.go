@@ -0,0 +1,249 @@
+package main
+
+import (
+	"log"
+	"octoAgent/octoprint"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrintEventType identifies a print lifecycle transition
+type PrintEventType string
+
+const (
+	PrintStarted        PrintEventType = "started"
+	PrintPaused         PrintEventType = "paused"
+	PrintResumed        PrintEventType = "resumed"
+	PrintDone           PrintEventType = "done"
+	PrintFailed         PrintEventType = "failed"
+	PrintCancelled      PrintEventType = "cancelled"
+	PrinterError        PrintEventType = "error"
+	PrinterDisconnected PrintEventType = "disconnected"
+)
+
+var allPrintEvents = []string{
+	string(PrintStarted), string(PrintPaused), string(PrintResumed), string(PrintDone),
+	string(PrintFailed), string(PrintCancelled), string(PrinterError), string(PrinterDisconnected),
+}
+
+// PrintEvent describes a lifecycle transition and the job it belongs to
+type PrintEvent struct {
+	Type           PrintEventType     `json:"type"`
+	Time           time.Time          `json:"time"`
+	State          string             `json:"state"`
+	File           string             `json:"file,omitempty"`
+	Path           string             `json:"path,omitempty"`
+	Started        time.Time          `json:"started,omitempty"`
+	Duration       float64            `json:"duration,omitempty"`
+	Progress       float64            `json:"progress,omitempty"`
+	FilamentLength float64            `json:"filament_length,omitempty"`
+	FilamentVolume float64            `json:"filament_volume,omitempty"`
+	FilamentTools  map[string]float64 `json:"filament_tools,omitempty"`
+}
+
+// PrintEventListener is called from the watcher goroutine for every event,
+// listeners that block should hand off to their own goroutine
+type PrintEventListener func(ev PrintEvent)
+
+type printPhase int
+
+const (
+	phaseUnknown printPhase = iota
+	phaseIdle
+	phasePrinting
+	phasePaused
+	phaseError
+	phaseOffline
+)
+
+// Global watcher instance, set up in main
+var printWatcher *PrintWatcher
+
+// PrintWatcher polls OctoPrint and turns state changes into PrintEvents
+type PrintWatcher struct {
+	mutex      sync.Mutex
+	listeners  []PrintEventListener
+	interval   time.Duration
+	phase      printPhase
+	lastJob    *octoprint.JobResponse
+	started    time.Time
+	cancelling bool
+}
+
+func NewPrintWatcher(interval time.Duration) *PrintWatcher {
+	return &PrintWatcher{interval: interval}
+}
+
+// Subscribe registers a listener for all future events
+func (w *PrintWatcher) Subscribe(listener PrintEventListener) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.listeners = append(w.listeners, listener)
+}
+
+// Start begins polling in the background
+func (w *PrintWatcher) Start() {
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			w.poll()
+		}
+	}()
+}
+
+func (w *PrintWatcher) poll() {
+	// The agent has deliberately disconnected, nothing to watch
+	if !isConnected {
+		w.phase = phaseUnknown
+		return
+	}
+
+	stateReq := octoprint.StateRequest{Exclude: []string{"temperature", "sd"}}
+	state, err := stateReq.Do(octoclient)
+	if err != nil {
+		if w.phase != phaseOffline {
+			log.Printf("PrintWatcher: printer state not available: %v", err)
+			w.transition(phaseOffline, err.Error(), nil)
+		}
+		return
+	}
+
+	var job *octoprint.JobResponse
+	jobReq := octoprint.JobRequest{}
+	if j, err := jobReq.Do(octoclient); err == nil {
+		job = j
+	}
+
+	w.transition(classifyState(state.State), state.State.Text, job)
+}
+
+func classifyState(state octoprint.PrinterState) printPhase {
+	text := octoprint.ConnectionState(state.Text)
+
+	switch {
+	case state.Flags.Error || state.Flags.ClosedOnError || text.IsError():
+		return phaseError
+	case text.IsOffline():
+		return phaseOffline
+	case state.Flags.Paused:
+		return phasePaused
+	case state.Flags.Printing || text.IsPrinting():
+		return phasePrinting
+	default:
+		return phaseIdle
+	}
+}
+
+// transition compares the new phase with the previous one and emits events
+func (w *PrintWatcher) transition(phase printPhase, text string, job *octoprint.JobResponse) {
+	previous := w.phase
+	w.phase = phase
+
+	if strings.HasPrefix(text, "Cancelling") {
+		w.cancelling = true
+	}
+
+	active := previous == phasePrinting || previous == phasePaused
+
+	// Keep the last job snapshot of an active print for the end events
+	if (phase == phasePrinting || phase == phasePaused) && job != nil {
+		w.lastJob = job
+	}
+
+	if phase == previous || previous == phaseUnknown {
+		// The agent (re)started in the middle of a print
+		if previous == phaseUnknown && (phase == phasePrinting || phase == phasePaused) {
+			w.started = time.Now()
+		}
+		return
+	}
+
+	switch phase {
+	case phasePrinting:
+		if previous == phasePaused {
+			w.emit(PrintResumed, text)
+		} else {
+			w.started = time.Now()
+			w.cancelling = false
+			w.emit(PrintStarted, text)
+		}
+
+	case phasePaused:
+		w.emit(PrintPaused, text)
+
+	case phaseIdle:
+		if active {
+			completion := 0.0
+			if w.lastJob != nil {
+				completion = w.lastJob.Progress.Completion
+			}
+			if job != nil && job.Progress.Completion > completion {
+				completion = job.Progress.Completion
+			}
+
+			if !w.cancelling && completion >= 99.5 {
+				w.emit(PrintDone, text)
+			} else {
+				w.emit(PrintCancelled, text)
+			}
+			w.endJob()
+		}
+
+	case phaseError:
+		if active {
+			w.emit(PrintFailed, text)
+			w.endJob()
+		}
+		w.emit(PrinterError, text)
+
+	case phaseOffline:
+		if active {
+			w.emit(PrintFailed, text)
+			w.endJob()
+		}
+		w.emit(PrinterDisconnected, text)
+	}
+}
+
+func (w *PrintWatcher) endJob() {
+	w.lastJob = nil
+	w.cancelling = false
+}
+
+func (w *PrintWatcher) emit(eventType PrintEventType, text string) {
+	ev := PrintEvent{
+		Type:    eventType,
+		Time:    time.Now(),
+		State:   text,
+		Started: w.started,
+	}
+
+	if w.lastJob != nil {
+		ev.File = w.lastJob.Job.File.Name
+		ev.Path = w.lastJob.Job.File.Path
+		ev.Duration = w.lastJob.Progress.PrintTime
+		ev.Progress = w.lastJob.Progress.Completion
+		ev.FilamentLength = w.lastJob.Job.Filament.Length
+		ev.FilamentVolume = w.lastJob.Job.Filament.Volume
+		for tool, filament := range w.lastJob.Job.Filament.Tools {
+			if ev.FilamentTools == nil {
+				ev.FilamentTools = make(map[string]float64)
+			}
+			ev.FilamentTools[tool] = filament.Length
+		}
+	}
+
+	log.Printf("PrintWatcher: print %s (%s) %s", ev.Type, ev.State, ev.File)
+
+	w.mutex.Lock()
+	listeners := make([]PrintEventListener, len(w.listeners))
+	copy(listeners, w.listeners)
+	w.mutex.Unlock()
+
+	for _, listener := range listeners {
+		listener(ev)
+	}
+}
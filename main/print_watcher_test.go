@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"octoAgent/octoprint"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyState(t *testing.T) {
+	state := func(text string, printing, paused, failed bool) octoprint.PrinterState {
+		s := octoprint.PrinterState{Text: text}
+		s.Flags.Printing, s.Flags.Paused, s.Flags.Error = printing, paused, failed
+		return s
+	}
+
+	for _, tc := range []struct {
+		state octoprint.PrinterState
+		phase printPhase
+	}{
+		{state("Operational", false, false, false), phaseIdle},
+		{state("Printing", true, false, false), phasePrinting},
+		{state("Printing from SD", false, false, false), phasePrinting},
+		{state("Sending file to SD", false, false, false), phasePrinting},
+		{state("Paused", false, true, false), phasePaused},
+		{state("Pausing", true, true, false), phasePaused},
+		{state("Cancelling", true, false, false), phasePrinting},
+		{state("Offline", false, false, false), phaseOffline},
+		{state("Closed", false, false, false), phaseOffline},
+		{state("Error: Thermal Runaway", false, false, false), phaseError},
+		{state("Offline after error", false, false, true), phaseError},
+	} {
+		assert.Equal(t, tc.phase, classifyState(tc.state), tc.state.Text)
+	}
+}
+
+// watcherStep is a poll result, completion is empty when there is no job
+type watcherStep struct {
+	phase      printPhase
+	text       string
+	completion string
+}
+
+func TestPrintWatcherTransitions(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		start  printPhase
+		steps  []watcherStep
+		events []PrintEventType
+	}{
+		{"done", phaseIdle, []watcherStep{
+			{phasePrinting, "Printing", "10"},
+			{phasePrinting, "Printing", "99.8"},
+			{phaseIdle, "Operational", ""},
+		}, []PrintEventType{PrintStarted, PrintDone}},
+		{"pause and resume", phaseIdle, []watcherStep{
+			{phasePrinting, "Printing", "10"},
+			{phasePaused, "Paused", "40"},
+			{phasePaused, "Paused", "40"},
+			{phasePrinting, "Printing", "45"},
+			{phaseIdle, "Operational", "100"},
+		}, []PrintEventType{PrintStarted, PrintPaused, PrintResumed, PrintDone}},
+		{"cancelled", phaseIdle, []watcherStep{
+			{phasePrinting, "Printing", "10"},
+			{phaseIdle, "Operational", "40"},
+		}, []PrintEventType{PrintStarted, PrintCancelled}},
+		{"cancelled near the end", phaseIdle, []watcherStep{
+			{phasePrinting, "Printing", "99"},
+			{phasePrinting, "Cancelling", "100"},
+			{phaseIdle, "Operational", "100"},
+		}, []PrintEventType{PrintStarted, PrintCancelled}},
+		{"cancelled while paused", phaseIdle, []watcherStep{
+			{phasePrinting, "Printing", "10"},
+			{phasePaused, "Paused", "20"},
+			{phaseIdle, "Operational", ""},
+		}, []PrintEventType{PrintStarted, PrintPaused, PrintCancelled}},
+		{"error while printing", phaseIdle, []watcherStep{
+			{phasePrinting, "Printing", "10"},
+			{phaseError, "Error: Thermal Runaway", ""},
+			{phaseError, "Error: Thermal Runaway", ""},
+		}, []PrintEventType{PrintStarted, PrintFailed, PrinterError}},
+		{"error while idle", phaseIdle, []watcherStep{
+			{phaseError, "Error: Printer halted", ""},
+			{phaseIdle, "Operational", ""},
+		}, []PrintEventType{PrinterError}},
+		{"disconnect while printing", phaseIdle, []watcherStep{
+			{phasePrinting, "Printing", "10"},
+			{phaseOffline, "Offline", ""},
+			{phaseIdle, "Operational", ""},
+		}, []PrintEventType{PrintStarted, PrintFailed, PrinterDisconnected}},
+		{"disconnect while paused", phaseIdle, []watcherStep{
+			{phasePrinting, "Printing", "10"},
+			{phasePaused, "Paused", "20"},
+			{phaseOffline, "Closed", ""},
+		}, []PrintEventType{PrintStarted, PrintPaused, PrintFailed, PrinterDisconnected}},
+		{"agent restarted mid print", phaseUnknown, []watcherStep{
+			{phasePrinting, "Printing", "50"},
+			{phaseIdle, "Operational", "100"},
+		}, []PrintEventType{PrintDone}},
+		{"agent restarted while idle", phaseUnknown, []watcherStep{
+			{phaseIdle, "Operational", ""},
+			{phaseIdle, "Operational", ""},
+		}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var events []PrintEvent
+			w := NewPrintWatcher(time.Second)
+			w.Subscribe(func(ev PrintEvent) { events = append(events, ev) })
+			w.phase = tc.start
+
+			for _, step := range tc.steps {
+				var job *octoprint.JobResponse
+				if step.completion != "" {
+					job = &octoprint.JobResponse{}
+					assert.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(jobWithTools, step.completion)), job))
+				}
+				w.transition(step.phase, step.text, job)
+			}
+
+			var types []PrintEventType
+			for _, ev := range events {
+				types = append(types, ev.Type)
+			}
+			assert.Equal(t, tc.events, types)
+
+			// Job events carry the job, the printer events after it do not
+			for _, ev := range events {
+				switch ev.Type {
+				case PrinterError, PrinterDisconnected:
+					assert.Empty(t, ev.File)
+				default:
+					assert.Equal(t, "cube.gcode", ev.File)
+					assert.Equal(t, "parts/cube.gcode", ev.Path)
+					assert.False(t, ev.Started.IsZero())
+					assert.Equal(t, map[string]float64{"tool0": 1200.5, "tool1": 300}, ev.FilamentTools)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintWatcherEventProgress(t *testing.T) {
+	var events []PrintEvent
+	w := NewPrintWatcher(time.Second)
+	w.Subscribe(func(ev PrintEvent) { events = append(events, ev) })
+	w.phase = phaseIdle
+
+	job := &octoprint.JobResponse{}
+	assert.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(jobWithTools, "60")), job))
+	w.transition(phasePrinting, "Printing", job)
+	w.transition(phasePaused, "Paused", job)
+	w.transition(phaseIdle, "Operational", nil)
+
+	if assert.Len(t, events, 3) {
+		cancelled := events[2]
+		assert.Equal(t, PrintCancelled, cancelled.Type)
+		assert.Equal(t, "Operational", cancelled.State)
+		assert.Equal(t, 60., cancelled.Progress)
+		assert.Equal(t, 3600., cancelled.Duration)
+		assert.Equal(t, events[0].Started, cancelled.Started)
+	}
+
+	// A new job starts from a clean state
+	w.transition(phasePrinting, "Printing", nil)
+	if assert.Len(t, events, 4) {
+		assert.Equal(t, PrintStarted, events[3].Type)
+		assert.Empty(t, events[3].File)
+		assert.False(t, events[3].Started.Before(events[0].Started))
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Progress reports:
+
+While a job runs, a status message and a webcam snapshot are posted to the
+Cwtch group PROGRESS_GROUP (a group handle, like NOTIFY_GROUPS) every
+PROGRESS_MINUTES minutes or every PROGRESS_LAYERS layers. Layers need the
+agent's G-code analysis of the job file. The schedule starts with each job
+and stops when it ends. The snapshot is delivered with the group's media
+delivery settings.
+
+progressreport [group=handle] [minutes=N | layers=N | off]
+
+*/
+
+const (
+	ReportOff     = "off"
+	ReportMinutes = "minutes"
+	ReportLayers  = "layers"
+)
+
+// progressPollInterval is how often the layer schedule looks at the status
+const progressPollInterval = 15 * time.Second
+
+// Global reporter instance, set up in main
+var progressReporter *ProgressReporter
+
+type ProgressReporter struct {
+	mutex  sync.Mutex
+	group  string
+	mode   string
+	every  int
+	stop   chan struct{}
+	file   string
+	posted int
+}
+
+func NewProgressReporter(group, minutes, layers string) (*ProgressReporter, error) {
+	pr := &ProgressReporter{group: group, mode: ReportOff}
+
+	switch {
+	case minutes != "" && layers != "":
+		return nil, errors.New("set either PROGRESS_MINUTES or PROGRESS_LAYERS")
+	case minutes != "":
+		pr.mode = ReportMinutes
+		return pr, pr.setEvery(minutes)
+	case layers != "":
+		pr.mode = ReportLayers
+		return pr, pr.setEvery(layers)
+	}
+	return pr, nil
+}
+
+func (pr *ProgressReporter) setEvery(value string) error {
+	every, err := strconv.Atoi(value)
+	if err != nil || every < 1 {
+		return fmt.Errorf("%s must be a positive number", pr.mode)
+	}
+	pr.every = every
+	return nil
+}
+
+// OnPrintEvent is the PrintWatcher listener that starts and stops the schedule
+func (pr *ProgressReporter) OnPrintEvent(ev PrintEvent) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	switch ev.Type {
+	case PrintStarted:
+		pr.file = ev.File
+		pr.start()
+	case PrintDone, PrintFailed, PrintCancelled, PrinterError, PrinterDisconnected:
+		pr.file = ""
+		pr.halt()
+	}
+}
+
+// start runs the schedule for the current job, pr.mutex is held
+func (pr *ProgressReporter) start() {
+	pr.halt()
+	if pr.mode == ReportOff || pr.group == "" || pr.file == "" {
+		return
+	}
+
+	stop := make(chan struct{})
+	pr.stop = stop
+	pr.posted = 0
+
+	interval := progressPollInterval
+	if pr.mode == ReportMinutes {
+		interval = time.Duration(pr.every) * time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				pr.tick(stop)
+			}
+		}
+	}()
+}
+
+// halt stops the schedule, pr.mutex is held
+func (pr *ProgressReporter) halt() {
+	if pr.stop != nil {
+		close(pr.stop)
+		pr.stop = nil
+	}
+}
+
+func (pr *ProgressReporter) tick(stop chan struct{}) {
+	if !isConnected {
+		return
+	}
+	status, err := _getPrintStatus()
+	if err != nil {
+		log.Printf("Error: progress report: %s", err)
+		return
+	}
+	pr.report(stop, status)
+}
+
+// report posts the status when it is due on the schedule that stop belongs to
+func (pr *ProgressReporter) report(stop chan struct{}, status *PrintStatus) {
+	pr.mutex.Lock()
+	// The job may have ended while the status was requested
+	if pr.stop != stop {
+		pr.mutex.Unlock()
+		return
+	}
+	if pr.mode == ReportLayers {
+		if status.Layer == nil || status.Layer.Layer < pr.posted+pr.every {
+			pr.mutex.Unlock()
+			return
+		}
+		pr.posted = status.Layer.Layer
+	}
+	group := pr.group
+	pr.mutex.Unlock()
+
+	pr.post(group, status)
+}
+
+// post sends the status and a snapshot to the group
+func (pr *ProgressReporter) post(group string, status *PrintStatus) {
+	conversation, err := transport.ContactInfo(group)
+	if err != nil {
+		log.Printf("Error: progress group is not a contact: %s", group)
+		return
+	}
+
+	if err := sendReply(conversation.ID, formatProgress(status)); err != nil {
+		log.Printf("Error: progress report to %s: %v", group, err)
+		return
+	}
+
+	// The group has no use for a local path, nothing is captured for it
+	pref := requesterPreference(conversation.ID)
+	if pref.Method == DeliverPath {
+		return
+	}
+	filePath, err := captureSnapshot()
+	if err != nil {
+		log.Printf("Error: progress snapshot: %s", err)
+		return
+	}
+	if _, err := deliverMediaWith(conversation.ID, filePath, pref); err != nil {
+		log.Printf("Error: progress snapshot to %s: %v", group, err)
+	}
+}
+
+func formatProgress(status *PrintStatus) string {
+	var strB strings.Builder
+	fmt.Fprintf(&strB, "%s: %s %.0f%%", bot_name, status.FileName, status.Progress)
+
+	if status.Layer != nil && status.Layer.Layer > 0 {
+		fmt.Fprintf(&strB, ", layer %d/%d", status.Layer.Layer, status.Layer.TotalLayers)
+	}
+	fmt.Fprintf(&strB, ", elapsed %s", time.Duration(status.TimeElapsed)*time.Second)
+
+	timeLeft := status.TimeLeft
+	if status.Layer != nil && status.Layer.TimeLeft > 0 {
+		timeLeft = status.Layer.TimeLeft
+	}
+	if timeLeft > 0 {
+		fmt.Fprintf(&strB, ", left %s", time.Duration(timeLeft)*time.Second)
+	}
+	fmt.Fprintf(&strB, ", tool %.0f°C, bed %.0f°C", status.ExtruderTemp, status.BedTemp)
+	return strB.String()
+}
+
+// Status describes the schedule
+func (pr *ProgressReporter) Status() string {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	if pr.mode == ReportOff || pr.group == "" {
+		return "Progress reports are off"
+	}
+	state := "waiting for a job"
+	if pr.stop != nil {
+		state = "running for " + pr.file
+	}
+	return fmt.Sprintf("Progress reports to %s every %d %s, %s", pr.group, pr.every, pr.mode, state)
+}
+
+// Command structure: progressreport [group=handle] [minutes=N | layers=N | off]
+func ProgressReport(commandList []string) string {
+	usage := "usage: progressreport [group=handle] [minutes=N | layers=N | off]"
+	if len(commandList) == 2 && commandList[1] == "-help" {
+		return usage
+	}
+	if progressReporter == nil {
+		return "Error: progress reports are not available"
+	}
+
+	pr := progressReporter
+	if len(commandList) > 1 {
+		pr.mutex.Lock()
+		group, mode, every := pr.group, pr.mode, pr.every
+		for _, arg := range commandList[1:] {
+			if arg == ReportOff {
+				mode = ReportOff
+				continue
+			}
+
+			key, value, found := strings.Cut(arg, "=")
+			if !found {
+				pr.mutex.Unlock()
+				return "Error: syntax, " + usage
+			}
+			switch key {
+			case "group":
+				if _, err := transport.ContactInfo(value); err != nil {
+					pr.mutex.Unlock()
+					return "Error: group is not a contact: " + value
+				}
+				group = value
+			case ReportMinutes, ReportLayers:
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					pr.mutex.Unlock()
+					return "Error: " + key + " must be a positive number"
+				}
+				mode, every = key, n
+			default:
+				pr.mutex.Unlock()
+				return "Error: unknown attribute " + key
+			}
+		}
+		pr.group, pr.mode, pr.every = group, mode, every
+
+		// Apply the new schedule to a running job
+		if pr.file != "" {
+			pr.start()
+		}
+		pr.mutex.Unlock()
+	}
+	return pr.Status()
+}
+
+// setProgressReporter sets up the reporter from the environment
+func setProgressReporter() error {
+	var err error
+	progressReporter, err = NewProgressReporter(os.Getenv("PROGRESS_GROUP"),
+		os.Getenv("PROGRESS_MINUTES"), os.Getenv("PROGRESS_LAYERS"))
+	return err
+}
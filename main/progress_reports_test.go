@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestProgressReporter installs a reporter to the group "printers" with
+// file cameras and snapshots in a temporary directory
+func newTestProgressReporter(t *testing.T, minutes, layers string) (*ProgressReporter, *LoopbackTransport) {
+	lt, _, _ := newTestTransport(t)
+	lt.AddContact("printers", PeerOnline)
+	setTestCameras(t)
+	newTestMediaPreferences(t)
+
+	previousDir := snapshot_dir
+	snapshot_dir = t.TempDir()
+	pr, err := NewProgressReporter("printers", minutes, layers)
+	assert.NoError(t, err)
+
+	previous := progressReporter
+	t.Cleanup(func() {
+		pr.OnPrintEvent(PrintEvent{Type: PrintDone})
+		progressReporter, snapshot_dir = previous, previousDir
+	})
+	progressReporter = pr
+	return pr, lt
+}
+
+// currentStop returns the stop channel of the running schedule
+func (pr *ProgressReporter) currentStop() chan struct{} {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	return pr.stop
+}
+
+func layerStatus(layer int) *PrintStatus {
+	return &PrintStatus{FileName: "cube.gcode", Progress: 40, Layer: &LayerProgress{Layer: layer, TotalLayers: 50}}
+}
+
+func TestProgressReportLayers(t *testing.T) {
+	pr, lt := newTestProgressReporter(t, "", "5")
+	assert.Equal(t, ReportLayers, pr.mode)
+
+	pr.OnPrintEvent(PrintEvent{Type: PrintStarted, File: "cube.gcode"})
+	stop := pr.currentStop()
+	assert.NotNil(t, stop)
+
+	// Every 5 layers, a skipped layer counts from the one posted
+	for _, layer := range []int{1, 4, 5, 6, 9, 11, 15, 16} {
+		pr.report(stop, layerStatus(layer))
+	}
+	assert.Equal(t, 16, pr.posted)
+	sent := lt.Sent()
+	if assert.Len(t, sent, 3) {
+		assert.Contains(t, Unwrap(sent[0].ConversationID, sent[0].Message).Data, "layer 5/50")
+		assert.Contains(t, Unwrap(sent[1].ConversationID, sent[1].Message).Data, "layer 11/50")
+	}
+	assert.Len(t, lt.SentFiles(), 3)
+
+	// Without layer information there is nothing to count
+	pr.report(stop, &PrintStatus{FileName: "cube.gcode"})
+	assert.Len(t, lt.Sent(), 3)
+}
+
+func TestProgressReportMinutes(t *testing.T) {
+	pr, lt := newTestProgressReporter(t, "10", "")
+	assert.Equal(t, ReportMinutes, pr.mode)
+
+	pr.OnPrintEvent(PrintEvent{Type: PrintStarted, File: "cube.gcode"})
+	stop := pr.currentStop()
+	pr.report(stop, &PrintStatus{FileName: "cube.gcode"})
+	pr.report(stop, &PrintStatus{FileName: "cube.gcode"})
+	assert.Len(t, lt.Sent(), 2)
+	assert.Len(t, lt.SentFiles(), 2)
+
+	// A group that wants paths gets no snapshot, none is captured for it
+	assert.NoError(t, mediaPreferences.Set("printers", MediaPreference{Method: DeliverPath}))
+	snapshot_dir = t.TempDir()
+	pr.report(stop, &PrintStatus{FileName: "cube.gcode"})
+	assert.Len(t, lt.Sent(), 3)
+	assert.Len(t, lt.SentFiles(), 2)
+	entries, err := os.ReadDir(snapshot_dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestProgressReportStopsWithJob(t *testing.T) {
+	pr, lt := newTestProgressReporter(t, "10", "")
+	assert.Equal(t, "Progress reports to printers every 10 minutes, waiting for a job", pr.Status())
+
+	pr.OnPrintEvent(PrintEvent{Type: PrintStarted, File: "cube.gcode"})
+	stop := pr.currentStop()
+	assert.Equal(t, "Progress reports to printers every 10 minutes, running for cube.gcode", pr.Status())
+
+	for _, eventType := range []PrintEventType{PrintDone, PrintFailed, PrintCancelled, PrinterError, PrinterDisconnected} {
+		pr.OnPrintEvent(PrintEvent{Type: PrintStarted, File: "cube.gcode"})
+		pr.OnPrintEvent(PrintEvent{Type: eventType})
+		assert.Nil(t, pr.currentStop(), eventType)
+	}
+	_, open := <-stop
+	assert.False(t, open)
+
+	// A status requested before the job ended is not posted
+	pr.report(stop, &PrintStatus{FileName: "cube.gcode"})
+	assert.Empty(t, lt.Sent())
+	assert.Equal(t, "Progress reports to printers every 10 minutes, waiting for a job", pr.Status())
+
+	// Pausing keeps the schedule
+	pr.OnPrintEvent(PrintEvent{Type: PrintStarted, File: "cube.gcode"})
+	pr.OnPrintEvent(PrintEvent{Type: PrintPaused})
+	assert.NotNil(t, pr.currentStop())
+
+	// Nothing runs without a group or schedule
+	off, err := NewProgressReporter("", "10", "")
+	assert.NoError(t, err)
+	off.OnPrintEvent(PrintEvent{Type: PrintStarted, File: "cube.gcode"})
+	assert.Nil(t, off.stop)
+	assert.Equal(t, "Progress reports are off", off.Status())
+}
+
+func TestProgressReportCommand(t *testing.T) {
+	pr, lt := newTestProgressReporter(t, "", "")
+	lt.AddContact("workshop", PeerOnline)
+	assert.Equal(t, "Progress reports are off", ProgressReport([]string{"progressreport"}))
+
+	assert.Equal(t, "Progress reports to workshop every 3 layers, waiting for a job",
+		ProgressReport([]string{"progressreport", "group=workshop", "layers=3"}))
+	assert.Equal(t, "Progress reports to workshop every 15 minutes, waiting for a job",
+		ProgressReport([]string{"progressreport", "minutes=15"}))
+
+	// A new schedule applies to the running job
+	pr.OnPrintEvent(PrintEvent{Type: PrintStarted, File: "cube.gcode"})
+	stop := pr.currentStop()
+	assert.Equal(t, "Progress reports to workshop every 2 layers, running for cube.gcode",
+		ProgressReport([]string{"progressreport", "layers=2"}))
+	assert.NotEqual(t, stop, pr.currentStop())
+	assert.Equal(t, "Progress reports are off", ProgressReport([]string{"progressreport", "off"}))
+	assert.Nil(t, pr.currentStop())
+
+	// Errors leave the settings as they were
+	for _, args := range []string{"group=nobody", "minutes=0", "layers=x", "hours=1", "daily", "group=printers minutes=-5"} {
+		output := ProgressReport(append([]string{"progressreport"}, strings.Fields(args)...))
+		assert.True(t, strings.HasPrefix(output, "Error: "), "%s: %s", args, output)
+	}
+	assert.Equal(t, "workshop", pr.group)
+	assert.Equal(t, 2, pr.every)
+
+	_, err := NewProgressReporter("printers", "10", "5")
+	assert.Error(t, err)
+	_, err = NewProgressReporter("printers", "", "0")
+	assert.EqualError(t, err, "layers must be a positive number")
+}
@@ -1,36 +1,402 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"octoAgent/octoprint"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
-
-	"cwtch.im/cwtch/model"
-	"cwtch.im/cwtch/protocol/connections"
 )
 
 /*
 
 Publish:
 
-This function publishes temp information derived from _getTempEntry
-every "increment" seconds until math.Round(status.Progress) is equal to 100 to peerID, where
-peerId can represent a peer or a group formed by a communityAgent. The adminID
-represents the admin or conductorAgent that is organizing/requesting the process.
+Subscriptions stream printer data to peerID every "interval" seconds, where
+peerId can represent a peer or a group formed by a communityAgent. The
+requester is the admin or conductorAgent that is organizing/requesting the
+process, it is notified when the subscription ends.
+
+Streams:
+temperature -> addtemprecord [{"Tool":..,"Time":..,"Actual":..,"Target":..}]  (_getTempEntry)
+progress    -> addprogressrecord {"file_name":..,"progress":..,"time_elapsed":..,"time_left":..}
+position    -> addpositionrecord {"X":..,"Y":..,"Z":..,"E":..}
+state       -> addstaterecord {"time":..,"state":..}, only sent when the printer state changes
+
+Stop conditions:
+jobend        stop when the print job completes or the printer is no longer printing
+duration=N    stop after N seconds
+count=N       stop after N ticks
 
-Note: if peerID = adminID then _getTempEntry data will be sent to the adminID
+Subscriptions are stored in SUBSCRIPTIONS_FILE (default subscriptions.json)
+and restarted when the agent starts.
 
-getTempEntry provides the following information:
-Tool:   tool,
-Time:   time.Now().Format("2006-01-02 15:04:05.999999999 -0700 MST"),
-Actual: state.Actual,
-Target: state.Target,
+publish increment peerId is kept as a shorthand for
+subscribe peerId increment temperature jobend
 
 */
 
+const (
+	StreamTemperature = "temperature"
+	StreamProgress    = "progress"
+	StreamPosition    = "position"
+	StreamState       = "state"
+
+	StopJobEnd   = "jobend"
+	StopDuration = "duration"
+	StopCount    = "count"
+)
+
+var validStreams = []string{StreamTemperature, StreamProgress, StreamPosition, StreamState}
+
+// Global subscription manager, set up in main
+var subscriptions *SubscriptionManager
+
+type Subscription struct {
+	ID        string    `json:"id"`
+	Peer      string    `json:"peer"`
+	Requester int       `json:"requester"`
+	Interval  int       `json:"interval"`
+	Streams   []string  `json:"streams"`
+	StopOn    string    `json:"stop_on"`
+	Limit     int       `json:"limit,omitempty"`
+	Created   time.Time `json:"created"`
+	Ticks     int       `json:"ticks"`
+
+	stop      chan struct{}
+	lastState string
+}
+
+type StateRecord struct {
+	Time  string `json:"time"`
+	State string `json:"state"`
+}
+
+type SubscriptionManager struct {
+	mutex sync.Mutex
+	subs  map[string]*Subscription
+	file  string
+
+	// saveMutex orders the writes of the run goroutines and the commands
+	saveMutex sync.Mutex
+}
+
+func NewSubscriptionManager(file string) *SubscriptionManager {
+	return &SubscriptionManager{
+		subs: make(map[string]*Subscription),
+		file: file,
+	}
+}
+
+// Restore loads persisted subscriptions and restarts them
+func (m *SubscriptionManager) Restore() error {
+	data, err := os.ReadFile(m.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var stored []*Subscription
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	for _, sub := range stored {
+		m.start(sub)
+		log.Printf("Restored subscription %s to %s", sub.ID, sub.Peer)
+	}
+	return nil
+}
+
+// Create validates and starts a new subscription
+func (m *SubscriptionManager) Create(sub *Subscription) (string, error) {
+	if sub.Interval < 1 {
+		return "", errors.New("interval must be at least 1 second")
+	}
+
+	for _, stream := range sub.Streams {
+		if !inList(stream, validStreams) {
+			return "", fmt.Errorf("unknown stream %q, use %s", stream, strings.Join(validStreams, ","))
+		}
+	}
+
+	if _, err := transport.ContactInfo(sub.Peer); err != nil {
+		return "", errors.New("peer is not a contact: " + sub.Peer)
+	}
+
+	if transport.PeerState(sub.Peer) == PeerOffline {
+		return "", errors.New("peer is not online")
+	}
+
+	id, err := newSubscriptionID()
+	if err != nil {
+		return "", err
+	}
+	sub.ID = id
+	sub.Created = time.Now()
+
+	m.start(sub)
+	m.save()
+	return sub.ID, nil
+}
+
+// Cancel stops a subscription and removes it
+func (m *SubscriptionManager) Cancel(id string) error {
+	m.mutex.Lock()
+	sub, exists := m.subs[id]
+	if exists {
+		delete(m.subs, id)
+		close(sub.stop)
+	}
+	m.mutex.Unlock()
+
+	if !exists {
+		return errors.New("subscription not found: " + id)
+	}
+
+	m.save()
+	return nil
+}
+
+// List returns a snapshot of all active subscriptions, oldest first
+func (m *SubscriptionManager) List() []Subscription {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	list := make([]Subscription, 0, len(m.subs))
+	for _, sub := range m.subs {
+		list = append(list, Subscription{
+			ID:        sub.ID,
+			Peer:      sub.Peer,
+			Requester: sub.Requester,
+			Interval:  sub.Interval,
+			Streams:   sub.Streams,
+			StopOn:    sub.StopOn,
+			Limit:     sub.Limit,
+			Created:   sub.Created,
+			Ticks:     sub.Ticks,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// start adds a subscription and runs it, its stop channel exists before
+// Cancel can find it
+func (m *SubscriptionManager) start(sub *Subscription) {
+	m.mutex.Lock()
+	sub.stop = make(chan struct{})
+	m.subs[sub.ID] = sub
+	m.mutex.Unlock()
+
+	go m.run(sub)
+}
+
+// run publishes the selected streams every interval until a stop condition is met
+func (m *SubscriptionManager) run(sub *Subscription) {
+	ticker := time.NewTicker(time.Duration(sub.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sub.stop:
+			log.Printf("Subscription %s was cancelled", sub.ID)
+			return
+
+		case <-ticker.C:
+			m.publish(sub)
+
+			m.mutex.Lock()
+			sub.Ticks++
+			ticks := sub.Ticks
+			m.mutex.Unlock()
+
+			if reason, done := m.done(sub, ticks); done {
+				m.finish(sub, reason)
+				return
+			}
+			m.save()
+		}
+	}
+}
+
+func (m *SubscriptionManager) publish(sub *Subscription) {
+	conversation, err := transport.ContactInfo(sub.Peer)
+	if err != nil {
+		log.Printf("Error: subscription %s, peer is not a contact: %s", sub.ID, sub.Peer)
+		return
+	}
+
+	for _, stream := range sub.Streams {
+		var msg string
+
+		switch stream {
+		case StreamTemperature:
+			msg = _getTempEntry()
+
+		case StreamProgress:
+			status := GetJobStatus()
+			if isErrorResult(status) {
+				msg = status
+			} else {
+				msg = "addprogressrecord " + status
+			}
+
+		case StreamPosition:
+			data, _ := json.Marshal(positionTracker.GetPosition())
+			msg = "addpositionrecord " + string(data)
+
+		case StreamState:
+			state, err := _getPrinterStateText()
+			if err != nil || state == sub.lastState {
+				continue
+			}
+			sub.lastState = state
+			data, _ := json.Marshal(StateRecord{Time: time.Now().Format(time.RFC3339), State: state})
+			msg = "addstaterecord " + string(data)
+		}
+
+		if err := sendReply(conversation.ID, msg); err != nil {
+			log.Printf("Error: subscription %s, sending %s to %d: %v", sub.ID, stream, conversation.ID, err)
+		}
+	}
+}
+
+// done evaluates the stop condition of a subscription after the given number
+// of ticks
+func (m *SubscriptionManager) done(sub *Subscription, ticks int) (string, bool) {
+	switch sub.StopOn {
+	case StopDuration:
+		if time.Since(sub.Created) >= time.Duration(sub.Limit)*time.Second {
+			return "duration reached", true
+		}
+
+	case StopCount:
+		if ticks >= sub.Limit {
+			return "count reached", true
+		}
+
+	default:
+		if !isConnected {
+			return "", false
+		}
+
+		octoReq := octoprint.JobRequest{}
+		job, err := octoReq.Do(octoclient)
+		if err != nil {
+			log.Printf("Error: subscription %s, job state: %v", sub.ID, err)
+			return "", false
+		}
+
+		// Log progress
+		log.Printf("Job Progress: %.1f, TimeLeft: %.1f", job.Progress.Completion, job.Progress.PrintTimeLeft)
+
+		if math.Round(job.Progress.Completion) >= 100 {
+			return "print job is complete", true
+		}
+
+		state, err := _getPrinterStateText()
+		if err == nil && !octoprint.ConnectionState(state).IsPrinting() {
+			return "printer is not printing", true
+		}
+	}
+	return "", false
+}
+
+func (m *SubscriptionManager) finish(sub *Subscription, reason string) {
+	m.mutex.Lock()
+	delete(m.subs, sub.ID)
+	m.mutex.Unlock()
+	m.save()
+
+	log.Printf("Subscription %s completed: %s", sub.ID, reason)
+
+	// Send message to originator of subscription request
+	msg := fmt.Sprintf("Publishing completed, subscription %s: %s", sub.ID, reason)
+	if err := sendReply(sub.Requester, msg); err != nil {
+		log.Printf("Error sending completion message to admin %d: %v", sub.Requester, err)
+	} else {
+		log.Printf("Sent completion message to admin %d", sub.Requester)
+	}
+}
+
+// save writes the active subscriptions to disk, through a temporary file so
+// a crash does not leave a partial file
+func (m *SubscriptionManager) save() {
+	m.saveMutex.Lock()
+	defer m.saveMutex.Unlock()
+
+	// Listed under saveMutex, so a later snapshot is never overwritten by an
+	// earlier one
+	list := m.List()
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		log.Printf("Error: encoding subscriptions: %v", err)
+		return
+	}
+
+	tmp := m.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Error: saving subscriptions to %s: %v", m.file, err)
+		return
+	}
+	if err := os.Rename(tmp, m.file); err != nil {
+		log.Printf("Error: saving subscriptions to %s: %v", m.file, err)
+	}
+}
+
+func newSubscriptionID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// _getPrinterStateText returns OctoPrint's current state text, e.g. "Printing"
+func _getPrinterStateText() (string, error) {
+	if !isConnected {
+		return "", errors.New("not connected")
+	}
+
+	stateReq := octoprint.StateRequest{Exclude: []string{"temperature", "sd"}}
+	state, err := stateReq.Do(octoclient)
+	if err != nil {
+		return "", err
+	}
+	return state.State.Text, nil
+}
+
+// parseStopCondition parses jobend, duration=N or count=N
+func parseStopCondition(value string) (string, int, error) {
+	if value == StopJobEnd {
+		return StopJobEnd, 0, nil
+	}
+
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || (parts[0] != StopDuration && parts[0] != StopCount) {
+		return "", 0, errors.New("stop condition must be jobend, duration=N or count=N")
+	}
+
+	limit, err := strconv.Atoi(parts[1])
+	if err != nil || limit < 1 {
+		return "", 0, errors.New("stop condition limit must be a positive number")
+	}
+	return parts[0], limit, nil
+}
+
 func Publish(commandList []string, adminID int) string {
 	switch len(commandList) {
 	case 2:
@@ -47,78 +413,108 @@ func Publish(commandList []string, adminID int) string {
 			return "Error: increment conversion failed "
 		}
 
-		// Get conversation information with destination
-		conversation, err := cwtchbot.Peer.FetchConversationInfo(commandList[2])
+		id, err := subscriptions.Create(&Subscription{
+			Peer:      commandList[2],
+			Requester: adminID,
+			Interval:  increment,
+			Streams:   []string{StreamTemperature},
+			StopOn:    StopJobEnd,
+		})
 		if err != nil {
-			return "Error: peer is not a contact: " + commandList[2]
+			return "Error: " + err.Error()
 		}
+		return "Publishing has started, subscription " + id
 
-		// Check peer online
-		connectionState := cwtchbot.Peer.GetPeerState(commandList[2])
-		if connectionState == connections.DISCONNECTED {
-			return "Error: peer is not online"
-		}
+	default:
+		return "Error: parameter mismatch"
+
+	}
+}
 
-		// Set tick interval
-		tickInterval := time.Duration(increment) * time.Second
+// Command structure: subscribe peerId interval streams [stop]
+func Subscribe(commandList []string, adminID int) string {
+	switch len(commandList) {
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: subscribe peerId interval temperature,progress,position,state [jobend|duration=N|count=N]"
+		} else {
+			return "Error: syntax, second attribute not recognized"
+		}
 
-		// Create a ticker that ticks every tickInterval
-		ticker := time.NewTicker(tickInterval)
+	case 4, 5:
+		interval, err := strconv.Atoi(commandList[2])
+		if err != nil {
+			return "Error: interval conversion failed"
+		}
 
-		// Define the function to be executed on each tick
-		tickerFunc := func() {
-			result := _getTempEntry()
-			msg := string(cwtchbot.PackMessage(model.OverlayChat, result))
-			if _, err := cwtchbot.Peer.SendMessage(conversation.ID, msg); err != nil {
-				log.Printf("Error sending completion message to admin %d: %v", conversation.ID, err)
-			} else {
-				log.Printf("Sent completion message to admin %d", conversation.ID)
+		stopOn, limit := StopJobEnd, 0
+		if len(commandList) == 5 {
+			stopOn, limit, err = parseStopCondition(commandList[4])
+			if err != nil {
+				return "Error: " + err.Error()
 			}
 		}
 
-		// Start a goroutine to execute the function on each tick
-		go func() {
-			for range ticker.C {
-				// Execute the function on each tick
-				tickerFunc()
-
-				// Get the Job Status to evaluate using it instead of duration for termination
-				statusRsp := GetJobStatus()
-				var status JobStatus
-				err := json.Unmarshal([]byte(statusRsp), &status)
-				if err != nil {
-					fmt.Printf("Error: failed to encode job state: %v", err.Error())
-					continue
-				}
-
-				// Log progress
-				log.Printf("Job Progress: %.1f, TimeLeft: %.1f", status.Progress, status.TimeLeft)
-
-				// Are we done?
-				if math.Round(status.Progress) >= 100 {
-					// Stop the ticker after duration seconds
-					ticker.Stop()
-
-					// Print log message
-					fmt.Println("Print job is complete...")
-
-					// Create completion message
-					msg := string(cwtchbot.PackMessage(model.OverlayChat, "Publishing completed"))
-
-					// Send message to originator of subscription request
-					if _, err := cwtchbot.Peer.SendMessage(adminID, msg); err != nil {
-						log.Printf("Error sending completion message to admin %d: %v", adminID, err)
-					} else {
-						log.Printf("Sent completion message to admin %d", adminID)
-					}
-					break
-				}
-			}
-		}()
-		return "Publishing has started"
+		id, err := subscriptions.Create(&Subscription{
+			Peer:      commandList[1],
+			Requester: adminID,
+			Interval:  interval,
+			Streams:   strings.Split(strings.ToLower(commandList[3]), ","),
+			StopOn:    stopOn,
+			Limit:     limit,
+		})
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		return "Subscription was created: " + id
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
+
+func GetSubscriptions(commandList []string) string {
+	switch len(commandList) {
+	case 1:
+		list := subscriptions.List()
+		if len(list) == 0 {
+			return "The list was empty"
+		}
+
+		jsonBytes, err := json.Marshal(list)
+		if err != nil {
+			return "Error: encoding of list"
+		}
+		return string(jsonBytes)
+
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: subscriptions"
+		} else {
+			return "Error: parameter mismatch"
+		}
 
 	default:
 		return "Error: parameter mismatch"
+	}
+}
 
+func Unsubscribe(commandList []string) string {
+	switch len(commandList) {
+	case 1:
+		return "Error: missing subscriptionID"
+
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: unsubscribe subscriptionID"
+		}
+
+		if err := subscriptions.Cancel(commandList[1]); err != nil {
+			return "Error: " + err.Error()
+		}
+		return "Subscription was cancelled"
+
+	default:
+		return "Error: parameter mismatch"
 	}
 }
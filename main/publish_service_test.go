@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionCreateCancel(t *testing.T) {
+	newTestTransport(t)
+	file := filepath.Join(t.TempDir(), "subscriptions.json")
+	m := NewSubscriptionManager(file)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := m.Create(&Subscription{Peer: "admin", Interval: 60, Streams: []string{StreamState}, StopOn: StopJobEnd})
+			assert.NoError(t, err)
+			assert.NoError(t, m.Cancel(id))
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, m.List())
+
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.JSONEq(t, "[]", string(data))
+	_, err = os.Stat(file + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Error(t, m.Cancel("missing"))
+}
+
+func TestSubscriptionRestore(t *testing.T) {
+	newTestTransport(t)
+	file := filepath.Join(t.TempDir(), "subscriptions.json")
+
+	m := NewSubscriptionManager(file)
+	id, err := m.Create(&Subscription{Peer: "admin", Interval: 60, Streams: []string{StreamTemperature}, StopOn: StopCount, Limit: 5})
+	assert.NoError(t, err)
+
+	restored := NewSubscriptionManager(file)
+	assert.NoError(t, restored.Restore())
+	list := restored.List()
+	assert.Equal(t, 1, len(list))
+	assert.Equal(t, id, list[0].ID)
+	assert.Equal(t, StopCount, list[0].StopOn)
+	assert.Equal(t, 5, list[0].Limit)
+
+	assert.NoError(t, restored.Cancel(id))
+	assert.NoError(t, m.Cancel(id))
+}
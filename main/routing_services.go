@@ -1,10 +1,5 @@
 package main
 
-import (
-	"cwtch.im/cwtch/model"
-	"cwtch.im/cwtch/protocol/connections"
-)
-
 // Command structure: route msg ntkID
 func Route(commandList []string) string {
 	switch len(commandList) {
@@ -17,22 +12,21 @@ func Route(commandList []string) string {
 
 	case 3:
 		// Get conversation information with destination
-		conversation, _ := cwtchbot.Peer.FetchConversationInfo(commandList[1])
-
-		// Get connection state of the NtKID
-		connectionState := cwtchbot.Peer.GetPeerState(commandList[1])
+		conversation, err := transport.ContactInfo(commandList[1])
+		if err != nil {
+			return "Error: peer is not a contact: " + commandList[1]
+		}
 
 		// Ensure destination is online
-		if connectionState == connections.DISCONNECTED {
+		if transport.PeerState(commandList[1]) == PeerOffline {
 			return "Error: peer is not online"
 		}
 
 		// Create message to be routed
 		message := commandList[2]
-		msg := string(cwtchbot.PackMessage(model.OverlayChat, message))
 
 		// Send message to destination
-		_, err := cwtchbot.Peer.SendMessage(conversation.ID, msg)
+		err = sendReply(conversation.ID, message)
 		if err != nil {
 			return "Error: message was not routed"
 		} else {
@@ -41,22 +35,21 @@ func Route(commandList []string) string {
 
 	case 4:
 		// Get conversation information with destination
-		conversation, _ := cwtchbot.Peer.FetchConversationInfo(commandList[1])
-
-		// Get connection state of the NtKID
-		connectionState := cwtchbot.Peer.GetPeerState(commandList[1])
+		conversation, err := transport.ContactInfo(commandList[1])
+		if err != nil {
+			return "Error: peer is not a contact: " + commandList[1]
+		}
 
 		// Ensure destination is online
-		if connectionState == connections.DISCONNECTED {
+		if transport.PeerState(commandList[1]) == PeerOffline {
 			return "Error: peer is not online"
 		}
 
 		// Create message to be routed
 		message := commandList[2] + " " + commandList[3]
-		msg := string(cwtchbot.PackMessage(model.OverlayChat, message))
 
 		// Send message to destination
-		_, err := cwtchbot.Peer.SendMessage(conversation.ID, msg)
+		err = sendReply(conversation.ID, message)
 		if err != nil {
 			return "Error: message was not routed"
 		} else {
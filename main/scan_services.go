@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"octoAgent/gcode"
+	"octoAgent/octoprint"
+	"os"
+	"strings"
+)
+
+/*
+
+G-code safety scan:
+
+Files downloaded with downloadfile are scanned before they can be printed,
+rejected files are deleted again and the findings are returned to the
+uploader. The pre-flight safety check runs the same scan.
+
+The policy rejects EEPROM writes, factory resets, firmware updates, cold
+extrusion, disabled endstops, temperatures over the limits and moves outside
+the build volume of the printer profile, and warns about configuration
+changes. It can be changed per OctoPrint printer profile in SCAN_POLICIES
+(default scan_policies.json), with "_default" as fallback:
+
+{"_default": {"max_tool_temp": 300, "volume_margin": 5, "commands": {"M500": "allow", "M117": "warn"}}}
+
+Actions are allow, warn and reject.
+
+*/
+
+var scanPolicies = map[string]gcode.Policy{}
+
+// loadScanPolicies reads the policies, missing settings keep their default
+func loadScanPolicies(file string) error {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var policies map[string]json.RawMessage
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	for key, raw := range policies {
+		policy := gcode.DefaultPolicy()
+		if err := json.Unmarshal(raw, &policy); err != nil {
+			return fmt.Errorf("%s: policy %s: %v", file, key, err)
+		}
+		scanPolicies[key] = policy
+	}
+	return nil
+}
+
+// scanPolicy returns the policy for the printer profile in use
+func scanPolicy() gcode.Policy {
+	profile := activePrinterProfile()
+
+	policy, exists := gcode.Policy{}, false
+	if profile != nil {
+		policy, exists = scanPolicies[profile.ID]
+	}
+	if !exists {
+		policy, exists = scanPolicies[defaultProfileKey]
+	}
+	if !exists {
+		policy = gcode.DefaultPolicy()
+	}
+
+	if profile != nil {
+		policy.Volume = buildVolume(profile)
+	}
+	return policy
+}
+
+// buildVolume returns the printable box of a printer profile
+func buildVolume(profile *octoprint.PrinterProfile) *gcode.Box {
+	v := profile.Volume
+	if v.Width <= 0 || v.Depth <= 0 || v.Height <= 0 {
+		return nil
+	}
+
+	if v.Origin == "center" || v.FormFactor == "circular" {
+		return &gcode.Box{MinX: -v.Width / 2, MaxX: v.Width / 2, MinY: -v.Depth / 2, MaxY: v.Depth / 2, MaxZ: v.Height}
+	}
+	return &gcode.Box{MaxX: v.Width, MaxY: v.Depth, MaxZ: v.Height}
+}
+
+// scanFile scans a local G-code file with the current policy
+func scanFile(filePath string) (*gcode.ScanReport, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return scanPolicy().Scan(f)
+}
+
+func formatScanReport(report *gcode.ScanReport) string {
+	var strB strings.Builder
+	for _, finding := range report.Findings {
+		fmt.Fprintf(&strB, "- line %d %s: %s (%s)\n", finding.Line, finding.Command, finding.Reason, finding.Action)
+	}
+	if report.Suppressed > 0 {
+		fmt.Fprintf(&strB, "- %d more findings\n", report.Suppressed)
+	}
+	return strB.String()
+}
+
+// isGcodeFile reports whether a file is scanned, models are not
+func isGcodeFile(fileName string) bool {
+	name := strings.ToLower(fileName)
+	return strings.HasSuffix(name, ".gcode") || strings.HasSuffix(name, ".gco") || strings.HasSuffix(name, ".g")
+}
+
+func ScanOctoFile(commandList []string) string {
+	switch len(commandList) {
+	case 2:
+		if commandList[1] == "-help" {
+			return "usage: scanfile filename.ext"
+		}
+
+		filePath, err := octoUploadPath(commandList[1])
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+
+		report, err := scanFile(filePath)
+		if err != nil {
+			return "Error: scanning file: " + err.Error()
+		}
+
+		jsonBytes, err := json.Marshal(report)
+		if err != nil {
+			return "Error: failed to encode report: " + err.Error()
+		}
+		return string(jsonBytes)
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"octoAgent/octoprint"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Temperature history:
+
+Per-tool temperatures are sampled every TEMP_HISTORY_INTERVAL seconds
+(default 10) and appended to TEMP_HISTORY_FILE (default temphistory.jsonl),
+one JSON sample per line. Samples older than TEMP_HISTORY_RETENTION hours
+(default 72) are dropped when the file is compacted. On start the gap since
+the last stored sample is filled from OctoPrint's own temperature history.
+
+temphistory [tool=bed] [since=2h | from=RFC3339 to=RFC3339] [points=100] [format=json|csv] [export]
+
+Readings are averaged into at most points buckets, each bucket keeps the
+min and max so that short swings remain visible. export writes the result
+into the uploads directory instead of returning it, ready for uploadfile.
+
+*/
+
+// TempSample is one reading of all tools
+type TempSample struct {
+	Time  time.Time                     `json:"time"`
+	Tools map[string]TempHistoryReading `json:"tools"`
+}
+
+type TempHistoryReading struct {
+	Actual float64 `json:"actual"`
+	Target float64 `json:"target"`
+}
+
+// TempHistoryPoint is a downsampled reading of a single tool
+type TempHistoryPoint struct {
+	Time    time.Time `json:"time"`
+	Tool    string    `json:"tool"`
+	Actual  float64   `json:"actual"`
+	Min     float64   `json:"min"`
+	Max     float64   `json:"max"`
+	Target  float64   `json:"target"`
+	Samples int       `json:"samples"`
+}
+
+// Global history instance, set up in main
+var tempHistory *TempHistory
+
+type TempHistory struct {
+	mutex     sync.Mutex
+	file      string
+	retention time.Duration
+	samples   []TempSample
+}
+
+func NewTempHistory(file string, retention time.Duration) (*TempHistory, error) {
+	h := &TempHistory{file: file, retention: retention}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load reads the stored samples and compacts the file
+func (h *TempHistory) load() error {
+	f, err := os.Open(h.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cutoff := time.Now().Add(-h.retention)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var sample TempSample
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			// A partial line from an unclean shutdown
+			continue
+		}
+		if sample.Time.After(cutoff) {
+			h.samples = append(h.samples, sample)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return h.compact()
+}
+
+// compact drops expired samples and rewrites the file
+func (h *TempHistory) compact() error {
+	cutoff := time.Now().Add(-h.retention)
+	i := sort.Search(len(h.samples), func(i int) bool { return h.samples[i].Time.After(cutoff) })
+	h.samples = h.samples[i:]
+
+	var buf bytes.Buffer
+	for _, sample := range h.samples {
+		line, _ := json.Marshal(sample)
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	tmp := h.file + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.file)
+}
+
+// Record appends a sample in memory and to the file
+func (h *TempHistory) Record(sample TempSample) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// Samples must stay in time order for the range queries
+	if n := len(h.samples); n > 0 && !sample.Time.After(h.samples[n-1].Time) {
+		return nil
+	}
+	h.samples = append(h.samples, sample)
+
+	f, err := os.OpenFile(h.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line, _ := json.Marshal(sample)
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Start samples the printer every interval and compacts the store hourly
+func (h *TempHistory) Start(interval time.Duration) {
+	go func() {
+		h.backfill()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		lastCompact := time.Now()
+
+		for now := range ticker.C {
+			if isConnected {
+				h.sample(now)
+			}
+
+			if now.Sub(lastCompact) > time.Hour {
+				h.mutex.Lock()
+				if err := h.compact(); err != nil {
+					log.Printf("Error: compacting temperature history: %v", err)
+				}
+				h.mutex.Unlock()
+				lastCompact = now
+			}
+		}
+	}()
+}
+
+func (h *TempHistory) sample(now time.Time) {
+	stateReq := octoprint.StateRequest{Exclude: []string{"sd", "state"}}
+	state, err := stateReq.Do(octoclient)
+	if err != nil {
+		return
+	}
+
+	sample := TempSample{Time: now, Tools: make(map[string]TempHistoryReading)}
+	for tool, data := range state.Temperature.Current {
+		sample.Tools[tool] = TempHistoryReading{Actual: data.Actual, Target: data.Target}
+	}
+	if err := h.Record(sample); err != nil {
+		log.Printf("Error: recording temperature history: %v", err)
+	}
+}
+
+// backfill fills the gap since the last stored sample from OctoPrint's history
+func (h *TempHistory) backfill() {
+	if !isConnected {
+		return
+	}
+
+	stateReq := octoprint.StateRequest{History: true, Limit: 300, Exclude: []string{"sd", "state"}}
+	state, err := stateReq.Do(octoclient)
+	if err != nil {
+		return
+	}
+
+	for _, historic := range state.Temperature.History {
+		sample := TempSample{Time: historic.Time.Time, Tools: make(map[string]TempHistoryReading)}
+		for tool, data := range historic.Tools {
+			sample.Tools[tool] = TempHistoryReading{Actual: data.Actual, Target: data.Target}
+		}
+		if err := h.Record(sample); err != nil {
+			log.Printf("Error: recording temperature history: %v", err)
+			return
+		}
+	}
+}
+
+// Query returns the readings of tool (all tools if empty) between from and to,
+// averaged into at most points buckets per tool
+func (h *TempHistory) Query(tool string, from, to time.Time, points int) []TempHistoryPoint {
+	h.mutex.Lock()
+	start := sort.Search(len(h.samples), func(i int) bool { return !h.samples[i].Time.Before(from) })
+	end := sort.Search(len(h.samples), func(i int) bool { return h.samples[i].Time.After(to) })
+	samples := h.samples[start:end]
+	h.mutex.Unlock()
+
+	if points < 1 {
+		points = 1
+	}
+	step := to.Sub(from) / time.Duration(points)
+	if step <= 0 {
+		step = time.Second
+	}
+
+	type bucketKey struct {
+		tool  string
+		index int64
+	}
+	buckets := make(map[bucketKey]*TempHistoryPoint)
+	var keys []bucketKey
+
+	for _, sample := range samples {
+		index := int64(sample.Time.Sub(from) / step)
+		for name, reading := range sample.Tools {
+			if tool != "" && name != tool {
+				continue
+			}
+
+			key := bucketKey{name, index}
+			point, exists := buckets[key]
+			if !exists {
+				point = &TempHistoryPoint{
+					Time: from.Add(time.Duration(index) * step),
+					Tool: name,
+					Min:  math.Inf(1),
+					Max:  math.Inf(-1),
+				}
+				buckets[key] = point
+				keys = append(keys, key)
+			}
+
+			// Running mean keeps the bucket in a single pass
+			point.Samples++
+			point.Actual += (reading.Actual - point.Actual) / float64(point.Samples)
+			point.Target += (reading.Target - point.Target) / float64(point.Samples)
+			point.Min = math.Min(point.Min, reading.Actual)
+			point.Max = math.Max(point.Max, reading.Actual)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].tool != keys[j].tool {
+			return keys[i].tool < keys[j].tool
+		}
+		return keys[i].index < keys[j].index
+	})
+
+	result := make([]TempHistoryPoint, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, *buckets[key])
+	}
+	return result
+}
+
+func tempHistoryCSV(points []TempHistoryPoint) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"time", "tool", "actual", "min", "max", "target", "samples"})
+
+	format := func(f float64) string { return strconv.FormatFloat(f, 'f', 1, 64) }
+	for _, p := range points {
+		w.Write([]string{
+			p.Time.Format(time.RFC3339), p.Tool, format(p.Actual), format(p.Min),
+			format(p.Max), format(p.Target), strconv.Itoa(p.Samples),
+		})
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// Command structure: temphistory [tool=T] [since=D | from=T to=T] [points=N] [format=json|csv] [export]
+func TempHistoryCommand(commandList []string) string {
+	if len(commandList) == 2 && commandList[1] == "-help" {
+		return "usage: temphistory [tool=bed] [since=2h | from=RFC3339 to=RFC3339] [points=100] [format=json|csv] [export]"
+	}
+
+	tool := ""
+	var from time.Time
+	to := time.Now()
+	since := time.Hour
+	sinceSet := false
+	points := 100
+	format := "json"
+	export := false
+
+	for _, arg := range commandList[1:] {
+		if arg == "export" {
+			export = true
+			continue
+		}
+
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			return "Error: syntax, expected key=value: " + arg
+		}
+
+		var err error
+		switch key {
+		case "tool":
+			tool = value
+		case "since":
+			since, err = time.ParseDuration(value)
+			if err == nil && since <= 0 {
+				err = errors.New("must be a positive duration")
+			}
+			sinceSet = true
+		case "from":
+			from, err = time.Parse(time.RFC3339, value)
+		case "to":
+			to, err = time.Parse(time.RFC3339, value)
+		case "points":
+			points, err = strconv.Atoi(value)
+			if err == nil && (points < 1 || points > 10000) {
+				err = errors.New("points must be between 1 and 10000")
+			}
+		case "format":
+			if value != "json" && value != "csv" {
+				err = errors.New("format must be json or csv")
+			}
+			format = value
+		default:
+			err = errors.New("unknown attribute")
+		}
+
+		if err != nil {
+			return "Error: " + key + ": " + err.Error()
+		}
+	}
+
+	// since counts back from to, wherever to appears in the arguments
+	if from.IsZero() {
+		from = to.Add(-since)
+	} else if sinceSet {
+		return "Error: since and from are exclusive"
+	}
+	if !from.Before(to) {
+		return "Error: from must be before to"
+	}
+
+	result := tempHistory.Query(tool, from, to, points)
+
+	var output string
+	if format == "csv" {
+		output = tempHistoryCSV(result)
+	} else {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		output = string(data)
+	}
+
+	if !export {
+		return output
+	}
+
+	DirExists(UpLoadFilePath)
+	fileName := fmt.Sprintf("temphistory-%s.%s", time.Now().Format(TIME_STAMP), format)
+	if err := os.WriteFile(filepath.Join(UpLoadFilePath, fileName), []byte(output), 0644); err != nil {
+		return "Error: " + err.Error()
+	}
+	return fileName + " was exported"
+}
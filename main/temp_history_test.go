@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTempHistory installs a history with a sample of both tools every 10s
+// for the last hour, 5s off the full seconds of now, the extruder swings by
+// 2 degrees
+func newTestTempHistory(t *testing.T, now time.Time) *TempHistory {
+	h, err := NewTempHistory(filepath.Join(t.TempDir(), "temphistory.jsonl"), 72*time.Hour)
+	assert.NoError(t, err)
+
+	for i := 360; i > 0; i-- {
+		swing := float64(i%2) * 2
+		assert.NoError(t, h.Record(TempSample{
+			Time: now.Add(-time.Duration(i)*10*time.Second + 5*time.Second),
+			Tools: map[string]TempHistoryReading{
+				"tool0": {Actual: 209 + swing, Target: 210},
+				"bed":   {Actual: 60, Target: 60},
+			},
+		}))
+	}
+
+	previous := tempHistory
+	t.Cleanup(func() { tempHistory = previous })
+	tempHistory = h
+	return h
+}
+
+func TestTempHistoryQuery(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	h := newTestTempHistory(t, now)
+
+	points := h.Query("tool0", now.Add(-time.Hour), now, 6)
+	if assert.Len(t, points, 6) {
+		for i, p := range points {
+			assert.Equal(t, "tool0", p.Tool)
+			assert.Equal(t, now.Add(-time.Hour+time.Duration(i)*10*time.Minute), p.Time)
+			assert.Equal(t, 60, p.Samples)
+			assert.InDelta(t, 210, p.Actual, 1e-9)
+			assert.Equal(t, 209., p.Min)
+			assert.Equal(t, 211., p.Max)
+			assert.InDelta(t, 210, p.Target, 1e-9)
+		}
+	}
+
+	// All tools, sorted by tool and time
+	points = h.Query("", now.Add(-time.Hour), now, 2)
+	if assert.Len(t, points, 4) {
+		assert.Equal(t, []string{"bed", "bed", "tool0", "tool0"},
+			[]string{points[0].Tool, points[1].Tool, points[2].Tool, points[3].Tool})
+		assert.True(t, points[0].Time.Before(points[1].Time))
+		assert.Equal(t, 60., points[0].Actual)
+	}
+
+	// Only the samples in range, more points than samples
+	points = h.Query("bed", now.Add(-time.Minute), now, 100)
+	total := 0
+	for _, p := range points {
+		total += p.Samples
+	}
+	assert.Equal(t, 6, total)
+	assert.Len(t, points, 6)
+
+	assert.Empty(t, h.Query("chamber", now.Add(-time.Hour), now, 10))
+	assert.Empty(t, h.Query("", now.Add(-3*time.Hour), now.Add(-2*time.Hour), 10))
+}
+
+func TestTempHistoryRecordOrder(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	file := filepath.Join(t.TempDir(), "temphistory.jsonl")
+	h, err := NewTempHistory(file, time.Hour)
+	assert.NoError(t, err)
+
+	sample := func(at time.Time) TempSample {
+		return TempSample{Time: at, Tools: map[string]TempHistoryReading{"bed": {Actual: 60}}}
+	}
+	assert.NoError(t, h.Record(sample(now.Add(-2*time.Hour))))
+	assert.NoError(t, h.Record(sample(now.Add(-time.Minute))))
+	// Out of order samples are dropped
+	assert.NoError(t, h.Record(sample(now.Add(-2*time.Minute))))
+	assert.Len(t, h.samples, 2)
+
+	// Reloading drops the expired sample
+	h, err = NewTempHistory(file, time.Hour)
+	assert.NoError(t, err)
+	if assert.Len(t, h.samples, 1) {
+		assert.True(t, h.samples[0].Time.Equal(now.Add(-time.Minute)))
+	}
+}
+
+func TestTempHistoryCSV(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	csv := tempHistoryCSV([]TempHistoryPoint{
+		{Time: at, Tool: "bed", Actual: 59.96, Min: 59.5, Max: 60.26, Target: 60, Samples: 3},
+	})
+	assert.Equal(t, "time,tool,actual,min,max,target,samples\n"+
+		"2024-01-02T03:04:05Z,bed,60.0,59.5,60.3,60.0,3\n", csv)
+}
+
+func TestTempHistoryCommand(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	newTestTempHistory(t, now)
+	to := now.Add(-30 * time.Minute).UTC().Format(time.RFC3339)
+
+	query := func(args ...string) []TempHistoryPoint {
+		output := TempHistoryCommand(append([]string{"temphistory"}, args...))
+		var points []TempHistoryPoint
+		assert.NoError(t, json.Unmarshal([]byte(output), &points), output)
+		return points
+	}
+
+	// since counts back from to in either order
+	before := query("tool=bed", "since=10m", "to="+to, "points=1")
+	after := query("tool=bed", "to="+to, "since=10m", "points=1")
+	if assert.Len(t, before, 1) && assert.Len(t, after, 1) {
+		assert.Equal(t, 60, before[0].Samples)
+		assert.Equal(t, before, after)
+	}
+
+	// The default window is the last hour
+	points := query("tool=bed", "points=1")
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, 360, points[0].Samples)
+	}
+
+	output := TempHistoryCommand([]string{"temphistory", "tool=bed", "since=1h", "points=2", "format=csv"})
+	assert.Equal(t, 3, strings.Count(output, "\n"))
+
+	for _, args := range [][]string{
+		{"since=2x"},
+		{"since=-1h"},
+		{"points=0"},
+		{"format=xml"},
+		{"color=red"},
+		{"bed"},
+		{"since=1h", "from=" + to},
+		{"from=" + to, "to=" + now.Add(-time.Hour).UTC().Format(time.RFC3339)},
+	} {
+		output := TempHistoryCommand(append([]string{"temphistory"}, args...))
+		assert.True(t, strings.HasPrefix(output, "Error: "), "%v: %s", args, output)
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"octoAgent/octoprint"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Thermal watchdog:
+
+Tracks actual vs target temperature of every heater and raises an alert when
+
+heating    a heater does not reach its target within HeatTimeout
+drop       a heater that reached its target falls more than DropThreshold below it
+runaway    a heater overshoots its target by RunawayMargin while rising for
+           runawayRiseSamples readings in a row, so a heater cooling down to a
+           lowered target does not trigger on noise, or rises by more than
+           RunawayRise within Window while its target is off
+oscillate  the temperature swings around the target by more than OscillationAmplitude
+           at least OscillationCrossings times within Window
+
+Alerts are sent to the admins. heating, drop and runaway are critical and
+trigger WATCHDOG_ACTION: alert (default), pause the job, or cancel the job
+and cool down. A runaway always cools the heaters down unless the action is
+alert. Oscillation is only reported.
+
+Thresholds are read from WATCHDOG_PROFILES (default watchdog_profiles.json),
+keyed by OctoPrint printer profile id with "_default" as fallback:
+
+{"_default": {"tool": {"heat_timeout": 300, ...}, "bed": {"heat_timeout": 600, ...}}}
+
+*/
+
+const (
+	AlertHeating   = "heating"
+	AlertDrop      = "drop"
+	AlertRunaway   = "runaway"
+	AlertOscillate = "oscillate"
+
+	WatchdogAlert  = "alert"
+	WatchdogPause  = "pause"
+	WatchdogCancel = "cancel"
+
+	defaultProfileKey = "_default"
+
+	// consecutive rising readings of an overshooting heater that make a runaway
+	runawayRiseSamples = 3
+)
+
+// ThermalThresholds are the limits for a single heater
+type ThermalThresholds struct {
+	HeatTimeout          int     `json:"heat_timeout"`          // seconds
+	ReachTolerance       float64 `json:"reach_tolerance"`       // °C below target counted as reached
+	DropThreshold        float64 `json:"drop_threshold"`        // °C
+	RunawayMargin        float64 `json:"runaway_margin"`        // °C above target
+	RunawayRise          float64 `json:"runaway_rise"`          // °C within Window with target off
+	OscillationAmplitude float64 `json:"oscillation_amplitude"` // °C
+	OscillationCrossings int     `json:"oscillation_crossings"`
+	Window               int     `json:"window"` // seconds
+}
+
+// ThermalProfile holds thresholds for the hotends and the bed
+type ThermalProfile struct {
+	Tool ThermalThresholds `json:"tool"`
+	Bed  ThermalThresholds `json:"bed"`
+}
+
+var defaultThermalProfile = ThermalProfile{
+	Tool: ThermalThresholds{
+		HeatTimeout: 300, ReachTolerance: 3, DropThreshold: 15, RunawayMargin: 15,
+		RunawayRise: 20, OscillationAmplitude: 5, OscillationCrossings: 6, Window: 120,
+	},
+	Bed: ThermalThresholds{
+		HeatTimeout: 900, ReachTolerance: 2, DropThreshold: 10, RunawayMargin: 10,
+		RunawayRise: 15, OscillationAmplitude: 3, OscillationCrossings: 6, Window: 300,
+	},
+}
+
+// ThermalAlert is a detected anomaly
+type ThermalAlert struct {
+	Tool     string    `json:"tool"`
+	Kind     string    `json:"kind"`
+	Critical bool      `json:"critical"`
+	Actual   float64   `json:"actual"`
+	Target   float64   `json:"target"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+type thermalSample struct {
+	time   time.Time
+	actual float64
+	target float64
+}
+
+// heaterState is the tracking state of a single heater
+type heaterState struct {
+	samples     []thermalSample
+	target      float64
+	heatStart   time.Time
+	reached     bool
+	activeAlert map[string]bool
+}
+
+// Global watchdog instance, set up in main
+var thermalWatchdog *ThermalWatchdog
+
+type ThermalWatchdog struct {
+	mutex    sync.Mutex
+	enabled  bool
+	action   string
+	profiles map[string]ThermalProfile
+	profile  string
+	heaters  map[string]*heaterState
+	alerts   []ThermalAlert
+}
+
+func NewThermalWatchdog(profileFile string, action string) (*ThermalWatchdog, error) {
+	w := &ThermalWatchdog{
+		enabled:  true,
+		action:   WatchdogAlert,
+		profiles: map[string]ThermalProfile{defaultProfileKey: defaultThermalProfile},
+		profile:  defaultProfileKey,
+		heaters:  make(map[string]*heaterState),
+	}
+
+	if action != "" {
+		if err := w.SetAction(action); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(profileFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles map[string]json.RawMessage
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %v", profileFile, err)
+	}
+
+	// Thresholds missing in a profile keep their default value
+	for key, raw := range profiles {
+		profile := defaultThermalProfile
+		if err := json.Unmarshal(raw, &profile); err != nil {
+			return nil, fmt.Errorf("%s: profile %s: %v", profileFile, key, err)
+		}
+		w.profiles[key] = profile
+	}
+	return w, nil
+}
+
+func (w *ThermalWatchdog) SetAction(action string) error {
+	switch action {
+	case WatchdogAlert, WatchdogPause, WatchdogCancel:
+		w.mutex.Lock()
+		w.action = action
+		w.mutex.Unlock()
+		return nil
+	default:
+		return errors.New("action must be alert, pause or cancel")
+	}
+}
+
+// Start polls the printer temperatures every interval
+func (w *ThermalWatchdog) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			w.poll()
+		}
+	}()
+}
+
+func (w *ThermalWatchdog) poll() {
+	w.mutex.Lock()
+	enabled := w.enabled
+	w.mutex.Unlock()
+
+	if !enabled || !isConnected {
+		return
+	}
+
+	w.selectProfile()
+
+	stateReq := octoprint.StateRequest{Exclude: []string{"sd"}}
+	state, err := stateReq.Do(octoclient)
+	if err != nil {
+		return
+	}
+
+	alerts := w.Evaluate(time.Now(), state.Temperature.Current)
+	for _, alert := range alerts {
+		w.handleAlert(alert, state.State.Flags.Printing || state.State.Flags.Paused)
+	}
+}
+
+// selectProfile picks the thresholds matching OctoPrint's printer profile
+func (w *ThermalWatchdog) selectProfile() {
+	octoReq := octoprint.ConnectionRequest{}
+	settings, err := octoReq.Do(octoclient)
+	if err != nil {
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	profile := settings.Current.PrinterProfile
+	if _, exists := w.profiles[profile]; !exists {
+		profile = defaultProfileKey
+	}
+	w.profile = profile
+}
+
+func (w *ThermalWatchdog) thresholds(tool string) ThermalThresholds {
+	profile := w.profiles[w.profile]
+	if tool == "bed" {
+		return profile.Bed
+	}
+	return profile.Tool
+}
+
+// Evaluate feeds a temperature reading into the watchdog and returns new alerts
+func (w *ThermalWatchdog) Evaluate(now time.Time, temps map[string]octoprint.TemperatureData) []ThermalAlert {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var alerts []ThermalAlert
+	for tool, data := range temps {
+		// Chambers and sensors without a heater are not watched
+		if tool != "bed" && !strings.HasPrefix(tool, "tool") {
+			continue
+		}
+
+		heater, exists := w.heaters[tool]
+		if !exists {
+			heater = &heaterState{activeAlert: make(map[string]bool)}
+			w.heaters[tool] = heater
+		}
+
+		th := w.thresholds(tool)
+		alerts = append(alerts, w.evaluateHeater(now, tool, heater, th, data)...)
+	}
+
+	w.alerts = append(w.alerts, alerts...)
+	if len(w.alerts) > 50 {
+		w.alerts = w.alerts[len(w.alerts)-50:]
+	}
+	return alerts
+}
+
+func (w *ThermalWatchdog) evaluateHeater(now time.Time, tool string, h *heaterState, th ThermalThresholds, data octoprint.TemperatureData) []ThermalAlert {
+	// A new target restarts the heat up phase
+	if data.Target != h.target {
+		h.target = data.Target
+		h.heatStart = now
+		h.reached = false
+		h.samples = nil
+		h.activeAlert = make(map[string]bool)
+	}
+
+	h.samples = append(h.samples, thermalSample{time: now, actual: data.Actual, target: data.Target})
+	window := time.Duration(th.Window) * time.Second
+	for len(h.samples) > 1 && now.Sub(h.samples[0].time) > window {
+		h.samples = h.samples[1:]
+	}
+
+	if data.Target > 0 && data.Actual >= data.Target-th.ReachTolerance {
+		h.reached = true
+	}
+
+	var alerts []ThermalAlert
+	raise := func(kind string, critical bool, condition bool, format string, args ...interface{}) {
+		if !condition {
+			delete(h.activeAlert, kind)
+			return
+		}
+		if h.activeAlert[kind] {
+			return
+		}
+		h.activeAlert[kind] = true
+		alerts = append(alerts, ThermalAlert{
+			Tool: tool, Kind: kind, Critical: critical,
+			Actual: data.Actual, Target: data.Target,
+			Message: fmt.Sprintf(format, args...), Time: now,
+		})
+	}
+
+	rise := data.Actual - h.samples[0].actual
+	rising := risingFor(h.samples, runawayRiseSamples)
+
+	raise(AlertHeating, true,
+		data.Target > 0 && !h.reached && now.Sub(h.heatStart) > time.Duration(th.HeatTimeout)*time.Second,
+		"%s did not reach %.1f°C within %ds, actual %.1f°C", tool, data.Target, th.HeatTimeout, data.Actual)
+
+	raise(AlertDrop, true,
+		data.Target > 0 && h.reached && data.Actual < data.Target-th.DropThreshold,
+		"%s dropped to %.1f°C, target %.1f°C", tool, data.Actual, data.Target)
+
+	raise(AlertRunaway, true,
+		(data.Target > 0 && data.Actual > data.Target+th.RunawayMargin && rising) ||
+			(data.Target == 0 && rise > th.RunawayRise),
+		"%s thermal runaway, actual %.1f°C, target %.1f°C, rise %.1f°C", tool, data.Actual, data.Target, rise)
+
+	crossings, amplitude := oscillation(h.samples)
+	raise(AlertOscillate, false,
+		h.reached && crossings >= th.OscillationCrossings && amplitude > th.OscillationAmplitude,
+		"%s oscillates ±%.1f°C around %.1f°C (%d crossings)", tool, amplitude, data.Target, crossings)
+
+	return alerts
+}
+
+// risingFor reports whether the last n samples each rose over the one before
+func risingFor(samples []thermalSample, n int) bool {
+	if len(samples) <= n {
+		return false
+	}
+	for i := len(samples) - n; i < len(samples); i++ {
+		if samples[i].actual <= samples[i-1].actual {
+			return false
+		}
+	}
+	return true
+}
+
+// oscillation counts target crossings and the largest deviation in samples
+func oscillation(samples []thermalSample) (int, float64) {
+	crossings := 0
+	amplitude := 0.0
+	previous := 0.0
+
+	for _, s := range samples {
+		deviation := s.actual - s.target
+		amplitude = math.Max(amplitude, math.Abs(deviation))
+		if deviation != 0 {
+			if previous != 0 && (deviation > 0) != (previous > 0) {
+				crossings++
+			}
+			previous = deviation
+		}
+	}
+	return crossings, amplitude
+}
+
+// handleAlert notifies the admins and applies the configured action
+func (w *ThermalWatchdog) handleAlert(alert ThermalAlert, printing bool) {
+	log.Printf("Thermal watchdog: %s", alert.Message)
+
+	w.mutex.Lock()
+	action := w.action
+	w.mutex.Unlock()
+
+	msg := bot_name + ": thermal watchdog " + alert.Message
+	if alert.Critical && action != WatchdogAlert {
+		msg += ", action " + action
+		if err := w.applyAction(action, alert, printing); err != nil {
+			msg += " failed: " + err.Error()
+		}
+	}
+
+	for _, admin := range bot_admin_list {
+		conversation, err := transport.ContactInfo(admin)
+		if err != nil {
+			continue
+		}
+		if err := sendReply(conversation.ID, msg); err != nil {
+			log.Printf("Error: sending watchdog alert to %s: %v", admin, err)
+		}
+	}
+}
+
+func (w *ThermalWatchdog) applyAction(action string, alert ThermalAlert, printing bool) error {
+	if printing {
+		switch action {
+		case WatchdogPause:
+			pauseReq := octoprint.PauseRequest{Action: octoprint.Pause}
+			if err := pauseReq.Do(octoclient); err != nil {
+				return err
+			}
+		case WatchdogCancel:
+			cancelReq := octoprint.CancelRequest{}
+			if err := cancelReq.Do(octoclient); err != nil {
+				return err
+			}
+		}
+	}
+
+	if action == WatchdogCancel || alert.Kind == AlertRunaway {
+		return coolDown()
+	}
+	return nil
+}
+
+// coolDown switches off all heaters
+func coolDown() error {
+	stateReq := octoprint.StateRequest{Exclude: []string{"sd", "state"}}
+	state, err := stateReq.Do(octoclient)
+	if err != nil {
+		return err
+	}
+
+	targets := make(map[string]float64)
+	for tool := range state.Temperature.Current {
+		if strings.HasPrefix(tool, "tool") {
+			targets[tool] = 0
+		}
+	}
+
+	if len(targets) > 0 {
+		toolReq := octoprint.ToolTargetRequest{Targets: targets}
+		if err := toolReq.Do(octoclient); err != nil {
+			return err
+		}
+	}
+
+	if _, exists := state.Temperature.Current["bed"]; exists {
+		bedReq := octoprint.BedTargetRequest{Target: 0}
+		return bedReq.Do(octoclient)
+	}
+	return nil
+}
+
+type WatchdogStatus struct {
+	Enabled bool           `json:"enabled"`
+	Action  string         `json:"action"`
+	Profile string         `json:"profile"`
+	Active  []string       `json:"active"`
+	Alerts  []ThermalAlert `json:"alerts"`
+}
+
+func (w *ThermalWatchdog) Status() WatchdogStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	status := WatchdogStatus{
+		Enabled: w.enabled,
+		Action:  w.action,
+		Profile: w.profile,
+		Active:  []string{},
+		Alerts:  append([]ThermalAlert{}, w.alerts...),
+	}
+	for tool, heater := range w.heaters {
+		for kind := range heater.activeAlert {
+			status.Active = append(status.Active, tool+":"+kind)
+		}
+	}
+	return status
+}
+
+// Command structure: watchdog [on|off|action alert|pause|cancel]
+func Watchdog(commandList []string) string {
+	switch len(commandList) {
+	case 1:
+		jsonBytes, err := json.Marshal(thermalWatchdog.Status())
+		if err != nil {
+			return "Error: failed to encode watchdog status: " + err.Error()
+		}
+		return string(jsonBytes)
+
+	case 2:
+		switch commandList[1] {
+		case "-help":
+			return "usage: watchdog [on|off|action alert|pause|cancel]"
+
+		case "on", "off":
+			thermalWatchdog.mutex.Lock()
+			thermalWatchdog.enabled = commandList[1] == "on"
+			thermalWatchdog.mutex.Unlock()
+			return "Watchdog is " + commandList[1]
+
+		default:
+			return "Error: syntax, second attribute not recognized"
+		}
+
+	case 3:
+		if commandList[1] != "action" {
+			return "Error: syntax, second attribute not recognized"
+		}
+		if err := thermalWatchdog.SetAction(commandList[2]); err != nil {
+			return "Error: " + err.Error()
+		}
+		return "Watchdog action was set to " + commandList[2]
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
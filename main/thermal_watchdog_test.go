@@ -0,0 +1,86 @@
+package main
+
+import (
+	"octoAgent/octoprint"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// thermalReading is a tool0 reading at the given second
+type thermalReading struct {
+	second         int
+	actual, target float64
+}
+
+func TestThermalWatchdogEvaluate(t *testing.T) {
+	cases := []struct {
+		name     string
+		readings []thermalReading
+		alerts   []string
+	}{
+		{"heats up in time", []thermalReading{
+			{0, 25, 210}, {60, 120, 210}, {120, 190, 210}, {180, 208, 210}, {400, 210, 210},
+		}, nil},
+		{"heat timeout", []thermalReading{
+			{0, 25, 210}, {100, 60, 210}, {200, 90, 210}, {310, 110, 210}, {320, 112, 210},
+		}, []string{AlertHeating}},
+		{"drop", []thermalReading{
+			{0, 200, 210}, {10, 209, 210}, {20, 200, 210}, {30, 190, 210}, {40, 185, 210},
+		}, []string{AlertDrop}},
+		{"runaway", []thermalReading{
+			{0, 209, 210}, {10, 226, 210}, {20, 228, 210}, {30, 231, 210}, {40, 235, 210},
+		}, []string{AlertRunaway}},
+		{"single upward tick above the target", []thermalReading{
+			{0, 209, 210}, {10, 226, 210}, {20, 225, 210}, {30, 227, 210}, {40, 224, 210},
+		}, nil},
+		{"target lowered", []thermalReading{
+			{0, 210, 210}, {10, 209, 150}, {20, 210, 150}, {30, 205, 150}, {40, 206, 150}, {50, 198, 150},
+		}, nil},
+		{"target off", []thermalReading{
+			{0, 210, 210}, {10, 209, 0}, {20, 210, 0}, {30, 200, 0}, {40, 201, 0}, {50, 190, 0},
+		}, nil},
+		{"runaway with target off", []thermalReading{
+			{0, 30, 0}, {10, 35, 0}, {20, 42, 0}, {30, 55, 0},
+		}, []string{AlertRunaway}},
+	}
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w, err := NewThermalWatchdog(filepath.Join(t.TempDir(), "missing.json"), "")
+			assert.NoError(t, err)
+
+			var kinds []string
+			for _, r := range c.readings {
+				now := start.Add(time.Duration(r.second) * time.Second)
+				for _, alert := range w.Evaluate(now, map[string]octoprint.TemperatureData{
+					"tool0": {Actual: r.actual, Target: r.target},
+					// Sensors without a heater are ignored
+					"chamber": {Actual: 500},
+				}) {
+					assert.Equal(t, "tool0", alert.Tool)
+					kinds = append(kinds, alert.Kind)
+				}
+			}
+			assert.Equal(t, c.alerts, kinds)
+		})
+	}
+}
+
+func TestRisingFor(t *testing.T) {
+	samples := func(values ...float64) []thermalSample {
+		list := make([]thermalSample, len(values))
+		for i, v := range values {
+			list[i].actual = v
+		}
+		return list
+	}
+
+	assert.True(t, risingFor(samples(1, 2, 3, 4), 3))
+	assert.False(t, risingFor(samples(2, 3, 4), 3))
+	assert.False(t, risingFor(samples(1, 2, 2, 4), 3))
+	assert.True(t, risingFor(samples(5, 1, 2, 3, 4), 3))
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"octoAgent/gcode"
+	"octoAgent/octoprint"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Timelapse:
+
+TIMELAPSE_MODE selects when frames are captured during a job:
+
+  off       (default) no timelapse
+  layer     at each layer change, the tracked Z rises while extruding
+  interval  every TIMELAPSE_INTERVAL seconds (default 30) while printing
+
+Frames are captured with the snapshot backend (see image_services.go) into
+TIMELAPSE_DIR (default timelapses). When the job ends they are assembled
+into an MP4 with ffmpeg at TIMELAPSE_FPS (default 25) and delivered to
+bot_notify_list as set by TIMELAPSE_DELIVER:
+
+  notify  (default) with each recipient's media delivery settings
+  share   over Cwtch file sharing
+  s3      as an encrypted S3 upload
+  none    only stored
+
+timelapse list
+timelapse get name
+
+list shows the agent's timelapses and the ones rendered by OctoPrint, get
+delivers one to the requester, OctoPrint's are downloaded first.
+
+*/
+
+const (
+	TimelapseOff      = "off"
+	TimelapseLayer    = "layer"
+	TimelapseInterval = "interval"
+)
+
+// timelapseMinFrames is the least number of frames worth a video
+const timelapseMinFrames = 2
+
+// TimelapseInfo describes a stored timelapse
+type TimelapseInfo struct {
+	Name   string    `json:"name"`
+	Size   int64     `json:"size"`
+	Date   time.Time `json:"date"`
+	Source string    `json:"source"`
+}
+
+// Global timelapse instance, set up in main
+var timelapse *Timelapse
+
+type Timelapse struct {
+	mutex    sync.Mutex
+	mode     string
+	interval time.Duration
+	dir      string
+	fps      int
+	deliver  string
+
+	// The job being recorded, framesDir is empty between jobs
+	framesDir string
+	name      string
+	frames    int
+	layerZ    float64
+	paused    bool
+	capturing bool
+}
+
+func NewTimelapse(mode string, interval time.Duration, dir string, fps int, deliver string) (*Timelapse, error) {
+	switch mode {
+	case "":
+		mode = TimelapseOff
+	case TimelapseOff, TimelapseLayer, TimelapseInterval:
+	default:
+		return nil, fmt.Errorf("unknown TIMELAPSE_MODE: %s", mode)
+	}
+
+	switch deliver {
+	case "":
+		deliver = "notify"
+	case "notify", DeliverShare, DeliverS3, "none":
+	default:
+		return nil, fmt.Errorf("unknown TIMELAPSE_DELIVER: %s", deliver)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Timelapse{mode: mode, interval: interval, dir: dir, fps: fps, deliver: deliver}, nil
+}
+
+// Start captures frames in interval mode
+func (tl *Timelapse) Start() {
+	if tl.mode != TimelapseInterval {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(tl.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			tl.mutex.Lock()
+			recording := tl.framesDir != "" && !tl.paused
+			tl.mutex.Unlock()
+
+			if recording {
+				tl.capture()
+			}
+		}
+	}()
+}
+
+// OnPrintEvent is the PrintWatcher listener that starts and ends recordings
+func (tl *Timelapse) OnPrintEvent(ev PrintEvent) {
+	if tl.mode == TimelapseOff {
+		return
+	}
+
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	switch ev.Type {
+	case PrintStarted:
+		started := ev.Started
+		if started.IsZero() {
+			started = ev.Time
+		}
+		tl.name = strings.TrimSuffix(toolpathName(ev.File, started), ".jsonl")
+		tl.framesDir = filepath.Join(tl.dir, tl.name+"-frames")
+		tl.frames = 0
+		tl.layerZ = 0
+		tl.paused = false
+		if err := os.MkdirAll(tl.framesDir, 0755); err != nil {
+			log.Printf("Error: timelapse: %s", err)
+			tl.framesDir = ""
+		}
+
+	case PrintPaused:
+		tl.paused = true
+	case PrintResumed:
+		tl.paused = false
+
+	case PrintDone, PrintFailed, PrintCancelled, PrinterError, PrinterDisconnected:
+		if tl.framesDir == "" {
+			return
+		}
+		framesDir, name, frames := tl.framesDir, tl.name, tl.frames
+		tl.framesDir = ""
+		go tl.finish(framesDir, name, frames, ev)
+	}
+}
+
+// OnMove is the PositionTracker listener that captures a frame when an
+// extruding move starts a higher layer, so Z hops do not count
+func (tl *Timelapse) OnMove(move gcode.Move, _ time.Time) {
+	if tl.mode != TimelapseLayer || !move.Extruding() {
+		return
+	}
+
+	tl.mutex.Lock()
+	newLayer := tl.framesDir != "" && !tl.paused && move.To.Z > tl.layerZ+1e-6
+	if newLayer {
+		tl.layerZ = move.To.Z
+	}
+	tl.mutex.Unlock()
+
+	if newLayer {
+		// The tracker must not wait for the camera
+		go tl.capture()
+	}
+}
+
+// capture adds a frame to the current recording, frames are skipped while
+// the previous one is still being captured
+func (tl *Timelapse) capture() {
+	tl.mutex.Lock()
+	if tl.framesDir == "" || tl.capturing {
+		tl.mutex.Unlock()
+		return
+	}
+	tl.capturing = true
+	framesDir := tl.framesDir
+	frame := tl.frames
+	tl.mutex.Unlock()
+
+	err := captureImage(filepath.Join(framesDir, fmt.Sprintf("frame%05d%s", frame, IMAGE_TYPE)))
+
+	tl.mutex.Lock()
+	tl.capturing = false
+	if err == nil && tl.framesDir == framesDir {
+		tl.frames++
+	}
+	tl.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("Error: timelapse frame: %s", err)
+	}
+}
+
+// finish assembles and delivers the recording of a job that ended
+func (tl *Timelapse) finish(framesDir, name string, frames int, ev PrintEvent) {
+	// Wait for a capture that is still running
+	for {
+		tl.mutex.Lock()
+		capturing := tl.capturing
+		tl.mutex.Unlock()
+		if !capturing {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if frames < timelapseMinFrames {
+		log.Printf("Timelapse: %s has %d frames, no video is rendered", name, frames)
+		os.RemoveAll(framesDir)
+		return
+	}
+
+	videoPath := filepath.Join(tl.dir, name+VIDEO_TYPE)
+	if err := tl.assemble(framesDir, videoPath); err != nil {
+		log.Printf("Error: timelapse %s: %s", name, err)
+		return
+	}
+	os.RemoveAll(framesDir)
+	log.Printf("Timelapse: %s rendered from %d frames", videoPath, frames)
+
+	tl.deliverVideo(videoPath, ev)
+}
+
+// assemble renders the frames into an H.264 video
+func (tl *Timelapse) assemble(framesDir, videoPath string) error {
+	cmd := exec.Command("ffmpeg", "-y", "-loglevel", "error",
+		"-framerate", strconv.Itoa(tl.fps),
+		"-i", filepath.Join(framesDir, "frame%05d"+IMAGE_TYPE),
+		// H.264 in yuv420p needs even dimensions
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "+faststart",
+		videoPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// deliverVideo sends the video to the notification recipients, with their
+// media delivery settings unless TIMELAPSE_DELIVER forces a method
+func (tl *Timelapse) deliverVideo(videoPath string, ev PrintEvent) {
+	if tl.deliver == "none" {
+		return
+	}
+
+	msg := fmt.Sprintf("Timelapse of %s (%s): %s", ev.File, ev.Type, filepath.Base(videoPath))
+	for _, recipient := range bot_notify_list {
+		conversation, err := transport.ContactInfo(recipient)
+		if err != nil {
+			log.Printf("Error: timelapse recipient is not a contact: %s", recipient)
+			continue
+		}
+
+		pref := requesterPreference(conversation.ID)
+		if tl.deliver != "notify" {
+			pref.Method = tl.deliver
+		}
+		if pref.Method == DeliverPath {
+			continue
+		}
+
+		sendReply(conversation.ID, msg)
+		if _, err := deliverMediaWith(conversation.ID, videoPath, pref); err != nil {
+			log.Printf("Error: delivering timelapse to %s: %v", recipient, err)
+			sendReply(conversation.ID, "Error: delivering "+filepath.Base(videoPath)+": "+err.Error())
+		}
+	}
+}
+
+// List returns the agent's and OctoPrint's timelapses, newest first
+func (tl *Timelapse) List() ([]TimelapseInfo, error) {
+	entries, err := os.ReadDir(tl.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []TimelapseInfo
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != VIDEO_TYPE {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, TimelapseInfo{Name: entry.Name(), Size: fileInfo.Size(), Date: fileInfo.ModTime(), Source: "agent"})
+	}
+
+	if isConnected {
+		timelapseReq := octoprint.TimelapseRequest{}
+		response, err := timelapseReq.Do(octoclient)
+		if err != nil {
+			log.Printf("Error: OctoPrint timelapses: %s", err)
+		} else {
+			for _, file := range response.Files {
+				date, _ := time.ParseInLocation("2006-01-02 15:04", file.Date, time.Local)
+				infos = append(infos, TimelapseInfo{Name: file.Name, Size: file.Bytes, Date: date, Source: "octoprint"})
+			}
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Date.After(infos[j].Date) })
+	return infos, nil
+}
+
+// Path returns the local path of a timelapse, OctoPrint's are downloaded
+// into the timelapse directory first
+func (tl *Timelapse) Path(name string) (string, error) {
+	if name != filepath.Base(name) || filepath.Ext(name) != VIDEO_TYPE {
+		return "", errors.New("invalid timelapse name")
+	}
+
+	localPath := filepath.Join(tl.dir, name)
+	if FileExists(localPath) {
+		return localPath, nil
+	}
+
+	if !isConnected {
+		return "", errors.New("timelapse not found: " + name)
+	}
+	timelapseReq := octoprint.TimelapseRequest{}
+	response, err := timelapseReq.Do(octoclient)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range response.Files {
+		if file.Name != name {
+			continue
+		}
+
+		if err := downloadTimelapse(file, localPath); err != nil {
+			return "", err
+		}
+		return localPath, nil
+	}
+	return "", errors.New("timelapse not found: " + name)
+}
+
+// downloadTimelapse streams an OctoPrint timelapse to a partial file that is
+// renamed when complete, so a failed download is not listed
+func downloadTimelapse(file octoprint.TimelapseFile, localPath string) error {
+	partPath := localPath + ".part"
+	out, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+
+	downloadReq := octoprint.DownloadTimelapseRequest{File: file}
+	err = downloadReq.Do(octoclient, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	return os.Rename(partPath, localPath)
+}
+
+// Command structure: timelapse list | timelapse get name
+func TimelapseCommand(commandList []string, requester int) string {
+	usage := "usage: timelapse list | timelapse get name"
+	if timelapse == nil {
+		return "Error: timelapse is not available"
+	}
+
+	switch len(commandList) {
+	case 2:
+		switch commandList[1] {
+		case "-help":
+			return usage
+		case "list":
+			infos, err := timelapse.List()
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			jsonBytes, err := json.Marshal(infos)
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			return string(jsonBytes)
+		}
+		return "Error: parameter mismatch, " + usage
+
+	case 3:
+		if commandList[1] != "get" {
+			return "Error: parameter mismatch, " + usage
+		}
+		videoPath, err := timelapse.Path(commandList[2])
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		return deliverMedia(requester, videoPath)
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"octoAgent/gcode"
+	"octoAgent/octoprint"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestTimelapse starts recording a job in a new timelapse
+func startTestTimelapse(t *testing.T, mode string) *Timelapse {
+	tl, err := NewTimelapse(mode, time.Second, t.TempDir(), 25, "none")
+	assert.NoError(t, err)
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tl.OnPrintEvent(PrintEvent{Type: PrintStarted, File: "cube.gcode", Started: started})
+	assert.Equal(t, filepath.Join(tl.dir, "cube-20240102-030405-frames"), tl.framesDir)
+	return tl
+}
+
+func (tl *Timelapse) frameCount() int {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	return tl.frames
+}
+
+func TestTimelapseLayerFrames(t *testing.T) {
+	setTestCameras(t)
+	tl := startTestTimelapse(t, TimelapseLayer)
+
+	extrude := func(z float64) gcode.Move {
+		return gcode.Move{From: gcode.Position{X: 0, Z: z}, To: gcode.Position{X: 10, Z: z}, Extrude: 0.5}
+	}
+	tl.OnMove(extrude(0.2), time.Now())
+	assert.Eventually(t, func() bool { return tl.frameCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.FileExists(t, filepath.Join(tl.framesDir, "frame00000"+IMAGE_TYPE))
+
+	// A Z hop, a travel and the same layer are no new layer
+	tl.OnMove(gcode.Move{From: gcode.Position{X: 10, Z: 0.2}, To: gcode.Position{X: 10, Z: 0.6}}, time.Now())
+	tl.OnMove(gcode.Move{From: gcode.Position{X: 10, Z: 0.6}, To: gcode.Position{X: 20, Z: 0.6}}, time.Now())
+	tl.OnMove(extrude(0.2), time.Now())
+	// Nothing while paused
+	tl.OnPrintEvent(PrintEvent{Type: PrintPaused})
+	tl.OnMove(extrude(0.4), time.Now())
+	tl.OnPrintEvent(PrintEvent{Type: PrintResumed})
+
+	tl.OnMove(extrude(0.4), time.Now())
+	assert.Eventually(t, func() bool { return tl.frameCount() == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0.4, tl.layerZ)
+
+	// Other modes ignore moves
+	tl.mode = TimelapseInterval
+	tl.OnMove(extrude(0.6), time.Now())
+	assert.Equal(t, 0.4, tl.layerZ)
+}
+
+func TestTimelapseCapture(t *testing.T) {
+	setTestCameras(t)
+	tl := startTestTimelapse(t, TimelapseInterval)
+
+	tl.capture()
+	tl.capture()
+	assert.Equal(t, 2, tl.frameCount())
+	assert.FileExists(t, filepath.Join(tl.framesDir, "frame00001"+IMAGE_TYPE))
+
+	// A failed capture is no frame
+	cameras = nil
+	tl.capture()
+	assert.Equal(t, 2, tl.frameCount())
+
+	// Between jobs nothing is captured
+	tl.framesDir = ""
+	setTestCameras(t)
+	tl.capture()
+	assert.Equal(t, 2, tl.frameCount())
+}
+
+func TestTimelapseFinish(t *testing.T) {
+	setTestCameras(t)
+	tl := startTestTimelapse(t, TimelapseInterval)
+	framesDir := tl.framesDir
+	tl.capture()
+
+	// Too few frames are dropped
+	tl.finish(framesDir, tl.name, tl.frameCount(), PrintEvent{Type: PrintDone})
+	assert.NoDirExists(t, framesDir)
+
+	// A failed render keeps the frames
+	tl = startTestTimelapse(t, TimelapseInterval)
+	framesDir = tl.framesDir
+	tl.capture()
+	tl.capture()
+	t.Setenv("PATH", "")
+	tl.finish(framesDir, tl.name, tl.frameCount(), PrintEvent{Type: PrintDone})
+	assert.DirExists(t, framesDir)
+	assert.NoFileExists(t, filepath.Join(tl.dir, tl.name+VIDEO_TYPE))
+
+	// The end of a job stops the recording and finishes it
+	tl = startTestTimelapse(t, TimelapseInterval)
+	framesDir = tl.framesDir
+	tl.OnPrintEvent(PrintEvent{Type: PrintCancelled})
+	assert.Empty(t, tl.framesDir)
+	tl.capture()
+	assert.Equal(t, 0, tl.frameCount())
+	assert.Eventually(t, func() bool { return !FileExists(framesDir) }, 5*time.Second, 10*time.Millisecond)
+}
+
+// setTestTimelapses serves OctoPrint's timelapse list with one video
+func setTestTimelapses(t *testing.T) {
+	mux := newTestOctoPrint(t)
+	mux.HandleFunc(octoprint.URITimelapse, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"files": [{"name": "ring.mp4", "bytes": 5, "date": "2024-01-01 12:30",
+			"url": "/downloads/timelapse/ring.mp4"}]}`))
+	})
+	mux.HandleFunc("/downloads/timelapse/ring.mp4", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("video"))
+	})
+
+	previous := isConnected
+	t.Cleanup(func() { isConnected = previous })
+	isConnected = true
+}
+
+func TestTimelapseList(t *testing.T) {
+	tl, err := NewTimelapse(TimelapseOff, time.Second, t.TempDir(), 25, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "notify", tl.deliver)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(tl.dir, "cube-20240102-030405.mp4"), []byte("video"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(tl.dir, "notes.txt"), []byte("text"), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(tl.dir, "cube-20240103-030405-frames"), 0755))
+
+	infos, err := tl.List()
+	assert.NoError(t, err)
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, TimelapseInfo{Name: "cube-20240102-030405.mp4", Size: 5, Date: infos[0].Date, Source: "agent"}, infos[0])
+	}
+
+	setTestTimelapses(t)
+	infos, err = tl.List()
+	assert.NoError(t, err)
+	if assert.Len(t, infos, 2) {
+		// Newest first, the agent's was written just now
+		assert.Equal(t, "agent", infos[0].Source)
+		assert.Equal(t, TimelapseInfo{Name: "ring.mp4", Size: 5, Date: time.Date(2024, 1, 1, 12, 30, 0, 0, time.Local), Source: "octoprint"}, infos[1])
+	}
+}
+
+func TestTimelapsePath(t *testing.T) {
+	tl, err := NewTimelapse(TimelapseOff, time.Second, t.TempDir(), 25, "")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"../cube.mp4", "cube.gcode", "ring.mp4"} {
+		_, err := tl.Path(name)
+		assert.Error(t, err, name)
+	}
+
+	local := filepath.Join(tl.dir, "cube.mp4")
+	assert.NoError(t, os.WriteFile(local, []byte("video"), 0644))
+	path, err := tl.Path("cube.mp4")
+	assert.NoError(t, err)
+	assert.Equal(t, local, path)
+
+	// OctoPrint's are downloaded into the timelapse directory
+	setTestTimelapses(t)
+	path, err = tl.Path("ring.mp4")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(tl.dir, "ring.mp4"), path)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "video", string(data))
+
+	_, err = tl.Path("missing.mp4")
+	assert.EqualError(t, err, "timelapse not found: missing.mp4")
+}
+
+func TestDownloadTimelapseFailure(t *testing.T) {
+	setTestTimelapses(t)
+	localPath := filepath.Join(t.TempDir(), "gone.mp4")
+
+	err := downloadTimelapse(octoprint.TimelapseFile{Name: "gone.mp4"}, localPath)
+	assert.Error(t, err)
+	// Nothing is left behind to be listed or delivered
+	assert.NoFileExists(t, localPath)
+	assert.NoFileExists(t, localPath+".part")
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"octoAgent/gcode"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Toolpath recording:
+
+Every move the position tracker interprets from serial.log while a job is
+running is appended to a JSONL file in TOOLPATH_DIR (default toolpaths),
+named after the job file and its start time. The first line is a header with
+the job, the following lines are the moves:
+
+{"t":12.345,"x":10,"y":20,"z":0.2,"e":0.05,"f":1800,"tool":0}
+
+t is the time since the job started in seconds, x/y/z the end position and e
+the extruded length of the move. Only the last TOOLPATH_KEEP recordings
+(default 20) are kept.
+
+toolpath list
+toolpath export name
+toolpath svg name [layer=N|last|all]
+
+svg renders the extrusions of a layer into the uploads directory. If the job
+file is still in OctoPrint's local storage, the planned path of the same
+layer is drawn underneath, so executed and planned paths can be compared.
+
+*/
+
+const toolpathFlushInterval = 2 * time.Second
+
+// ToolpathHeader is the first line of a recording
+type ToolpathHeader struct {
+	File    string    `json:"file"`
+	Path    string    `json:"path"`
+	Started time.Time `json:"started"`
+}
+
+// ToolpathPoint is an executed move
+type ToolpathPoint struct {
+	T    float64 `json:"t"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+	Z    float64 `json:"z"`
+	E    float64 `json:"e"`
+	F    float64 `json:"f"`
+	Tool int     `json:"tool"`
+}
+
+// ToolpathInfo describes a stored recording
+type ToolpathInfo struct {
+	Name    string    `json:"name"`
+	File    string    `json:"file"`
+	Started time.Time `json:"started"`
+	Size    int64     `json:"size"`
+}
+
+// Global recorder instance, set up in main
+var toolpathRecorder *ToolpathRecorder
+
+type ToolpathRecorder struct {
+	mutex     sync.Mutex
+	dir       string
+	keep      int
+	file      *os.File
+	writer    *bufio.Writer
+	started   time.Time
+	lastFlush time.Time
+	last      gcode.Position
+}
+
+func NewToolpathRecorder(dir string, keep int) (*ToolpathRecorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ToolpathRecorder{dir: dir, keep: keep}, nil
+}
+
+// OnPrintEvent is the PrintWatcher listener that starts and ends recordings
+func (r *ToolpathRecorder) OnPrintEvent(ev PrintEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch ev.Type {
+	case PrintStarted:
+		r.close()
+		if err := r.open(ev); err != nil {
+			log.Printf("Error: toolpath recording: %s", err)
+		}
+		r.prune()
+	case PrintPaused:
+		r.flush()
+	case PrintDone, PrintFailed, PrintCancelled, PrinterError, PrinterDisconnected:
+		r.close()
+	}
+}
+
+func (r *ToolpathRecorder) open(ev PrintEvent) error {
+	started := ev.Started
+	if started.IsZero() {
+		started = ev.Time
+	}
+
+	name := toolpathName(ev.File, started)
+	file, err := os.Create(filepath.Join(r.dir, name))
+	if err != nil {
+		return err
+	}
+
+	r.file = file
+	r.writer = bufio.NewWriterSize(file, 64*1024)
+	r.started = started
+	r.lastFlush = time.Now()
+
+	header := ToolpathHeader{File: ev.File, Path: ev.Path, Started: started}
+	return json.NewEncoder(r.writer).Encode(header)
+}
+
+func (r *ToolpathRecorder) flush() {
+	if r.writer == nil {
+		return
+	}
+	if err := r.writer.Flush(); err != nil {
+		log.Printf("Error: toolpath recording: %s", err)
+	}
+	r.lastFlush = time.Now()
+}
+
+func (r *ToolpathRecorder) close() {
+	if r.file == nil {
+		return
+	}
+	r.flush()
+	r.file.Close()
+	r.file = nil
+	r.writer = nil
+}
+
+// Close ends the active recording, e.g. on shutdown
+func (r *ToolpathRecorder) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.close()
+}
+
+// prune removes the oldest recordings beyond keep
+func (r *ToolpathRecorder) prune() {
+	infos, err := r.List()
+	if err != nil || len(infos) <= r.keep {
+		return
+	}
+	for _, info := range infos[r.keep:] {
+		os.Remove(filepath.Join(r.dir, info.Name))
+	}
+}
+
+// OnMove is the PositionTracker listener that appends executed moves
+func (r *ToolpathRecorder) OnMove(move gcode.Move, at time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.writer == nil {
+		return
+	}
+
+	point := ToolpathPoint{
+		T:    math.Round(at.Sub(r.started).Seconds()*1000) / 1000,
+		X:    move.To.X,
+		Y:    move.To.Y,
+		Z:    move.To.Z,
+		E:    math.Round(move.Extrude*100000) / 100000,
+		F:    move.Feedrate,
+		Tool: move.Tool,
+	}
+	if move.Home {
+		point.E = 0
+	}
+
+	if err := json.NewEncoder(r.writer).Encode(point); err != nil {
+		log.Printf("Error: toolpath recording: %s", err)
+		return
+	}
+	if at.Sub(r.lastFlush) >= toolpathFlushInterval {
+		r.flush()
+	}
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// toolpathName is the recording name for a job file and start time
+func toolpathName(file string, started time.Time) string {
+	base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	base = unsafeNameChars.ReplaceAllString(base, "_")
+	if base == "" || base == "." {
+		base = "job"
+	}
+	return fmt.Sprintf("%s-%s.jsonl", base, started.Format("20060102-150405"))
+}
+
+// List returns the stored recordings, newest first
+func (r *ToolpathRecorder) List() ([]ToolpathInfo, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []ToolpathInfo
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".jsonl" {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		info := ToolpathInfo{Name: entry.Name(), Size: fileInfo.Size(), Started: fileInfo.ModTime()}
+		if header, err := r.readHeader(entry.Name()); err == nil {
+			info.File = header.File
+			info.Started = header.Started
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.After(infos[j].Started) })
+	return infos, nil
+}
+
+func (r *ToolpathRecorder) readHeader(name string) (*ToolpathHeader, error) {
+	file, err := os.Open(filepath.Join(r.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := &ToolpathHeader{}
+	if err := json.NewDecoder(file).Decode(header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// Load reads a recording, the active one is flushed first
+func (r *ToolpathRecorder) Load(name string) (*ToolpathHeader, []ToolpathPoint, error) {
+	if name != filepath.Base(name) || filepath.Ext(name) != ".jsonl" {
+		return nil, nil, errors.New("invalid recording name")
+	}
+
+	r.mutex.Lock()
+	r.flush()
+	r.mutex.Unlock()
+
+	file, err := os.Open(filepath.Join(r.dir, name))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	header := &ToolpathHeader{}
+	if err := decoder.Decode(header); err != nil {
+		return nil, nil, err
+	}
+
+	var points []ToolpathPoint
+	for {
+		var point ToolpathPoint
+		err := decoder.Decode(&point)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A recording cut off mid-line still has all complete moves
+			break
+		}
+		points = append(points, point)
+	}
+	return header, points, nil
+}
+
+// toolpathSegment is an extruding line in a layer
+type toolpathSegment struct {
+	X1, Y1, X2, Y2 float64
+}
+
+// toolpathLayer groups extrusions at one Z
+type toolpathLayer struct {
+	Z        float64
+	Segments []toolpathSegment
+}
+
+// executedLayers groups the extruding moves of a recording by Z, in the
+// order the layers were started
+func executedLayers(points []ToolpathPoint) []toolpathLayer {
+	var layers []toolpathLayer
+	index := make(map[float64]int)
+
+	for i := 1; i < len(points); i++ {
+		from, to := points[i-1], points[i]
+		if to.E <= 0 || (from.X == to.X && from.Y == to.Y) {
+			continue
+		}
+
+		z := layerZ(to.Z)
+		n, ok := index[z]
+		if !ok {
+			n = len(layers)
+			index[z] = n
+			layers = append(layers, toolpathLayer{Z: z})
+		}
+		layers[n].Segments = append(layers[n].Segments, toolpathSegment{from.X, from.Y, to.X, to.Y})
+	}
+	return layers
+}
+
+// layerZ rounds a height to a micron, the key of a layer
+func layerZ(z float64) float64 {
+	return math.Round(z*1000) / 1000
+}
+
+// plannedSegments returns the extruding moves of a G-code file by layerZ
+func plannedSegments(filePath string) (map[float64][]toolpathSegment, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	segments := make(map[float64][]toolpathSegment)
+	machine := gcode.NewMachine()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		cmd, ok := gcode.ParseLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		move, isMove := machine.Apply(cmd)
+		if !isMove || !move.Extruding() {
+			continue
+		}
+		z := layerZ(move.To.Z)
+		segments[z] = append(segments[z], toolpathSegment{move.From.X, move.From.Y, move.To.X, move.To.Y})
+	}
+	return segments, scanner.Err()
+}
+
+// toolpathSVG draws the planned path in grey and the executed path in red,
+// printer Y points up
+func toolpathSVG(title string, planned, executed []toolpathSegment) string {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, segments := range [][]toolpathSegment{planned, executed} {
+		for _, s := range segments {
+			minX = math.Min(minX, math.Min(s.X1, s.X2))
+			maxX = math.Max(maxX, math.Max(s.X1, s.X2))
+			minY = math.Min(minY, math.Min(s.Y1, s.Y2))
+			maxY = math.Max(maxY, math.Max(s.Y1, s.Y2))
+		}
+	}
+	if math.IsInf(minX, 1) {
+		minX, minY, maxX, maxY = 0, 0, 1, 1
+	}
+
+	const margin = 2.0
+	width := maxX - minX + 2*margin
+	height := maxY - minY + 2*margin
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="800" height="%.0f" viewBox="%.3f %.3f %.3f %.3f">`+"\n",
+		800*height/width, minX-margin, -maxY-margin, width, height)
+	fmt.Fprintf(&sb, "<title>%s</title>\n", escapeXML(title))
+	fmt.Fprintf(&sb, `<rect x="%.3f" y="%.3f" width="%.3f" height="%.3f" fill="white"/>`+"\n",
+		minX-margin, -maxY-margin, width, height)
+
+	path := func(segments []toolpathSegment, color string, strokeWidth float64) {
+		if len(segments) == 0 {
+			return
+		}
+		fmt.Fprintf(&sb, `<path fill="none" stroke="%s" stroke-width="%.2f" stroke-linecap="round" d="`, color, strokeWidth)
+		lastX, lastY := math.NaN(), math.NaN()
+		for _, s := range segments {
+			if s.X1 != lastX || s.Y1 != lastY {
+				fmt.Fprintf(&sb, "M%.3f %.3f", s.X1, -s.Y1)
+			}
+			fmt.Fprintf(&sb, "L%.3f %.3f", s.X2, -s.Y2)
+			lastX, lastY = s.X2, s.Y2
+		}
+		sb.WriteString("\"/>\n")
+	}
+	path(planned, "#bbbbbb", 0.6)
+	path(executed, "#d62728", 0.3)
+
+	sb.WriteString("</svg>\n")
+	return sb.String()
+}
+
+func escapeXML(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// renderToolpath writes SVG files for the selected layers of a recording
+// into the uploads directory and returns their names
+func renderToolpath(name, selection string) ([]string, error) {
+	header, points, err := toolpathRecorder.Load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := executedLayers(points)
+	if len(layers) == 0 {
+		return nil, errors.New("the recording has no extrusions")
+	}
+
+	var selected []int
+	switch selection {
+	case "last":
+		selected = []int{len(layers) - 1}
+	case "all":
+		for i := range layers {
+			selected = append(selected, i)
+		}
+	default:
+		n, err := strconv.Atoi(selection)
+		if err != nil || n < 1 || n > len(layers) {
+			return nil, fmt.Errorf("layer must be between 1 and %d, last or all", len(layers))
+		}
+		selected = []int{n - 1}
+	}
+
+	// The planned path needs the job file in local storage, it is parsed once
+	// for all layers
+	var planned map[float64][]toolpathSegment
+	if header.Path != "" {
+		if filePath, err := octoUploadPath(header.Path); err == nil {
+			if _, err := os.Stat(filePath); err == nil {
+				planned, err = plannedSegments(filePath)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	DirExists(UpLoadFilePath)
+	base := strings.TrimSuffix(name, ".jsonl")
+	var files []string
+	for _, i := range selected {
+		layer := layers[i]
+		title := fmt.Sprintf("%s layer %d Z%.3f", header.File, i+1, layer.Z)
+		fileName := fmt.Sprintf("%s-layer%03d.svg", base, i+1)
+		svg := toolpathSVG(title, planned[layer.Z], layer.Segments)
+		if err := os.WriteFile(filepath.Join(UpLoadFilePath, fileName), []byte(svg), 0644); err != nil {
+			return files, err
+		}
+		files = append(files, fileName)
+	}
+	return files, nil
+}
+
+// Command structure: toolpath list | export name | svg name [layer=N|last|all]
+func ToolpathCommand(commandList []string) string {
+	usage := "usage: toolpath list | export name | svg name [layer=N|last|all]"
+	if len(commandList) < 2 {
+		return "Error: parameter mismatch"
+	}
+	if toolpathRecorder == nil {
+		return "Error: toolpath recording is not available"
+	}
+
+	switch commandList[1] {
+	case "-help":
+		return usage
+
+	case "list":
+		if len(commandList) != 2 {
+			return "Error: parameter mismatch"
+		}
+		infos, err := toolpathRecorder.List()
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		jsonBytes, err := json.Marshal(infos)
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		return string(jsonBytes)
+
+	case "export":
+		if len(commandList) != 3 {
+			return "Error: parameter mismatch"
+		}
+		name := commandList[2]
+		if name != filepath.Base(name) {
+			return "Error: invalid recording name"
+		}
+		toolpathRecorder.mutex.Lock()
+		toolpathRecorder.flush()
+		toolpathRecorder.mutex.Unlock()
+
+		data, err := os.ReadFile(filepath.Join(toolpathRecorder.dir, name))
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		DirExists(UpLoadFilePath)
+		if err := os.WriteFile(filepath.Join(UpLoadFilePath, name), data, 0644); err != nil {
+			return "Error: " + err.Error()
+		}
+		return name + " was exported"
+
+	case "svg":
+		if len(commandList) < 3 || len(commandList) > 4 {
+			return "Error: parameter mismatch"
+		}
+		selection := "last"
+		if len(commandList) == 4 {
+			key, value, found := strings.Cut(commandList[3], "=")
+			if !found || key != "layer" {
+				return "Error: syntax, expected layer=N|last|all: " + commandList[3]
+			}
+			selection = value
+		}
+
+		files, err := renderToolpath(commandList[2], selection)
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		if len(files) == 1 {
+			return files[0] + " was rendered"
+		}
+		return fmt.Sprintf("%d layers were rendered: %s ... %s", len(files), files[0], files[len(files)-1])
+
+	default:
+		return "Error: unknown subcommand, " + usage
+	}
+}
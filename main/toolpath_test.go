@@ -0,0 +1,110 @@
+package main
+
+import (
+	"octoAgent/gcode"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToolpathName(t *testing.T) {
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	assert.Equal(t, "cube-20240102-030405.jsonl", toolpathName("cube.gcode", started))
+	assert.Equal(t, "My_Cube_v2_-20240102-030405.jsonl", toolpathName("parts/My Cube (v2).gcode", started))
+	assert.Equal(t, "job-20240102-030405.jsonl", toolpathName(".gcode", started))
+	assert.Equal(t, "job-20240102-030405.jsonl", toolpathName("", started))
+}
+
+func TestExecutedLayers(t *testing.T) {
+	points := []ToolpathPoint{
+		{X: 0, Y: 0, Z: 0.2},
+		{X: 10, Y: 0, Z: 0.2, E: 0.5},
+		{X: 10, Y: 10, Z: 0.2, E: 0.5},
+		// Travel and retraction are not drawn
+		{X: 20, Y: 20, Z: 0.2},
+		{X: 20, Y: 20, Z: 0.2, E: 0.8},
+		{X: 20, Y: 20, Z: 0.1 + 0.2},
+		{X: 30, Y: 20, Z: 0.1 + 0.2, E: 0.5},
+		// Moves back at an earlier height are added to its layer
+		{X: 0, Y: 10, Z: 0.2, E: 0.5},
+	}
+
+	layers := executedLayers(points)
+	assert.Equal(t, 2, len(layers))
+	assert.Equal(t, 0.2, layers[0].Z)
+	assert.Equal(t, []toolpathSegment{{0, 0, 10, 0}, {10, 0, 10, 10}, {30, 20, 0, 10}}, layers[0].Segments)
+	assert.Equal(t, 0.3, layers[1].Z)
+	assert.Equal(t, []toolpathSegment{{20, 20, 30, 20}}, layers[1].Segments)
+
+	assert.Empty(t, executedLayers(nil))
+}
+
+func TestPlannedSegments(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "cube.gcode")
+	gcode := strings.Join([]string{
+		"G28", "G90", "M83",
+		"G1 Z0.2 F600", "G1 X10 Y0 E1", "G1 X10 Y10 E1",
+		"G0 Z0.4", "G0 X0 Y0", "G1 X5 Y5 E0.5",
+	}, "\n")
+	assert.NoError(t, os.WriteFile(filePath, []byte(gcode), 0644))
+
+	planned, err := plannedSegments(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(planned))
+	assert.Equal(t, []toolpathSegment{{0, 0, 10, 0}, {10, 0, 10, 10}}, planned[0.2])
+	assert.Equal(t, []toolpathSegment{{0, 0, 5, 5}}, planned[0.4])
+
+	_, err = plannedSegments(filepath.Join(t.TempDir(), "missing.gcode"))
+	assert.Error(t, err)
+}
+
+func TestToolpathSVG(t *testing.T) {
+	planned := []toolpathSegment{{0, 0, 10, 0}, {10, 0, 10, 10}}
+	executed := []toolpathSegment{{0, 0, 10, 0}, {20, 20, 30, 20}}
+
+	svg := toolpathSVG("cube <v2> & more", planned, executed)
+	assert.True(t, strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg"`))
+	assert.True(t, strings.HasSuffix(svg, "</svg>\n"))
+	assert.Contains(t, svg, "<title>cube &lt;v2&gt; &amp; more</title>")
+	// The bounding box of both paths with a 2mm margin, Y is flipped
+	assert.Contains(t, svg, `viewBox="-2.000 -22.000 34.000 24.000"`)
+	// Connected segments continue the path, others start a new one
+	assert.Contains(t, svg, `stroke="#bbbbbb" stroke-width="0.60" stroke-linecap="round" d="M0.000 -0.000L10.000 -0.000L10.000 -10.000"/>`)
+	assert.Contains(t, svg, `stroke="#d62728" stroke-width="0.30" stroke-linecap="round" d="M0.000 -0.000L10.000 -0.000M20.000 -20.000L30.000 -20.000"/>`)
+
+	empty := toolpathSVG("empty", nil, nil)
+	assert.Contains(t, empty, `viewBox="-2.000 -3.000 5.000 5.000"`)
+	assert.NotContains(t, empty, "<path")
+}
+
+func TestToolpathRecorderClose(t *testing.T) {
+	r, err := NewToolpathRecorder(t.TempDir(), 5)
+	assert.NoError(t, err)
+
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	r.OnPrintEvent(PrintEvent{Type: PrintStarted, File: "cube.gcode", Started: started})
+	r.OnMove(gcode.Move{To: gcode.Position{X: 10, Y: 10, Z: 0.2}, Extrude: 0.5, Feedrate: 1200}, started.Add(time.Second))
+
+	// Moves are buffered until the recording is closed
+	name := toolpathName("cube.gcode", started)
+	data, err := os.ReadFile(filepath.Join(r.dir, name))
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	r.Close()
+	data, err = os.ReadFile(filepath.Join(r.dir, name))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+
+	// Nothing is recorded after closing
+	r.OnMove(gcode.Move{To: gcode.Position{X: 20}}, started.Add(2*time.Second))
+	r.Close()
+	_, points, err := r.Load(name)
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+}
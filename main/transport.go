@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	bot "octoAgent"
+	"strconv"
+	"sync"
+
+	"cwtch.im/cwtch/event"
+	"cwtch.im/cwtch/functionality/filesharing"
+	"cwtch.im/cwtch/protocol/connections"
+)
+
+// Global transport instance, set up in main
+var transport Transport
+
+// PeerState is the transport independent connection state of a contact
+type PeerState int
+
+const (
+	PeerOffline PeerState = iota
+	PeerConnecting
+	PeerOnline
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerOnline:
+		return "online"
+	case PeerConnecting:
+		return "connecting"
+	default:
+		return "offline"
+	}
+}
+
+// ContactInfo describes a conversation known to the transport
+type ContactInfo struct {
+	ID     int    `json:"id"`
+	Handle string `json:"handle"`
+}
+
+// TransportEventType identifies the kind of inbound event
+type TransportEventType int
+
+const (
+	UnhandledEvent TransportEventType = iota
+	ContactRequestEvent
+	GroupInviteEvent
+	PeerMessageEvent
+	GroupMessageEvent
+	PeerStateEvent
+	ServerStateEvent
+	AcknowledgementEvent
+	IgnoredEvent
+)
+
+// TransportEvent is an inbound event delivered by a transport
+type TransportEvent struct {
+	Type    TransportEventType
+	Contact ContactInfo
+	Data    string
+	State   string
+	Raw     string
+}
+
+// Transport is the messaging layer used by the command handlers
+type Transport interface {
+	// Send delivers an already packaged message to a conversation
+	Send(conversationID int, msg string) error
+	// SendFile offers a local file to a conversation
+	SendFile(conversationID int, path string) error
+	// Next blocks until the next inbound event is available
+	Next() TransportEvent
+	// PeerState returns the connection state of a contact
+	PeerState(handle string) PeerState
+	// ContactInfo returns the conversation associated with a contact
+	ContactInfo(handle string) (*ContactInfo, error)
+	// Contact returns the contact of a conversation
+	Contact(conversationID int) (*ContactInfo, error)
+	// AcceptContact accepts a pending contact request
+	AcceptContact(conversationID int) error
+	// ImportBundle imports a contact or group bundle
+	ImportBundle(bundle string) error
+	// Address returns the address of the agent on this transport
+	Address() string
+}
+
+// packMessage wraps msg into the overlay envelope understood by peers
+func packMessage(overlay int, msg string) string {
+	data, _ := json.Marshal(bot.MessageWrapper{Overlay: overlay, Data: msg})
+	return string(data)
+}
+
+// sendReply packages msg as a chat message and sends it to a conversation
+func sendReply(conversationID int, msg string) error {
+	return transport.Send(conversationID, packageReply(msg))
+}
+
+/*
+
+CwtchTransport:
+
+The production backend, a thin adapter over cwtchbot.Peer and cwtchbot.Queue.
+Cwtch events are translated into TransportEvents so that the dispatch loop
+does not depend on the cwtch event model.
+
+*/
+
+type CwtchTransport struct {
+	bot *bot.CwtchBot
+}
+
+func NewCwtchTransport(cb *bot.CwtchBot) *CwtchTransport {
+	return &CwtchTransport{bot: cb}
+}
+
+func (t *CwtchTransport) Send(conversationID int, msg string) error {
+	_, err := t.bot.Peer.SendMessage(conversationID, msg)
+	return err
+}
+
+// SendFile shares the file over the file sharing overlay, the peer downloads
+// it while the agent is online
+func (t *CwtchTransport) SendFile(conversationID int, path string) error {
+	_, message, err := filesharing.FunctionalityGate().ShareFile(path, t.bot.Peer)
+	if err != nil {
+		return err
+	}
+	_, err = t.bot.Peer.SendMessage(conversationID, message)
+	return err
+}
+
+func (t *CwtchTransport) Next() TransportEvent {
+	message := t.bot.Queue.Next()
+	ev := TransportEvent{
+		Data:  message.Data[event.Data],
+		State: message.Data[event.ConnectionState],
+		Raw:   string(message.EventType),
+	}
+	ev.Contact.Handle = message.Data[event.RemotePeer]
+
+	switch message.EventType {
+	case event.InvitePeerToGroup:
+		ev.Type = GroupInviteEvent
+	case event.ContactCreated:
+		ev.Type = ContactRequestEvent
+	case event.NewMessageFromPeer:
+		ev.Type = PeerMessageEvent
+	case event.NewMessageFromGroup:
+		ev.Type = GroupMessageEvent
+		id, err := strconv.Atoi(message.Data[event.ConversationID])
+		if err != nil {
+			ev.Type = UnhandledEvent
+			ev.Raw = fmt.Sprintf("invalid group conversation id %q", message.Data[event.ConversationID])
+			return ev
+		}
+		ev.Contact.ID = id
+		return ev
+	case event.PeerStateChange:
+		ev.Type = PeerStateEvent
+		return ev
+	case event.ServerStateChange:
+		ev.Type = ServerStateEvent
+		return ev
+	case event.PeerAcknowledgement:
+		ev.Type = AcknowledgementEvent
+		ev.Data = message.Data[event.EventID]
+		return ev
+	case event.SendRetValMessageToPeer, event.NewGetValMessageFromPeer:
+		// We need to dig into this, but it does not effect the functionality of the bot
+		ev.Type = IgnoredEvent
+		return ev
+	default:
+		ev.Type = UnhandledEvent
+		return ev
+	}
+
+	// Resolve the conversation for peer scoped events
+	if conversation, err := t.bot.Peer.FetchConversationInfo(ev.Contact.Handle); err == nil {
+		ev.Contact.ID = conversation.ID
+	}
+	return ev
+}
+
+func (t *CwtchTransport) PeerState(handle string) PeerState {
+	switch t.bot.Peer.GetPeerState(handle) {
+	case connections.AUTHENTICATED, connections.CONNECTED:
+		return PeerOnline
+	case connections.CONNECTING:
+		return PeerConnecting
+	default:
+		return PeerOffline
+	}
+}
+
+func (t *CwtchTransport) ContactInfo(handle string) (*ContactInfo, error) {
+	conversation, err := t.bot.Peer.FetchConversationInfo(handle)
+	if err != nil {
+		return nil, err
+	}
+	return &ContactInfo{ID: conversation.ID, Handle: conversation.Handle}, nil
+}
+
+func (t *CwtchTransport) Contact(conversationID int) (*ContactInfo, error) {
+	conversation, err := t.bot.Peer.GetConversationInfo(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	return &ContactInfo{ID: conversation.ID, Handle: conversation.Handle}, nil
+}
+
+func (t *CwtchTransport) AcceptContact(conversationID int) error {
+	return t.bot.Peer.AcceptConversation(conversationID)
+}
+
+func (t *CwtchTransport) ImportBundle(bundle string) error {
+	return t.bot.Peer.ImportBundle(bundle)
+}
+
+func (t *CwtchTransport) Address() string {
+	return t.bot.Peer.GetOnion()
+}
+
+/*
+
+LoopbackTransport:
+
+An in-memory backend that never touches Tor. Inbound events are queued with
+Inject and every message sent by the agent is recorded in the outbox, which
+allows the dispatch loop and services such as Publish to run in tests or be
+embedded in other tooling.
+
+*/
+
+// SentMessage is a message recorded by the LoopbackTransport
+type SentMessage struct {
+	ConversationID int
+	Message        string
+}
+
+type LoopbackTransport struct {
+	mutex    sync.Mutex
+	inbound  chan TransportEvent
+	outbox   []SentMessage
+	files    []SentMessage
+	contacts map[string]*ContactInfo
+	states   map[string]PeerState
+	accepted map[int]bool
+	bundles  []string
+	nextID   int
+}
+
+func NewLoopbackTransport() *LoopbackTransport {
+	return &LoopbackTransport{
+		inbound:  make(chan TransportEvent, 64),
+		contacts: make(map[string]*ContactInfo),
+		states:   make(map[string]PeerState),
+		accepted: make(map[int]bool),
+		nextID:   1,
+	}
+}
+
+// AddContact registers a contact with the given state and returns its conversation
+func (t *LoopbackTransport) AddContact(handle string, state PeerState) ContactInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	contact, exists := t.contacts[handle]
+	if !exists {
+		contact = &ContactInfo{ID: t.nextID, Handle: handle}
+		t.contacts[handle] = contact
+		t.nextID++
+	}
+	t.states[handle] = state
+	return *contact
+}
+
+// Inject queues an inbound event to be returned by Next
+func (t *LoopbackTransport) Inject(ev TransportEvent) {
+	t.inbound <- ev
+}
+
+// InjectMessage queues a chat message from a registered contact
+func (t *LoopbackTransport) InjectMessage(handle string, msg string) error {
+	contact, err := t.ContactInfo(handle)
+	if err != nil {
+		return err
+	}
+	t.Inject(TransportEvent{Type: PeerMessageEvent, Contact: *contact, Data: packageReply(msg)})
+	return nil
+}
+
+// Sent returns a copy of all messages sent so far
+func (t *LoopbackTransport) Sent() []SentMessage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	sent := make([]SentMessage, len(t.outbox))
+	copy(sent, t.outbox)
+	return sent
+}
+
+func (t *LoopbackTransport) Send(conversationID int, msg string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.outbox = append(t.outbox, SentMessage{ConversationID: conversationID, Message: msg})
+	return nil
+}
+
+// SentFiles returns a copy of all files offered so far, Message is the path
+func (t *LoopbackTransport) SentFiles() []SentMessage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	files := make([]SentMessage, len(t.files))
+	copy(files, t.files)
+	return files
+}
+
+func (t *LoopbackTransport) SendFile(conversationID int, path string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.files = append(t.files, SentMessage{ConversationID: conversationID, Message: path})
+	return nil
+}
+
+func (t *LoopbackTransport) Next() TransportEvent {
+	return <-t.inbound
+}
+
+func (t *LoopbackTransport) PeerState(handle string) PeerState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.states[handle]
+}
+
+func (t *LoopbackTransport) ContactInfo(handle string) (*ContactInfo, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	contact, exists := t.contacts[handle]
+	if !exists {
+		return nil, errors.New("contact not found: " + handle)
+	}
+	info := *contact
+	return &info, nil
+}
+
+func (t *LoopbackTransport) Contact(conversationID int) (*ContactInfo, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, contact := range t.contacts {
+		if contact.ID == conversationID {
+			info := *contact
+			return &info, nil
+		}
+	}
+	return nil, fmt.Errorf("conversation not found: %d", conversationID)
+}
+
+func (t *LoopbackTransport) AcceptContact(conversationID int) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.accepted[conversationID] = true
+	return nil
+}
+
+func (t *LoopbackTransport) ImportBundle(bundle string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.bundles = append(t.bundles, bundle)
+	return nil
+}
+
+func (t *LoopbackTransport) Address() string {
+	return "loopback"
+}
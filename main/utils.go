@@ -7,11 +7,11 @@ import (
 )
 
 func packageReply(msg string) string {
-	return string(cwtchbot.PackMessage(model.OverlayChat, msg))
+	return packMessage(model.OverlayChat, msg)
 }
 
 func packageActionableReply(msg string) string {
-	return string(cwtchbot.PackMessage(ActionableMessageOverlay, msg))
+	return packMessage(ActionableMessageOverlay, msg)
 }
 
 func Unwrap(onion int, msg string) *OverlayEnvelope {
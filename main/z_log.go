@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+Z logs:
+
+Every Z change the position tracker sees is appended to a log in the -z-dir
+directory (default zlogs), one "seconds z" line per change. A running job
+gets its own log named after the job file and start time, like the toolpath
+recordings, with the seconds since the job started. Changes outside a job go
+to idle.z with Unix seconds, it is rotated to idle.z.1 when it grows beyond
+1MB. Writes are buffered and flushed every zLogFlushInterval (3 seconds),
+when a job is paused or ends and before a log is read. Only the last 50 job
+logs are kept.
+
+zlog list
+zlog name|current [unique]
+
+unique returns the distinct Z values sorted ascending, the way z_stream.txt
+used to be written.
+
+*/
+
+const (
+	zLogKeep          = 50
+	zLogIdleName      = "idle.z"
+	zLogIdleMaxSize   = 1024 * 1024
+	zLogFlushInterval = 3 * time.Second
+)
+
+// ZSample is a Z change, Time is the number of seconds since the job
+// started or the Unix time in the idle log
+type ZSample struct {
+	Time float64 `json:"t"`
+	Z    float64 `json:"z"`
+}
+
+// ZLogInfo describes a stored Z log
+type ZLogInfo struct {
+	Name     string    `json:"name"`
+	Modified time.Time `json:"modified"`
+	Size     int64     `json:"size"`
+}
+
+// Global Z log, set up in init with the position tracker
+var zLog *ZLog
+
+type ZLog struct {
+	mutex   sync.Mutex
+	dir     string
+	name    string
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+	started time.Time
+}
+
+func NewZLog(dir string) (*ZLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	z := &ZLog{dir: dir}
+	if err := z.open(zLogIdleName, time.Unix(0, 0)); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// open appends to the named log
+func (z *ZLog) open(name string, started time.Time) error {
+	file, err := os.OpenFile(filepath.Join(z.dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	z.name = name
+	z.file = file
+	z.writer = bufio.NewWriter(file)
+	z.size = info.Size()
+	z.started = started
+	return nil
+}
+
+func (z *ZLog) flush() {
+	if z.writer == nil {
+		return
+	}
+	if err := z.writer.Flush(); err != nil {
+		log.Printf("Error: Z log %s: %s", z.name, err)
+	}
+}
+
+// Start flushes buffered changes every zLogFlushInterval, so the log is
+// current while Z does not change, e.g. during a long layer
+func (z *ZLog) Start() {
+	go func() {
+		ticker := time.NewTicker(zLogFlushInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			z.mutex.Lock()
+			if z.writer != nil && z.writer.Buffered() > 0 {
+				z.flush()
+			}
+			z.mutex.Unlock()
+		}
+	}()
+}
+
+func (z *ZLog) close() {
+	if z.file == nil {
+		return
+	}
+	z.flush()
+	z.file.Close()
+	z.file = nil
+	z.writer = nil
+}
+
+// Close closes the current log, e.g. on shutdown
+func (z *ZLog) Close() {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	z.close()
+}
+
+// switchTo closes the current log and appends to the named one
+func (z *ZLog) switchTo(name string, started time.Time) {
+	z.close()
+	if err := z.open(name, started); err != nil {
+		log.Printf("Error: Z log %s: %s", name, err)
+	}
+}
+
+// OnPrintEvent is the PrintWatcher listener that switches between job logs
+func (z *ZLog) OnPrintEvent(ev PrintEvent) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	switch ev.Type {
+	case PrintStarted:
+		started := ev.Started
+		if started.IsZero() {
+			started = ev.Time
+		}
+		z.switchTo(zLogName(ev.File, started), started)
+		z.prune()
+	case PrintPaused:
+		z.flush()
+	case PrintDone, PrintFailed, PrintCancelled, PrinterError, PrinterDisconnected:
+		if z.name != zLogIdleName {
+			z.switchTo(zLogIdleName, time.Unix(0, 0))
+		}
+	}
+}
+
+// Record appends a Z change
+func (z *ZLog) Record(value float64, at time.Time) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if z.writer == nil {
+		return
+	}
+
+	// Only the idle log grows without bound
+	if z.name == zLogIdleName && z.size > zLogIdleMaxSize {
+		z.close()
+		path := filepath.Join(z.dir, zLogIdleName)
+		if err := os.Rename(path, path+".1"); err != nil {
+			log.Printf("Error: Z log rotation: %s", err)
+		}
+		if err := z.open(zLogIdleName, time.Unix(0, 0)); err != nil {
+			log.Printf("Error: Z log %s: %s", zLogIdleName, err)
+			return
+		}
+	}
+
+	n, err := fmt.Fprintf(z.writer, "%.3f %.3f\n", at.Sub(z.started).Seconds(), value)
+	if err != nil {
+		log.Printf("Error: Z log %s: %s", z.name, err)
+		return
+	}
+	z.size += int64(n)
+}
+
+// prune removes the oldest job logs beyond zLogKeep
+func (z *ZLog) prune() {
+	infos, err := z.List()
+	if err != nil {
+		return
+	}
+
+	var jobs []ZLogInfo
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name, zLogIdleName) && info.Name != z.name {
+			jobs = append(jobs, info)
+		}
+	}
+	if len(jobs) < zLogKeep {
+		return
+	}
+	for _, info := range jobs[zLogKeep-1:] {
+		os.Remove(filepath.Join(z.dir, info.Name))
+	}
+}
+
+// zLogName is the log name for a job file and start time
+func zLogName(file string, started time.Time) string {
+	return strings.TrimSuffix(toolpathName(file, started), ".jsonl") + ".z"
+}
+
+// List returns the stored logs, most recently written first
+func (z *ZLog) List() ([]ZLogInfo, error) {
+	entries, err := os.ReadDir(z.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []ZLogInfo
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, ZLogInfo{Name: entry.Name(), Modified: fileInfo.ModTime(), Size: fileInfo.Size()})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Modified.After(infos[j].Modified) })
+	return infos, nil
+}
+
+// Current returns the name of the log that is written to
+func (z *ZLog) Current() string {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	return z.name
+}
+
+// Read returns the samples of a log, the current log is flushed first
+func (z *ZLog) Read(name string) ([]ZSample, error) {
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return nil, errors.New("invalid log name")
+	}
+
+	z.mutex.Lock()
+	if name == z.name {
+		z.flush()
+	}
+	z.mutex.Unlock()
+
+	file, err := os.Open(filepath.Join(z.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var samples []ZSample
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		t, err1 := strconv.ParseFloat(fields[0], 64)
+		value, err2 := strconv.ParseFloat(fields[1], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		samples = append(samples, ZSample{Time: t, Z: value})
+	}
+	return samples, scanner.Err()
+}
+
+// uniqueZ returns the distinct Z values, ascending
+func uniqueZ(samples []ZSample) []float64 {
+	seen := make(map[float64]bool)
+	var values []float64
+	for _, s := range samples {
+		value := math.Round(s.Z*1000) / 1000
+		if !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	sort.Float64s(values)
+	return values
+}
+
+// Command structure: zlog list | zlog name|current [unique]
+func ZLogCommand(commandList []string) string {
+	usage := "usage: zlog list | zlog name|current [unique]"
+	if zLog == nil {
+		return "Error: Z logging is disabled"
+	}
+
+	switch len(commandList) {
+	case 2:
+		switch commandList[1] {
+		case "-help":
+			return usage
+		case "list":
+			infos, err := zLog.List()
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			jsonBytes, err := json.Marshal(infos)
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			return string(jsonBytes)
+		}
+		fallthrough
+
+	case 3:
+		name := commandList[1]
+		if name == "current" {
+			name = zLog.Current()
+		}
+		unique := false
+		if len(commandList) == 3 {
+			if commandList[2] != "unique" {
+				return "Error: parameter mismatch, " + usage
+			}
+			unique = true
+		}
+
+		samples, err := zLog.Read(name)
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+
+		var result interface{} = samples
+		if unique {
+			result = uniqueZ(samples)
+		}
+		jsonBytes, err := json.Marshal(result)
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		return string(jsonBytes)
+
+	default:
+		return "Error: parameter mismatch"
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZLogJob(t *testing.T) {
+	dir := t.TempDir()
+	z, err := NewZLog(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, zLogIdleName, z.Current())
+
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	z.OnPrintEvent(PrintEvent{Type: PrintStarted, File: "cube.gcode", Started: started})
+	assert.Equal(t, "cube-20240102-030405.z", z.Current())
+
+	z.Record(0.2, started.Add(time.Second))
+	z.Record(0.4, started.Add(90*time.Second))
+	z.Record(0.2, started.Add(91*time.Second))
+
+	// Buffered until flushed, reading the current log flushes it
+	data, err := os.ReadFile(filepath.Join(dir, z.Current()))
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+	samples, err := z.Read(z.Current())
+	assert.NoError(t, err)
+	assert.Equal(t, []ZSample{{1, 0.2}, {90, 0.4}, {91, 0.2}}, samples)
+	assert.Equal(t, []float64{0.2, 0.4}, uniqueZ(samples))
+
+	z.OnPrintEvent(PrintEvent{Type: PrintDone, File: "cube.gcode"})
+	assert.Equal(t, zLogIdleName, z.Current())
+
+	_, err = z.Read("../cube-20240102-030405.z")
+	assert.Error(t, err)
+}
+
+func TestZLogClose(t *testing.T) {
+	dir := t.TempDir()
+	z, err := NewZLog(dir)
+	assert.NoError(t, err)
+
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	z.OnPrintEvent(PrintEvent{Type: PrintStarted, File: "cube.gcode", Started: started})
+	z.Record(0.2, started.Add(time.Second))
+
+	// Closing writes out the buffered changes, later ones are dropped
+	z.Close()
+	z.Record(0.4, started.Add(2*time.Second))
+	z.Close()
+	data, err := os.ReadFile(filepath.Join(dir, "cube-20240102-030405.z"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1.000 0.200\n", string(data))
+}
@@ -18,6 +18,9 @@ type Client struct {
 	Endpoint string
 	// APIKey used to connect to the OctoPrint REST API server.
 	APIKey string
+	// ErrorHandler if set is called for every request that fails, either at
+	// the transport level or with an error status code.
+	ErrorHandler func(method, target string, err error)
 
 	c *http.Client
 }
@@ -47,6 +50,30 @@ func (c *Client) doJSONRequest(
 func (c *Client) doRequest(
 	method, target, contentType string, body io.Reader, m statusMapping,
 ) ([]byte, error) {
+	b, err := c.sendRequest(method, target, contentType, body, m)
+	if err != nil && c.ErrorHandler != nil {
+		c.ErrorHandler(method, target, err)
+	}
+
+	return b, err
+}
+
+// doStreamRequest is doRequest for large responses, the body is copied to w
+// instead of being read into memory.
+func (c *Client) doStreamRequest(
+	method, target string, w io.Writer, m statusMapping,
+) error {
+	err := c.streamRequest(method, target, w, m)
+	if err != nil && c.ErrorHandler != nil {
+		c.ErrorHandler(method, target, err)
+	}
+
+	return err
+}
+
+func (c *Client) newRequest(
+	method, target, contentType string, body io.Reader,
+) (*http.Request, error) {
 	req, err := http.NewRequest(method, joinURL(c.Endpoint, target), body)
 	if err != nil {
 		return nil, err
@@ -60,6 +87,16 @@ func (c *Client) doRequest(
 	}
 
 	req.Header.Add("X-Api-Key", c.APIKey)
+	return req, nil
+}
+
+func (c *Client) sendRequest(
+	method, target, contentType string, body io.Reader, m statusMapping,
+) ([]byte, error) {
+	req, err := c.newRequest(method, target, contentType, body)
+	if err != nil {
+		return nil, err
+	}
 
 	resp, err := c.c.Do(req)
 	if err != nil {
@@ -69,17 +106,50 @@ func (c *Client) doRequest(
 	return c.handleResponse(resp, m)
 }
 
-func (c *Client) handleResponse(r *http.Response, m statusMapping) ([]byte, error) {
-	defer r.Body.Close()
+func (c *Client) streamRequest(
+	method, target string, w io.Writer, m statusMapping,
+) error {
+	req, err := c.newRequest(method, target, "", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp, m); err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 209 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
 
+// checkStatus returns the error of a mapped status code or a missing API key
+func checkStatus(r *http.Response, m statusMapping) error {
 	if m != nil {
 		if err := m.Error(r.StatusCode); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
 	if r.StatusCode == 401 {
-		return nil, ErrUnauthorized
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+func (c *Client) handleResponse(r *http.Response, m statusMapping) ([]byte, error) {
+	defer r.Body.Close()
+
+	if err := checkStatus(r, m); err != nil {
+		return nil, err
 	}
 
 	if r.StatusCode == 204 {
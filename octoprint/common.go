@@ -33,6 +33,8 @@ type JobResponse struct {
 	Job JobInformation `json:"job"`
 	// Progress contains information regarding the progress of the current job.
 	Progress ProgressInformation `json:"progress"`
+	// State is the state of the printer, e.g. `Printing`.
+	State string `json:"state"`
 }
 
 // JobInformation contains information regarding the target of the current job.
@@ -45,13 +47,8 @@ type JobInformation struct {
 	LastPrintTime float64 `json:"lastPrintTime"`
 	// Filament contains Information regarding the estimated filament
 	// usage of the print job.
-	Filament struct {
-		// Length of filament used, in mm
-		Length float64 `json:"length"`
-		// Volume of filament used, in cm³
-		Volume float64 `json:"volume"`
-	} `json:"filament"`
-	FilePosition uint64 `json:"filepos"`
+	Filament     FilamentInformation `json:"filament"`
+	FilePosition uint64              `json:"filepos"`
 }
 
 // ProgressInformation contains information regarding the progress of the
@@ -245,6 +242,45 @@ type Profile struct {
 	Name string `json:"name"`
 }
 
+// PrinterProfilesResponse is the response to a PrinterProfilesRequest.
+type PrinterProfilesResponse struct {
+	// Profiles by identifier.
+	Profiles map[string]*PrinterProfile `json:"profiles"`
+}
+
+// PrinterProfile is a printer profile with its build volume.
+type PrinterProfile struct {
+	// ID is the identifier of the profile.
+	ID string `json:"id"`
+	// Name is the display name of the profile.
+	Name string `json:"name"`
+	// Model of the printer.
+	Model string `json:"model"`
+	// Default whether this is the default profile.
+	Default bool `json:"default"`
+	// Current whether this profile is currently in use.
+	Current bool `json:"current"`
+	// HeatedBed whether the printer has a heated bed.
+	HeatedBed bool `json:"heatedBed"`
+	// Volume is the build volume.
+	Volume struct {
+		// FormFactor is `rectangular` or `circular`.
+		FormFactor string `json:"formFactor"`
+		// Origin is `lowerleft` or `center`.
+		Origin string  `json:"origin"`
+		Width  float64 `json:"width"`
+		Depth  float64 `json:"depth"`
+		Height float64 `json:"height"`
+	} `json:"volume"`
+	// Extruder information.
+	Extruder struct {
+		// Count is the number of extruders.
+		Count int `json:"count"`
+		// NozzleDiameter in mm.
+		NozzleDiameter float64 `json:"nozzleDiameter"`
+	} `json:"extruder"`
+}
+
 // FilesResponse is the response to a FilesRequest.
 type FilesResponse struct {
 	// Files is the list of requested files. Might be an empty list if no files
@@ -317,12 +353,79 @@ type GCodeAnalysisInformation struct {
 	// EstimatedPrintTime is the estimated print time of the file, in seconds.
 	EstimatedPrintTime float64 `json:"estimatedPrintTime"`
 	// Filament estimated usage of filament
-	Filament struct {
-		// Length estimated of filament used, in mm
-		Length uint32 `json:"length"`
-		// Volume estimated of filament used, in cm³
-		Volume float64 `json:"volume"`
-	} `json:"filament"`
+	Filament FilamentInformation `json:"filament"`
+	// Dimensions of the printed model, in mm.
+	Dimensions struct {
+		Width  float64 `json:"width"`
+		Depth  float64 `json:"depth"`
+		Height float64 `json:"height"`
+	} `json:"dimensions"`
+	// PrintingArea is the bounding box of all moves while extruding, in mm.
+	PrintingArea struct {
+		MinX float64 `json:"minX"`
+		MaxX float64 `json:"maxX"`
+		MinY float64 `json:"minY"`
+		MaxY float64 `json:"maxY"`
+		MinZ float64 `json:"minZ"`
+		MaxZ float64 `json:"maxZ"`
+	} `json:"printingArea"`
+}
+
+// FilamentInformation is the filament usage in total and per tool.
+type FilamentInformation struct {
+	// Length of filament used by all tools, in mm
+	Length float64 `json:"length"`
+	// Volume of filament used by all tools, in cm³
+	Volume float64 `json:"volume"`
+	// Tools usage per tool, e.g. `tool0`.
+	Tools map[string]ToolFilament `json:"tools,omitempty"`
+}
+
+// ToolFilament is the filament usage of a single tool.
+type ToolFilament struct {
+	// Length of filament used, in mm
+	Length float64 `json:"length"`
+	// Volume of filament used, in cm³
+	Volume float64 `json:"volume"`
+}
+
+// UnmarshalJSON accepts the per tool format `{"tool0": {"length": ..}}`
+// returned by OctoPrint as well as a flat `{"length": .., "volume": ..}`.
+func (f *FilamentInformation) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*f = FilamentInformation{}
+	if _, flat := raw["length"]; flat {
+		usage := ToolFilament{}
+		if err := json.Unmarshal(b, &usage); err != nil {
+			return err
+		}
+		f.Length, f.Volume = usage.Length, usage.Volume
+		return nil
+	}
+
+	for tool, data := range raw {
+		if !strings.HasPrefix(tool, "tool") {
+			continue
+		}
+
+		// Tools without usage are reported as null
+		usage := ToolFilament{}
+		if err := json.Unmarshal(data, &usage); err != nil {
+			return err
+		}
+
+		if f.Tools == nil {
+			f.Tools = make(map[string]ToolFilament)
+		}
+		f.Tools[tool] = usage
+		f.Length += usage.Length
+		f.Volume += usage.Volume
+	}
+	return nil
 }
 
 // PrintStats information from the print stats of a file.
@@ -169,6 +169,38 @@ func TestFileInformation_IsFolder(t *testing.T) {
 	assert.False(t, f.IsFolder())
 }
 
+func TestFilamentInformation(t *testing.T) {
+	js := []byte(`{
+		"tool0": {
+			"length": 810.5,
+			"volume": 5.36
+		},
+		"tool1": null
+	}`)
+
+	f := &FilamentInformation{}
+
+	err := json.Unmarshal(js, f)
+	assert.NoError(t, err)
+
+	assert.Len(t, f.Tools, 2)
+	assert.Equal(t, f.Tools["tool0"].Length, 810.5)
+	assert.Equal(t, f.Length, 810.5)
+	assert.Equal(t, f.Volume, 5.36)
+}
+
+func TestFilamentInformation_Flat(t *testing.T) {
+	js := []byte(`{"length": 810, "volume": 5.36}`)
+
+	f := &FilamentInformation{}
+
+	err := json.Unmarshal(js, f)
+	assert.NoError(t, err)
+
+	assert.Len(t, f.Tools, 0)
+	assert.Equal(t, f.Length, 810.)
+}
+
 func TestJSONTime_UnmarshalJSONWithNull(t *testing.T) {
 	time := &JSONTime{}
 	err := time.UnmarshalJSON([]byte("null"))
@@ -0,0 +1,25 @@
+package octoprint
+
+import (
+	"encoding/json"
+)
+
+const URIPrinterProfiles = "/api/printerprofiles"
+
+// PrinterProfilesRequest retrieves all configured printer profiles.
+type PrinterProfilesRequest struct{}
+
+// Do sends an API request and returns the API response.
+func (cmd *PrinterProfilesRequest) Do(c *Client) (*PrinterProfilesResponse, error) {
+	b, err := c.doJSONRequest("GET", URIPrinterProfiles, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &PrinterProfilesResponse{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+
+	return r, err
+}
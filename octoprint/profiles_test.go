@@ -0,0 +1,18 @@
+package octoprint
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrinterProfilesRequest_Do(t *testing.T) {
+	cli := NewClient("http://localhost:5000", "")
+
+	r := &PrinterProfilesRequest{}
+	profiles, err := r.Do(cli)
+	assert.NoError(t, err)
+
+	assert.Contains(t, profiles.Profiles, "_default")
+	assert.True(t, profiles.Profiles["_default"].Volume.Width > 0)
+}
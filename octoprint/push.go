@@ -0,0 +1,135 @@
+package octoprint
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	URILogin = "/api/login"
+	URIPush  = "/sockjs/websocket"
+)
+
+// LoginRequest logs in with the API key, a passive login does not create a
+// browser session.
+type LoginRequest struct {
+	Passive bool `json:"passive"`
+}
+
+// LoginResponse is the user that is logged in.
+type LoginResponse struct {
+	Name    string `json:"name"`
+	Session string `json:"session"`
+	Active  bool   `json:"active"`
+	Admin   bool   `json:"admin"`
+}
+
+// Do sends an API request and returns the API response.
+func (cmd *LoginRequest) Do(c *Client) (*LoginResponse, error) {
+	b := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(b).Encode(cmd); err != nil {
+		return nil, err
+	}
+
+	data, err := c.doJSONRequest("POST", URILogin, b, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &LoginResponse{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+
+	return r, err
+}
+
+// PushCurrent is the state update the push API sends about twice a second,
+// Logs are the lines of the serial communication since the last update, in
+// the format of serial.log, e.g. `Send: N12 G1 X10*85` or `Recv: ok`.
+type PushCurrent struct {
+	State    PrinterState        `json:"state"`
+	Job      JobInformation      `json:"job"`
+	Progress ProgressInformation `json:"progress"`
+	Logs     []string            `json:"logs"`
+	Messages []string            `json:"messages"`
+}
+
+// PushEvent is an event fired by OctoPrint.
+type PushEvent struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// PushMessage is a message of the push API, only one field is set.
+type PushMessage struct {
+	Connected json.RawMessage `json:"connected,omitempty"`
+	Current   *PushCurrent    `json:"current,omitempty"`
+	History   *PushCurrent    `json:"history,omitempty"`
+	Event     *PushEvent      `json:"event,omitempty"`
+}
+
+// PushConnection is an authenticated connection to the push API.
+type PushConnection struct {
+	conn *websocket.Conn
+}
+
+// Push logs in passively with the API key and connects to the push API.
+func (c *Client) Push() (*PushConnection, error) {
+	login, err := (&LoginRequest{Passive: true}).Do(c)
+	if err != nil {
+		return nil, fmt.Errorf("login: %w", err)
+	}
+
+	u, err := url.Parse(joinURL(c.Endpoint, URIPush))
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+
+	header := http.Header{}
+	header.Add("X-Api-Key", c.APIKey)
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := map[string]string{"auth": login.Name + ":" + login.Session}
+	if err := conn.WriteJSON(auth); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &PushConnection{conn: conn}, nil
+}
+
+// Throttle sets how often current messages are sent, as a multiple of 500ms.
+func (p *PushConnection) Throttle(factor int) error {
+	return p.conn.WriteJSON(map[string]int{"throttle": factor})
+}
+
+// Next blocks until the next message arrives.
+func (p *PushConnection) Next() (*PushMessage, error) {
+	_, data, err := p.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &PushMessage{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Close closes the connection.
+func (p *PushConnection) Close() error {
+	return p.conn.Close()
+}
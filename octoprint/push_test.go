@@ -0,0 +1,39 @@
+package octoprint
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushMessage_Current(t *testing.T) {
+	data := []byte(`{"current": {
+		"state": {"text": "Printing", "flags": {"printing": true}},
+		"job": {"file": {"name": "Ring.gcode", "origin": "local"}},
+		"progress": {"completion": 12.5, "filepos": 1024},
+		"logs": ["Send: N12 G1 X10 Y20 E0.5*85", "Recv: ok"],
+		"messages": []
+	}}`)
+
+	m := &PushMessage{}
+	err := json.Unmarshal(data, m)
+	assert.NoError(t, err)
+
+	assert.NotNil(t, m.Current)
+	assert.Nil(t, m.Event)
+	assert.True(t, m.Current.State.Flags.Printing)
+	assert.Equal(t, "Ring.gcode", m.Current.Job.File.Name)
+	assert.Equal(t, []string{"Send: N12 G1 X10 Y20 E0.5*85", "Recv: ok"}, m.Current.Logs)
+}
+
+func TestPushMessage_Event(t *testing.T) {
+	data := []byte(`{"event": {"type": "PrintStarted", "payload": {"name": "Ring.gcode"}}}`)
+
+	m := &PushMessage{}
+	err := json.Unmarshal(data, m)
+	assert.NoError(t, err)
+
+	assert.Nil(t, m.Current)
+	assert.Equal(t, "PrintStarted", m.Event.Type)
+}
@@ -0,0 +1,169 @@
+package octoprint
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+const URITimelapse = "/api/timelapse"
+
+var (
+	TimelapseDeleteErrors = statusMapping{
+		404: "The timelapse file does not exist",
+	}
+	TimelapseUnrenderedErrors = statusMapping{
+		400: "The command is unknown or the request is otherwise invalid",
+		404: "The unrendered timelapse does not exist",
+		409: "The timelapse is still being recorded or rendered",
+	}
+)
+
+// TimelapseConfig is the timelapse configuration, Type is `off`, `zchange`
+// or `timed`.
+type TimelapseConfig struct {
+	Type string `json:"type"`
+	// PostRoll in seconds, the last frame is repeated this long.
+	PostRoll int `json:"postRoll,omitempty"`
+	// FPS of the rendered video.
+	FPS int `json:"fps,omitempty"`
+	// Interval between frames of a timed timelapse, in seconds.
+	Interval int `json:"interval,omitempty"`
+	// RetractionZHop of a zchange timelapse, in mm, Z changes of this height
+	// are not captured.
+	RetractionZHop float64 `json:"retractionZHop,omitempty"`
+	// MinDelay between frames of a zchange timelapse, in seconds.
+	MinDelay float64 `json:"minDelay,omitempty"`
+	// RenderAfterPrint is `always`, `success`, `failure` or `off`.
+	RenderAfterPrint string `json:"renderAfterPrint,omitempty"`
+}
+
+// TimelapseFile is a rendered timelapse.
+type TimelapseFile struct {
+	Name string `json:"name"`
+	// Size is human readable, e.g. `2.5MB`.
+	Size  string `json:"size"`
+	Bytes int64  `json:"bytes"`
+	Date  string `json:"date"`
+	// URL to download the file from, relative to the server.
+	URL       string `json:"url"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+// UnrenderedTimelapse is a recording that has not been rendered.
+type UnrenderedTimelapse struct {
+	Name       string `json:"name"`
+	Size       string `json:"size"`
+	Bytes      int64  `json:"bytes"`
+	Date       string `json:"date"`
+	Recording  bool   `json:"recording"`
+	Rendering  bool   `json:"rendering"`
+	Processing bool   `json:"processing"`
+}
+
+// TimelapseResponse is the timelapse configuration and the stored timelapses.
+type TimelapseResponse struct {
+	Config     TimelapseConfig       `json:"config"`
+	Enabled    bool                  `json:"enabled"`
+	Files      []TimelapseFile       `json:"files"`
+	Unrendered []UnrenderedTimelapse `json:"unrendered"`
+}
+
+// TimelapseRequest retrieves the timelapse configuration and the rendered
+// timelapses.
+type TimelapseRequest struct {
+	// Unrendered if set, the unrendered recordings are included.
+	Unrendered bool
+}
+
+// Do sends an API request and returns the API response.
+func (cmd *TimelapseRequest) Do(c *Client) (*TimelapseResponse, error) {
+	uri := fmt.Sprintf("%s?unrendered=%t", URITimelapse, cmd.Unrendered)
+	b, err := c.doJSONRequest("GET", uri, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &TimelapseResponse{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+
+	return r, err
+}
+
+// TimelapseConfigRequest changes the timelapse configuration.
+type TimelapseConfigRequest struct {
+	TimelapseConfig
+	// Save if set, the configuration becomes the default.
+	Save bool `json:"save"`
+}
+
+// Do sends an API request and returns an error if any.
+func (cmd *TimelapseConfigRequest) Do(c *Client) error {
+	b := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(b).Encode(cmd); err != nil {
+		return err
+	}
+
+	_, err := c.doJSONRequest("POST", URITimelapse, b, nil)
+	return err
+}
+
+// DeleteTimelapseRequest deletes a rendered timelapse.
+type DeleteTimelapseRequest struct {
+	Filename string
+}
+
+// Do sends an API request and returns an error if any.
+func (cmd *DeleteTimelapseRequest) Do(c *Client) error {
+	uri := fmt.Sprintf("%s/%s", URITimelapse, url.PathEscape(cmd.Filename))
+	_, err := c.doJSONRequest("DELETE", uri, nil, TimelapseDeleteErrors)
+	return err
+}
+
+// RenderTimelapseRequest renders an unrendered recording.
+type RenderTimelapseRequest struct {
+	Name string
+}
+
+// Do sends an API request and returns an error if any.
+func (cmd *RenderTimelapseRequest) Do(c *Client) error {
+	b := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(b).Encode(map[string]string{"command": "render"}); err != nil {
+		return err
+	}
+
+	uri := fmt.Sprintf("%s/unrendered/%s", URITimelapse, url.PathEscape(cmd.Name))
+	_, err := c.doJSONRequest("POST", uri, b, TimelapseUnrenderedErrors)
+	return err
+}
+
+// DeleteUnrenderedTimelapseRequest deletes an unrendered recording.
+type DeleteUnrenderedTimelapseRequest struct {
+	Name string
+}
+
+// Do sends an API request and returns an error if any.
+func (cmd *DeleteUnrenderedTimelapseRequest) Do(c *Client) error {
+	uri := fmt.Sprintf("%s/unrendered/%s", URITimelapse, url.PathEscape(cmd.Name))
+	_, err := c.doJSONRequest("DELETE", uri, nil, TimelapseUnrenderedErrors)
+	return err
+}
+
+// DownloadTimelapseRequest downloads a rendered timelapse.
+type DownloadTimelapseRequest struct {
+	// File as returned by TimelapseRequest.
+	File TimelapseFile
+}
+
+// Do sends an API request and writes the video to w.
+func (cmd *DownloadTimelapseRequest) Do(c *Client, w io.Writer) error {
+	uri := cmd.File.URL
+	if uri == "" {
+		uri = "/downloads/timelapse/" + url.PathEscape(cmd.File.Name)
+	}
+	return c.doStreamRequest("GET", uri, w, TimelapseDeleteErrors)
+}
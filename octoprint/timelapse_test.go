@@ -0,0 +1,39 @@
+package octoprint
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimelapseRequest_Do(t *testing.T) {
+	cli := NewClient("http://localhost:5000", "")
+
+	r := &TimelapseRequest{Unrendered: true}
+	timelapse, err := r.Do(cli)
+	assert.NoError(t, err)
+
+	assert.NotEmpty(t, timelapse.Config.Type)
+}
+
+func TestTimelapseResponse(t *testing.T) {
+	data := []byte(`{
+		"config": {"type": "zchange", "postRoll": 0, "fps": 25, "retractionZHop": 0.4, "minDelay": 5},
+		"enabled": true,
+		"files": [{"name": "Ring_20240101120000.mp4", "size": "1.2MB", "bytes": 1258291,
+			"date": "2024-01-01 12:30", "url": "/downloads/timelapse/Ring_20240101120000.mp4"}],
+		"unrendered": [{"name": "Cube_20240102", "size": "5.0MB", "bytes": 5242880,
+			"date": "2024-01-02 09:00", "recording": false, "rendering": true, "processing": true}]
+	}`)
+
+	r := &TimelapseResponse{}
+	err := json.Unmarshal(data, r)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "zchange", r.Config.Type)
+	assert.Equal(t, 0.4, r.Config.RetractionZHop)
+	assert.Len(t, r.Files, 1)
+	assert.Equal(t, int64(1258291), r.Files[0].Bytes)
+	assert.True(t, r.Unrendered[0].Rendering)
+}
@@ -0,0 +1,163 @@
+package vision
+
+import (
+	"image"
+	"math"
+)
+
+// Config holds the parameters of the detector.
+type Config struct {
+	// GridWidth and GridHeight are the number of cells an image is reduced to.
+	GridWidth  int `json:"grid_width"`
+	GridHeight int `json:"grid_height"`
+	// BaselineFrames are analyzed before scoring starts, they make up the
+	// texture of the intact print.
+	BaselineFrames int `json:"baseline_frames"`
+	// ChangeThreshold is the luminance difference of a changed cell.
+	ChangeThreshold float64 `json:"change_threshold"`
+	// TextureFactor is the growth over the baseline of a cell with new texture.
+	TextureFactor float64 `json:"texture_factor"`
+	// TextureFloor is the least texture that counts as new, so flat areas do
+	// not trigger on sensor noise.
+	TextureFloor float64 `json:"texture_floor"`
+	// ChangeArea and TextureArea are the fractions of the image that score 1.
+	ChangeArea  float64 `json:"change_area"`
+	TextureArea float64 `json:"texture_area"`
+	// Adaptation is how fast the baseline follows the growing print, 0-1.
+	Adaptation float64 `json:"adaptation"`
+	// Smoothing weights the newest score against the previous confidence, 0-1.
+	Smoothing float64 `json:"smoothing"`
+	// Threshold is the confidence of a suspected failure, Confirm the number
+	// of consecutive frames above it before a failure is reported.
+	Threshold float64 `json:"threshold"`
+	Confirm   int     `json:"confirm"`
+	// PauseChange is the least Change of the confirming frame that makes a
+	// failure severe enough to pause the job. A failure seen mostly in the
+	// texture may be a part that grows faster than the baseline adapts.
+	PauseChange float64 `json:"pause_change"`
+}
+
+// DefaultConfig returns parameters that suit a webcam looking at the bed.
+func DefaultConfig() Config {
+	return Config{
+		GridWidth:       32,
+		GridHeight:      24,
+		BaselineFrames:  2,
+		ChangeThreshold: 0.08,
+		TextureFactor:   1.8,
+		TextureFloor:    0.02,
+		ChangeArea:      0.3,
+		TextureArea:     0.35,
+		Adaptation:      0.2,
+		Smoothing:       0.5,
+		Threshold:       0.6,
+		Confirm:         3,
+		PauseChange:     0.1,
+	}
+}
+
+// Result is the analysis of a single frame.
+type Result struct {
+	// Confidence that the print failed, 0-1.
+	Confidence float64 `json:"confidence"`
+	// Change is the fraction of cells that changed since the previous frame.
+	Change float64 `json:"change"`
+	// Texture is the fraction of cells with new texture over the baseline.
+	Texture float64 `json:"texture"`
+	// Frames analyzed since the last reset.
+	Frames int `json:"frames"`
+	// Baseline is set while the baseline is collected.
+	Baseline bool `json:"baseline"`
+	// Failure is set when Confidence stayed above the threshold for the
+	// confirmation frames.
+	Failure bool `json:"failure"`
+	// Pause is set for a failure that also changed at least PauseChange of
+	// the image.
+	Pause bool `json:"pause"`
+}
+
+// Detector compares consecutive frames of a print. A print in progress adds
+// texture slowly and in a small area, spaghetti adds texture quickly and all
+// over the image while the scene keeps changing. Single frames with the print
+// head in front of the camera are filtered by smoothing and confirmation.
+type Detector struct {
+	config     Config
+	previous   *Frame
+	baseline   []float64
+	frames     int
+	confidence float64
+	above      int
+}
+
+// NewDetector returns a detector with the given configuration.
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config}
+}
+
+// Config returns the configuration of the detector.
+func (d *Detector) Config() Config {
+	return d.config
+}
+
+// Reset forgets the baseline, e.g. when a job starts or is resumed.
+func (d *Detector) Reset() {
+	d.previous = nil
+	d.baseline = nil
+	d.frames = 0
+	d.confidence = 0
+	d.above = 0
+}
+
+// Analyze scores the next frame of the print.
+func (d *Detector) Analyze(img image.Image) Result {
+	frame := NewFrame(img, d.config.GridWidth, d.config.GridHeight)
+	d.frames++
+	defer func() { d.previous = frame }()
+
+	if d.frames <= d.config.BaselineFrames || d.previous == nil {
+		d.learn(frame.Texture, 1/float64(d.frames))
+		return Result{Frames: d.frames, Baseline: true}
+	}
+
+	cells := float64(len(frame.Luma))
+	var changed, textured float64
+	for i := range frame.Luma {
+		if math.Abs(frame.Luma[i]-d.previous.Luma[i]) > d.config.ChangeThreshold {
+			changed++
+		}
+		if frame.Texture[i] > d.config.TextureFloor && frame.Texture[i] > d.baseline[i]*d.config.TextureFactor {
+			textured++
+		}
+	}
+
+	result := Result{Change: changed / cells, Texture: textured / cells, Frames: d.frames}
+	changeScore := math.Min(1, result.Change/d.config.ChangeArea)
+	textureScore := math.Min(1, result.Texture/d.config.TextureArea)
+	score := 0.7*textureScore + 0.3*changeScore
+
+	d.confidence = d.config.Smoothing*score + (1-d.config.Smoothing)*d.confidence
+	result.Confidence = d.confidence
+
+	if d.confidence >= d.config.Threshold {
+		d.above++
+	} else {
+		d.above = 0
+	}
+	result.Failure = d.above >= d.config.Confirm
+	result.Pause = result.Failure && result.Change >= d.config.PauseChange
+
+	// The baseline follows the print, too slowly to absorb a failure before
+	// it is confirmed
+	d.learn(frame.Texture, d.config.Adaptation)
+	return result
+}
+
+// learn blends a frame into the baseline texture with the given weight.
+func (d *Detector) learn(texture []float64, weight float64) {
+	if d.baseline == nil {
+		d.baseline = make([]float64, len(texture))
+	}
+	for i, t := range texture {
+		d.baseline[i] += weight * (t - d.baseline[i])
+	}
+}
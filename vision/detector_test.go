@@ -0,0 +1,151 @@
+package vision
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testWidth, testHeight = 320, 240
+
+// testScene draws a flat bed with a checkered part of the given size in the
+// middle and the print head at headX.
+func testScene(partSize, headX int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, testWidth, testHeight))
+	for i := range img.Pix {
+		img.Pix[i] = 100
+	}
+
+	x0, y0 := (testWidth-partSize)/2, (testHeight-partSize)/2
+	for y := y0; y < y0+partSize; y++ {
+		for x := x0; x < x0+partSize; x++ {
+			if (x/4+y/4)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 160})
+			}
+		}
+	}
+
+	for y := 20; y < 60; y++ {
+		for x := headX; x < headX+40 && x < testWidth; x++ {
+			img.SetGray(x, y, color.Gray{Y: 30})
+		}
+	}
+	return img
+}
+
+// addSpaghetti scatters strands of filament over the image.
+func addSpaghetti(img *image.Gray, rng *rand.Rand, strands int) {
+	for i := 0; i < strands; i++ {
+		x, y := rng.Intn(testWidth), rng.Intn(testHeight)
+		for j := 0; j < 60; j++ {
+			x = (x + rng.Intn(3) - 1 + testWidth) % testWidth
+			y = (y + rng.Intn(3) - 1 + testHeight) % testHeight
+			img.SetGray(x, y, color.Gray{Y: 230})
+		}
+	}
+}
+
+func TestNewFrame(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+
+	f := NewFrame(img, 8, 6)
+	assert.Equal(t, 48, len(f.Luma))
+	for i := range f.Luma {
+		assert.InDelta(t, 1., f.Luma[i], 1e-9)
+		assert.InDelta(t, 0., f.Texture[i], 1e-9)
+	}
+
+	f = NewFrame(testScene(120, 0), 32, 24)
+	center := 12*32 + 16
+	assert.True(t, f.Texture[center] > f.Texture[0])
+}
+
+func TestDetectorIntactPrint(t *testing.T) {
+	d := NewDetector(DefaultConfig())
+
+	for i := 0; i < 20; i++ {
+		// The part grows and the head moves across the bed
+		result := d.Analyze(testScene(60+i*2, (i*37)%testWidth))
+		assert.False(t, result.Failure, "frame %d", i)
+		assert.True(t, result.Confidence < d.Config().Threshold, "frame %d: %f", i, result.Confidence)
+	}
+}
+
+func TestDetectorLargePart(t *testing.T) {
+	for _, step := range []int{5, 8} {
+		d := NewDetector(DefaultConfig())
+		size := 60
+		for i := 0; i < 30; i++ {
+			// The part grows past 20% of the frame, up to 230x230 pixels
+			size = 60 + i*step
+			if size > 230 {
+				size = 230
+			}
+			result := d.Analyze(testScene(size, (i*37)%testWidth))
+			assert.False(t, result.Failure, "step %d frame %d", step, i)
+			assert.True(t, result.Confidence < d.Config().Threshold, "step %d frame %d: %f", step, i, result.Confidence)
+		}
+		assert.True(t, float64(size*size) > 0.2*testWidth*testHeight)
+	}
+}
+
+func TestDetectorPauseNeedsChange(t *testing.T) {
+	// A detector sensitive enough to report the growing part
+	config := DefaultConfig()
+	config.Threshold = 0.2
+	d := NewDetector(config)
+
+	failed := false
+	for i := 0; i < 20; i++ {
+		result := d.Analyze(testScene(60+i*8, (i*37)%testWidth))
+		failed = failed || result.Failure
+		assert.False(t, result.Pause, "frame %d", i)
+	}
+	assert.True(t, failed)
+}
+
+func TestDetectorSpaghetti(t *testing.T) {
+	d := NewDetector(DefaultConfig())
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 3; i++ {
+		result := d.Analyze(testScene(80, i*50))
+		assert.False(t, result.Failure)
+	}
+
+	detected := false
+	for i := 0; i < 8 && !detected; i++ {
+		img := testScene(80, 100)
+		addSpaghetti(img, rng, 150+i*50)
+		result := d.Analyze(img)
+		detected = result.Failure
+		if detected {
+			assert.True(t, result.Confidence >= d.Config().Threshold)
+			assert.True(t, result.Texture > 0.1)
+			assert.True(t, result.Pause)
+		}
+	}
+	assert.True(t, detected)
+}
+
+func TestDetectorReset(t *testing.T) {
+	d := NewDetector(DefaultConfig())
+
+	result := d.Analyze(testScene(80, 0))
+	assert.True(t, result.Baseline)
+	assert.Equal(t, 1, result.Frames)
+	d.Analyze(testScene(80, 0))
+	result = d.Analyze(testScene(80, 0))
+	assert.False(t, result.Baseline)
+
+	d.Reset()
+	result = d.Analyze(testScene(80, 0))
+	assert.True(t, result.Baseline)
+	assert.Equal(t, 1, result.Frames)
+}
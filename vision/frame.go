@@ -0,0 +1,117 @@
+// Package vision implements CPU-only heuristics that look for print failures
+// such as spaghetti in consecutive webcam snapshots.
+package vision
+
+import (
+	"image"
+	_ "image/jpeg" // snapshots are JPEG
+	_ "image/png"
+	"io"
+	"math"
+	"os"
+)
+
+// cellSize is the number of samples per grid cell and axis, the texture of a
+// cell is measured on these samples.
+const cellSize = 4
+
+// Frame is a snapshot reduced to a grid of cells, each with its mean
+// luminance and texture, both in 0-1.
+type Frame struct {
+	Width   int
+	Height  int
+	Luma    []float64
+	Texture []float64
+}
+
+// Decode reads a JPEG or PNG image.
+func Decode(r io.Reader) (image.Image, error) {
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// DecodeFile reads a JPEG or PNG image file.
+func DecodeFile(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Decode(file)
+}
+
+// NewFrame reduces an image to a grid of width x height cells.
+func NewFrame(img image.Image, width, height int) *Frame {
+	sw, sh := width*cellSize, height*cellSize
+	samples := sample(img, sw, sh)
+
+	f := &Frame{
+		Width:   width,
+		Height:  height,
+		Luma:    make([]float64, width*height),
+		Texture: make([]float64, width*height),
+	}
+	for cy := 0; cy < height; cy++ {
+		for cx := 0; cx < width; cx++ {
+			var luma, gradient float64
+			for y := cy * cellSize; y < (cy+1)*cellSize; y++ {
+				for x := cx * cellSize; x < (cx+1)*cellSize; x++ {
+					v := samples[y*sw+x]
+					luma += v
+					if x+1 < sw {
+						gradient += math.Abs(samples[y*sw+x+1] - v)
+					}
+					if y+1 < sh {
+						gradient += math.Abs(samples[(y+1)*sw+x] - v)
+					}
+				}
+			}
+			n := float64(cellSize * cellSize)
+			f.Luma[cy*width+cx] = luma / n
+			f.Texture[cy*width+cx] = gradient / (2 * n)
+		}
+	}
+	return f
+}
+
+// sample averages the luminance of the image into a width x height grid.
+func sample(img image.Image, width, height int) []float64 {
+	bounds := img.Bounds()
+	sums := make([]float64, width*height)
+	counts := make([]int, width*height)
+
+	// Larger images are subsampled, a few samples per grid point are enough
+	step := bounds.Dx() / (width * 4)
+	if step < 1 {
+		step = 1
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		gy := (y - bounds.Min.Y) * height / bounds.Dy()
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			gx := (x - bounds.Min.X) * width / bounds.Dx()
+			sums[gy*width+gx] += luminance(img, x, y)
+			counts[gy*width+gx]++
+		}
+	}
+
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= float64(counts[i])
+		}
+	}
+	return sums
+}
+
+// luminance returns the brightness of a pixel in 0-1, decoded JPEGs are read
+// from their Y plane directly.
+func luminance(img image.Image, x, y int) float64 {
+	switch img := img.(type) {
+	case *image.YCbCr:
+		return float64(img.Y[img.YOffset(x, y)]) / 255
+	case *image.Gray:
+		return float64(img.Pix[img.PixOffset(x, y)]) / 255
+	}
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 0xffff
+}